@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// HealthChecker is implemented by the consumers and producers.
+type HealthChecker interface {
+	// Healthy returns an error if the component isn't healthy.
+	Healthy(ctx context.Context) error
+}
+
+// CombineHealth checks the health of all the named checkers concurrently,
+// i.e. to back a single readiness check for all the consumers and producers
+// of a service. It returns the health of each component keyed by its name,
+// with a nil error for healthy components, and an error joining the errors
+// of all the unhealthy components, if any.
+func CombineHealth(ctx context.Context, checkers map[string]HealthChecker) (map[string]error, error) {
+	status := make(map[string]error, len(checkers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, checker := range checkers {
+		wg.Add(1)
+		go func(name string, checker HealthChecker) {
+			defer wg.Done()
+			err := checker.Healthy(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			status[name] = err
+		}(name, checker)
+	}
+	wg.Wait()
+
+	names := make([]string, 0, len(status))
+	for name, err := range status {
+		if err != nil {
+			names = append(names, name)
+		}
+	}
+	// Sort the unhealthy components so the joined error is deterministic.
+	sort.Strings(names)
+	errs := make([]error, 0, len(names))
+	for _, name := range names {
+		errs = append(errs, fmt.Errorf("%s: %w", name, status[name]))
+	}
+	return status, errors.Join(errs...)
+}
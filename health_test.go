@@ -0,0 +1,51 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCombineHealth(t *testing.T) {
+	status, err := CombineHealth(context.Background(), map[string]HealthChecker{
+		"consumer": healthFunc(func(context.Context) error { return nil }),
+		"producer": healthFunc(func(context.Context) error {
+			return fmt.Errorf("kafka: %w", ErrBackendUnavailable)
+		}),
+		"sink": healthFunc(func(context.Context) error { return ErrConsumerClosed }),
+	})
+	assert.EqualError(t, err, "producer: kafka: backend unavailable\nsink: consumer closed")
+	assert.ErrorIs(t, err, ErrBackendUnavailable)
+	assert.Equal(t, map[string]error{
+		"consumer": nil,
+		"producer": fmt.Errorf("kafka: %w", ErrBackendUnavailable),
+		"sink":     ErrConsumerClosed,
+	}, status)
+
+	status, err = CombineHealth(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, status)
+}
+
+type healthFunc func(context.Context) error
+
+func (f healthFunc) Healthy(ctx context.Context) error { return f(ctx) }
@@ -15,8 +15,9 @@
 // specific language governing permissions and limitations
 // under the License.
 
-// Package telemetry allows setting up telemetry for pubsublite consumers and
-// producers
+// Package telemetry allows setting up telemetry for the consumers and
+// producers of the Google Cloud Pub/Sub and Pub/Sub Lite backends, which
+// both exchange pubsub.Message.
 package telemetry
 
 import (
@@ -32,8 +33,9 @@ import (
 
 type consumerHandler = func(context.Context, *pubsub.Message)
 
-// Consumer adds telemetry data to messages received
-func Consumer(tracer trace.Tracer, h consumerHandler, attrs []attribute.KeyValue) consumerHandler {
+// Consumer adds telemetry data to messages received. The system is the
+// messaging system of the spans, i.e. pubsublite, and prefixes their name.
+func Consumer(tracer trace.Tracer, system string, h consumerHandler, attrs []attribute.KeyValue) consumerHandler {
 	return func(ctx context.Context, msg *pubsub.Message) {
 		if msg == nil {
 			return
@@ -44,16 +46,17 @@ func Consumer(tracer trace.Tracer, h consumerHandler, attrs []attribute.KeyValue
 			ctx = propagator.Extract(ctx, propagation.MapCarrier(msg.Attributes))
 		}
 
-		attrs = append(attrs,
-			semconv.MessagingSystemKey.String("pubsublite"),
+		// Copy attrs, since they're shared by all the messages.
+		spanAttrs := append(attrs[:len(attrs):len(attrs)],
+			semconv.MessagingSystemKey.String(system),
 			semconv.MessagingSourceKindTopic,
 			semconv.MessagingOperationProcess,
 			semconv.MessagingMessageIDKey.String(msg.ID),
 		)
 
-		ctx, span := tracer.Start(ctx, "pubsublite.Receive",
+		ctx, span := tracer.Start(ctx, system+".Receive",
 			trace.WithSpanKind(trace.SpanKindConsumer),
-			trace.WithAttributes(attrs...),
+			trace.WithAttributes(spanAttrs...),
 		)
 		defer span.End()
 
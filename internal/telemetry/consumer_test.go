@@ -24,9 +24,11 @@ import (
 
 	"cloud.google.com/go/pubsub"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/instrumentation"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
@@ -137,7 +139,7 @@ func TestConsumer(t *testing.T) {
 		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			h := Consumer(tp.Tracer("test"), func(ctx context.Context, msg *pubsub.Message) {
+			h := Consumer(tp.Tracer("test"), "pubsublite", func(ctx context.Context, msg *pubsub.Message) {
 				// No need to do anything here
 			}, tt.attributes)
 
@@ -174,3 +176,85 @@ func mustTraceIDFromHex(t *testing.T, s string) (tr trace.TraceID) {
 	assert.NoError(t, err)
 	return tr
 }
+
+func TestBaggageRoundTrip(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	defer otel.SetTextMapPropagator(propagation.TraceContext{})
+	tp := sdktrace.NewTracerProvider()
+	defer tp.Shutdown(context.Background())
+
+	tenant, err := baggage.NewMember("tenant", "a")
+	require.NoError(t, err)
+	bag, err := baggage.New(tenant)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(baggage.ContextWithBaggage(context.Background(), bag))
+	defer cancel()
+
+	var published *pubsub.Message
+	Publisher(ctx, tp.Tracer("test"), "pubsublite", &pubsub.Message{}, func(_ context.Context, msg *pubsub.Message) *pubsub.PublishResult {
+		published = msg
+		return &pubsub.PublishResult{}
+	}, nil)
+	require.NotNil(t, published)
+
+	var got string
+	Consumer(tp.Tracer("test"), "pubsublite", func(ctx context.Context, _ *pubsub.Message) {
+		got = baggage.FromContext(ctx).Member("tenant").Value()
+	}, nil)(context.Background(), published)
+	assert.Equal(t, "a", got)
+}
+
+func TestConsumerSharedAttributes(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer tp.Shutdown(context.Background())
+
+	attrs := make([]attribute.KeyValue, 1, 10)
+	attrs[0] = attribute.String("project", "project_name")
+	h := Consumer(tp.Tracer("test"), "pubsublite", func(context.Context, *pubsub.Message) {}, attrs)
+	h(context.Background(), &pubsub.Message{ID: "1"})
+	h(context.Background(), &pubsub.Message{ID: "2"})
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	for i, id := range []string{"1", "2"} {
+		assert.Equal(t, []attribute.KeyValue{
+			attribute.String("project", "project_name"),
+			semconv.MessagingSystemKey.String("pubsublite"),
+			semconv.MessagingSourceKindTopic,
+			semconv.MessagingOperationProcess,
+			semconv.MessagingMessageIDKey.String(id),
+		}, spans[i].Attributes)
+	}
+	assert.Equal(t, []attribute.KeyValue{attribute.String("project", "project_name")}, attrs)
+}
+
+func BenchmarkConsumer(b *testing.B) {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(tracetest.NewSpanRecorder()),
+	)
+	defer tp.Shutdown(context.Background())
+	attrs := []attribute.KeyValue{
+		semconv.MessagingSourceName("topic"),
+		semconv.CloudRegion("region"),
+		semconv.CloudAccountID("project"),
+	}
+	msg := &pubsub.Message{ID: "0:1", Data: []byte("{}")}
+	h := func(context.Context, *pubsub.Message) {}
+	for name, tracer := range map[string]trace.Tracer{
+		"noop":     trace.NewNoopTracerProvider().Tracer("test"),
+		"recorded": tp.Tracer("test"),
+	} {
+		b.Run(name, func(b *testing.B) {
+			handler := Consumer(tracer, "pubsublite", h, attrs)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler(ctx, msg)
+			}
+		})
+	}
+}
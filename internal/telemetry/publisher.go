@@ -31,14 +31,15 @@ import (
 
 type producerHandler = func(context.Context, *pubsub.Message) *pubsub.PublishResult
 
-// Publisher adds telemetry data to messages published
-func Publisher(ctx context.Context, tracer trace.Tracer, msg *pubsub.Message, h producerHandler, attrs []attribute.KeyValue) *pubsub.PublishResult {
+// Publisher adds telemetry data to messages published. The system is the
+// messaging system of the span, i.e. pubsublite, and prefixes its name.
+func Publisher(ctx context.Context, tracer trace.Tracer, system string, msg *pubsub.Message, h producerHandler, attrs []attribute.KeyValue) *pubsub.PublishResult {
 
 	attrs = append(attrs,
-		semconv.MessagingSystemKey.String("pubsublite"),
+		semconv.MessagingSystemKey.String(system),
 		semconv.MessagingDestinationKindTopic,
 	)
-	ctx, span := tracer.Start(ctx, "pubsublite.Publish",
+	ctx, span := tracer.Start(ctx, system+".Publish",
 		trace.WithSpanKind(trace.SpanKindProducer),
 		trace.WithAttributes(attrs...),
 	)
@@ -162,7 +162,7 @@ func TestPublisher(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			res := &pubsub.PublishResult{}
 			ctx, cancel := context.WithCancel(context.Background())
-			_ = Publisher(ctx, tp.Tracer("test"), tt.msg, func(ctx context.Context, msg *pubsub.Message) *pubsub.PublishResult {
+			_ = Publisher(ctx, tp.Tracer("test"), "pubsublite", tt.msg, func(ctx context.Context, msg *pubsub.Message) *pubsub.PublishResult {
 				return res
 			}, tt.attributes)
 
@@ -0,0 +1,128 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// transactionAbortTimeout is the maximum time spent aborting a transaction
+// whose records failed to be produced.
+const transactionAbortTimeout = 10 * time.Second
+
+// transactionalClient is the subset of *kgo.Client used to produce records
+// in transactions, it's overridden in tests.
+type transactionalClient interface {
+	BeginTransaction() error
+	ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults
+	AbortBufferedRecords(ctx context.Context) error
+	EndTransaction(ctx context.Context, commit kgo.TransactionEndTry) error
+	Close()
+}
+
+// ProduceAtomically produces each event to its topic in a single Kafka
+// transaction, waiting until it's committed. If any of the records can't be
+// produced, the transaction is aborted and an error is returned. Aborted
+// records are skipped by consumers reading committed records only, i.e.
+// kafka Consumers with ReadCommitted set. It requires a TransactionalID to be configured,
+// otherwise it returns an error wrapping apmqueue.ErrAtomicUnsupported.
+func (p *Producer) ProduceAtomically(ctx context.Context, events []apmqueue.TopicEvent) (err error) {
+	if p.txn == nil {
+		return fmt.Errorf("kafka: %w: transactional id must be set", apmqueue.ErrAtomicUnsupported)
+	}
+	ctx, span := p.tracer.Start(ctx, "producer.ProduceAtomically", trace.WithAttributes(
+		attribute.Int("batch.size", len(events)),
+	))
+	defer span.End()
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	m, ok, err := queuecontext.EncodeFromContext(ctx, p.cfg.MetadataCodec)
+	if err != nil {
+		return err
+	}
+	var headers []kgo.RecordHeader
+	if ok {
+		for k, v := range m {
+			headers = append(headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+		}
+	}
+	records := make([]*kgo.Record, 0, len(events))
+	for _, e := range events {
+		encoded, err := p.cfg.Encoder.Encode(e.Event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+		record := &kgo.Record{
+			Headers: headers,
+			Topic:   string(e.Topic),
+			Value:   encoded,
+		}
+		if p.cfg.TimestampFn != nil {
+			record.Timestamp = p.cfg.TimestampFn(&e.Event)
+		}
+		records = append(records, record)
+	}
+
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	if err := p.txn.BeginTransaction(); err != nil {
+		return fmt.Errorf("kafka: failed to begin transaction: %w", err)
+	}
+	if err := p.txn.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		if abortErr := p.abortTransaction(ctx); abortErr != nil {
+			err = errors.Join(err, abortErr)
+		}
+		return fmt.Errorf("kafka: transaction aborted: %w", err)
+	}
+	if err := p.txn.EndTransaction(ctx, kgo.TryCommit); err != nil {
+		return fmt.Errorf("kafka: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// abortTransaction aborts the records still buffered by the client, and
+// then the transaction. Producing may have failed because ctx is done, so
+// the transaction is aborted with a detached context, bounded by
+// transactionAbortTimeout.
+func (p *Producer) abortTransaction(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(queuecontext.DetachedContext(ctx), transactionAbortTimeout)
+	defer cancel()
+	if err := p.txn.AbortBufferedRecords(ctx); err != nil {
+		return err
+	}
+	return p.txn.EndTransaction(ctx, kgo.TryAbort)
+}
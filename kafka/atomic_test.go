@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+// fakeTransactionalClient records the transactions, and fails producing the
+// records to the failing topic.
+type fakeTransactionalClient struct {
+	failing   string
+	produced  []*kgo.Record
+	committed []*kgo.Record
+	ops       []string
+}
+
+func (c *fakeTransactionalClient) BeginTransaction() error {
+	c.ops = append(c.ops, "begin")
+	c.produced = nil
+	return nil
+}
+
+func (c *fakeTransactionalClient) ProduceSync(_ context.Context, rs ...*kgo.Record) kgo.ProduceResults {
+	results := make(kgo.ProduceResults, 0, len(rs))
+	for _, r := range rs {
+		var err error
+		if r.Topic == c.failing {
+			err = errors.New("not leader for partition")
+		}
+		c.produced = append(c.produced, r)
+		results = append(results, kgo.ProduceResult{Record: r, Err: err})
+	}
+	return results
+}
+
+func (c *fakeTransactionalClient) AbortBufferedRecords(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	c.ops = append(c.ops, "abort buffered")
+	return nil
+}
+
+func (c *fakeTransactionalClient) EndTransaction(ctx context.Context, commit kgo.TransactionEndTry) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if commit == kgo.TryCommit {
+		c.ops = append(c.ops, "commit")
+		c.committed = append(c.committed, c.produced...)
+	} else {
+		c.ops = append(c.ops, "abort")
+	}
+	c.produced = nil
+	return nil
+}
+
+func (c *fakeTransactionalClient) Close() {}
+
+func TestProducerProduceAtomically(t *testing.T) {
+	_, brokers := newClusterWithTopics(t, "events", "index")
+	codec := json.JSON{}
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: codec,
+		TopicRouter: func(model.APMEvent) apmqueue.Topic {
+			return "events"
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	events := []apmqueue.TopicEvent{
+		{Topic: "events", Event: model.APMEvent{Transaction: &model.Transaction{ID: "1"}}},
+		{Topic: "index", Event: model.APMEvent{Transaction: &model.Transaction{ID: "1"}}},
+	}
+	// A transactional ID is required.
+	err = producer.ProduceAtomically(context.Background(), events)
+	assert.ErrorIs(t, err, apmqueue.ErrAtomicUnsupported)
+
+	txn := &fakeTransactionalClient{}
+	producer.txn = txn
+	require.NoError(t, producer.ProduceAtomically(context.Background(), events))
+	assert.Equal(t, []string{"begin", "commit"}, txn.ops)
+	require.Len(t, txn.committed, 2)
+	for i, record := range txn.committed {
+		assert.Equal(t, string(events[i].Topic), record.Topic)
+		var event model.APMEvent
+		require.NoError(t, codec.Decode(record.Value, &event))
+		assert.Equal(t, events[i].Event, event)
+	}
+
+	// Failing to produce any of the records aborts the whole transaction.
+	txn.ops, txn.committed, txn.failing = nil, nil, "index"
+	err = producer.ProduceAtomically(context.Background(), events)
+	assert.EqualError(t, err, "kafka: transaction aborted: not leader for partition")
+	assert.Equal(t, []string{"begin", "abort buffered", "abort"}, txn.ops)
+	assert.Empty(t, txn.committed)
+
+	// The transaction is aborted even if producing failed because the
+	// context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	txn.ops = nil
+	err = producer.ProduceAtomically(ctx, events)
+	assert.EqualError(t, err, "kafka: transaction aborted: not leader for partition")
+	assert.Equal(t, []string{"begin", "abort buffered", "abort"}, txn.ops)
+}
@@ -0,0 +1,191 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// defaultCheckpointInterval is the default ConsumerConfig.CheckpointInterval.
+const defaultCheckpointInterval = 5 * time.Second
+
+// Checkpoint holds the next offset to consume for each topic partition.
+type Checkpoint map[apmqueue.Topic]map[int32]int64
+
+// Checkpointer loads and stores the consumer position, allowing consumption
+// to be resumed from a position stored outside of Kafka.
+type Checkpointer interface {
+	// Load returns the stored checkpoint. An empty checkpoint must be
+	// returned if none has been stored yet.
+	Load(ctx context.Context) (Checkpoint, error)
+	// Store stores the checkpoint, replacing any previously stored one.
+	Store(ctx context.Context, checkpoint Checkpoint) error
+}
+
+// FileCheckpointer is a Checkpointer which stores the checkpoint as JSON in
+// a local file.
+type FileCheckpointer struct {
+	path string
+}
+
+// NewFileCheckpointer returns a Checkpointer which stores the checkpoint in
+// the file at path.
+func NewFileCheckpointer(path string) *FileCheckpointer {
+	return &FileCheckpointer{path: path}
+}
+
+// Load reads the checkpoint from the file. If the file doesn't exist, an
+// empty checkpoint is returned.
+func (f *FileCheckpointer) Load(context.Context) (Checkpoint, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Checkpoint{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed reading checkpoint: %w", err)
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("kafka: failed decoding checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// Store writes the checkpoint to a temporary file, which then replaces the
+// checkpoint file, so the checkpoint isn't corrupted by partial writes.
+func (f *FileCheckpointer) Store(_ context.Context, checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("kafka: failed encoding checkpoint: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("kafka: failed writing checkpoint: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("kafka: failed writing checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("kafka: failed writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("kafka: failed writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+// checkpoints tracks the consumer position, to be stored by a Checkpointer.
+type checkpoints struct {
+	mu      sync.Mutex
+	offsets Checkpoint
+	dirty   bool
+}
+
+func newCheckpoints(loaded Checkpoint) *checkpoints {
+	return &checkpoints{offsets: loaded.clone()}
+}
+
+// set sets the next offset to consume for the topic partition. It's a no-op
+// on a nil receiver, when checkpointing is disabled.
+func (c *checkpoints) set(topic string, partition int32, offset int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	partitions, ok := c.offsets[apmqueue.Topic(topic)]
+	if !ok {
+		partitions = make(map[int32]int64)
+		c.offsets[apmqueue.Topic(topic)] = partitions
+	}
+	partitions[partition] = offset
+	c.dirty = true
+}
+
+// offset returns the next offset to consume for the topic partition, if
+// any. It returns false on a nil receiver.
+func (c *checkpoints) offset(topic string, partition int32) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offset, ok := c.offsets[apmqueue.Topic(topic)][partition]
+	return offset, ok
+}
+
+// adjust sets the fetch offsets of the assigned partitions which have a
+// checkpoint. It must be set as the kgo.AdjustFetchOffsetsFn.
+func (c *checkpoints) adjust(_ context.Context, assigned map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic, partitions := range assigned {
+		for partition := range partitions {
+			if offset, ok := c.offsets[apmqueue.Topic(topic)][partition]; ok {
+				// Clear the epoch, since the checkpoint doesn't store it.
+				partitions[partition] = kgo.NewOffset().At(offset).WithEpoch(-1)
+			}
+		}
+	}
+	return assigned, nil
+}
+
+// snapshot returns a copy of the tracked checkpoint if it has changed since
+// the last snapshot.
+func (c *checkpoints) snapshot() (Checkpoint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil, false
+	}
+	c.dirty = false
+	return c.offsets.clone(), true
+}
+
+// invalidate marks the tracked checkpoint as changed, i.e. when storing the
+// last snapshot failed.
+func (c *checkpoints) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirty = true
+}
+
+func (c Checkpoint) clone() Checkpoint {
+	clone := make(Checkpoint, len(c))
+	for topic, partitions := range c {
+		clone[topic] = make(map[int32]int64, len(partitions))
+		for partition, offset := range partitions {
+			clone[topic][partition] = offset
+		}
+	}
+	return clone
+}
@@ -0,0 +1,110 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestFileCheckpointer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp := NewFileCheckpointer(path)
+
+	checkpoint, err := cp.Load(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, checkpoint)
+
+	want := Checkpoint{"a": {0: 10, 1: 20}, "b": {0: 5}}
+	require.NoError(t, cp.Store(context.Background(), want))
+	checkpoint, err = cp.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, want, checkpoint)
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	_, err = cp.Load(context.Background())
+	assert.ErrorContains(t, err, "kafka: failed decoding checkpoint")
+}
+
+func TestConsumerCheckpoint(t *testing.T) {
+	topic := apmqueue.Topic("topic")
+	_, addrs := newClusterWithTopics(t, topic)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(addrs...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	codec := json.JSON{}
+	for i := 0; i < 10; i++ {
+		b, err := codec.Encode(model.APMEvent{Transaction: &model.Transaction{ID: "1"}})
+		require.NoError(t, err)
+		produceRecord(context.Background(), t, client,
+			&kgo.Record{Topic: string(topic), Partition: 0, Value: b},
+		)
+	}
+
+	checkpointer := NewFileCheckpointer(filepath.Join(t.TempDir(), "checkpoint.json"))
+	require.NoError(t, checkpointer.Store(context.Background(), Checkpoint{topic: {0: 6}}))
+
+	var processed atomic.Int64
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers:            addrs,
+		Topics:             []apmqueue.Topic{topic},
+		GroupID:            "groupid",
+		Decoder:            codec,
+		Logger:             zap.NewNop(),
+		Delivery:           apmqueue.AtLeastOnceDeliveryType,
+		Checkpointer:       checkpointer,
+		CheckpointInterval: 10 * time.Millisecond,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed.Add(int64(len(*b)))
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	// Consumption resumes from the checkpoint, and the new position is stored.
+	assert.Eventually(t, func() bool {
+		checkpoint, err := checkpointer.Load(context.Background())
+		require.NoError(t, err)
+		return checkpoint[topic][0] == 10
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(4), processed.Load())
+}
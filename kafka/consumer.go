@@ -24,11 +24,16 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/pkg/sasl"
 	"github.com/twmb/franz-go/plugin/kotel"
 	"github.com/twmb/franz-go/plugin/kzap"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/zap"
 
 	"github.com/elastic/apm-data/model"
@@ -40,6 +45,10 @@ var (
 	// ErrCommitFailed may be returned by `consumer.Run` when DeliveryType is
 	// apmqueue.AtMostOnceDelivery.
 	ErrCommitFailed = errors.New("kafka: failed to commit offsets")
+
+	// errMaxRuntime is the cause of the Run context cancellation once the
+	// MaxRuntime has elapsed.
+	errMaxRuntime = errors.New("kafka: max runtime reached")
 )
 
 // SASLMechanism type alias to sasl.Mechanism
@@ -67,12 +76,42 @@ type ConsumerConfig struct {
 	Version string
 	// Decoder holds an encoding.Decoder for decoding records.
 	Decoder Decoder
+	// DecoderSelfTest, when set, is a sample record value which is decoded
+	// with Decoder when the consumer is created. NewConsumer returns an error
+	// if it can't be decoded, guarding against deploying a consumer whose
+	// Decoder doesn't match the format of the produced records.
+	DecoderSelfTest []byte
 	// MaxPollRecords defines an upper bound to the number of records that can
 	// be polled on a single fetch. If MaxPollRecords <= 0, defaults to 100.
 	//
 	// It is best to keep the number of polled records small or the consumer
 	// risks being forced out of the group if it exceeds rebalance.timeout.ms.
+	//
+	// MaxPollRecords only limits how many of the already fetched records are
+	// processed in each poll cycle, the Fetch* settings determine how many
+	// records are fetched from the brokers and buffered by the client.
 	MaxPollRecords int
+	// FetchMaxBytes sets the maximum number of bytes that the brokers return
+	// in a single fetch response. Larger values increase throughput at the
+	// expense of memory usage, since fetched records are buffered until they
+	// are polled. If FetchMaxBytes <= 0, defaults to 50MiB.
+	FetchMaxBytes int32
+	// FetchMinBytes sets the minimum number of bytes that the brokers wait to
+	// accumulate before answering a fetch request, up to FetchMaxWait. Larger
+	// values increase throughput at the expense of latency on low traffic
+	// topics. If FetchMinBytes <= 0, defaults to 1 byte.
+	FetchMinBytes int32
+	// FetchMaxWait sets the maximum time that the brokers wait for
+	// FetchMinBytes to accumulate before answering a fetch request. Must be
+	// at least 10ms. If FetchMaxWait <= 0, defaults to 5s.
+	FetchMaxWait time.Duration
+	// ReadCommitted, when true, only reads the records of committed
+	// transactions, skipping those of aborted transactions, i.e. produced
+	// with Producer.ProduceAtomically. Partitions are then only read up to
+	// the last stable offset, so records are delayed while a transaction is
+	// open. By default, all records are read, as before transactions were
+	// supported.
+	ReadCommitted bool
 	// Delivery mechanism to use to acknowledge the messages.
 	// AtMostOnceDeliveryType and AtLeastOnceDeliveryType are supported.
 	// If not set, it defaults to apmqueue.AtMostOnceDeliveryType.
@@ -101,8 +140,68 @@ type ConsumerConfig struct {
 	// This option conflicts with TLS. Only one can be used.
 	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
 
-	// DisableTelemetry disables the OpenTelemetry hook
+	// DisableTelemetry disables the OpenTelemetry hook, and the extraction
+	// of the trace context and baggage from the record headers.
 	DisableTelemetry bool
+	// MeterProvider allows specifying a custom otel meter provider.
+	// Defaults to the global one.
+	MeterProvider metric.MeterProvider
+	// LagPollInterval is the interval at which the consumer group lag is
+	// polled from the brokers while the consumer is running, and reported
+	// as the consumer.group.lag metric for each topic and partition. The lag
+	// is the difference between the high watermark and the committed offset.
+	// If LagPollInterval <= 0, the consumer group lag isn't polled.
+	LagPollInterval time.Duration
+	// Checkpointer, when set, is consulted when partitions are assigned to
+	// the consumer, which starts consuming them from the stored offsets
+	// rather than the consumer group committed offsets. The position of the
+	// consumer is stored every CheckpointInterval after records have been
+	// processed (or committed, when using AtLeastOnceDeliveryType), and when
+	// the consumer is closed. It allows resuming one-shot replay jobs which
+	// don't rely on a durable consumer group position.
+	Checkpointer Checkpointer
+	// CheckpointInterval is the interval at which the consumer position is
+	// stored with the Checkpointer. If CheckpointInterval <= 0, defaults to
+	// 5s.
+	CheckpointInterval time.Duration
+	// EndPosition, when set, makes the consumer stop processing each
+	// partition once it reaches its end position, and Run return nil once
+	// all the partitions have reached it. End positions are resolved when
+	// Run is called, and capped at the partitions' high watermark, so
+	// records produced afterwards are never processed. Combined with a
+	// Checkpointer, it allows replaying a bounded range of records.
+	//
+	// When using AtMostOnceDeliveryType, records past the end position
+	// which are fetched together with records before it are committed
+	// without being processed. Use AtLeastOnceDeliveryType to only commit
+	// up to the end position.
+	EndPosition *EndPosition
+	// MaxRuntime, when > 0, is the maximum time Run consumes records for.
+	// Once elapsed, Run stops consuming and returns nil, regardless of the
+	// remaining backlog, and the stop reason is logged. It bounds the
+	// duration of one-shot processing jobs.
+	MaxRuntime time.Duration
+	// HighWaterMark, when set, is called with the topic and partition of
+	// each batch of fetched records, and returns the offset below which the
+	// records of the partition have already been processed, i.e. tracked by
+	// the processor in a durable store. Records with a lower offset are
+	// skipped without being processed, and committed, providing cheap
+	// deduplication for idempotent re-runs. It returns a value <= 0 when no
+	// records of the partition have been processed.
+	HighWaterMark func(topic apmqueue.Topic, partition int32) int64
+	// KeyHandler, when set, is called with the record key and the decoded
+	// event before the event is processed, allowing the event to be enriched
+	// with the identity carried in the record key.
+	KeyHandler func(key []byte, event *model.APMEvent)
+	// MetadataCodec, when set, decodes the record headers into structured
+	// metadata, which is stored in the processing context and can be
+	// retrieved with queuecontext.StructuredMetadataFromContext. Records
+	// whose headers can't be decoded are handled as decoding failures.
+	MetadataCodec queuecontext.MetadataCodec
+	// RedactAttributes holds the record headers whose values are replaced
+	// with a placeholder in the logs, i.e. headers which may contain
+	// personal data.
+	RedactAttributes []string
 }
 
 // Validate ensures the configuration is valid, otherwise, returns an error.
@@ -129,6 +228,12 @@ func (cfg ConsumerConfig) Validate() error {
 	if cfg.TLS != nil && cfg.Dialer != nil {
 		errs = append(errs, errors.New("kafka: only one of TLS or Dialer can be set"))
 	}
+	if cfg.FetchMaxWait > 0 && cfg.FetchMaxWait < 10*time.Millisecond {
+		errs = append(errs, errors.New("kafka: fetch max wait must be at least 10ms"))
+	}
+	if cfg.FetchMinBytes > 0 && cfg.FetchMaxBytes > 0 && cfg.FetchMinBytes > cfg.FetchMaxBytes {
+		errs = append(errs, errors.New("kafka: fetch min bytes cannot exceed fetch max bytes"))
+	}
 	return errors.Join(errs...)
 }
 
@@ -139,25 +244,72 @@ type Consumer struct {
 	client   *kgo.Client
 	cfg      ConsumerConfig
 	consumer *consumer
+	lag      *groupLag
+	// running is true while Run is executing.
+	running atomic.Bool
+	// checkpoints is nil unless a Checkpointer is configured.
+	checkpoints *checkpoints
+	// runDone is closed once Run returns for the first time.
+	runDone runDone
 }
 
 // NewConsumer creates a new instance of a Consumer. The consumer will read from
 // each partition concurrently by using a dedicated goroutine per partition.
 func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("kafka: invalid consumer config: %w", err)
+		return nil, fmt.Errorf("kafka: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	if cfg.DecoderSelfTest != nil {
+		var event model.APMEvent
+		if err := cfg.Decoder.Decode(cfg.DecoderSelfTest, &event); err != nil {
+			return nil, fmt.Errorf("kafka: %w: decoder self test failed: %w",
+				apmqueue.ErrInvalidConfig, err,
+			)
+		}
+	}
+	var checkpoints *checkpoints
+	if cfg.Checkpointer != nil {
+		loaded, err := cfg.Checkpointer.Load(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("kafka: failed loading checkpoint: %w", err)
+		}
+		checkpoints = newCheckpoints(loaded)
+		if cfg.CheckpointInterval <= 0 {
+			cfg.CheckpointInterval = defaultCheckpointInterval
+		}
+	}
+	meterProvider := cfg.MeterProvider
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+	duplicate, err := meterProvider.Meter("kafka").Int64Counter("consumer.duplicate",
+		metric.WithDescription("Number of records committed because the processor had already processed them"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed creating consumer metrics: %w", err)
 	}
 	consumer := &consumer{
-		consumers: make(map[topicPartition]partitionConsumer),
-		processor: cfg.Processor,
-		logger:    cfg.Logger.Named("partition"),
-		decoder:   cfg.Decoder,
-		delivery:  cfg.Delivery,
+		consumers:   make(map[topicPartition]partitionConsumer),
+		processor:   cfg.Processor,
+		logger:      cfg.Logger.Named("partition"),
+		decoder:     cfg.Decoder,
+		delivery:    cfg.Delivery,
+		checkpoints: checkpoints,
+		highWater:   cfg.HighWaterMark,
+		keyHandler:  cfg.KeyHandler,
+		metaCodec:   cfg.MetadataCodec,
+		redact:      newRedactor(cfg.RedactAttributes),
+		duplicate:   duplicate,
+		telemetry:   !cfg.DisableTelemetry,
 	}
 	topics := make([]string, 0, len(cfg.Topics))
 	for _, t := range cfg.Topics {
 		topics = append(topics, string(t))
 	}
+	consumer.topics = topics
+	if cfg.EndPosition != nil {
+		consumer.end = newEndOffsets()
+	}
 	opts := []kgo.Opt{
 		kgo.SeedBrokers(cfg.Brokers...),
 		kgo.ConsumerGroup(cfg.GroupID),
@@ -177,6 +329,11 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 		kgo.OnPartitionsLost(consumer.lost),
 		kgo.OnPartitionsRevoked(consumer.lost),
 	}
+	if cfg.ReadCommitted {
+		// Skip the records of aborted transactions, see
+		// Producer.ProduceAtomically.
+		opts = append(opts, kgo.FetchIsolationLevel(kgo.ReadCommitted()))
+	}
 	if cfg.ClientID != "" {
 		opts = append(opts, kgo.ClientID(cfg.ClientID))
 		if cfg.Version != "" {
@@ -196,6 +353,18 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	if cfg.MaxPollRecords <= 0 {
 		cfg.MaxPollRecords = 100
 	}
+	if cfg.FetchMaxBytes > 0 {
+		opts = append(opts, kgo.FetchMaxBytes(cfg.FetchMaxBytes))
+	}
+	if cfg.FetchMinBytes > 0 {
+		opts = append(opts, kgo.FetchMinBytes(cfg.FetchMinBytes))
+	}
+	if cfg.FetchMaxWait > 0 {
+		opts = append(opts, kgo.FetchMaxWait(cfg.FetchMaxWait))
+	}
+	if checkpoints != nil {
+		opts = append(opts, kgo.AdjustFetchOffsetsFn(checkpoints.adjust))
+	}
 
 	if !cfg.DisableTelemetry {
 		kotelService := kotel.NewKotel()
@@ -204,15 +373,26 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 
 	client, err := kgo.NewClient(opts...)
 	if err != nil {
-		return nil, fmt.Errorf("kafka: failed creating kafka consumer: %w", err)
+		return nil, fmt.Errorf("kafka: %w: failed creating kafka consumer: %w",
+			apmqueue.ErrInvalidConfig, err,
+		)
+	}
+	var lag *groupLag
+	if cfg.LagPollInterval > 0 {
+		if lag, err = newGroupLag(client, meterProvider, cfg, topics); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("kafka: failed creating consumer group lag metric: %w", err)
+		}
 	}
 	// Issue a metadata refresh request on construction, so the broker list is
 	// populated.
 	client.ForceMetadataRefresh()
 	return &Consumer{
-		cfg:      cfg,
-		client:   client,
-		consumer: consumer,
+		cfg:         cfg,
+		client:      client,
+		consumer:    consumer,
+		lag:         lag,
+		checkpoints: checkpoints,
 	}, nil
 }
 
@@ -224,6 +404,12 @@ func (c *Consumer) Close() error {
 	// allow rebalances since polls aren't concurrent with Close().
 	c.client.Close()
 	c.consumer.wg.Wait() // Wait for all the goroutines to exit.
+	if c.checkpoints != nil {
+		c.storeCheckpoint(context.Background())
+	}
+	if c.lag != nil {
+		return c.lag.close()
+	}
 	return nil
 }
 
@@ -234,14 +420,113 @@ func (c *Consumer) Close() error {
 //   - ErrCommitFailed.
 //
 // To shut down the consumer, cancel the context, or call consumer.Close().
-func (c *Consumer) Run(ctx context.Context) error {
+// Run returns an error wrapping apmqueue.ErrAlreadyStarted if the consumer is
+// already running, and apmqueue.ErrConsumerClosed once it has been closed.
+func (c *Consumer) Run(ctx context.Context) (err error) {
+	if !c.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("kafka: %w", apmqueue.ErrAlreadyStarted)
+	}
+	defer c.running.Store(false)
+	defer func() { c.runDone.finish(err) }()
+	ctx, stop := context.WithCancelCause(ctx)
+	cancel := func() { stop(nil) }
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	if c.cfg.MaxRuntime > 0 {
+		timer := time.AfterFunc(c.cfg.MaxRuntime, func() { stop(errMaxRuntime) })
+		defer timer.Stop()
+	}
+	end := c.consumer.end
+	if end != nil {
+		if err := end.resolve(ctx, c.client, *c.cfg.EndPosition,
+			c.cfg.GroupID, c.consumer.topics, c.checkpoints,
+		); err != nil {
+			return fmt.Errorf("kafka: %w: failed resolving end position: %w",
+				apmqueue.ErrBackendUnavailable, err,
+			)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-end.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	if c.lag != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.lag.run(ctx)
+		}()
+	}
+	if c.checkpoints != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(c.cfg.CheckpointInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					c.storeCheckpoint(ctx)
+				}
+			}
+		}()
+	}
 	for {
 		if err := c.fetch(ctx); err != nil {
+			if end != nil {
+				select {
+				case <-end.done:
+					return nil // All partitions reached the end position.
+				default:
+				}
+			}
+			if errors.Is(context.Cause(ctx), errMaxRuntime) {
+				c.cfg.Logger.Info("stopping consumer: max runtime reached",
+					zap.Duration("max_runtime", c.cfg.MaxRuntime),
+				)
+				return nil
+			}
 			return err
 		}
 	}
 }
 
+// Done returns a channel which is closed once Run returns for the first
+// time, allowing the termination of the consumer to be awaited alongside
+// other events.
+func (c *Consumer) Done() <-chan struct{} {
+	return c.runDone.done()
+}
+
+// Err returns nil until Done is closed, and the error returned by Run
+// afterwards.
+func (c *Consumer) Err() error {
+	return c.runDone.error()
+}
+
+// EffectiveConfig returns the configuration the consumer is running with,
+// once the defaults have been applied. Secrets are redacted: the SASL
+// mechanism is omitted, and so are the certificates of the TLS config.
+func (c *Consumer) EffectiveConfig() ConsumerConfig {
+	cfg := c.cfg
+	cfg.SASL = nil
+	if cfg.TLS != nil {
+		cfg.TLS = cfg.TLS.Clone()
+		cfg.TLS.Certificates = nil
+		cfg.TLS.GetCertificate = nil
+		cfg.TLS.GetClientCertificate = nil
+	}
+	return cfg
+}
+
 // fetch polls the Kafka broker for new records up to cfg.MaxPollRecords.
 // Any errors returned by fetch should be considered fatal.
 func (c *Consumer) fetch(ctx context.Context) error {
@@ -249,7 +534,7 @@ func (c *Consumer) fetch(ctx context.Context) error {
 	defer c.client.AllowRebalance()
 
 	if fetches.IsClientClosed() {
-		return fmt.Errorf("client is closed: %w", context.Canceled)
+		return fmt.Errorf("kafka: %w: %w", apmqueue.ErrConsumerClosed, context.Canceled)
 	}
 	if errors.Is(fetches.Err0(), context.Canceled) ||
 		errors.Is(fetches.Err0(), context.DeadlineExceeded) {
@@ -306,11 +591,24 @@ func (c *Consumer) fetch(ctx context.Context) error {
 	return nil
 }
 
+// storeCheckpoint stores the consumer position if it changed since it was
+// last stored.
+func (c *Consumer) storeCheckpoint(ctx context.Context) {
+	checkpoint, ok := c.checkpoints.snapshot()
+	if !ok {
+		return
+	}
+	if err := c.cfg.Checkpointer.Store(ctx, checkpoint); err != nil {
+		c.checkpoints.invalidate()
+		c.cfg.Logger.Error("failed storing checkpoint", zap.Error(err))
+	}
+}
+
 // Healthy returns an error if the Kafka client fails to reach a discovered
 // broker.
 func (c *Consumer) Healthy(ctx context.Context) error {
 	if err := c.client.Ping(ctx); err != nil {
-		return fmt.Errorf("health probe: %w", err)
+		return fmt.Errorf("kafka: %w: health probe: %w", apmqueue.ErrBackendUnavailable, err)
 	}
 	return nil
 }
@@ -325,6 +623,24 @@ type consumer struct {
 	logger    *zap.Logger
 	decoder   Decoder
 	delivery  apmqueue.DeliveryType
+	// checkpoints is nil unless a Checkpointer is configured.
+	checkpoints *checkpoints
+	// topics and end are used to resolve the EndPosition, end is nil
+	// unless an EndPosition is configured.
+	topics []string
+	end    *endOffsets
+	// highWater is nil unless a HighWaterMark is configured.
+	highWater func(apmqueue.Topic, int32) int64
+	// keyHandler is nil unless a KeyHandler is configured.
+	keyHandler func([]byte, *model.APMEvent)
+	// metaCodec is nil unless a MetadataCodec is configured.
+	metaCodec queuecontext.MetadataCodec
+	// redact is nil unless RedactAttributes are configured.
+	redact redactor
+	// duplicate counts the records the processor had already processed.
+	duplicate metric.Int64Counter
+	// telemetry is false when DisableTelemetry is set.
+	telemetry bool
 }
 
 type topicPartition struct {
@@ -342,12 +658,20 @@ func (c *consumer) assigned(ctx context.Context, client *kgo.Client, assigned ma
 		for _, partition := range partitions {
 			c.wg.Add(1)
 			pc := partitionConsumer{
-				records:   make(chan []*kgo.Record),
-				processor: c.processor,
-				logger:    c.logger,
-				decoder:   c.decoder,
-				client:    client,
-				delivery:  c.delivery,
+				records:     make(chan []*kgo.Record),
+				processor:   c.processor,
+				logger:      c.logger,
+				decoder:     c.decoder,
+				client:      client,
+				delivery:    c.delivery,
+				checkpoints: c.checkpoints,
+				end:         c.end,
+				highWater:   c.highWater,
+				keyHandler:  c.keyHandler,
+				metaCodec:   c.metaCodec,
+				redact:      c.redact,
+				duplicate:   c.duplicate,
+				telemetry:   c.telemetry,
 			}
 			go func(topic string, partition int32) {
 				defer c.wg.Done()
@@ -384,6 +708,20 @@ type partitionConsumer struct {
 	logger    *zap.Logger
 	decoder   Decoder
 	delivery  apmqueue.DeliveryType
+	// checkpoints is nil unless a Checkpointer is configured.
+	checkpoints *checkpoints
+	// end is nil unless an EndPosition is configured.
+	end *endOffsets
+	// highWater is nil unless a HighWaterMark is configured.
+	highWater func(apmqueue.Topic, int32) int64
+	// keyHandler is nil unless a KeyHandler is configured.
+	keyHandler func([]byte, *model.APMEvent)
+	// metaCodec is nil unless a MetadataCodec is configured.
+	metaCodec queuecontext.MetadataCodec
+	// redact is nil unless RedactAttributes are configured.
+	redact    redactor
+	duplicate metric.Int64Counter
+	telemetry bool
 }
 
 // consume processed the records from a topic and partition. Calling consume
@@ -395,10 +733,23 @@ func (pc partitionConsumer) consume(ctx context.Context, topic string, partition
 		zap.Int32("partition", partition),
 	)
 	for records := range pc.records {
+		records = pc.end.filter(topic, partition, records)
+		if len(records) == 0 {
+			continue
+		}
 		// Store the last processed record. Default to -1 for cases where
 		// only the first record is received.
 		last := -1
+		var highWater int64
+		if pc.highWater != nil {
+			highWater = pc.highWater(apmqueue.Topic(topic), partition)
+		}
 		for i, msg := range records {
+			if msg.Offset < highWater {
+				// Already processed, commit without processing it again.
+				last = i
+				continue
+			}
 			meta := make(map[string]string)
 			for _, h := range msg.Headers {
 				meta[h.Key] = string(h.Value)
@@ -409,20 +760,50 @@ func (pc partitionConsumer) consume(ctx context.Context, topic string, partition
 					zap.Error(err),
 					zap.ByteString("message.value", msg.Value),
 					zap.Int64("offset", msg.Offset),
-					zap.Any("headers", meta),
+					zap.Any("headers", pc.redact.attributes(meta)),
 				)
 				// NOTE(marclop) The decoding has failed, a DLQ may be helpful.
 				continue
 			}
-			ctx := queuecontext.WithMetadata(ctx, meta)
+			if pc.keyHandler != nil {
+				pc.keyHandler(msg.Key, &event)
+			}
+			ctx := ctx
+			if pc.telemetry {
+				// Extract the trace context and baggage propagated in the
+				// record headers, so they're available to the processor.
+				ctx = otel.GetTextMapPropagator().Extract(ctx, kotel.NewRecordCarrier(msg))
+			}
+			ctx = queuecontext.WithMetadata(ctx, meta)
+			if pc.metaCodec != nil {
+				structured, err := pc.metaCodec.DecodeMetadata(meta)
+				if err != nil {
+					logger.Error("unable to decode message headers into metadata",
+						zap.Error(err),
+						zap.Int64("offset", msg.Offset),
+						zap.Any("headers", pc.redact.attributes(meta)),
+					)
+					continue
+				}
+				ctx = queuecontext.WithStructuredMetadata(ctx, structured)
+			}
 			batch := model.Batch{event}
 			// If a record can't be processed, no retries are attempted and it
 			// may be lost. https://github.com/elastic/apm-queue/issues/118.
-			if err := pc.processor.ProcessBatch(ctx, &batch); err != nil {
+			err := pc.processor.ProcessBatch(ctx, &batch)
+			if errors.Is(err, apmqueue.ErrAlreadyProcessed) {
+				// Duplicates are committed as successfully processed.
+				pc.duplicate.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("topic", topic),
+					attribute.Int("partition", int(partition)),
+				))
+				err = nil
+			}
+			if err != nil {
 				logger.Error("data loss: unable to process event",
 					zap.Error(err),
 					zap.Int64("offset", msg.Offset),
-					zap.Any("headers", meta),
+					zap.Any("headers", pc.redact.attributes(meta)),
 				)
 				switch pc.delivery {
 				case apmqueue.AtLeastOnceDeliveryType:
@@ -444,7 +825,15 @@ func (pc partitionConsumer) consume(ctx context.Context, topic string, partition
 				logger.Info("committed",
 					zap.Int64("offset", lastRecord.Offset),
 				)
+				pc.checkpoints.set(topic, partition, lastRecord.Offset+1)
+				pc.end.reached(topic, partition, lastRecord.Offset+1)
 			}
 		}
+		// AtMostOnceDeliveryType commits the records as soon as they're
+		// fetched, so they're never consumed again regardless of the outcome.
+		if pc.delivery == apmqueue.AtMostOnceDeliveryType && len(records) > 0 {
+			pc.checkpoints.set(topic, partition, records[len(records)-1].Offset+1)
+			pc.end.reached(topic, partition, records[len(records)-1].Offset+1)
+		}
 	}
 }
@@ -21,6 +21,8 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"testing"
@@ -28,16 +30,24 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kfake"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/elastic/apm-data/model"
 	apmqueue "github.com/elastic/apm-queue"
 	"github.com/elastic/apm-queue/codec/json"
 	saslplain "github.com/elastic/apm-queue/kafka/sasl/plain"
+	"github.com/elastic/apm-queue/queuecontext"
 )
 
 func TestNewConsumer(t *testing.T) {
@@ -59,6 +69,32 @@ func TestNewConsumer(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		"invalid fetch settings": {
+			cfg: ConsumerConfig{
+				Brokers:       []string{"localhost:9092"},
+				Topics:        []apmqueue.Topic{"topic"},
+				GroupID:       "groupid",
+				Decoder:       json.JSON{},
+				Logger:        zap.NewNop(),
+				Processor:     model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+				FetchMaxWait:  time.Millisecond,
+				FetchMinBytes: 2 << 20,
+				FetchMaxBytes: 1 << 20,
+			},
+			expectErr: true,
+		},
+		"decoder self test failure": {
+			cfg: ConsumerConfig{
+				Brokers:         []string{"localhost:9092"},
+				Topics:          []apmqueue.Topic{"topic"},
+				GroupID:         "groupid",
+				Decoder:         json.JSON{},
+				DecoderSelfTest: []byte("not json"),
+				Logger:          zap.NewNop(),
+				Processor:       model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+			},
+			expectErr: true,
+		},
 		"valid": {
 			cfg: ConsumerConfig{
 				Brokers:   []string{"localhost:9092"},
@@ -71,6 +107,11 @@ func TestNewConsumer(t *testing.T) {
 				Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
 				SASL:      saslplain.New(saslplain.Plain{}),
 				TLS:       &tls.Config{},
+
+				DecoderSelfTest: []byte(`{"transaction":{"id":"1"}}`),
+				FetchMaxBytes:   1 << 20,
+				FetchMinBytes:   1 << 10,
+				FetchMaxWait:    100 * time.Millisecond,
 			},
 			expectErr: false,
 		},
@@ -82,7 +123,7 @@ func TestNewConsumer(t *testing.T) {
 				defer assert.NoError(t, consumer.Close())
 			}
 			if tc.expectErr {
-				assert.Error(t, err)
+				assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
 				assert.Nil(t, consumer)
 			} else {
 				assert.NoError(t, err)
@@ -128,7 +169,7 @@ func TestConsumerHealth(t *testing.T) {
 			}
 
 			if tc.expectErr {
-				assert.Error(t, consumer.Healthy(context.Background()))
+				assert.ErrorIs(t, consumer.Healthy(context.Background()), apmqueue.ErrBackendUnavailable)
 			} else {
 				assert.NoError(t, consumer.Healthy(context.Background()))
 			}
@@ -528,6 +569,300 @@ func TestMultipleConsumerGroups(t *testing.T) {
 	}
 }
 
+func TestConsumerMaxRuntime(t *testing.T) {
+	_, addrs := newClusterWithTopics(t, "topic")
+	core, logs := observer.New(zapcore.InfoLevel)
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers:    addrs,
+		Topics:     []apmqueue.Topic{"topic"},
+		GroupID:    "groupid",
+		Decoder:    json.JSON{},
+		Logger:     zap.New(core),
+		Processor:  model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		MaxRuntime: 100 * time.Millisecond,
+	})
+	start := time.Now()
+	assert.NoError(t, consumer.Run(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, 1, logs.FilterMessage("stopping consumer: max runtime reached").Len())
+}
+
+func TestConsumerEffectiveConfig(t *testing.T) {
+	_, addrs := newClusterWithTopics(t, "topic")
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers:      addrs,
+		Topics:       []apmqueue.Topic{"topic"},
+		GroupID:      "groupid",
+		Decoder:      json.JSON{},
+		Logger:       zap.NewNop(),
+		Processor:    model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		Checkpointer: NewFileCheckpointer(filepath.Join(t.TempDir(), "checkpoint.json")),
+	})
+	cfg := consumer.EffectiveConfig()
+	// Defaults are applied.
+	assert.Equal(t, 100, cfg.MaxPollRecords)
+	assert.Equal(t, defaultCheckpointInterval, cfg.CheckpointInterval)
+	assert.Equal(t, []apmqueue.Topic{"topic"}, cfg.Topics)
+
+	t.Run("redacted", func(t *testing.T) {
+		tlsConfig := &tls.Config{
+			ServerName:   "broker",
+			Certificates: []tls.Certificate{{Certificate: [][]byte{[]byte("cert")}}},
+		}
+		consumer := &Consumer{cfg: ConsumerConfig{
+			SASL: saslplain.New(saslplain.Plain{User: "user", Pass: "secret"}),
+			TLS:  tlsConfig,
+		}}
+		cfg := consumer.EffectiveConfig()
+		assert.Nil(t, cfg.SASL)
+		assert.Equal(t, "broker", cfg.TLS.ServerName)
+		assert.Nil(t, cfg.TLS.Certificates)
+		// The configured TLS config isn't modified.
+		assert.Len(t, tlsConfig.Certificates, 1)
+	})
+}
+
+func TestConsumerDone(t *testing.T) {
+	_, addrs := newClusterWithTopics(t, "topic")
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers:   addrs,
+		Topics:    []apmqueue.Topic{"topic"},
+		GroupID:   "groupid",
+		Decoder:   json.JSON{},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- consumer.Run(ctx) }()
+	select {
+	case <-consumer.Done():
+		t.Fatal("done before Run returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, consumer.Err())
+
+	cancel()
+	err := <-errs
+	require.Error(t, err)
+	select {
+	case <-consumer.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not done after Run returned")
+	}
+	assert.Equal(t, err, consumer.Err())
+}
+
+func init() {
+	// The default global propagator delegates to the first propagator set,
+	// so it can't be restored once a test has set one. The tests start with
+	// an explicit no-op propagator instead, which can be saved and restored.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+}
+
+func TestConsumerBaggage(t *testing.T) {
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagator) })
+
+	topic := apmqueue.Topic("topic")
+	_, addrs := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:     addrs,
+		Sync:        true,
+		Logger:      zap.NewNop(),
+		Encoder:     json.JSON{},
+		TopicRouter: func(model.APMEvent) apmqueue.Topic { return topic },
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, producer.Close()) })
+
+	tenant, err := baggage.NewMember("tenant", "a")
+	require.NoError(t, err)
+	bag, err := baggage.New(tenant)
+	require.NoError(t, err)
+	ctx := baggage.ContextWithBaggage(context.Background(), bag)
+	require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+	}))
+
+	for name, tc := range map[string]struct {
+		disableTelemetry bool
+		tenant           string
+	}{
+		"enabled":  {tenant: "a"},
+		"disabled": {disableTelemetry: true, tenant: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tenants := make(chan string, 1)
+			consumer := newConsumer(t, ConsumerConfig{
+				Brokers:          addrs,
+				Topics:           []apmqueue.Topic{topic},
+				GroupID:          name,
+				Decoder:          json.JSON{},
+				Logger:           zap.NewNop(),
+				DisableTelemetry: tc.disableTelemetry,
+				Processor: model.ProcessBatchFunc(func(ctx context.Context, _ *model.Batch) error {
+					tenants <- baggage.FromContext(ctx).Member("tenant").Value()
+					return nil
+				}),
+			})
+			runCtx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go consumer.Run(runCtx)
+			select {
+			case got := <-tenants:
+				assert.Equal(t, tc.tenant, got)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the record to be processed")
+			}
+		})
+	}
+}
+
+func TestConsumerHighWaterMark(t *testing.T) {
+	topic := apmqueue.Topic("topic")
+	client, addrs := newClusterWithTopics(t, topic)
+	codec := json.JSON{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var partition int32
+	for i := 0; i < 5; i++ {
+		b, err := codec.Encode(model.APMEvent{Transaction: &model.Transaction{ID: strconv.Itoa(i)}})
+		require.NoError(t, err)
+		// Produce all the records with the same key to the same partition.
+		record := kgo.Record{Topic: string(topic), Key: []byte("key"), Value: b}
+		produceRecord(ctx, t, client, &record)
+		partition = record.Partition
+	}
+
+	processed := make(chan string, 5)
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers: addrs,
+		Topics:  []apmqueue.Topic{topic},
+		GroupID: "groupid",
+		Decoder: codec,
+		Logger:  zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed <- (*b)[0].Transaction.ID
+			return nil
+		}),
+		HighWaterMark: func(t apmqueue.Topic, p int32) int64 {
+			if t == topic && p == partition {
+				return 3
+			}
+			return 0
+		},
+	})
+	go consumer.Run(ctx)
+	for _, want := range []string{"3", "4"} {
+		select {
+		case got := <-processed:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the record to be processed")
+		}
+	}
+	// The skipped records are committed along with the processed ones.
+	admin := kadm.NewClient(client)
+	assert.Eventually(t, func() bool {
+		offsets, err := admin.FetchOffsets(ctx, "groupid")
+		if err != nil {
+			return false
+		}
+		o, ok := offsets.Lookup(string(topic), partition)
+		return ok && o.At == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case id := <-processed:
+		t.Fatalf("unexpected record processed: %s", id)
+	default:
+	}
+}
+
+func TestConsumerKeyHandler(t *testing.T) {
+	topic := apmqueue.Topic("topic")
+	client, addrs := newClusterWithTopics(t, topic)
+	codec := json.JSON{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, err := codec.Encode(model.APMEvent{Transaction: &model.Transaction{ID: "1"}})
+	require.NoError(t, err)
+	produceRecord(ctx, t, client, &kgo.Record{Topic: string(topic), Key: []byte("svc"), Value: b})
+
+	processed := make(chan model.APMEvent, 1)
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers: addrs,
+		Topics:  []apmqueue.Topic{topic},
+		GroupID: "groupid",
+		Decoder: codec,
+		Logger:  zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed <- (*b)[0]
+			return nil
+		}),
+		KeyHandler: func(key []byte, event *model.APMEvent) {
+			event.Service.Name = string(key)
+		},
+	})
+	go consumer.Run(ctx)
+	select {
+	case event := <-processed:
+		assert.Equal(t, model.APMEvent{
+			Service:     model.Service{Name: "svc"},
+			Transaction: &model.Transaction{ID: "1"},
+		}, event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+}
+
+func TestConsumerMetadataCodec(t *testing.T) {
+	topic := apmqueue.Topic("topic")
+	_, addrs := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:     addrs,
+		Sync:        true,
+		Logger:      zap.NewNop(),
+		Encoder:     json.JSON{},
+		TopicRouter: func(model.APMEvent) apmqueue.Topic { return topic },
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, producer.Close()) })
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	ctx = queuecontext.WithStructuredMetadata(ctx, queuecontext.Metadata{"n": 1})
+	require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+	}))
+
+	metadata := make(chan queuecontext.Metadata, 1)
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers:       addrs,
+		Topics:        []apmqueue.Topic{topic},
+		GroupID:       "groupid",
+		Decoder:       json.JSON{},
+		Logger:        zap.NewNop(),
+		MetadataCodec: queuecontext.IdentityCodec{},
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, _ *model.Batch) error {
+			meta, _ := queuecontext.StructuredMetadataFromContext(ctx)
+			metadata <- meta
+			return nil
+		}),
+	})
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(runCtx)
+	select {
+	case got := <-metadata:
+		assert.Equal(t, queuecontext.Metadata{"a": "b", "n": "1"}, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+}
+
 func TestConsumerRunError(t *testing.T) {
 	consumer := newConsumer(t, ConsumerConfig{
 		Brokers:   []string{"localhost:9092"},
@@ -543,8 +878,200 @@ func TestConsumerRunError(t *testing.T) {
 	cancel()
 	require.Error(t, consumer.Run(ctx))
 
+	// Concurrent runs are rejected.
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	assert.Eventually(t, func() bool {
+		return errors.Is(consumer.Run(ctx), apmqueue.ErrAlreadyStarted)
+	}, time.Second, time.Millisecond)
+	cancelRun()
+	<-done
+
 	consumer.Close()
-	require.Error(t, consumer.Run(context.Background()))
+	require.ErrorIs(t, consumer.Run(context.Background()), apmqueue.ErrConsumerClosed)
+}
+
+func TestConsumerGroupLag(t *testing.T) {
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	codec := json.JSON{}
+	topics := []apmqueue.Topic{"topic"}
+	client, addrs := newClusterWithTopics(t, topics...)
+
+	b, err := codec.Encode(event)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		produceRecord(context.Background(), t, client,
+			&kgo.Record{Topic: string(topics[0]), Value: b},
+		)
+	}
+
+	rdr := sdkmetric.NewManualReader()
+	release := make(chan struct{})
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers:         addrs,
+		Topics:          topics,
+		GroupID:         "groupid",
+		Decoder:         codec,
+		Logger:          zap.NewNop(),
+		Delivery:        apmqueue.AtLeastOnceDeliveryType,
+		MeterProvider:   sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+		LagPollInterval: 10 * time.Millisecond,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, _ *model.Batch) error {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	totalLag := func() int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		var total int64
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "consumer.group.lag" {
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+					total += dp.Value
+				}
+			}
+		}
+		return total
+	}
+	// No records are committed while the processor is blocked.
+	assert.Eventually(t, func() bool { return totalLag() == 10 },
+		5*time.Second, 10*time.Millisecond,
+	)
+	close(release)
+	assert.Eventually(t, func() bool { return totalLag() == 0 },
+		5*time.Second, 10*time.Millisecond,
+	)
+}
+
+func TestConsumerAlreadyProcessed(t *testing.T) {
+	topic := apmqueue.Topic("topic")
+	client, addrs := newClusterWithTopics(t, topic)
+	codec := json.JSON{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var partition int32
+	for i := 0; i < 2; i++ {
+		b, err := codec.Encode(model.APMEvent{Transaction: &model.Transaction{ID: strconv.Itoa(i)}})
+		require.NoError(t, err)
+		record := kgo.Record{Topic: string(topic), Key: []byte("key"), Value: b}
+		produceRecord(ctx, t, client, &record)
+		partition = record.Partition
+	}
+
+	rdr := sdkmetric.NewManualReader()
+	consumer := newConsumer(t, ConsumerConfig{
+		Brokers:       addrs,
+		Topics:        []apmqueue.Topic{topic},
+		GroupID:       "groupid",
+		Decoder:       codec,
+		Logger:        zap.NewNop(),
+		Delivery:      apmqueue.AtLeastOnceDeliveryType,
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			if (*b)[0].Transaction.ID == "0" {
+				return fmt.Errorf("processed: %w", apmqueue.ErrAlreadyProcessed)
+			}
+			return nil
+		}),
+	})
+	go consumer.Run(ctx)
+
+	// Duplicates are committed as successfully processed.
+	admin := kadm.NewClient(client)
+	assert.Eventually(t, func() bool {
+		offsets, err := admin.FetchOffsets(ctx, "groupid")
+		if err != nil {
+			return false
+		}
+		o, ok := offsets.Lookup(string(topic), partition)
+		return ok && o.At == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	var dps []metricdata.DataPoint[int64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "consumer.duplicate" {
+				dps = append(dps, m.Data.(metricdata.Sum[int64]).DataPoints...)
+			}
+		}
+	}
+	require.Len(t, dps, 1)
+	assert.Equal(t, int64(1), dps[0].Value)
+}
+
+func BenchmarkConsumerThroughput(b *testing.B) {
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	codec := json.JSON{}
+	encoded, err := codec.Encode(event)
+	require.NoError(b, err)
+	for _, bc := range []struct {
+		name           string
+		maxPollRecords int
+		fetchMaxBytes  int32
+		fetchMinBytes  int32
+		fetchMaxWait   time.Duration
+	}{
+		{name: "defaults"},
+		{name: "poll_1000", maxPollRecords: 1000},
+		{name: "fetch_max_64KiB", fetchMaxBytes: 64 << 10},
+		{name: "fetch_min_64KiB", fetchMinBytes: 64 << 10, fetchMaxWait: 50 * time.Millisecond},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			topic := apmqueue.Topic("topic")
+			client, addrs := newClusterWithTopics(b, topic)
+			for i := 0; i < b.N; i++ {
+				client.Produce(context.Background(),
+					&kgo.Record{Topic: string(topic), Value: encoded}, nil,
+				)
+			}
+			require.NoError(b, client.Flush(context.Background()))
+
+			var processed atomic.Int64
+			done := make(chan struct{})
+			consumer := newConsumer(b, ConsumerConfig{
+				Brokers:        addrs,
+				Topics:         []apmqueue.Topic{topic},
+				GroupID:        "groupid",
+				Decoder:        codec,
+				Logger:         zap.NewNop(),
+				MaxPollRecords: bc.maxPollRecords,
+				FetchMaxBytes:  bc.fetchMaxBytes,
+				FetchMinBytes:  bc.fetchMinBytes,
+				FetchMaxWait:   bc.fetchMaxWait,
+				Processor: model.ProcessBatchFunc(func(_ context.Context, batch *model.Batch) error {
+					if processed.Add(int64(len(*batch))) == int64(b.N) {
+						close(done)
+					}
+					return nil
+				}),
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			b.ResetTimer()
+			go consumer.Run(ctx)
+			<-done
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "records/s")
+		})
+	}
 }
 
 func newConsumer(t testing.TB, cfg ConsumerConfig) *Consumer {
@@ -17,4 +17,12 @@
 
 // Package kafka abstracts the production and consumption of model.Batch
 // to and from Kafka.
+//
+// Unless DisableTelemetry is set, the producer injects the trace context and
+// baggage of the produced events into the record headers using the global
+// otel propagator, and the consumer extracts them into the context passed to
+// the processor. Baggage is only propagated when the global propagator
+// includes propagation.Baggage. The W3C baggage header is limited to 8192
+// bytes, and counts towards the record size, which is limited by the
+// broker's message.max.bytes.
 package kafka
@@ -0,0 +1,167 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// EndPosition is the position at which the consumer stops consuming each
+// partition. The end position of a partition is exclusive, the record at the
+// end position isn't processed.
+type EndPosition struct {
+	// Offsets holds the end offset of topic partitions.
+	Offsets Checkpoint
+	// Timestamp, when set, is the end position of the partitions which
+	// aren't in Offsets: the first record produced at or after Timestamp.
+	Timestamp time.Time
+}
+
+// endOffsets tracks which partitions have reached their end offset. The end
+// offsets are resolved when the consumer is started.
+type endOffsets struct {
+	mu        sync.Mutex
+	ends      map[topicPartition]int64
+	remaining map[topicPartition]struct{}
+	// done is closed once all the partitions have reached their end offset.
+	done chan struct{}
+}
+
+func newEndOffsets() *endOffsets {
+	return &endOffsets{
+		ends:      make(map[topicPartition]int64),
+		remaining: make(map[topicPartition]struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// resolve resolves the end offset of every partition of the topics, and the
+// partitions which have already reached it, given the position where their
+// consumption starts. End offsets are capped at the partition's high
+// watermark, so consumption stops once all the records produced before the
+// consumer started have been consumed.
+func (e *endOffsets) resolve(ctx context.Context, client *kgo.Client, pos EndPosition,
+	group string, topics []string, checkpoints *checkpoints,
+) error {
+	admin := kadm.NewClient(client)
+	highWatermarks, err := admin.ListEndOffsets(ctx, topics...)
+	if err != nil {
+		return fmt.Errorf("failed listing end offsets: %w", err)
+	}
+	var afterTimestamp kadm.ListedOffsets
+	if !pos.Timestamp.IsZero() {
+		if afterTimestamp, err = admin.ListOffsetsAfterMilli(ctx,
+			pos.Timestamp.UnixMilli(), topics...,
+		); err != nil {
+			return fmt.Errorf("failed listing offsets after timestamp: %w", err)
+		}
+	}
+	startOffsets, err := admin.ListStartOffsets(ctx, topics...)
+	if err != nil {
+		return fmt.Errorf("failed listing start offsets: %w", err)
+	}
+	committed, err := admin.FetchOffsets(ctx, group)
+	if err != nil {
+		return fmt.Errorf("failed fetching committed offsets: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var errs []error
+	highWatermarks.Each(func(hwm kadm.ListedOffset) {
+		if hwm.Err != nil {
+			errs = append(errs, hwm.Err)
+			return
+		}
+		tp := topicPartition{topic: hwm.Topic, partition: hwm.Partition}
+		end := hwm.Offset
+		if offset, ok := pos.Offsets[apmqueue.Topic(hwm.Topic)][hwm.Partition]; ok {
+			end = offset
+		} else if o, ok := afterTimestamp.Lookup(hwm.Topic, hwm.Partition); ok && o.Offset >= 0 {
+			end = o.Offset
+		}
+		if end > hwm.Offset {
+			end = hwm.Offset
+		}
+		var start int64
+		if offset, ok := checkpoints.offset(hwm.Topic, hwm.Partition); ok {
+			start = offset
+		} else if o, ok := committed.Lookup(hwm.Topic, hwm.Partition); ok && o.Err == nil && o.At >= 0 {
+			start = o.At
+		} else if o, ok := startOffsets.Lookup(hwm.Topic, hwm.Partition); ok {
+			start = o.Offset
+		}
+		e.ends[tp] = end
+		if start < end {
+			e.remaining[tp] = struct{}{}
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("failed listing end offsets: %w", errors.Join(errs...))
+	}
+	if len(e.remaining) == 0 {
+		close(e.done)
+	}
+	return nil
+}
+
+// filter returns the records before the partition end offset. It's a no-op
+// on a nil receiver, when no EndPosition is configured.
+func (e *endOffsets) filter(topic string, partition int32, records []*kgo.Record) []*kgo.Record {
+	if e == nil {
+		return records
+	}
+	e.mu.Lock()
+	end, ok := e.ends[topicPartition{topic: topic, partition: partition}]
+	e.mu.Unlock()
+	if !ok {
+		return records
+	}
+	for i, r := range records {
+		if r.Offset >= end {
+			return records[:i]
+		}
+	}
+	return records
+}
+
+// reached marks the partition as having consumed up to next, the offset of
+// the next record. It's a no-op on a nil receiver.
+func (e *endOffsets) reached(topic string, partition int32, next int64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	tp := topicPartition{topic: topic, partition: partition}
+	if _, ok := e.remaining[tp]; !ok || next < e.ends[tp] {
+		return
+	}
+	delete(e.remaining, tp)
+	if len(e.remaining) == 0 {
+		close(e.done)
+	}
+}
@@ -0,0 +1,93 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestConsumerEndPosition(t *testing.T) {
+	topic := apmqueue.Topic("topic")
+	_, addrs := newClusterWithTopics(t, topic)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(addrs...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	codec := json.JSON{}
+	b, err := codec.Encode(model.APMEvent{Transaction: &model.Transaction{ID: "1"}})
+	require.NoError(t, err)
+	// Partition 0 has 10 records, partition 1 is empty.
+	for i := 0; i < 10; i++ {
+		produceRecord(context.Background(), t, client,
+			&kgo.Record{Topic: string(topic), Partition: 0, Value: b},
+		)
+	}
+
+	testCases := map[string]struct {
+		end       EndPosition
+		processed int64
+	}{
+		"offsets": {
+			end:       EndPosition{Offsets: Checkpoint{topic: {0: 7}}},
+			processed: 7,
+		},
+		"high watermark": {
+			end:       EndPosition{Offsets: Checkpoint{topic: {0: 100}}},
+			processed: 10,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var processed atomic.Int64
+			end := tc.end
+			consumer := newConsumer(t, ConsumerConfig{
+				Brokers:     addrs,
+				Topics:      []apmqueue.Topic{topic},
+				GroupID:     name,
+				Decoder:     codec,
+				Logger:      zap.NewNop(),
+				Delivery:    apmqueue.AtLeastOnceDeliveryType,
+				EndPosition: &end,
+				Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					processed.Add(int64(len(*b)))
+					return nil
+				}),
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			// Run returns once all the partitions reach their end position.
+			assert.NoError(t, consumer.Run(ctx))
+			assert.Equal(t, tc.processed, processed.Load())
+		})
+	}
+}
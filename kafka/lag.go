@@ -0,0 +1,135 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// groupLag periodically polls the consumer group lag using the admin API and
+// reports it as the consumer.group.lag metric.
+type groupLag struct {
+	admin    *kadm.Client
+	group    string
+	topics   []string
+	interval time.Duration
+	logger   *zap.Logger
+
+	gauge        metric.Int64ObservableGauge
+	registration metric.Registration
+
+	mu  sync.RWMutex
+	lag kadm.GroupLag
+}
+
+func newGroupLag(client *kgo.Client, mp metric.MeterProvider, cfg ConsumerConfig, topics []string) (*groupLag, error) {
+	l := groupLag{
+		admin:    kadm.NewClient(client),
+		group:    cfg.GroupID,
+		topics:   topics,
+		interval: cfg.LagPollInterval,
+		logger:   cfg.Logger.Named("lag"),
+	}
+	meter := mp.Meter("kafka")
+	var err error
+	if l.gauge, err = meter.Int64ObservableGauge("consumer.group.lag",
+		metric.WithDescription("Difference between the high watermark and the committed offset of the consumer group"),
+	); err != nil {
+		return nil, err
+	}
+	if l.registration, err = meter.RegisterCallback(l.observe, l.gauge); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// run polls the consumer group lag every interval until ctx is done.
+func (l *groupLag) run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.update(ctx); err != nil && ctx.Err() == nil {
+				l.logger.Warn("failed to poll consumer group lag", zap.Error(err))
+			}
+		}
+	}
+}
+
+// update fetches the consumer group committed offsets and the partitions' end
+// offsets, storing the calculated lag.
+func (l *groupLag) update(ctx context.Context) error {
+	described, err := l.admin.DescribeGroups(ctx, l.group)
+	if err != nil {
+		return fmt.Errorf("failed to describe group: %w", err)
+	}
+	group, ok := described[l.group]
+	if !ok {
+		return fmt.Errorf("group %q not found", l.group)
+	}
+	if group.Err != nil {
+		return fmt.Errorf("failed to describe group: %w", group.Err)
+	}
+	commits, err := l.admin.FetchOffsets(ctx, l.group)
+	if err != nil {
+		return fmt.Errorf("failed to fetch committed offsets: %w", err)
+	}
+	endOffsets, err := l.admin.ListEndOffsets(ctx, l.topics...)
+	if err != nil {
+		return fmt.Errorf("failed to list end offsets: %w", err)
+	}
+	lag := kadm.CalculateGroupLag(group, commits, endOffsets)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lag = lag
+	return nil
+}
+
+// observe reports the last polled lag of each topic and partition.
+func (l *groupLag) observe(_ context.Context, o metric.Observer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for topic, partitions := range l.lag {
+		for partition, lag := range partitions {
+			if lag.Err != nil {
+				continue
+			}
+			o.ObserveInt64(l.gauge, lag.Lag, metric.WithAttributes(
+				attribute.String("topic", topic),
+				attribute.Int("partition", int(partition)),
+			))
+		}
+	}
+	return nil
+}
+
+func (l *groupLag) close() error {
+	return l.registration.Unregister()
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -67,6 +68,10 @@ func Lz4Compression() CompressionCodec { return kgo.Lz4Compression() }
 // ZstdCompression enables zstd compression with the default compression level.
 func ZstdCompression() CompressionCodec { return kgo.ZstdCompression() }
 
+// IdempotencyKeyHeader is the record header which holds the idempotency key
+// of the produced event. See ProducerConfig.IdempotencyKeyFn.
+const IdempotencyKeyHeader = "idempotency-key"
+
 // ProducerConfig holds configuration for publishing events to Kafka.
 type ProducerConfig struct {
 	// Brokers holds a slice of (host:port) addresses of the Kafka brokers
@@ -114,6 +119,30 @@ type ProducerConfig struct {
 	// TracerProvider allows specifying a custom otel tracer provider.
 	// Defaults to the global one.
 	TracerProvider trace.TracerProvider
+	// MetadataCodec encodes the structured metadata stored in the context
+	// with queuecontext.WithStructuredMetadata into record headers. Defaults
+	// to queuecontext.IdentityCodec.
+	MetadataCodec queuecontext.MetadataCodec
+	// RedactAttributes holds the record headers whose values are replaced
+	// with a placeholder in the logs, i.e. headers which may contain
+	// personal data.
+	RedactAttributes []string
+	// TimestampFn, when set, returns the timestamp of the record produced for
+	// each event, i.e. the original event time when backfilling historical
+	// events. When nil or when it returns the zero time, records are
+	// timestamped with the current time.
+	TimestampFn func(*model.APMEvent) time.Time
+	// IdempotencyKeyFn, when set, returns the idempotency key of each event,
+	// which is set in the IdempotencyKeyHeader of its record, unless empty.
+	// The producer is idempotent, so its retried produce requests don't
+	// result in duplicate records, but events produced more than once by
+	// the application, i.e. when a failed batch is retried, aren't
+	// deduplicated: the key allows consumers to deduplicate their records.
+	IdempotencyKeyFn func(*model.APMEvent) string
+	// TransactionalID, when set, enables ProduceAtomically, which produces
+	// records in transactions using a dedicated client with this
+	// transactional ID. It must be unique to each producer instance.
+	TransactionalID string
 }
 
 // Validate checks that cfg is valid, and returns an error otherwise.
@@ -142,6 +171,12 @@ type Producer struct {
 	cfg    ProducerConfig
 	client *kgo.Client
 	tracer trace.Tracer
+	// redact is nil unless RedactAttributes are configured.
+	redact redactor
+	// txn is nil unless a TransactionalID is configured. txnMu serializes
+	// the transactions, since a client runs one at a time.
+	txn   transactionalClient
+	txnMu sync.Mutex
 
 	mu sync.RWMutex
 }
@@ -149,7 +184,7 @@ type Producer struct {
 // NewProducer returns a new Producer with the given config.
 func NewProducer(cfg ProducerConfig) (*Producer, error) {
 	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("kafka: invalid producer config: %w", err)
+		return nil, fmt.Errorf("kafka: %w: %w", apmqueue.ErrInvalidConfig, err)
 	}
 
 	opts := []kgo.Opt{
@@ -193,17 +228,32 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 
 	client, err := kgo.NewClient(opts...)
 	if err != nil {
-		return nil, fmt.Errorf("kafka: failed creating producer: %w", err)
+		return nil, fmt.Errorf("kafka: %w: failed creating producer: %w",
+			apmqueue.ErrInvalidConfig, err,
+		)
 	}
 	// Issue a metadata refresh request on construction, so the broker list is
 	// populated.
 	client.ForceMetadataRefresh()
 
-	return &Producer{
+	p := &Producer{
 		cfg:    cfg,
 		client: client,
 		tracer: tracerProvider.Tracer("kafka"),
-	}, nil
+		redact: newRedactor(cfg.RedactAttributes),
+	}
+	if cfg.TransactionalID != "" {
+		txnOpts := append(opts[:len(opts):len(opts)], kgo.TransactionalID(cfg.TransactionalID))
+		txn, err := kgo.NewClient(txnOpts...)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("kafka: %w: failed creating transactional producer: %w",
+				apmqueue.ErrInvalidConfig, err,
+			)
+		}
+		p.txn = txn
+	}
+	return p, nil
 }
 
 // Close stops the producer
@@ -216,6 +266,9 @@ func (p *Producer) Close() error {
 	defer p.mu.Unlock()
 	p.client.Flush(context.Background())
 	p.client.Close()
+	if p.txn != nil {
+		p.txn.Close()
+	}
 	return nil
 }
 
@@ -235,8 +288,14 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
+	m, ok, err := queuecontext.EncodeFromContext(ctx, p.cfg.MetadataCodec)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
 	var headers []kgo.RecordHeader
-	if m, ok := queuecontext.MetadataFromContext(ctx); ok {
+	if ok {
 		for k, v := range m {
 			headers = append(headers, kgo.RecordHeader{
 				Key:   k,
@@ -252,6 +311,19 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 			Headers: headers,
 			Topic:   string(p.cfg.TopicRouter(event)),
 		}
+		if p.cfg.TimestampFn != nil {
+			record.Timestamp = p.cfg.TimestampFn(&event)
+		}
+		if p.cfg.IdempotencyKeyFn != nil {
+			if key := p.cfg.IdempotencyKeyFn(&event); key != "" {
+				// Copy the shared headers, since they're reused by all
+				// the records of the batch.
+				record.Headers = append(headers[:len(headers):len(headers)], kgo.RecordHeader{
+					Key:   IdempotencyKeyHeader,
+					Value: []byte(key),
+				})
+			}
+		}
 		encoded, err := p.cfg.Encoder.Encode(event)
 		if err != nil {
 			err = fmt.Errorf("failed to encode event: %w", err)
@@ -275,7 +347,7 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 					zap.String("topic", msg.Topic),
 					zap.Int64("offset", msg.Offset),
 					zap.Int32("partition", msg.Partition),
-					zap.Any("headers", headers),
+					zap.Any("headers", p.redact.headers(headers)),
 				)
 			}
 		})
@@ -291,7 +363,7 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 // broker.
 func (p *Producer) Healthy(ctx context.Context) error {
 	if err := p.client.Ping(ctx); err != nil {
-		return fmt.Errorf("health probe: %w", err)
+		return fmt.Errorf("kafka: %w: health probe: %w", apmqueue.ErrBackendUnavailable, err)
 	}
 	return nil
 }
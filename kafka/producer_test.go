@@ -42,7 +42,7 @@ import (
 
 func TestNewProducer(t *testing.T) {
 	_, err := NewProducer(ProducerConfig{})
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
 }
 
 func TestNewProducerBasic(t *testing.T) {
@@ -155,6 +155,92 @@ func TestNewProducerBasic(t *testing.T) {
 	test(t, false)
 }
 
+func TestProducerTimestampFn(t *testing.T) {
+	topic := apmqueue.Topic("default-topic")
+	client, brokers := newClusterWithTopics(t, topic)
+	backfilled := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return topic
+		},
+		TimestampFn: func(event *model.APMEvent) time.Time {
+			if event.Transaction.ID == "backfilled" {
+				return backfilled
+			}
+			return time.Time{}
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	before := time.Now()
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "backfilled"}},
+		{Transaction: &model.Transaction{ID: "current"}},
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client.AddConsumeTopics(string(topic))
+	timestamps := make(map[string]time.Time)
+	for len(timestamps) < len(batch) {
+		fetches := client.PollRecords(ctx, 1)
+		require.NoError(t, fetches.Err())
+		for _, record := range fetches.Records() {
+			var event model.APMEvent
+			require.NoError(t, json.JSON{}.Decode(record.Value, &event))
+			timestamps[event.Transaction.ID] = record.Timestamp
+		}
+	}
+	assert.True(t, backfilled.Equal(timestamps["backfilled"]), timestamps["backfilled"])
+	assert.False(t, timestamps["current"].Before(before.Truncate(time.Millisecond)))
+}
+
+func TestProducerIdempotencyKeyFn(t *testing.T) {
+	topic := apmqueue.Topic("default-topic")
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return topic
+		},
+		IdempotencyKeyFn: func(event *model.APMEvent) string {
+			return event.Transaction.ID
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx = queuecontext.WithMetadata(ctx, map[string]string{"a": "b"})
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{}},
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client.AddConsumeTopics(string(topic))
+	var headers [][]kgo.RecordHeader
+	for len(headers) < len(batch) {
+		fetches := client.PollRecords(ctx, 1)
+		require.NoError(t, fetches.Err())
+		for _, record := range fetches.Records() {
+			headers = append(headers, record.Headers)
+		}
+	}
+	assert.ElementsMatch(t, [][]kgo.RecordHeader{
+		{{Key: "a", Value: []byte("b")}, {Key: IdempotencyKeyHeader, Value: []byte("1")}},
+		{{Key: "a", Value: []byte("b")}},
+	}, headers)
+}
+
 func newClusterWithTopics(t testing.TB, topics ...apmqueue.Topic) (*kgo.Client, []string) {
 	t.Helper()
 	cluster, err := kfake.NewCluster()
@@ -0,0 +1,46 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestRedactor(t *testing.T) {
+	attrs := map[string]string{"user.email": "a@b.c", "tenant": "a"}
+	headers := []kgo.RecordHeader{
+		{Key: "user.email", Value: []byte("a@b.c")},
+		{Key: "tenant", Value: []byte("a")},
+	}
+	var r redactor
+	assert.Equal(t, attrs, r.attributes(attrs))
+	assert.Equal(t, headers, r.headers(headers))
+
+	r = newRedactor([]string{"user.email"})
+	assert.Equal(t, map[string]string{"user.email": "[redacted]", "tenant": "a"}, r.attributes(attrs))
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "user.email", Value: []byte("[redacted]")},
+		{Key: "tenant", Value: []byte("a")},
+	}, r.headers(headers))
+	// The original attributes and headers aren't modified.
+	assert.Equal(t, "a@b.c", attrs["user.email"])
+	assert.Equal(t, []byte("a@b.c"), headers[0].Value)
+}
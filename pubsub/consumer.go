@@ -0,0 +1,269 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/option"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/internal/telemetry"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// messagingSystem is the messaging system of the consumer and producer spans.
+const messagingSystem = "gcp_pubsub"
+
+// Decoder decodes a []byte into a model.APMEvent
+type Decoder interface {
+	// Decode decodes an encoded model.APM Event into its struct form.
+	Decode([]byte, *model.APMEvent) error
+}
+
+// ConsumerConfig defines the configuration for the Pub/Sub consumer.
+type ConsumerConfig struct {
+	// Project is the GCP project of the subscriptions.
+	Project string
+	// Topics holds the Pub/Sub topics from which messages will be consumed,
+	// through the subscription with the same name as each topic.
+	Topics []apmqueue.Topic
+	// Decoder holds an encoding.Decoder for decoding events.
+	Decoder Decoder
+	// Logger to use for any errors.
+	Logger *zap.Logger
+	// Processor that will be used to process each event individually.
+	// Processor may be called from multiple goroutines and needs to be
+	// safe for concurrent use.
+	Processor model.BatchProcessor
+	// Delivery mechanism to use to acknowledge the messages.
+	// AtMostOnceDeliveryType and AtLeastOnceDeliveryType are supported.
+	// With AtLeastOnceDeliveryType, messages which fail to be processed are
+	// nacked, so Pub/Sub redelivers them according to the subscription's
+	// retry and dead letter policies.
+	Delivery apmqueue.DeliveryType
+	// MaxOutstandingMessages is the maximum number of messages of each
+	// subscription being processed at a time. If MaxOutstandingMessages
+	// <= 0, the Pub/Sub client default is used.
+	MaxOutstandingMessages int
+	ClientOpts             []option.ClientOption
+
+	// TracerProvider allows specifying a custom otel tracer provider.
+	// Defaults to the global one.
+	TracerProvider trace.TracerProvider
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg ConsumerConfig) Validate() error {
+	var errs []error
+	if len(cfg.Topics) == 0 {
+		errs = append(errs, errors.New("pubsub: at least one topic must be set"))
+	}
+	if cfg.Project == "" {
+		errs = append(errs, errors.New("pubsub: project must be set"))
+	}
+	if cfg.Decoder == nil {
+		errs = append(errs, errors.New("pubsub: decoder must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("pubsub: logger must be set"))
+	}
+	if cfg.Processor == nil {
+		errs = append(errs, errors.New("pubsub: processor must be set"))
+	}
+	switch cfg.Delivery {
+	case apmqueue.AtLeastOnceDeliveryType:
+	case apmqueue.AtMostOnceDeliveryType:
+	default:
+		errs = append(errs, errors.New("pubsub: delivery is not valid"))
+	}
+	return errors.Join(errs...)
+}
+
+// Consumer receives Pub/Sub messages from existing subscription(s). The
+// underlying library processes messages of each subscription concurrently,
+// up to MaxOutstandingMessages.
+type Consumer struct {
+	mu             sync.Mutex
+	cfg            ConsumerConfig
+	client         *pubsub.Client
+	consumers      []*consumer
+	stopSubscriber context.CancelFunc
+	tracer         trace.Tracer
+}
+
+// NewConsumer creates a new consumer instance for the subscriptions of the
+// configured topics.
+func NewConsumer(ctx context.Context, cfg ConsumerConfig) (*Consumer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("pubsub: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	client, err := pubsub.NewClient(ctx, cfg.Project, cfg.ClientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %w: failed creating consumer: %w",
+			apmqueue.ErrInvalidConfig, err,
+		)
+	}
+	cfg.Logger = cfg.Logger.Named("pubsub")
+	consumers := make([]*consumer, 0, len(cfg.Topics))
+	for _, topic := range cfg.Topics {
+		sub := client.Subscription(string(topic))
+		if cfg.MaxOutstandingMessages > 0 {
+			sub.ReceiveSettings.MaxOutstandingMessages = cfg.MaxOutstandingMessages
+		}
+		consumers = append(consumers, &consumer{
+			Subscription: sub,
+			delivery:     cfg.Delivery,
+			processor:    cfg.Processor,
+			decoder:      cfg.Decoder,
+			logger: cfg.Logger.With(
+				zap.String("subscription", string(topic)),
+				zap.String("project", cfg.Project),
+			),
+			telemetryAttributes: []attribute.KeyValue{
+				semconv.MessagingSourceNameKey.String(string(topic)),
+				semconv.CloudAccountID(cfg.Project),
+			},
+		})
+	}
+
+	tracerProvider := cfg.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+
+	return &Consumer{
+		cfg:       cfg,
+		client:    client,
+		consumers: consumers,
+		tracer:    tracerProvider.Tracer("pubsub"),
+	}, nil
+}
+
+// Close closes the consumer. Once the consumer is closed, it can't be re-used.
+func (c *Consumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopSubscriber != nil {
+		c.stopSubscriber()
+	}
+	return c.client.Close()
+}
+
+// Run executes the consumer in a blocking manner. It should only be called once,
+// any subsequent calls will return an error wrapping apmqueue.ErrAlreadyStarted.
+func (c *Consumer) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if c.stopSubscriber != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("pubsub: %w", apmqueue.ErrAlreadyStarted)
+	}
+	ctx, c.stopSubscriber = context.WithCancel(ctx)
+	c.mu.Unlock()
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, consumer := range c.consumers {
+		consumer := consumer
+		g.Go(func() error {
+			// Receive retries retryable errors itself, and returns nil once
+			// ctx is done.
+			return consumer.Receive(ctx, telemetry.Consumer(
+				c.tracer,
+				messagingSystem,
+				consumer.processMessage,
+				consumer.telemetryAttributes,
+			))
+		})
+	}
+	return g.Wait()
+}
+
+// Healthy returns an error if any of the subscriptions can't be reached.
+func (c *Consumer) Healthy(ctx context.Context) error {
+	for _, consumer := range c.consumers {
+		exists, err := consumer.Exists(ctx)
+		if err != nil {
+			return fmt.Errorf("pubsub: %w: %w", apmqueue.ErrBackendUnavailable, err)
+		}
+		if !exists {
+			return fmt.Errorf("pubsub: %w: subscription %s not found",
+				apmqueue.ErrBackendUnavailable, consumer.ID(),
+			)
+		}
+	}
+	return nil
+}
+
+// consumer wraps a Pub/Sub Subscription.
+type consumer struct {
+	*pubsub.Subscription
+	logger              *zap.Logger
+	delivery            apmqueue.DeliveryType
+	processor           model.BatchProcessor
+	decoder             Decoder
+	telemetryAttributes []attribute.KeyValue
+}
+
+func (c *consumer) processMessage(ctx context.Context, msg *pubsub.Message) {
+	var event model.APMEvent
+	if err := c.decoder.Decode(msg.Data, &event); err != nil {
+		// Decoding errors aren't transient, acknowledge the message so it
+		// isn't redelivered indefinitely.
+		defer msg.Ack()
+		c.logger.Error("unable to decode message.Data into model.APMEvent",
+			zap.Error(err),
+			zap.ByteString("message.value", msg.Data),
+			zap.String("id", msg.ID),
+			zap.Any("headers", msg.Attributes),
+		)
+		return
+	}
+	batch := model.Batch{event}
+	ctx = queuecontext.WithMetadata(ctx, msg.Attributes)
+	if c.delivery == apmqueue.AtMostOnceDeliveryType {
+		msg.Ack()
+	}
+	err := c.processor.ProcessBatch(ctx, &batch)
+	if err != nil {
+		c.logger.Error("unable to process event",
+			zap.Error(err),
+			zap.String("id", msg.ID),
+			zap.Any("delivery_attempt", msg.DeliveryAttempt),
+			zap.Any("headers", msg.Attributes),
+		)
+	}
+	if c.delivery != apmqueue.AtLeastOnceDeliveryType {
+		return
+	}
+	if err != nil {
+		msg.Nack()
+		return
+	}
+	msg.Ack()
+}
@@ -0,0 +1,162 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestNewConsumer(t *testing.T) {
+	_, err := NewConsumer(context.Background(), ConsumerConfig{})
+	assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+}
+
+func TestConsumer(t *testing.T) {
+	for name, tc := range map[string]struct {
+		delivery apmqueue.DeliveryType
+		// attempts of the message which fails to be processed once.
+		attempts int
+	}{
+		// The failed message was acknowledged before being processed, so
+		// it isn't redelivered.
+		"at_most_once":  {delivery: apmqueue.AtMostOnceDeliveryType, attempts: 1},
+		"at_least_once": {delivery: apmqueue.AtLeastOnceDeliveryType, attempts: 2},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			srv, opts := newFakeServer(t, "topic")
+			srv.Publish("projects/project/topics/topic", []byte(`{"transaction":{"id":"ok"}}`), map[string]string{"key": "value"})
+			srv.Publish("projects/project/topics/topic", []byte(`{"transaction":{"id":"fail"}}`), nil)
+
+			var mu sync.Mutex
+			attempts := make(map[string]int)
+			processed := make(chan map[string]string, 3)
+			c, err := NewConsumer(context.Background(), ConsumerConfig{
+				Project:    "project",
+				Topics:     []apmqueue.Topic{"topic"},
+				Decoder:    json.JSON{},
+				Logger:     zap.NewNop(),
+				Delivery:   tc.delivery,
+				ClientOpts: opts,
+				Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+					id := (*b)[0].Transaction.ID
+					mu.Lock()
+					attempts[id]++
+					attempt := attempts[id]
+					mu.Unlock()
+					meta, _ := queuecontext.MetadataFromContext(ctx)
+					processed <- meta
+					if id == "fail" && attempt == 1 {
+						return errors.New("boom")
+					}
+					return nil
+				}),
+			})
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go c.Run(ctx)
+			defer c.Close()
+
+			metas := make([]map[string]string, 0, 1+tc.attempts)
+			for len(metas) < cap(metas) {
+				select {
+				case meta := <-processed:
+					metas = append(metas, meta)
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for messages")
+				}
+			}
+			assert.Contains(t, metas, map[string]string{"key": "value"})
+			assert.Eventually(t, func() bool {
+				for _, msg := range srv.Messages() {
+					if msg.Acks == 0 {
+						return false
+					}
+				}
+				return true
+			}, 5*time.Second, 10*time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, map[string]int{"ok": 1, "fail": tc.attempts}, attempts)
+		})
+	}
+}
+
+func TestConsumerHealthy(t *testing.T) {
+	_, opts := newFakeServer(t, "topic")
+	newConsumer := func(topic apmqueue.Topic) *Consumer {
+		c, err := NewConsumer(context.Background(), ConsumerConfig{
+			Project:    "project",
+			Topics:     []apmqueue.Topic{topic},
+			Decoder:    json.JSON{},
+			Logger:     zap.NewNop(),
+			ClientOpts: opts,
+			Processor:  model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	assert.NoError(t, newConsumer("topic").Healthy(context.Background()))
+	err := newConsumer("missing").Healthy(context.Background())
+	assert.ErrorIs(t, err, apmqueue.ErrBackendUnavailable)
+	assert.EqualError(t, err, "pubsub: backend unavailable: subscription missing not found")
+}
+
+// newFakeServer starts a fake Pub/Sub server with the topics, and a
+// subscription named after each of them. It returns the client options to
+// connect to the server.
+func newFakeServer(t testing.TB, topics ...string) (*pstest.Server, []option.ClientOption) {
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	opts := []option.ClientOption{option.WithGRPCConn(conn)}
+
+	client, err := pubsub.NewClient(context.Background(), "project", opts...)
+	require.NoError(t, err)
+	for _, name := range topics {
+		topic, err := client.CreateTopic(context.Background(), name)
+		require.NoError(t, err)
+		_, err = client.CreateSubscription(context.Background(), name, pubsub.SubscriptionConfig{
+			Topic: topic,
+		})
+		require.NoError(t, err)
+	}
+	return srv, opts
+}
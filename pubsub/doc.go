@@ -0,0 +1,25 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package pubsub abstracts the production and consumption of model.Batch
+// to and from GCP Pub/Sub. Unlike Pub/Sub Lite, Pub/Sub doesn't require
+// provisioning throughput capacity upfront, which makes it a better fit for
+// spiky workloads.
+//
+// Messages are consumed from the subscription named after each topic.
+// Redelivery limits and dead lettering are configured on the subscription.
+package pubsub
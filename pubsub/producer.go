@@ -0,0 +1,257 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/option"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/internal/telemetry"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// Encoder encodes a model.APMEvent to a []byte
+type Encoder interface {
+	// Encode accepts a model.APMEvent and returns the encoded representation.
+	Encode(model.APMEvent) ([]byte, error)
+}
+
+// ProducerConfig for the Pub/Sub producer.
+type ProducerConfig struct {
+	// Project is the GCP project for the producer.
+	Project string
+	// Encoder holds an encoding.Encoder for encoding events.
+	Encoder Encoder
+	// Logger for the producer.
+	Logger *zap.Logger
+	// TopicRouter returns the topic where an event should be produced.
+	TopicRouter apmqueue.TopicRouter
+	// Sync can be used to indicate whether production should be synchronous.
+	// Messages are published in batches, so producing synchronously waits
+	// for the batch of the messages to be flushed.
+	Sync       bool
+	ClientOpts []option.ClientOption
+
+	// TracerProvider allows specifying a custom otel tracer provider.
+	// Defaults to the global one.
+	TracerProvider trace.TracerProvider
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg ProducerConfig) Validate() error {
+	var errs []error
+	if cfg.Project == "" {
+		errs = append(errs, errors.New("pubsub: project must be set"))
+	}
+	if cfg.Encoder == nil {
+		errs = append(errs, errors.New("pubsub: encoder must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("pubsub: logger must be set"))
+	}
+	if cfg.TopicRouter == nil {
+		errs = append(errs, errors.New("pubsub: topic router must be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// resTopic enriches a pubsub.PublishResult with its topic.
+type resTopic struct {
+	response *pubsub.PublishResult
+	topic    apmqueue.Topic
+}
+
+// Producer implementes the model.BatchProcessor interface and sends each of
+// the events in a batch to a Pub/Sub topic, which is determined by calling
+// the configured TopicRouter.
+type Producer struct {
+	mu        sync.RWMutex
+	cfg       ProducerConfig
+	client    *pubsub.Client
+	topics    sync.Map // map[apmqueue.Topic]*pubsub.Topic
+	errg      errgroup.Group
+	responses chan []resTopic
+	closed    chan struct{}
+	tracer    trace.Tracer
+}
+
+// NewProducer creates a new Pub/Sub producer for a single project.
+func NewProducer(cfg ProducerConfig) (*Producer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("pubsub: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	client, err := pubsub.NewClient(context.Background(), cfg.Project, cfg.ClientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %w: failed creating producer: %w",
+			apmqueue.ErrInvalidConfig, err,
+		)
+	}
+
+	tracerProvider := cfg.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+
+	p := &Producer{
+		cfg:    cfg,
+		client: client,
+		closed: make(chan struct{}),
+		// The channel size must be greater than 0, so async produces don't
+		// block, see the pubsublite producer.
+		responses: make(chan []resTopic, 1000),
+		tracer:    tracerProvider.Tracer("pubsub"),
+	}
+
+	if !cfg.Sync {
+		// If producing is async, start a goroutine that blocks until the
+		// all messages have been produced. This happens in the ProcessBatch
+		// function when producing is set to sync.
+		p.errg.Go(func() error {
+			ctx := context.Background()
+			for responses := range p.responses {
+				blockUntilProduced(ctx, responses, cfg.Logger)
+			}
+			return nil
+		})
+	}
+	return p, nil
+}
+
+// Close stops the producer.
+//
+// This call is blocking and flushes the messages buffered by all the topics.
+// If producing is asynchronous, it'll block until all messages have been
+// produced. After Close() is called, Producer cannot be reused.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.topics.Range(func(key, value any) bool {
+		value.(*pubsub.Topic).Stop()
+		return true
+	})
+	close(p.closed)
+	close(p.responses)
+	return errors.Join(p.errg.Wait(), p.client.Close())
+}
+
+// ProcessBatch publishes the batch to the Pub/Sub topic inferred from the
+// configured TopicRouter. If the Producer is synchronous, it waits until all
+// messages have been produced to Pub/Sub, otherwise, returns as soon as the
+// messages have been stored in the producer's buffer.
+func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	select {
+	case <-p.closed:
+		return errors.New("pubsub: producer closed")
+	default:
+	}
+	meta, hasMeta := queuecontext.MetadataFromContext(ctx)
+	responses := make([]resTopic, 0, len(*batch))
+	for _, event := range *batch {
+		encoded, err := p.cfg.Encoder.Encode(event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+		msg := pubsub.Message{Data: encoded}
+		if hasMeta {
+			msg.Attributes = make(map[string]string, len(meta))
+			for k, v := range meta {
+				msg.Attributes[k] = v
+			}
+		}
+		topic := p.cfg.TopicRouter(event)
+		responses = append(responses, resTopic{
+			response: telemetry.Publisher(ctx, p.tracer, messagingSystem, &msg, p.topic(topic).Publish, []attribute.KeyValue{
+				semconv.MessagingDestinationNameKey.String(string(topic)),
+				semconv.CloudAccountID(p.cfg.Project),
+			}),
+			topic: topic,
+		})
+	}
+	if p.cfg.Sync {
+		blockUntilProduced(ctx, responses, p.cfg.Logger)
+		return nil
+	}
+	select {
+	case p.responses <- responses:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// topic returns the publisher of the topic, creating it on first use.
+func (p *Producer) topic(topic apmqueue.Topic) *pubsub.Topic {
+	if v, ok := p.topics.Load(topic); ok {
+		return v.(*pubsub.Topic)
+	}
+	t := p.client.Topic(string(topic))
+	if existing, ok := p.topics.LoadOrStore(topic, t); ok {
+		// Another goroutine created the topic concurrently, the one created
+		// here hasn't published anything, so it needn't be stopped.
+		t = existing.(*pubsub.Topic)
+	}
+	return t
+}
+
+func blockUntilProduced(ctx context.Context, res []resTopic, logger *zap.Logger) {
+	for _, res := range res {
+		if serverID, err := res.response.Get(ctx); err != nil {
+			logger.Error("failed producing message",
+				zap.Error(err),
+				zap.String("server_id", serverID),
+				zap.String("topic", string(res.topic)),
+			)
+		}
+	}
+}
+
+// Healthy returns an error if any of the topics which have been published
+// to can't be reached.
+func (p *Producer) Healthy(ctx context.Context) error {
+	var err error
+	p.topics.Range(func(key, value any) bool {
+		var exists bool
+		if exists, err = value.(*pubsub.Topic).Exists(ctx); err != nil {
+			err = fmt.Errorf("pubsub: %w: %w", apmqueue.ErrBackendUnavailable, err)
+			return false
+		}
+		if !exists {
+			err = fmt.Errorf("pubsub: %w: topic %s not found",
+				apmqueue.ErrBackendUnavailable, key,
+			)
+			return false
+		}
+		return true
+	})
+	return err
+}
@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsub
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestNewProducer(t *testing.T) {
+	_, err := NewProducer(ProducerConfig{})
+	assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+}
+
+func TestProducerProcessBatch(t *testing.T) {
+	for _, sync := range []bool{true, false} {
+		srv, opts := newFakeServer(t, "transaction", "span")
+		p, err := NewProducer(ProducerConfig{
+			Project:     "project",
+			Encoder:     json.JSON{},
+			Logger:      zap.NewNop(),
+			TopicRouter: apmqueue.NewEventTypeTopicRouter(""),
+			Sync:        sync,
+			ClientOpts:  opts,
+		})
+		require.NoError(t, err)
+
+		ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"key": "value"})
+		batch := model.Batch{
+			{Processor: model.TransactionProcessor, Transaction: &model.Transaction{ID: "1"}},
+			{Processor: model.SpanProcessor, Span: &model.Span{ID: "2"}},
+		}
+		require.NoError(t, p.ProcessBatch(ctx, &batch))
+		if sync {
+			assert.Len(t, srv.Messages(), 2)
+		}
+		require.NoError(t, p.Close())
+
+		msgs := srv.Messages()
+		require.Len(t, msgs, 2, "sync=%t", sync)
+		for _, msg := range msgs {
+			var event model.APMEvent
+			require.NoError(t, stdjson.Unmarshal(msg.Data, &event))
+			assert.Equal(t, "value", msg.Attributes["key"])
+		}
+		assert.ErrorContains(t, p.ProcessBatch(ctx, &batch), "producer closed")
+	}
+}
+
+func TestProducerHealthy(t *testing.T) {
+	_, opts := newFakeServer(t, "transaction")
+	p, err := NewProducer(ProducerConfig{
+		Project:     "project",
+		Encoder:     json.JSON{},
+		Logger:      zap.NewNop(),
+		TopicRouter: func(model.APMEvent) apmqueue.Topic { return "transaction" },
+		Sync:        true,
+		ClientOpts:  opts,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// No topics have been published to yet.
+	assert.NoError(t, p.Healthy(ctx))
+	require.NoError(t, p.ProcessBatch(ctx, &model.Batch{{Transaction: &model.Transaction{ID: "1"}}}))
+	assert.NoError(t, p.Healthy(ctx))
+
+	// Deleted topics make the producer unhealthy.
+	client, err := pubsub.NewClient(ctx, "project", opts...)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Topic("transaction").Delete(ctx))
+	err = p.Healthy(ctx)
+	assert.ErrorIs(t, err, apmqueue.ErrBackendUnavailable)
+	assert.EqualError(t, err, "pubsub: backend unavailable: topic transaction not found")
+}
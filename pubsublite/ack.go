@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// defaultAckBatchInterval is the default ConsumerConfig.AckBatchInterval.
+const defaultAckBatchInterval = time.Second
+
+// pendingAck is a processed message which hasn't been acknowledged yet.
+type pendingAck struct {
+	msg      *pubsub.Message
+	offset   int64
+	received time.Time
+}
+
+// ackBatcher accumulates the acknowledgements of processed messages per
+// partition, so they can be acknowledged in batches.
+type ackBatcher struct {
+	mu      sync.Mutex
+	size    int
+	pending map[int][]pendingAck
+}
+
+func newAckBatcher(size int) *ackBatcher {
+	return &ackBatcher{size: size, pending: make(map[int][]pendingAck)}
+}
+
+// add adds the message to its partition batch. The batch is returned when it
+// is full and must be acknowledged by the caller.
+func (b *ackBatcher) add(msg *pubsub.Message, received time.Time) []pendingAck {
+	partition, offset := partitionOffset(msg.ID)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batch := append(b.pending[partition], pendingAck{
+		msg: msg, offset: offset, received: received,
+	})
+	if len(batch) < b.size {
+		b.pending[partition] = batch
+		return nil
+	}
+	delete(b.pending, partition)
+	return sortAcks(batch)
+}
+
+// flush returns all the pending batches, which must be acknowledged by the
+// caller.
+func (b *ackBatcher) flush() [][]pendingAck {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batches := make([][]pendingAck, 0, len(b.pending))
+	for partition, batch := range b.pending {
+		batches = append(batches, sortAcks(batch))
+		delete(b.pending, partition)
+	}
+	return batches
+}
+
+// sortAcks sorts the batch by offset, so messages are acked in order.
+func sortAcks(batch []pendingAck) []pendingAck {
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].offset < batch[j].offset
+	})
+	return batch
+}
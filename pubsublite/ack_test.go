@@ -0,0 +1,48 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckBatcher(t *testing.T) {
+	b := newAckBatcher(3)
+	offsets := func(batch []pendingAck) (res []int64) {
+		for _, p := range batch {
+			res = append(res, p.offset)
+		}
+		return res
+	}
+	now := time.Now()
+	assert.Nil(t, b.add(&pubsub.Message{ID: "0:2"}, now))
+	assert.Nil(t, b.add(&pubsub.Message{ID: "1:1"}, now))
+	assert.Nil(t, b.add(&pubsub.Message{ID: "0:1"}, now))
+	// The partition batch is returned in offset order once it's full.
+	assert.Equal(t, []int64{1, 2, 3}, offsets(b.add(&pubsub.Message{ID: "0:3"}, now)))
+
+	batches := b.flush()
+	require.Len(t, batches, 1)
+	assert.Equal(t, []int64{1}, offsets(batches[0]))
+	assert.Empty(t, b.flush())
+}
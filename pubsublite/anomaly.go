@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+const (
+	// anomalyGap is reported when offsets of a partition are skipped.
+	anomalyGap = "gap"
+	// anomalyNonIncreasing is reported when an offset isn't greater than
+	// the last offset received from its partition.
+	anomalyNonIncreasing = "non_increasing"
+)
+
+// offsetAnomalies tracks the last offset received from each partition to
+// detect gaps and non-increasing offsets.
+type offsetAnomalies struct {
+	mu   sync.Mutex
+	last map[int]int64
+}
+
+func newOffsetAnomalies() *offsetAnomalies {
+	return &offsetAnomalies{last: make(map[int]int64)}
+}
+
+// observe records the offset received from the partition, and returns the
+// anomaly it represents, if any, along with the previous offset.
+func (a *offsetAnomalies) observe(partition int, offset int64) (anomaly string, last int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last, ok := a.last[partition]
+	switch {
+	case !ok:
+		// The first offset received from a partition can't be validated.
+	case offset <= last:
+		// Keep the highest offset, so the redelivered messages which
+		// follow aren't reported as anomalies too.
+		return anomalyNonIncreasing, last
+	case offset > last+1:
+		anomaly = anomalyGap
+	}
+	a.last[partition] = offset
+	return anomaly, last
+}
+
+// reset forgets the received offsets, since messages are expected to be
+// redelivered from the committed offsets when receiving restarts.
+func (a *offsetAnomalies) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last = make(map[int]int64)
+}
+
+// checkOffset reports the message if its offset is anomalous.
+func (c *consumer[T]) checkOffset(ctx context.Context, msg *pubsub.Message) {
+	partition, offset := partitionOffset(msg.ID)
+	anomaly, last := c.anomalies.observe(partition, offset)
+	if anomaly == "" {
+		return
+	}
+	c.messageLogger(ctx, msg).Warn("offset anomaly detected",
+		zap.String("anomaly", anomaly),
+		zap.Int("partition", partition),
+		zap.Int64("offset", offset),
+		zap.Int64("last_offset", last),
+	)
+	c.metrics.offsetAnomaly.Add(ctx, 1, metric.WithAttributes(append(
+		[]attribute.KeyValue{attribute.String("anomaly", anomaly)},
+		c.telemetryAttributes...,
+	)...))
+}
@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestOffsetAnomalies(t *testing.T) {
+	a := newOffsetAnomalies()
+	for _, tc := range []struct {
+		partition int
+		offset    int64
+		anomaly   string
+	}{
+		{partition: 0, offset: 10},
+		{partition: 0, offset: 11},
+		{partition: 1, offset: 3},
+		{partition: 0, offset: 14, anomaly: anomalyGap},
+		{partition: 0, offset: 12, anomaly: anomalyNonIncreasing},
+		{partition: 0, offset: 14, anomaly: anomalyNonIncreasing},
+		// The highest offset is kept after a non-increasing offset.
+		{partition: 0, offset: 15},
+		{partition: 1, offset: 4},
+	} {
+		anomaly, _ := a.observe(tc.partition, tc.offset)
+		assert.Equal(t, tc.anomaly, anomaly, "partition %d offset %d", tc.partition, tc.offset)
+	}
+	// Redelivered messages aren't anomalies once receiving restarts.
+	a.reset()
+	anomaly, _ := a.observe(0, 12)
+	assert.Empty(t, anomaly)
+}
+
+func TestConsumerCheckOffset(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	core, logs := observer.New(zapcore.WarnLevel)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Logger:                zap.New(core),
+			MeterProvider:         sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			DetectOffsetAnomalies: true,
+		},
+	})
+	ctx := context.Background()
+	for _, id := range []string{"0:1", "0:2", "0:5", "0:3", "0:6"} {
+		c.checkOffset(ctx, &pubsub.Message{ID: id})
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	sum, ok := findMetric(t, rm, "consumer.offset.anomaly").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	counts := make(map[string]int64)
+	for _, dp := range sum.DataPoints {
+		v, _ := dp.Attributes.Value("anomaly")
+		counts[v.AsString()] = dp.Value
+	}
+	assert.Equal(t, map[string]int64{anomalyGap: 1, anomalyNonIncreasing: 1}, counts)
+
+	entries := logs.FilterMessage("offset anomaly detected").All()
+	require.Len(t, entries, 2)
+	assert.Equal(t, map[string]any{
+		"subscription": "topic",
+		"region":       "us-central1",
+		"project":      "project",
+		"anomaly":      anomalyGap,
+		"partition":    int64(0),
+		"offset":       int64(5),
+		"last_offset":  int64(2),
+	}, entries[0].ContextMap())
+}
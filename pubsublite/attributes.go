@@ -0,0 +1,93 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// maxObservedValues is the number of distinct values recorded per
+	// observed attribute, protecting the cardinality of the metric.
+	maxObservedValues = 50
+	// otherValue replaces the values of an observed attribute once
+	// maxObservedValues distinct values have been recorded.
+	otherValue = "__other__"
+)
+
+// attributeObserver tracks the distinct values recorded for each of the
+// observed attributes.
+type attributeObserver struct {
+	mu     sync.Mutex
+	keys   []string
+	values map[string]map[string]struct{}
+}
+
+// newAttributeObserver returns nil when no attributes are observed.
+func newAttributeObserver(keys []string) *attributeObserver {
+	if len(keys) == 0 {
+		return nil
+	}
+	values := make(map[string]map[string]struct{}, len(keys))
+	for _, key := range keys {
+		values[key] = make(map[string]struct{})
+	}
+	return &attributeObserver{keys: keys, values: values}
+}
+
+// value returns the value recorded for the attribute, which is the value
+// itself unless maxObservedValues other values have already been recorded.
+func (o *attributeObserver) value(key, value string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seen := o.values[key]
+	if _, ok := seen[value]; ok {
+		return value
+	}
+	if len(seen) >= maxObservedValues {
+		return otherValue
+	}
+	seen[value] = struct{}{}
+	return value
+}
+
+// observeAttributes counts the values of the observed attributes present
+// in the message.
+func (c *consumer[T]) observeAttributes(ctx context.Context, msg *pubsub.Message) {
+	if c.observer == nil {
+		return
+	}
+	for _, key := range c.observer.keys {
+		value, ok := msg.Attributes[key]
+		if !ok {
+			continue
+		}
+		c.metrics.attributeValue.Add(ctx, 1, metric.WithAttributes(append(
+			[]attribute.KeyValue{
+				attribute.String("attribute", key),
+				attribute.String("value", c.observer.value(key, value)),
+			},
+			c.telemetryAttributes...,
+		)...))
+	}
+}
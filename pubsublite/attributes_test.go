@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerObserveAttributes(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:          apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider:     sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			ObserveAttributes: []string{"region", "tenant"},
+		},
+	})
+	ctx := context.Background()
+	for _, attrs := range []map[string]string{
+		{"region": "us-east1", "tenant": "a"},
+		{"region": "us-east1"},
+		{"region": "europe-west1"},
+		nil,
+	} {
+		c.processMessage(ctx, &pubsub.Message{Data: []byte(`{}`), Attributes: attrs})
+	}
+	// Exceed the distinct values cap of the tenant attribute.
+	for i := 0; i < maxObservedValues+2; i++ {
+		c.processMessage(ctx, &pubsub.Message{
+			Data:       []byte(`{}`),
+			Attributes: map[string]string{"tenant": fmt.Sprint("tenant-", i)},
+		})
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	sum, ok := findMetric(t, rm, "consumer.attribute.value").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	counts := make(map[string]int64)
+	for _, dp := range sum.DataPoints {
+		key, _ := dp.Attributes.Value("attribute")
+		value, _ := dp.Attributes.Value("value")
+		counts[key.AsString()+"="+value.AsString()] = dp.Value
+	}
+	assert.Len(t, counts, 2+maxObservedValues+1)
+	assert.Equal(t, int64(2), counts["region=us-east1"])
+	assert.Equal(t, int64(1), counts["region=europe-west1"])
+	assert.Equal(t, int64(1), counts["tenant=a"])
+	assert.Equal(t, int64(1), counts["tenant=tenant-0"])
+	// "a" and the first 49 tenants fill the cap, the last 3 overflow.
+	assert.Equal(t, int64(3), counts["tenant="+otherValue])
+}
@@ -0,0 +1,168 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+)
+
+// defaultAuditBufferSize is the default number of sampled messages buffered
+// until they're published to the audit topic.
+const defaultAuditBufferSize = 1000
+
+// AuditPublisher publishes the sampled messages to the audit topic. It's
+// implemented by *pscompat.PublisherClient.
+type AuditPublisher interface {
+	Publish(ctx context.Context, msg *pubsub.Message) *pubsub.PublishResult
+}
+
+// AuditSampler copies a fraction of all the consumed messages, their raw
+// payload and attributes, to an audit topic, regardless of the outcome of
+// their processing.
+type AuditSampler struct {
+	// Ratio is the fraction of the messages, between 0 and 1, copied to the
+	// audit topic. The sampler is disabled when 0.
+	Ratio float64
+	// Publisher publishes the sampled messages to the audit topic. Its
+	// lifecycle is managed by the caller, which must not stop it before
+	// Run returns.
+	Publisher AuditPublisher
+	// BufferSize is the number of sampled messages buffered until they're
+	// published. Sampled messages are dropped, and counted in the
+	// consumer.audit.dropped metric, while the buffer is full, so
+	// publishing never delays processing. Messages still buffered when the
+	// consumer stops are dropped and counted in the same metric. Defaults
+	// to 1000.
+	BufferSize int
+}
+
+func (s AuditSampler) validate() error {
+	if s.Ratio < 0 || s.Ratio > 1 {
+		return errors.New("pubsublite: audit sampler ratio must be between 0 and 1")
+	}
+	if s.Ratio > 0 && s.Publisher == nil {
+		return errors.New("pubsublite: audit sampler publisher must be set")
+	}
+	return nil
+}
+
+// auditor samples messages into a bounded buffer, which is drained by run
+// in the background.
+type auditor struct {
+	ratio   float64
+	random  func() float64
+	publish func(ctx context.Context, msg *pubsub.Message) publishResult
+	logger  *zap.Logger
+	metrics consumerMetrics
+	buffer  chan *pubsub.Message
+}
+
+// newAuditor returns nil when the sampler is disabled.
+func newAuditor(cfg AuditSampler, logger *zap.Logger, metrics consumerMetrics) *auditor {
+	if cfg.Ratio <= 0 {
+		return nil
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultAuditBufferSize
+	}
+	return &auditor{
+		ratio:  cfg.Ratio,
+		random: rand.Float64,
+		publish: func(ctx context.Context, msg *pubsub.Message) publishResult {
+			return cfg.Publisher.Publish(ctx, msg)
+		},
+		logger:  logger.Named("audit"),
+		metrics: metrics,
+		buffer:  make(chan *pubsub.Message, cfg.BufferSize),
+	}
+}
+
+// sample buffers a copy of the message if it's sampled, without blocking.
+func (a *auditor) sample(ctx context.Context, msg *pubsub.Message) {
+	if a.random() >= a.ratio {
+		return
+	}
+	audit := &pubsub.Message{Data: msg.Data}
+	if len(msg.Attributes) > 0 {
+		audit.Attributes = make(map[string]string, len(msg.Attributes))
+		for k, v := range msg.Attributes {
+			audit.Attributes[k] = v
+		}
+	}
+	select {
+	case a.buffer <- audit:
+		a.metrics.auditBuffered.Add(ctx, 1)
+	default:
+		a.metrics.auditDropped.Add(ctx, 1)
+	}
+}
+
+// run publishes the buffered messages until ctx is done. Messages still
+// buffered when ctx is done aren't published, they're discarded.
+func (a *auditor) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	results := make(chan publishResult, cap(a.buffer))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for res := range results {
+			if _, err := res.Get(context.Background()); err != nil {
+				a.logger.Warn("failed to publish audit message", zap.Error(err))
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(results)
+	for {
+		select {
+		case <-ctx.Done():
+			a.discard()
+			return
+		case msg := <-a.buffer:
+			// The buffer may be drained after ctx is done, whose measurements
+			// would be dropped.
+			a.metrics.auditBuffered.Add(context.Background(), -1)
+			results <- a.publish(ctx, msg)
+		}
+	}
+}
+
+// discard drops the buffered messages, so the buffered messages metric
+// doesn't account for them once the auditor is stopped.
+func (a *auditor) discard() {
+	var discarded int64
+	for {
+		select {
+		case <-a.buffer:
+			discarded++
+		default:
+			if discarded > 0 {
+				ctx := context.Background()
+				a.metrics.auditBuffered.Add(ctx, -discarded)
+				a.metrics.auditDropped.Add(ctx, discarded)
+			}
+			return
+		}
+	}
+}
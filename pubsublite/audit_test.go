@@ -0,0 +1,156 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestAuditSamplerValidate(t *testing.T) {
+	assert.NoError(t, AuditSampler{}.validate())
+	assert.EqualError(t, AuditSampler{Ratio: 2}.validate(),
+		"pubsublite: audit sampler ratio must be between 0 and 1",
+	)
+	assert.EqualError(t, AuditSampler{Ratio: 0.5}.validate(),
+		"pubsublite: audit sampler publisher must be set",
+	)
+}
+
+func TestConsumerAuditSampler(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			AuditSampler: AuditSampler{
+				Ratio: 0.5, BufferSize: 2, Publisher: unusedAuditPublisher{},
+			},
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			return errors.New("processing failed")
+		}),
+	})
+	a := c.auditor
+	samples := []float64{0.1, 0.9, 0.2, 0.3}
+	a.random = func() float64 {
+		r := samples[0]
+		samples = samples[1:]
+		return r
+	}
+	published := make(chan *pubsub.Message, 10)
+	a.publish = func(_ context.Context, msg *pubsub.Message) publishResult {
+		published <- msg
+		return fakeResult{err: errors.New("audit topic unavailable")}
+	}
+	ctx := context.Background()
+	for _, msg := range []*pubsub.Message{
+		{ID: "0:1", Data: []byte(`{"name":"a"}`), Attributes: map[string]string{"k": "v"}},
+		{ID: "0:2", Data: []byte(`{"name":"b"}`)},
+		{ID: "0:3", Data: []byte(`{"name":"c"}`)},
+		{ID: "0:4", Data: []byte(`{"name":"d"}`)},
+	} {
+		c.processMessage(ctx, msg)
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	// The 1st and 3rd messages are buffered, the 4th one is dropped since
+	// the buffer is full.
+	buffered := findMetric(t, rm, "consumer.audit.buffered").Data.(metricdata.Sum[int64])
+	assert.Equal(t, int64(2), buffered.DataPoints[0].Value)
+	dropped := findMetric(t, rm, "consumer.audit.dropped").Data.(metricdata.Sum[int64])
+	assert.Equal(t, int64(1), dropped.DataPoints[0].Value)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.run(runCtx)
+	}()
+	// Messages are sampled regardless of their processing outcome, and
+	// publishing errors don't affect processing.
+	for _, expected := range []*pubsub.Message{
+		{Data: []byte(`{"name":"a"}`), Attributes: map[string]string{"k": "v"}},
+		{Data: []byte(`{"name":"c"}`)},
+	} {
+		select {
+		case msg := <-published:
+			assert.Equal(t, expected, msg)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the audit message to be published")
+		}
+	}
+	cancel()
+	<-done
+
+	require.NoError(t, reader.Collect(ctx, &rm))
+	buffered = findMetric(t, rm, "consumer.audit.buffered").Data.(metricdata.Sum[int64])
+	assert.Equal(t, int64(0), buffered.DataPoints[0].Value)
+}
+
+func TestAuditorDiscardOnStop(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	metrics, err := newConsumerMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), nil)
+	require.NoError(t, err)
+
+	a := newAuditor(AuditSampler{Ratio: 1, BufferSize: 3}, zap.NewNop(), metrics)
+	var published int64
+	a.publish = func(context.Context, *pubsub.Message) publishResult {
+		published++
+		return fakeResult{}
+	}
+	ctx := context.Background()
+	a.sample(ctx, &pubsub.Message{Data: []byte("a")})
+	a.sample(ctx, &pubsub.Message{Data: []byte("b")})
+
+	// The auditor is stopped before publishing all the buffered messages,
+	// run may still publish some of them before noticing.
+	stopped, cancel := context.WithCancel(ctx)
+	cancel()
+	a.run(stopped)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	buffered := findMetric(t, rm, "consumer.audit.buffered").Data.(metricdata.Sum[int64])
+	assert.Equal(t, int64(0), buffered.DataPoints[0].Value)
+	if published < 2 {
+		dropped := findMetric(t, rm, "consumer.audit.dropped").Data.(metricdata.Sum[int64])
+		assert.Equal(t, 2-published, dropped.DataPoints[0].Value)
+	}
+	assert.Len(t, a.buffer, 0)
+}
+
+// unusedAuditPublisher is the publisher of the audit samplers whose publish
+// function is replaced by the tests.
+type unusedAuditPublisher struct{}
+
+func (unusedAuditPublisher) Publish(context.Context, *pubsub.Message) *pubsub.PublishResult {
+	panic("unexpected audit publish")
+}
@@ -0,0 +1,74 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package auth provides helpers to build the client options used to
+// authenticate the Pub/Sub Lite producer and consumer.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+const (
+	// externalAccountType is the credentials type of Workload Identity
+	// Federation credential configuration files.
+	externalAccountType = "external_account"
+	// cloudPlatformScope is the OAuth2 scope required by Pub/Sub Lite.
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// WIFClientOptions returns the client options to authenticate with Workload
+// Identity Federation, using the credential configuration file at configPath.
+// The returned options can be set as the producer or consumer ClientOpts.
+//
+// The credential configuration file is generated with:
+//
+//	gcloud iam workload-identity-pools create-cred-config
+//
+// It is typically used to authenticate workloads running outside of GCP,
+// i.e. in non-GKE Kubernetes clusters, which exchange their identity tokens
+// for short-lived Google credentials. No tokens are requested until the
+// options are used by a client.
+func WIFClientOptions(configPath string) ([]option.ClientOption, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("auth: failed reading credential configuration: %w", err)
+	}
+	var cfg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("auth: failed parsing credential configuration: %w", err)
+	}
+	if cfg.Type != externalAccountType {
+		return nil, fmt.Errorf(
+			"auth: credential configuration type must be %q, got %q",
+			externalAccountType, cfg.Type,
+		)
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), data, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("auth: invalid credential configuration: %w", err)
+	}
+	return []option.ClientOption{option.WithCredentials(creds)}, nil
+}
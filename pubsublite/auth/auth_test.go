@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWIFClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("token"), 0600))
+	writeConfig := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "config.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+	testCases := map[string]struct {
+		path      string
+		expectErr string
+	}{
+		"valid": {
+			path: writeConfig(t, `{
+				"type": "external_account",
+				"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+				"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+				"token_url": "https://sts.googleapis.com/v1/token",
+				"credential_source": {"file": "`+tokenPath+`"}
+			}`),
+		},
+		"missing file": {
+			path:      filepath.Join(dir, "missing.json"),
+			expectErr: "auth: failed reading credential configuration",
+		},
+		"invalid json": {
+			path:      writeConfig(t, `{`),
+			expectErr: "auth: failed parsing credential configuration",
+		},
+		"service account": {
+			path:      writeConfig(t, `{"type": "service_account"}`),
+			expectErr: `auth: credential configuration type must be "external_account", got "service_account"`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts, err := WIFClientOptions(tc.path)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				assert.Nil(t, opts)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, opts, 1)
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"github.com/elastic/apm-data/model"
+)
+
+// BatchDecoder decodes a []byte holding multiple events into a model.Batch.
+type BatchDecoder interface {
+	// DecodeBatch decodes the encoded events into their struct form.
+	DecodeBatch([]byte) (model.Batch, error)
+}
+
+// TypedBatchDecoder decodes a []byte holding multiple Ts.
+type TypedBatchDecoder[T any] interface {
+	// DecodeBatch decodes the encoded Ts into their struct form.
+	DecodeBatch([]byte) ([]T, error)
+}
+
+// batchDecoder adapts a BatchDecoder to a TypedBatchDecoder.
+type batchDecoder struct {
+	BatchDecoder
+}
+
+// DecodeBatch decodes the events as a []model.APMEvent.
+func (d batchDecoder) DecodeBatch(data []byte) ([]model.APMEvent, error) {
+	return d.BatchDecoder.DecodeBatch(data)
+}
+
+// decode decodes the message data into the events processed as one batch:
+// all the events decoded by the BatchDecoder, if set, or the single event
+// decoded by the Decoder.
+func (c *consumer[T]) decode(data []byte) ([]T, error) {
+	if c.batchDecoder != nil {
+		return c.batchDecoder.DecodeBatch(data)
+	}
+	var event T
+	if err := c.decoder.Decode(data, &event); err != nil {
+		return nil, err
+	}
+	return []T{event}, nil
+}
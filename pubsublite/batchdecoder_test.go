@@ -0,0 +1,103 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerConfigBatchDecoder(t *testing.T) {
+	cfg := ConsumerConfig{
+		Project:   "project",
+		Region:    "region",
+		Topics:    []apmqueue.Topic{"topic"},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+	}
+	assert.ErrorContains(t, cfg.Validate(), "pubsublite: decoder must be set")
+
+	cfg.BatchDecoder = jsonBatchDecoder{}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Decoder = jsonDecoder[model.APMEvent]{}
+	assert.EqualError(t, cfg.Validate(), "pubsublite: only one of decoder or batch decoder can be set")
+}
+
+func TestConsumerBatchDecoder(t *testing.T) {
+	results := make(chan ProcessResult, 10)
+	var processed [][]customEvent
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery: apmqueue.AtLeastOnceDeliveryType,
+			Results:  results,
+		},
+		BatchDecoder: typedJSONBatchDecoder[customEvent]{},
+		Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			processed = append(processed, events)
+			return nil
+		}),
+	})
+	c.processMessage(context.Background(), &pubsub.Message{
+		ID: "0:1", Data: []byte(`[{"name":"a"},{"name":"b"},{"name":"c"}]`),
+	})
+	// All the events decoded from the message are processed as one batch,
+	// and the message is acknowledged once.
+	assert.Equal(t, [][]customEvent{{{Name: "a"}, {Name: "b"}, {Name: "c"}}}, processed)
+	require.Len(t, results, 1)
+	assert.Equal(t, OutcomeAcked, (<-results).Outcome)
+
+	c.processMessage(context.Background(), &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+	assert.Len(t, processed, 1)
+	r := <-results
+	assert.Equal(t, OutcomeNacked, r.Outcome)
+	assert.Error(t, r.Err)
+}
+
+func TestBatchEventType(t *testing.T) {
+	transaction := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	span := model.APMEvent{Span: &model.Span{ID: "1"}}
+	assert.Equal(t, "transaction", batchEventType([]model.APMEvent{transaction, transaction}))
+	assert.Equal(t, "unknown", batchEventType([]model.APMEvent{transaction, span}))
+	assert.Equal(t, "unknown", batchEventType(nil))
+}
+
+type typedJSONBatchDecoder[T any] struct{}
+
+func (typedJSONBatchDecoder[T]) DecodeBatch(data []byte) ([]T, error) {
+	var events []T
+	err := json.Unmarshal(data, &events)
+	return events, err
+}
+
+type jsonBatchDecoder struct{}
+
+func (jsonBatchDecoder) DecodeBatch(data []byte) (model.Batch, error) {
+	var batch model.Batch
+	err := json.Unmarshal(data, &batch)
+	return batch, err
+}
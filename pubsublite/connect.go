@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+const (
+	// minConnectBackoff is the initial backoff between the attempts to
+	// create the subscriber clients when LazyConnect is enabled.
+	minConnectBackoff = time.Second
+	// maxConnectBackoff bounds the backoff between the attempts to create
+	// the subscriber clients.
+	maxConnectBackoff = 30 * time.Second
+)
+
+// connect creates the subscriber clients of the pending subscriptions,
+// retrying with an exponential backoff until all of them have been created or
+// ctx is done. Each subscription is started as soon as its client is created.
+func (c *TypedConsumer[T]) connect(ctx context.Context) {
+	backoff := c.connectBackoff
+	for {
+		c.mu.Lock()
+		pending := append([]apmqueue.Topic(nil), c.pending...)
+		c.mu.Unlock()
+		for _, topic := range pending {
+			consumer, err := c.dial(ctx, topic)
+			if err != nil {
+				c.cfg.Logger.Warn("failed creating subscriber client, retrying",
+					zap.Error(err),
+					zap.String("subscription", string(topic)),
+					zap.Duration("backoff", backoff),
+				)
+				continue
+			}
+			c.connected(ctx, topic, consumer)
+		}
+		c.mu.Lock()
+		remaining := len(c.pending)
+		c.mu.Unlock()
+		if remaining == 0 {
+			c.connecting.Store(false)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// connected adds the consumer of a pending subscription, starting it if the
+// consumer is running. The consumer is discarded if the subscription has been
+// removed in the meantime.
+func (c *TypedConsumer[T]) connected(ctx context.Context, topic apmqueue.Topic, consumer *consumer[T]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range c.pending {
+		if t != topic {
+			continue
+		}
+		c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+		c.consumers = append(c.consumers, consumer)
+		if c.group != nil && ctx.Err() == nil {
+			c.start(consumer)
+		}
+		return
+	}
+}
@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestConsumerLazyConnect(t *testing.T) {
+	cfg := ConsumerConfig{
+		Project:   "project",
+		Region:    "invalid",
+		Topics:    []apmqueue.Topic{"a", "b"},
+		Decoder:   json.JSON{},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+	}
+	// The subscriber clients can't be created in an invalid region.
+	_, err := NewConsumer(context.Background(), cfg)
+	require.Error(t, err)
+
+	cfg.LazyConnect = true
+	core, logs := observer.New(zapcore.WarnLevel)
+	cfg.Logger = zap.New(core)
+	lazy, err := NewConsumer(context.Background(), cfg)
+	require.NoError(t, err)
+	err = lazy.Healthy(context.Background())
+	assert.ErrorIs(t, err, apmqueue.ErrBackendUnavailable)
+	assert.ErrorContains(t, err, "consumer connecting")
+
+	// Fail creating the "b" client twice before succeeding.
+	var attempts int
+	c := lazy.TypedConsumer
+	c.connectBackoff = time.Millisecond
+	c.dial = func(ctx context.Context, topic apmqueue.Topic) (*consumer[model.APMEvent], error) {
+		if topic == "b" {
+			if attempts++; attempts <= 2 {
+				return nil, errors.New("backend unavailable")
+			}
+		}
+		return &consumer[model.APMEvent]{topic: topic}, nil
+	}
+	c.connect(context.Background())
+	assert.NoError(t, lazy.Healthy(context.Background()))
+	assert.Empty(t, c.pending)
+	require.Len(t, c.consumers, 2)
+	assert.Equal(t, apmqueue.Topic("a"), c.consumers[0].topic)
+	assert.Equal(t, apmqueue.Topic("b"), c.consumers[1].topic)
+	assert.Equal(t, 2, logs.FilterMessage("failed creating subscriber client, retrying").Len())
+}
+
+func TestConsumerLazyConnectRemoveSubscription(t *testing.T) {
+	consumer, err := NewTypedConsumer(context.Background(), TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Project:     "project",
+			Region:      "invalid",
+			Topics:      []apmqueue.Topic{"a"},
+			Logger:      zap.NewNop(),
+			LazyConnect: true,
+		},
+		Decoder:   jsonDecoder[customEvent]{},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error { return nil }),
+	})
+	require.NoError(t, err)
+	assert.Error(t, consumer.Healthy(context.Background()))
+	assert.EqualError(t, consumer.AddSubscription(context.Background(), "a"),
+		"pubsublite: already subscribed to a",
+	)
+	require.NoError(t, consumer.RemoveSubscription("a"))
+	assert.NoError(t, consumer.Healthy(context.Background()))
+}
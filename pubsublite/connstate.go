@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/stats"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// connTracker tracks the gRPC connections of a subscriber client. The client
+// hides its connection pool, so the connections are observed through a stats
+// handler, which is notified as they're established and closed.
+type connTracker struct {
+	// started is set once the subscriber starts receiving, which is when
+	// the client connects.
+	started atomic.Bool
+	opened  atomic.Bool
+	open    atomic.Int64
+}
+
+// dialOption returns the dial option installing the tracker.
+func (t *connTracker) dialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(t)
+}
+
+// state returns the connectivity state of the subscriber client:
+//   - Idle until it starts receiving.
+//   - Connecting until its first connection is established.
+//   - Ready while at least one connection is established.
+//   - TransientFailure once all its connections are closed.
+func (t *connTracker) state() connectivity.State {
+	switch {
+	case t.open.Load() > 0:
+		return connectivity.Ready
+	case t.opened.Load():
+		return connectivity.TransientFailure
+	case t.started.Load():
+		return connectivity.Connecting
+	}
+	return connectivity.Idle
+}
+
+// TagConn implements stats.Handler.
+func (t *connTracker) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements stats.Handler, counting the open connections.
+func (t *connTracker) HandleConn(_ context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		t.open.Add(1)
+		t.opened.Store(true)
+	case *stats.ConnEnd:
+		t.open.Add(-1)
+	}
+}
+
+// TagRPC implements stats.Handler.
+func (t *connTracker) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+// HandleRPC implements stats.Handler.
+func (t *connTracker) HandleRPC(context.Context, stats.RPCStats) {}
+
+// ConnectionState returns the gRPC connectivity state of the topic's
+// subscriber client: Idle until the consumer runs, Connecting until its
+// first connection is established, Ready while connected and
+// TransientFailure once disconnected, until the client reconnects. The state
+// is tracked as connections are established and closed, so it's cheap to
+// poll, i.e. on every readiness probe. It returns false if the consumer isn't
+// subscribed to the topic, or the subscription isn't connected yet.
+func (c *TypedConsumer[T]) ConnectionState(topic apmqueue.Topic) (connectivity.State, bool) {
+	consumer, err := c.subscribed(topic)
+	if err != nil || consumer.conns == nil {
+		return connectivity.Idle, false
+	}
+	return consumer.conns.state(), true
+}
+
+// disconnected returns an error if any subscriber client lost all its
+// connections. Must be called with the lock held.
+func (c *TypedConsumer[T]) disconnected() error {
+	for _, consumer := range c.consumers {
+		if consumer.conns != nil && consumer.conns.state() == connectivity.TransientFailure {
+			return fmt.Errorf("pubsublite: %w: subscription %s disconnected",
+				apmqueue.ErrBackendUnavailable, consumer.subscription,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConnTracker(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conns := &connTracker{}
+	c := &TypedConsumer[customEvent]{
+		consumers: []*consumer[customEvent]{{
+			topic:        "topic",
+			subscription: "projects/project/locations/region/subscriptions/topic",
+			conns:        conns,
+		}},
+		pauser: newPauser(),
+	}
+	state := func() connectivity.State {
+		state, ok := c.ConnectionState("topic")
+		require.True(t, ok)
+		return state
+	}
+	assert.Equal(t, connectivity.Idle, state())
+	conns.started.Store(true)
+	assert.Equal(t, connectivity.Connecting, state())
+
+	conn, err := grpc.Dial(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		conns.dialOption(),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Connect()
+	assert.Eventually(t, func() bool {
+		return state() == connectivity.Ready
+	}, 10*time.Second, time.Millisecond)
+	assert.NoError(t, c.Healthy(context.Background()))
+
+	server.Stop()
+	assert.Eventually(t, func() bool {
+		return state() == connectivity.TransientFailure
+	}, 10*time.Second, time.Millisecond)
+	err = c.Healthy(context.Background())
+	assert.ErrorIs(t, err, apmqueue.ErrBackendUnavailable)
+	assert.EqualError(t, err, "pubsublite: backend unavailable: subscription projects/project/locations/region/subscriptions/topic disconnected")
+
+	_, ok := c.ConnectionState("unknown")
+	assert.False(t, ok)
+}
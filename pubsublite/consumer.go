@@ -21,21 +21,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime/pprof"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/pubsublite/pscompat"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
 	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/option"
 
 	"github.com/elastic/apm-data/model"
 	apmqueue "github.com/elastic/apm-queue"
-	"github.com/elastic/apm-queue/pubsublite/internal/telemetry"
+	"github.com/elastic/apm-queue/internal/telemetry"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
@@ -45,6 +53,26 @@ type Decoder interface {
 	Decode([]byte, *model.APMEvent) error
 }
 
+// TypedDecoder decodes a []byte into a T.
+type TypedDecoder[T any] interface {
+	// Decode decodes an encoded T into its struct form.
+	Decode([]byte, *T) error
+}
+
+// TypedProcessor processes decoded events of type T.
+type TypedProcessor[T any] interface {
+	// Process processes the decoded events.
+	Process(context.Context, []T) error
+}
+
+// TypedProcessorFunc is a function type that implements TypedProcessor.
+type TypedProcessorFunc[T any] func(context.Context, []T) error
+
+// Process calls f(ctx, events).
+func (f TypedProcessorFunc[T]) Process(ctx context.Context, events []T) error {
+	return f(ctx, events)
+}
+
 // ConsumerConfig defines the configuration for the PubSub Lite consumer.
 type ConsumerConfig struct {
 	// Region is the GCP region for the producer.
@@ -55,22 +83,399 @@ type ConsumerConfig struct {
 	Topics []apmqueue.Topic
 	// Decoder holds an encoding.Decoder for decoding events.
 	Decoder Decoder
+	// BatchDecoder, when set instead of Decoder, decodes each message into
+	// multiple events, which are processed as a single batch, and
+	// acknowledged or nacked together with their message. Exactly one of
+	// Decoder and BatchDecoder must be set.
+	BatchDecoder BatchDecoder
+	// DecoderSelfTest, when set, is a sample message payload which is
+	// decoded with the Decoder, or BatchDecoder, when the consumer is
+	// created, which fails if it can't be decoded. It guards against
+	// deploying a consumer whose Decoder doesn't match the format of the
+	// published messages.
+	DecoderSelfTest []byte
 	// Logger to use for any errors.
 	Logger *zap.Logger
+	// Loggers overrides the Logger used by the subscription of each topic,
+	// allowing the logs of different subscriptions to be routed to different
+	// sinks. Subscriptions without an override use Logger.
+	Loggers map[apmqueue.Topic]*zap.Logger
 	// Processor that will be used to process each event individually.
 	// Processor may be called from multiple goroutines and needs to be
 	// safe for concurrent use.
 	Processor model.BatchProcessor
 	// Delivery mechanism to use to acknowledge the messages.
 	// AtMostOnceDeliveryType and AtLeastOnceDeliveryType are supported.
-	Delivery   apmqueue.DeliveryType
+	//
+	// With AtLeastOnceDeliveryType, messages which fail to be processed are
+	// nacked on their 3rd delivery. Deliveries are counted by partition and
+	// offset, across reconnects, while the partition remains assigned to
+	// the subscriber. When a partition is assigned away, the deliveries of
+	// its messages are forgotten, so they start over if it's assigned back.
+	// Partition assignments are counted in the consumer.reassignment.count
+	// metric.
+	Delivery apmqueue.DeliveryType
+	// ClientOpts are passed to the underlying Pub/Sub Lite clients. The
+	// auth package provides helpers to build the authentication options.
 	ClientOpts []option.ClientOption
 
 	// TracerProvider allows specifying a custom otel tracer provider.
 	// Defaults to the global one.
 	TracerProvider trace.TracerProvider
+	// MeterProvider allows specifying a custom otel meter provider.
+	// Defaults to the global one.
+	MeterProvider metric.MeterProvider
+	// LatencyBuckets are the histogram bucket boundaries, in seconds, of the
+	// consumer.process.duration and consumer.message.dwell histograms. They
+	// must be strictly increasing. Defaults to DefaultLatencyBuckets.
+	// Views registered with the MeterProvider take precedence.
+	LatencyBuckets []float64
+
+	// AckDeadline is the time within which a message is expected to be
+	// acknowledged after it has been received. Pub/Sub Lite doesn't have a
+	// server-side ack deadline, messages stay outstanding (and count towards
+	// the flow control limits) until they're acknowledged, so the deadline
+	// is only used to record the consumer.ack.headroom histogram, which
+	// measures how close processing runs to it, and to warn when the P99 of
+	// the recent processing durations exceeds 80% of it, which is logged
+	// and counted in the consumer.deadline.risk metric. Disabled when <= 0.
+	AckDeadline time.Duration
+	// MaintenanceSchedule, when set, pauses message processing while the
+	// schedule is in a maintenance window, and resumes it once the window
+	// ends. Messages received during the window are left unacknowledged, and
+	// the consumer reports itself as unhealthy.
+	MaintenanceSchedule MaintenanceSchedule
+	// AckBatchSize, when > 1, accumulates the acknowledgements of
+	// successfully processed messages per partition, and acknowledges them
+	// in offset order once AckBatchSize messages are pending, or every
+	// AckBatchInterval. Requires AtLeastOnceDeliveryType.
+	//
+	// Messages which have been processed but not yet acknowledged are
+	// redelivered if the consumer crashes, slightly widening the window in
+	// which duplicates may be processed.
+	AckBatchSize int
+	// AckBatchInterval is the maximum time an acknowledgement is held for
+	// when AckBatchSize is set. If AckBatchInterval <= 0, defaults to 1s.
+	AckBatchInterval time.Duration
+	// ContextDecorator, when set, is called with the message attributes
+	// before each message is processed. The returned context is passed to
+	// the Processor, allowing request scoped values to be derived from the
+	// message attributes.
+	ContextDecorator func(ctx context.Context, attrs map[string]string) context.Context
+	// MetadataCodec, when set, decodes the message attributes into
+	// structured metadata, which is stored in the processing context and can
+	// be retrieved with queuecontext.StructuredMetadataFromContext. Messages
+	// whose attributes can't be decoded are handled as decoding failures.
+	MetadataCodec queuecontext.MetadataCodec
+	// StartupProbeMessages, when > 0, processes the first
+	// StartupProbeMessages messages received by the consumer one at a time,
+	// and makes Run return an error if any of them can't be decoded or
+	// processed. Once all of them have been processed successfully, the
+	// consumer resumes its normal, concurrent and resilient, behavior.
+	// It allows catching misconfigurations, i.e. mismatched encoders and
+	// decoders, as soon as the consumer is deployed.
+	StartupProbeMessages int
+	// DecodeGuard, when its Threshold is set, makes Run return an error once
+	// the decode failure rate of a subscription exceeds the threshold,
+	// catching misconfigurations which would otherwise quietly discard all
+	// the messages. Unlike StartupProbeMessages, it keeps guarding the
+	// subscriptions for the whole lifetime of the consumer.
+	DecodeGuard DecodeGuard
+	// AuditSampler, when its Ratio is set, copies a fraction of all the
+	// consumed messages to an audit topic before they're processed, for
+	// compliance auditing. Sampled messages are published asynchronously,
+	// without affecting their processing. The number of sampled messages
+	// waiting to be published is reported by the consumer.audit.buffered
+	// metric.
+	AuditSampler AuditSampler
+	// ReorderWindow, when > 0, buffers the messages received from all the
+	// subscriptions and partitions, and processes them one at a time in
+	// publish time order. Each message is buffered until it's older than
+	// ReorderWindow, so messages published up to ReorderWindow apart which
+	// arrive out of order are reordered.
+	//
+	// This adds at least ReorderWindow of latency to every message, and
+	// serializes processing, which greatly reduces throughput. The number of
+	// buffered messages is bounded by the subscriber flow control settings.
+	// Messages which arrive after a message published later than them has
+	// been processed are dropped, acknowledged without processing, and
+	// counted in the consumer.reorder.late metric.
+	ReorderWindow time.Duration
+	// LogSampling, when its Interval is set, samples the message decoding and
+	// processing error logs per subscription, so repeated identical errors,
+	// i.e. while a downstream system is unavailable, don't flood the logs.
+	// Distinct errors are always logged.
+	LogSampling LogSampling
+	// DeferredAckTimeout is the maximum time to wait for the acknowledgement
+	// of a message deferred with DeferAck to be settled, after which the
+	// message is handled as a processing failure. If DeferredAckTimeout <= 0,
+	// defaults to 1m. Requires AtLeastOnceDeliveryType.
+	DeferredAckTimeout time.Duration
+	// Results, when set, receives the result of every message once it has
+	// been acknowledged, nacked, or left unacknowledged to be redelivered,
+	// allowing the outcome of each message to be observed. Results are sent
+	// without blocking, and are dropped if the channel is full, so a slow
+	// receiver doesn't slow down message processing. The channel is never
+	// closed by the consumer.
+	Results chan<- ProcessResult
+	// ShutdownOrder, when set, makes Close stop the listed subscriptions
+	// one at a time in the given order, waiting for the in-flight messages
+	// of each subscription to be processed and acknowledged before stopping
+	// the next one. The subscriptions which aren't listed are stopped
+	// concurrently once all the listed ones have been drained. It allows
+	// fully flushing the subscriptions which feed critical sinks first.
+	ShutdownOrder []apmqueue.Topic
+	// ShutdownTimeout, when > 0, is the maximum time Close waits for the
+	// subscriptions to be drained. When ShutdownOrder is set, the remaining
+	// time is split evenly across the remaining shutdown steps, so a slow
+	// subscription can't use up the time of the subscriptions stopped after
+	// it. Close returns an error for the subscriptions which aren't drained
+	// in time. If both ShutdownOrder and ShutdownTimeout are unset, Close
+	// stops all the subscriptions concurrently without waiting for them.
+	ShutdownTimeout time.Duration
+	// OnContextCancel determines what happens to the in-flight messages of a
+	// subscription when its context is cancelled, i.e. when the consumer is
+	// closed, before they're processed or while they're being processed.
+	// Either way, the cancelled messages aren't acknowledged: the subscriber
+	// is terminated without waiting for them, and they're redelivered from
+	// the subscription's last committed cursor once it's consumed again.
+	// Defaults to LeaveUnackedOnCancel.
+	OnContextCancel CancelPolicy
+	// OnEmptyPayload determines how messages with an empty payload, i.e.
+	// intentional tombstones, are handled. Defaults to ErrorOnEmptyPayload.
+	OnEmptyPayload EmptyPayloadPolicy
+	// RecoveredLog determines how messages successfully processed with the
+	// at-least-once delivery type are logged, which can flood the logs while
+	// recovering from a downstream outage. The messages which succeed after
+	// failing are counted in the consumer.recovered metric regardless.
+	// Defaults to InfoRecoveredLog.
+	RecoveredLog RecoveredLogPolicy
+	// MaxRuntime, when > 0, is the maximum time Run consumes messages for.
+	// Once elapsed, the consumer stops receiving messages, drains the
+	// in-flight ones, and Run returns, regardless of the remaining backlog.
+	// The stop reason is logged. It bounds the duration of one-shot
+	// processing jobs.
+	MaxRuntime time.Duration
+	// ReportTermination, when true, emits a consumer.subscriber.terminated
+	// error log and span when a subscription terminates with a fatal error,
+	// i.e. a non-recoverable receive error, before Run returns it. Both
+	// carry the subscription and the cause, and the log includes the offset
+	// of the last message received from each partition as last_offset.
+	ReportTermination bool
+	// Version, when set, is added as the service.version attribute to all
+	// the consumer metrics and spans, i.e. to compare the error rates and
+	// latencies of the old and new versions during a canary deployment. It
+	// must be a single low-cardinality value, such as a release version or
+	// deployment ID, since each distinct value creates new metric series.
+	Version string
+	// CorrelationIDAttribute, when set, is the message attribute holding a
+	// business correlation ID. Its value is added as the correlation_id
+	// field to the logs about the message, and as the
+	// messaging.message.conversation_id attribute to its processing span.
+	CorrelationIDAttribute string
+	// LogTraceContext, when true, adds the trace_id and span_id fields of
+	// the message processing span to the logs about the message, so they
+	// can be correlated with the trace. The logs are written by the Logger,
+	// which can be built on a zapcore.Core exporting them as OTel logs.
+	LogTraceContext bool
+	// DetectOffsetAnomalies, when true, tracks the last offset received from
+	// each partition, and emits an "offset anomaly detected" warning log
+	// and the consumer.offset.anomaly metric when an offset is skipped (gap)
+	// or isn't greater than the last one (non_increasing). The offsets are
+	// forgotten when receiving restarts, since messages are then expected
+	// to be redelivered, but redeliveries caused by partitions being
+	// reassigned between subscribers are reported. It's a diagnostic aid
+	// for ordering guarantees.
+	DetectOffsetAnomalies bool
+	// OnStart, when set, is called by Run before the subscriptions start
+	// receiving messages, i.e. to load a snapshot of a processor's state and
+	// warm its caches. If it fails, Run returns its error without receiving
+	// any message. It's called with the consumer locked, so it must not call
+	// the consumer's methods.
+	OnStart func(ctx context.Context) error
+	// OnStop, when set, is called by Run once all the subscriptions have
+	// stopped and their received messages have been processed, i.e. to
+	// persist a snapshot of a processor's state. Its context is detached
+	// from the cancellation of Run's context. Its error is returned by Run,
+	// joined with Run's error, if any.
+	OnStop func(ctx context.Context) error
+	// EventTypeAttribute, when true, sets the event.type attribute to the
+	// type of the decoded event (transaction, span, error, metric or log) on
+	// the processing span and the consumer.process.duration metric. Events
+	// of any other type, and messages decoded by a BatchDecoder into events
+	// of different types, are reported as unknown, bounding the attribute's
+	// cardinality. It only applies when messages are decoded into
+	// model.APMEvent.
+	EventTypeAttribute bool
+	// ShadowProcessor, when set, processes every event alongside Processor,
+	// concurrently and on a best-effort basis, i.e. to validate a new
+	// processor implementation against production traffic. Its result never
+	// affects the acknowledgement of messages: its failures are counted in
+	// the consumer.shadow.errors metric, and results which differ from the
+	// Processor result are logged. The events are shared with Processor, so
+	// ShadowProcessor must not modify them.
+	ShadowProcessor model.BatchProcessor
+	// RouteAttribute is the message attribute whose value selects the
+	// processor of the message from the ProcessorRouter. It must be set
+	// when ProcessorRouter is set.
+	RouteAttribute string
+	// ProcessorRouter, when set, holds the processors of the messages keyed
+	// by the value of their RouteAttribute. Messages without the attribute,
+	// or with a value which isn't in the router, are processed by Processor.
+	// The message is acknowledged according to the result of the selected
+	// processor.
+	ProcessorRouter map[string]model.BatchProcessor
+	// SerializeKeyAttribute, when set, is the message attribute whose value
+	// serializes the processing of messages across all the subscriptions of
+	// the consumer: messages with the same value are never processed
+	// concurrently, i.e. when the events of an entity are published to
+	// multiple topics. Messages without the attribute aren't serialized.
+	//
+	// Use with care: a message waiting for its key holds its place in the
+	// subscription's flow control, so frequent keys reduce the throughput of
+	// every subscription they appear in, down to a single message at a time.
+	// A processor must never wait for the processing of another message with
+	// the same key, since it would deadlock until the consumer is stopped.
+	// The order in which messages sharing a key are
+	// processed across subscriptions isn't guaranteed.
+	SerializeKeyAttribute string
+	// SupportedSchemaVersions, when set, holds the values of the
+	// SchemaVersionAttribute which the consumer can decode and process.
+	// Messages with any other schema version are acked and dropped without
+	// being decoded, and counted in the consumer.unsupported.schema metric.
+	// Messages without the attribute are always processed.
+	SupportedSchemaVersions []string
+	// LazyConnect, when true, defers the creation of the subscriber clients
+	// from NewConsumer to Run, which retries with an exponential backoff
+	// until they're created, so a transient backend outage at startup
+	// doesn't fail the consumer creation. Each subscription starts as soon
+	// as its client is created, and Healthy reports the consumer as
+	// connecting until all of them have been created.
+	LazyConnect bool
+	// RedactAttributes holds the message attributes whose values are
+	// replaced with a placeholder in the logs, i.e. attributes which may
+	// contain personal data.
+	RedactAttributes []string
+	// RateLimit, when > 0, caps the number of messages processed per second
+	// across all the subscriptions. Messages waiting for the rate limit are
+	// left unacknowledged, and count towards the flow control limits.
+	RateLimit float64
+	// MaxConcurrency, when > 0, caps the number of messages processed
+	// concurrently across all the subscriptions. Otherwise, the concurrency
+	// is only bounded by the subscriber flow control settings.
+	MaxConcurrency int
+	// MaxAttempts is the number of failed processing attempts after which
+	// a message is nacked, which Pub/Sub Lite handles by logging and
+	// acknowledging it. If MaxAttempts <= 0, defaults to 3. Requires
+	// AtLeastOnceDeliveryType.
+	MaxAttempts int
+	// Filter, when set, is called with the attributes of every message and
+	// reports whether the message must be processed. Messages which are
+	// filtered out are acked without being decoded, and counted in the
+	// consumer.filtered metric.
+	Filter func(attrs map[string]string) bool
+	// RetryBackoff, when its Initial delay is set, holds the messages which
+	// failed to be processed and reprocesses them once the delay has
+	// elapsed, rather than reprocessing them as soon as they're redelivered,
+	// so a recovering downstream system isn't hammered with retries. The
+	// delay grows exponentially with each failed attempt, up to its Max, and
+	// is reported as the RetryDelay of the retried ProcessResult. Requires
+	// AtLeastOnceDeliveryType.
+	RetryBackoff RetryBackoff
+	// PartitionBackoff, when its Initial delay is set, delays the processing
+	// of the messages of a partition whose messages consecutively failed to
+	// be processed, i.e. while a poison message is blocking it, so a single
+	// failing partition doesn't consume the processing capacity of the
+	// subscription. The delay grows exponentially with each consecutive
+	// failure, up to its Max, and is reset once a message of the partition
+	// is processed successfully. The other partitions are processed without
+	// delay. The applied delays are recorded in the consumer.partition.backoff
+	// histogram, by partition.
+	PartitionBackoff RetryBackoff
+	// RequiredAttributes holds the message attributes which every message
+	// is expected to have. Messages missing any of them are still
+	// processed, but each missing attribute is counted in the
+	// consumer.missing.attribute metric, labeled by attribute name,
+	// surfacing producer bugs.
+	RequiredAttributes []string
+	// ObserveAttributes holds low-cardinality message attributes, i.e. the
+	// region or event type, whose values are counted in the
+	// consumer.attribute.value metric, labeled by attribute name and value,
+	// to help debug skew. Only the first 50 distinct values of each
+	// attribute are recorded by each subscription, further values are
+	// counted as __other__. Messages without the attribute aren't counted.
+	ObserveAttributes []string
+	// CreateMissingSubscriptions, when true, creates the subscriptions which
+	// don't exist when their clients are created, using the admin API. Each
+	// subscription is attached to the topic with the same name, and delivers
+	// messages immediately. Otherwise, Run returns ErrSubscriptionNotFound,
+	// naming the subscription, when a subscription doesn't exist.
+	CreateMissingSubscriptions bool
+	// Pipeline, when set, transforms the raw payload of each message with
+	// its ordered stages before the payload is decoded, i.e. to decompress,
+	// decrypt or normalize it. Messages for which a stage fails are handled
+	// as decoding failures. Each stage is recorded as a pipeline.stage
+	// event of the processing span, and timed in the
+	// consumer.pipeline.stage.duration metric. The DecoderSelfTest sample is
+	// decoded without being transformed.
+	Pipeline Pipeline
+	// Decrypter, when set, decrypts the payload of the messages whose
+	// EncryptionAttribute is set, before the Pipeline stages and decoding.
+	// Messages which can't be decrypted, or which are encrypted when no
+	// Decrypter is set, are nacked, and their result error wraps
+	// ErrDecryptionFailed. Messages without the attribute aren't decrypted.
+	Decrypter Decrypter
 }
 
+// CancelPolicy determines how in-flight messages are handled when the
+// consumer context is cancelled.
+type CancelPolicy uint8
+
+const (
+	// LeaveUnackedOnCancel leaves the cancelled messages unacknowledged
+	// until the retries and deferred acknowledgements in flight have settled
+	// their messages, and then terminates the subscriber. It's the safest
+	// policy, since it minimizes the redelivered messages.
+	LeaveUnackedOnCancel CancelPolicy = iota
+	// NackOnCancel nacks the cancelled messages straight away. Pub/Sub Lite
+	// has no concept of nack, so the nack handler terminates the subscriber
+	// for them, without acknowledging them. The messages whose retry or
+	// deferred acknowledgement is still in flight are redelivered too.
+	NackOnCancel
+)
+
+// EmptyPayloadPolicy determines how messages with an empty payload are
+// handled.
+type EmptyPayloadPolicy uint8
+
+const (
+	// ErrorOnEmptyPayload decodes empty payloads like any other payload,
+	// which usually fails and is handled as a decoding failure.
+	ErrorOnEmptyPayload EmptyPayloadPolicy = iota
+	// SkipEmptyPayload acknowledges messages with an empty payload without
+	// processing them.
+	SkipEmptyPayload
+	// ProcessEmptyPayload processes messages with an empty payload as a
+	// single zero value T, without decoding them. The message attributes
+	// are available in the processing context, as for any other message.
+	ProcessEmptyPayload
+)
+
+// RecoveredLogPolicy determines how the "processed previously failed event"
+// log is emitted.
+type RecoveredLogPolicy uint8
+
+const (
+	// InfoRecoveredLog logs every message processed successfully with the
+	// at-least-once delivery type at info level.
+	InfoRecoveredLog RecoveredLogPolicy = iota
+	// DebugRecoveredLog logs the messages at debug level.
+	DebugRecoveredLog
+	// NoRecoveredLog doesn't log the messages, leaving the consumer.recovered
+	// metric to report the recovery.
+	NoRecoveredLog
+)
+
 // Subscription represents a PubSub Lite subscription.
 type Subscription struct {
 	// Project where the subscription is located.
@@ -87,8 +492,109 @@ func (s Subscription) String() string {
 	)
 }
 
+// TypedConsumerConfig defines the configuration for a TypedConsumer. The
+// Decoder, BatchDecoder and Processor fields of the embedded ConsumerConfig
+// are ignored in favour of their typed counterparts.
+type TypedConsumerConfig[T any] struct {
+	// ConsumerConfig holds the settings shared with the model.APMEvent
+	// consumer. Its Decoder, BatchDecoder, Processor, ShadowProcessor and
+	// ProcessorRouter must not be set, they're superseded by the typed
+	// fields below.
+	ConsumerConfig
+	// Decoder holds a TypedDecoder for decoding messages into T.
+	Decoder TypedDecoder[T]
+	// BatchDecoder, when set instead of Decoder, decodes each message into
+	// multiple Ts. See ConsumerConfig.BatchDecoder.
+	BatchDecoder TypedBatchDecoder[T]
+	// Processor that will be used to process each decoded T individually.
+	// Processor may be called from multiple goroutines and needs to be
+	// safe for concurrent use.
+	Processor TypedProcessor[T]
+	// ShadowProcessor, when set, processes each decoded T alongside
+	// Processor without affecting the acknowledgement of messages. See
+	// ConsumerConfig.ShadowProcessor.
+	ShadowProcessor TypedProcessor[T]
+	// ProcessorRouter, when set, holds the processors of each decoded T
+	// keyed by the value of the message RouteAttribute. See
+	// ConsumerConfig.ProcessorRouter.
+	ProcessorRouter map[string]TypedProcessor[T]
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg TypedConsumerConfig[T]) Validate() error {
+	errs := cfg.ConsumerConfig.validate()
+	for _, field := range cfg.ConsumerConfig.untypedFields() {
+		errs = append(errs, fmt.Errorf(
+			"pubsublite: ConsumerConfig.%[1]s is not used by typed consumers, set %[1]s instead", field,
+		))
+	}
+	switch {
+	case cfg.Decoder == nil && cfg.BatchDecoder == nil:
+		errs = append(errs, errors.New("pubsublite: decoder must be set"))
+	case cfg.Decoder != nil && cfg.BatchDecoder != nil:
+		errs = append(errs, errors.New("pubsublite: only one of decoder or batch decoder can be set"))
+	}
+	if cfg.Processor == nil {
+		errs = append(errs, errors.New("pubsublite: processor must be set"))
+	}
+	errs = append(errs, validateRouter(len(cfg.ProcessorRouter), cfg.RouteAttribute)...)
+	if _, ok := any(*new(T)).(model.APMEvent); cfg.EventTypeAttribute && !ok {
+		errs = append(errs, errors.New("pubsublite: event type attribute only applies to model.APMEvent consumers"))
+	}
+	return errors.Join(errs...)
+}
+
 // Validate ensures the configuration is valid, otherwise, returns an error.
 func (cfg ConsumerConfig) Validate() error {
+	errs := cfg.validate()
+	switch {
+	case cfg.Decoder == nil && cfg.BatchDecoder == nil:
+		errs = append(errs, errors.New("pubsublite: decoder must be set"))
+	case cfg.Decoder != nil && cfg.BatchDecoder != nil:
+		errs = append(errs, errors.New("pubsublite: only one of decoder or batch decoder can be set"))
+	}
+	if cfg.Processor == nil {
+		errs = append(errs, errors.New("pubsublite: processor must be set"))
+	}
+	errs = append(errs, validateRouter(len(cfg.ProcessorRouter), cfg.RouteAttribute)...)
+	return errors.Join(errs...)
+}
+
+// untypedFields returns the names of the set fields which only apply to
+// model.APMEvent consumers, and are superseded in TypedConsumerConfig.
+func (cfg ConsumerConfig) untypedFields() []string {
+	var fields []string
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"Decoder", cfg.Decoder != nil},
+		{"BatchDecoder", cfg.BatchDecoder != nil},
+		{"Processor", cfg.Processor != nil},
+		{"ShadowProcessor", cfg.ShadowProcessor != nil},
+		{"ProcessorRouter", cfg.ProcessorRouter != nil},
+	} {
+		if field.set {
+			fields = append(fields, field.name)
+		}
+	}
+	return fields
+}
+
+// validateRouter validates the processor router settings, which are set
+// separately for typed consumers.
+func validateRouter(routes int, attribute string) []error {
+	switch {
+	case routes > 0 && attribute == "":
+		return []error{errors.New("pubsublite: route attribute must be set with a processor router")}
+	case routes == 0 && attribute != "":
+		return []error{errors.New("pubsublite: processor router must be set with a route attribute")}
+	}
+	return nil
+}
+
+// validate validates the settings shared by all consumer configurations.
+func (cfg ConsumerConfig) validate() []error {
 	var errs []error
 	if len(cfg.Topics) == 0 {
 		errs = append(errs,
@@ -101,41 +607,258 @@ func (cfg ConsumerConfig) Validate() error {
 	if cfg.Region == "" {
 		errs = append(errs, errors.New("pubsublite: region must be set"))
 	}
-	if cfg.Decoder == nil {
-		errs = append(errs, errors.New("pubsublite: decoder must be set"))
-	}
 	if cfg.Logger == nil {
 		errs = append(errs, errors.New("pubsublite: logger must be set"))
 	}
-	if cfg.Processor == nil {
-		errs = append(errs, errors.New("pubsublite: processor must be set"))
+	if err := cfg.partialConfig().Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateLatencyBuckets(cfg.LatencyBuckets); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.OnEmptyPayload > ProcessEmptyPayload {
+		errs = append(errs, fmt.Errorf("pubsublite: invalid empty payload policy %d", cfg.OnEmptyPayload))
+	}
+	if cfg.RecoveredLog > NoRecoveredLog {
+		errs = append(errs, fmt.Errorf("pubsublite: invalid recovered log policy %d", cfg.RecoveredLog))
 	}
 	switch cfg.Delivery {
 	case apmqueue.AtLeastOnceDeliveryType:
 	case apmqueue.AtMostOnceDeliveryType:
+		// Messages are acknowledged before being processed, so the settings
+		// of the acknowledgement after processing would be silently ignored.
+		if cfg.AckBatchSize > 1 {
+			errs = append(errs, errors.New("pubsublite: ack batch size requires at least once delivery"))
+		}
+		if cfg.RetryBackoff.Initial > 0 {
+			errs = append(errs, errors.New("pubsublite: retry backoff requires at least once delivery"))
+		}
+		if cfg.MaxAttempts > 0 {
+			errs = append(errs, errors.New("pubsublite: max attempts requires at least once delivery"))
+		}
+		if cfg.DeferredAckTimeout > 0 {
+			errs = append(errs, errors.New("pubsublite: deferred ack timeout requires at least once delivery"))
+		}
+		if cfg.RecoveredLog != InfoRecoveredLog {
+			errs = append(errs, errors.New("pubsublite: recovered log policy requires at least once delivery"))
+		}
 	default:
 		errs = append(errs, errors.New("pubsublite: delivery is not valid"))
 	}
-	return errors.Join(errs...)
+	if err := cfg.Pipeline.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.DecodeGuard.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.AuditSampler.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
 }
 
-// Consumer receives PubSub Lite messages from a existing subscription(s). The
-// underlying library processes messages concurrently per subscription and
-// partition.
+// ExpiresAtAttribute is the message attribute which holds the RFC 3339 time
+// after which a message is no longer useful. Expired messages are acked and
+// dropped by the consumer without being decoded or processed. Unlike broker
+// based retention, the expiry is set by the producer for each message.
+const ExpiresAtAttribute = "expires-at"
+
+// SchemaVersionAttribute is the message attribute which holds the version of
+// the message payload schema. See ConsumerConfig.SupportedSchemaVersions.
+const SchemaVersionAttribute = "schema-version"
+
+// maintenanceCheckInterval is how often the MaintenanceSchedule is checked.
+const maintenanceCheckInterval = time.Second
+
+// errMaxRuntime is the cause of the Run context cancellation once the
+// MaxRuntime has elapsed.
+var errMaxRuntime = errors.New("pubsublite: max runtime reached")
+
+// errNackedOnCancel is returned by the nack handler for the messages nacked
+// because their processing was cancelled. Pub/Sub Lite has no nack, the
+// error terminates the subscriber without acknowledging them, or waiting for
+// the other outstanding messages, so they're redelivered.
+var errNackedOnCancel = errors.New("pubsublite: message nacked on cancel")
+
+// Consumer receives PubSub Lite messages from a existing subscription(s) and
+// decodes them into model.APMEvent. The underlying library processes messages
+// concurrently per subscription and partition.
 type Consumer struct {
+	*TypedConsumer[model.APMEvent]
+	// untyped holds the model.APMEvent specific settings, which aren't
+	// part of the TypedConsumer configuration.
+	untyped ConsumerConfig
+}
+
+// NewConsumer creates a new consumer instance for a single subscription.
+func NewConsumer(ctx context.Context, cfg ConsumerConfig) (*Consumer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("pubsublite: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	c, err := NewTypedConsumer(ctx, cfg.typed())
+	if err != nil {
+		return nil, err
+	}
+	return &Consumer{TypedConsumer: c, untyped: cfg}, nil
+}
+
+// EffectiveConfig returns the configuration the consumer is running with,
+// see TypedConsumer.EffectiveConfig.
+func (c *Consumer) EffectiveConfig() ConsumerConfig {
+	cfg := c.TypedConsumer.EffectiveConfig()
+	cfg.Decoder = c.untyped.Decoder
+	cfg.BatchDecoder = c.untyped.BatchDecoder
+	cfg.Processor = c.untyped.Processor
+	cfg.ShadowProcessor = c.untyped.ShadowProcessor
+	cfg.ProcessorRouter = c.untyped.ProcessorRouter
+	return cfg
+}
+
+// typed returns the TypedConsumerConfig of a model.APMEvent consumer with
+// the same settings.
+func (cfg ConsumerConfig) typed() TypedConsumerConfig[model.APMEvent] {
+	typed := TypedConsumerConfig[model.APMEvent]{
+		ConsumerConfig: cfg,
+		Decoder:        cfg.Decoder,
+		Processor:      batchProcessor{cfg.Processor},
+	}
+	// The settings superseded by the typed fields are cleared.
+	typed.ConsumerConfig.Decoder = nil
+	typed.ConsumerConfig.BatchDecoder = nil
+	typed.ConsumerConfig.Processor = nil
+	typed.ConsumerConfig.ShadowProcessor = nil
+	typed.ConsumerConfig.ProcessorRouter = nil
+	if cfg.BatchDecoder != nil {
+		typed.BatchDecoder = batchDecoder{cfg.BatchDecoder}
+	}
+	if cfg.ShadowProcessor != nil {
+		typed.ShadowProcessor = batchProcessor{cfg.ShadowProcessor}
+	}
+	if len(cfg.ProcessorRouter) > 0 {
+		typed.ProcessorRouter = make(map[string]TypedProcessor[model.APMEvent], len(cfg.ProcessorRouter))
+		for value, processor := range cfg.ProcessorRouter {
+			typed.ProcessorRouter[value] = batchProcessor{processor}
+		}
+	}
+	return typed
+}
+
+// batchProcessor adapts a model.BatchProcessor to a TypedProcessor.
+type batchProcessor struct {
+	model.BatchProcessor
+}
+
+// Process processes the events as a single model.Batch.
+func (p batchProcessor) Process(ctx context.Context, events []model.APMEvent) error {
+	batch := model.Batch(events)
+	return p.ProcessBatch(ctx, &batch)
+}
+
+// TypedConsumer receives PubSub Lite messages from a existing subscription(s)
+// and decodes them into T. The underlying library processes messages
+// concurrently per subscription and partition.
+type TypedConsumer[T any] struct {
 	mu             sync.Mutex
-	cfg            ConsumerConfig
-	consumers      []*consumer
+	cfg            TypedConsumerConfig[T]
+	settings       pscompat.ReceiveSettings
+	consumers      []*consumer[T]
 	stopSubscriber context.CancelFunc
 	tracer         trace.Tracer
+	metrics        consumerMetrics
+	pauser         *pauser
+	probe          *startupProbe
+	decodeGuard    *decodeGuard
+	auditor        *auditor
+	reorder        *reorderBuffer
+	// keyLocks is nil unless SerializeKeyAttribute is set.
+	keyLocks *keyedMutex
+	// throughputCallback reports the consumer.throughput metric.
+	throughputCallback metric.Registration
+	// group and runCtx are set when the consumer is started.
+	group  *errgroup.Group
+	runCtx context.Context
+	// now returns the current time, it's overridden in tests.
+	now func() time.Time
+	// pending holds the subscriptions whose clients haven't been created
+	// yet when LazyConnect is enabled, connecting is true until they are.
+	pending    []apmqueue.Topic
+	connecting atomic.Bool
+	// dial creates the consumer of a subscription and connectBackoff is the
+	// initial backoff between failed attempts, they're overridden in tests.
+	dial           func(context.Context, apmqueue.Topic) (*consumer[T], error)
+	connectBackoff time.Duration
+	// newAdmin creates the admin client used to create missing
+	// subscriptions, it's overridden in tests.
+	newAdmin func(context.Context) (subscriptionAdmin, error)
+	// live holds the settings which can be changed with Reconfigure.
+	live    atomic.Pointer[liveConfig]
+	limiter *limiter
+	// runDone is closed once Run returns.
+	runDone runDone
 }
 
-// NewConsumer creates a new consumer instance for a single subscription.
-func NewConsumer(ctx context.Context, cfg ConsumerConfig) (*Consumer, error) {
+// NewTypedConsumer creates a new consumer instance which decodes messages
+// into T.
+func NewTypedConsumer[T any](ctx context.Context, cfg TypedConsumerConfig[T]) (*TypedConsumer[T], error) {
 	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("pubsublite: invalid consumer config: %w", err)
+		return nil, fmt.Errorf("pubsublite: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	if cfg.DecoderSelfTest != nil {
+		self := &consumer[T]{decoder: cfg.Decoder, batchDecoder: cfg.BatchDecoder}
+		if _, err := self.decode(cfg.DecoderSelfTest); err != nil {
+			return nil, fmt.Errorf("pubsublite: %w: decoder self test failed: %w",
+				apmqueue.ErrInvalidConfig, err,
+			)
+		}
+	}
+	cfg.Logger = cfg.Logger.Named("pubsublite")
+	meterProvider := cfg.MeterProvider
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+	metrics, err := newConsumerMetrics(meterProvider, cfg.LatencyBuckets)
+	if err != nil {
+		return nil, fmt.Errorf("pubsublite: failed creating consumer metrics: %w", err)
+	}
+	tracerProvider := cfg.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	if cfg.AckBatchInterval <= 0 {
+		cfg.AckBatchInterval = defaultAckBatchInterval
+	}
+	if cfg.DeferredAckTimeout <= 0 {
+		cfg.DeferredAckTimeout = defaultDeferredAckTimeout
+	}
+	c := &TypedConsumer[T]{
+		cfg:     cfg,
+		tracer:  tracerProvider.Tracer("pubsublite"),
+		metrics: metrics,
+		pauser:  newPauser(),
+		now:     time.Now,
+	}
+	if c.throughputCallback, err = meterProvider.Meter("pubsublite").RegisterCallback(
+		c.observeThroughput, metrics.throughput,
+	); err != nil {
+		return nil, fmt.Errorf("pubsublite: failed creating consumer metrics: %w", err)
 	}
-	settings := pscompat.ReceiveSettings{
+	c.dial = c.newConsumer
+	c.newAdmin = c.newAdminClient
+	c.connectBackoff = minConnectBackoff
+	c.live.Store(newLiveConfig(cfg.partialConfig()))
+	c.limiter = newLimiter(&c.live)
+	if cfg.StartupProbeMessages > 0 {
+		c.probe = &startupProbe{remaining: cfg.StartupProbeMessages}
+	}
+	c.decodeGuard = newDecodeGuard(cfg.DecodeGuard)
+	c.auditor = newAuditor(cfg.AuditSampler, cfg.Logger, metrics)
+	if cfg.SerializeKeyAttribute != "" {
+		c.keyLocks = newKeyedMutex()
+	}
+	if cfg.ReorderWindow > 0 {
+		c.reorder = newReorderBuffer(cfg.ReorderWindow, c.now)
+	}
+	c.settings = pscompat.ReceiveSettings{
 		// Pub/Sub Lite does not have a concept of 'nack'. If the nack handler
 		// implementation returns nil, the message is acknowledged. If an error
 		// is returned, it's considered a fatal error and the client terminates.
@@ -148,168 +871,1326 @@ func NewConsumer(ctx context.Context, cfg ConsumerConfig) (*Consumer, error) {
 			cfg.Logger.Error("handling nacked message",
 				zap.Int("partition", partition),
 				zap.Int64("offset", offset),
-				zap.Any("attributes", msg.Attributes),
+				zap.Any("attributes", loadConfig(&c.live).redact.attributes(msg.Attributes)),
 			)
 			return nil // nil is returned to avoid terminating the subscriber.
 		},
 	}
-	consumers := make([]*consumer, 0, len(cfg.Topics))
-	cfg.Logger = cfg.Logger.Named("pubsublite")
+	c.consumers = make([]*consumer[T], 0, len(cfg.Topics))
+	if cfg.LazyConnect {
+		c.pending = append(c.pending, cfg.Topics...)
+		c.connecting.Store(len(c.pending) > 0)
+		return c, nil
+	}
 	for _, topic := range cfg.Topics {
-		subscription := Subscription{
-			Name:    string(topic),
-			Project: cfg.Project,
-			Region:  cfg.Region,
+		consumer, err := c.newConsumer(ctx, topic)
+		if err != nil {
+			return nil, err
 		}
-		client, err := pscompat.NewSubscriberClientWithSettings(
-			ctx, subscription.String(), settings, cfg.ClientOpts...,
+		c.consumers = append(c.consumers, consumer)
+	}
+	return c, nil
+}
+
+// newConsumer creates a consumer for the topic's subscription.
+func (c *TypedConsumer[T]) newConsumer(ctx context.Context, topic apmqueue.Topic) (*consumer[T], error) {
+	subscription := Subscription{
+		Name:    string(topic),
+		Project: c.cfg.Project,
+		Region:  c.cfg.Region,
+	}
+	if c.cfg.CreateMissingSubscriptions {
+		if err := c.ensureSubscription(ctx, subscription); err != nil {
+			return nil, err
+		}
+	}
+	// The reassignment handler is only called once the client receives,
+	// after the consumer has been created.
+	var sub *consumer[T]
+	settings := c.settings
+	settings.ReassignmentHandler = func(previous, next []int) error {
+		sub.reassigned(previous, next)
+		return nil
+	}
+	nack := settings.NackHandler
+	settings.NackHandler = func(msg *pubsub.Message) error {
+		if _, ok := sub.cancelNacks.LoadAndDelete(msg.ID); ok {
+			return errNackedOnCancel
+		}
+		return nack(msg)
+	}
+	conns := &connTracker{}
+	opts := append(c.cfg.ClientOpts[:len(c.cfg.ClientOpts):len(c.cfg.ClientOpts)],
+		option.WithGRPCDialOption(conns.dialOption()),
+	)
+	client, err := pscompat.NewSubscriberClientWithSettings(
+		ctx, subscription.String(), settings, opts...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("pubsublite: %w: failed creating consumer: %w",
+			apmqueue.ErrInvalidConfig, err,
 		)
-		if err != nil {
-			return nil, fmt.Errorf("pubsublite: failed creating consumer: %w", err)
-		}
-		consumers = append(consumers, &consumer{
-			SubscriberClient: client,
-			delivery:         cfg.Delivery,
-			processor:        cfg.Processor,
-			decoder:          cfg.Decoder,
-			logger: cfg.Logger.With(
-				zap.String("subscription", string(topic)),
-				zap.String("region", cfg.Region),
-				zap.String("project", cfg.Project),
-			),
-			telemetryAttributes: []attribute.KeyValue{
-				semconv.MessagingSourceNameKey.String(string(topic)),
-				semconv.CloudRegion(cfg.Region),
-				semconv.CloudAccountID(cfg.Project),
-			},
-		})
 	}
+	sub = c.subscriber(topic, subscription)
+	sub.SubscriberClient = client
+	sub.conns = conns
+	return sub, nil
+}
 
-	tracerProvider := cfg.TracerProvider
-	if tracerProvider == nil {
-		tracerProvider = otel.GetTracerProvider()
+// subscriber creates the consumer of the topic's subscription, without its
+// subscriber client.
+func (c *TypedConsumer[T]) subscriber(topic apmqueue.Topic, subscription Subscription) *consumer[T] {
+	logger := c.cfg.Logger
+	if l := c.cfg.Loggers[topic]; l != nil {
+		logger = l.Named("pubsublite")
+	}
+	var acks *ackBatcher
+	if c.cfg.AckBatchSize > 1 && c.cfg.Delivery == apmqueue.AtLeastOnceDeliveryType {
+		acks = newAckBatcher(c.cfg.AckBatchSize)
+	}
+	var offsets *lastOffsets
+	if c.cfg.ReportTermination {
+		offsets = newLastOffsets()
+	}
+	var anomalies *offsetAnomalies
+	if c.cfg.DetectOffsetAnomalies {
+		anomalies = newOffsetAnomalies()
 	}
+	return &consumer[T]{
+		topic:              topic,
+		delivery:           c.cfg.Delivery,
+		processor:          c.cfg.Processor,
+		shadowProcessor:    c.cfg.ShadowProcessor,
+		routeAttribute:     c.cfg.RouteAttribute,
+		router:             c.cfg.ProcessorRouter,
+		live:               &c.live,
+		limiter:            c.limiter,
+		subscription:       subscription.String(),
+		decoder:            c.cfg.Decoder,
+		batchDecoder:       c.cfg.BatchDecoder,
+		metrics:            c.metrics,
+		ackDeadline:        c.cfg.AckDeadline,
+		deadlines:          newDeadlineTracker(c.cfg.AckDeadline),
+		pauser:             c.pauser,
+		topicPauser:        newPauser(),
+		throughput:         newThroughput(c.now),
+		acks:               acks,
+		contextDecorator:   c.cfg.ContextDecorator,
+		probe:              c.probe,
+		decodeGuard:        c.decodeGuard,
+		keyLocks:           c.keyLocks,
+		partitionBackoff:   newPartitionBackoff(c.cfg.PartitionBackoff),
+		serializeKey:       c.cfg.SerializeKeyAttribute,
+		auditor:            c.auditor,
+		sampler:            newErrorSampler(c.cfg.LogSampling, c.now),
+		deferredAckTimeout: c.cfg.DeferredAckTimeout,
+		results:            c.cfg.Results,
+		tracer:             c.tracer,
+		lastOffsets:        offsets,
+		anomalies:          anomalies,
+		onEmptyPayload:     c.cfg.OnEmptyPayload,
+		recoveredLog:       c.cfg.RecoveredLog,
+		correlationID:      c.cfg.CorrelationIDAttribute,
+		logTraceContext:    c.cfg.LogTraceContext,
+		acked:              newLastOffsets(),
+		metadataCodec:      c.cfg.MetadataCodec,
+		eventType:          c.cfg.EventTypeAttribute,
+		retryBackoff:       c.cfg.RetryBackoff,
+		requiredAttributes: c.cfg.RequiredAttributes,
+		observer:           newAttributeObserver(c.cfg.ObserveAttributes),
+		pipeline:           c.cfg.Pipeline,
+		decrypter:          c.cfg.Decrypter,
+		logger: logger.With(
+			zap.String("subscription", string(topic)),
+			zap.String("region", c.cfg.Region),
+			zap.String("project", c.cfg.Project),
+		),
+		telemetryAttributes: c.telemetryAttributes(topic),
+	}
+}
 
-	return &Consumer{
-		cfg:       cfg,
-		consumers: consumers,
-		tracer:    tracerProvider.Tracer("pubsublite"),
-	}, nil
+// telemetryAttributes returns the attributes of the metrics and spans of
+// the topic's subscription.
+func (c *TypedConsumer[T]) telemetryAttributes(topic apmqueue.Topic) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		semconv.MessagingSourceNameKey.String(string(topic)),
+		semconv.CloudRegion(c.cfg.Region),
+		semconv.CloudAccountID(c.cfg.Project),
+	}
+	if c.cfg.Version != "" {
+		attrs = append(attrs, semconv.ServiceVersion(c.cfg.Version))
+	}
+	return attrs
 }
 
 // Close closes the consumer. Once the consumer is closed, it can't be re-used.
-func (c *Consumer) Close() error {
+// See ShutdownOrder and ShutdownTimeout for how subscriptions are drained.
+func (c *TypedConsumer[T]) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	var err error
+	if c.group != nil && (len(c.cfg.ShutdownOrder) > 0 || c.cfg.ShutdownTimeout > 0) {
+		err = c.drain()
+	}
 	c.stopSubscriber()
-	return nil
+	if c.throughputCallback != nil {
+		err = errors.Join(err, c.throughputCallback.Unregister())
+	}
+	return err
+}
+
+// drain stops the subscriptions in the configured shutdown order, waiting for
+// each step to be drained before starting the next one. It must be called
+// with c.mu held.
+func (c *TypedConsumer[T]) drain() error {
+	var deadline time.Time
+	if c.cfg.ShutdownTimeout > 0 {
+		deadline = time.Now().Add(c.cfg.ShutdownTimeout)
+	}
+	steps := c.shutdownSteps()
+	var errs []error
+	for i, step := range steps {
+		ctx := context.Background()
+		cancel := func() {}
+		if !deadline.IsZero() {
+			budget := time.Until(deadline) / time.Duration(len(steps)-i)
+			ctx, cancel = context.WithTimeout(ctx, budget)
+		}
+		for _, consumer := range step {
+			consumer.stop()
+		}
+		for _, consumer := range step {
+			select {
+			case <-consumer.done:
+			case <-ctx.Done():
+				// Subscriptions drained by the deadline aren't timed out.
+				select {
+				case <-consumer.done:
+				default:
+					errs = append(errs, fmt.Errorf(
+						"pubsublite: timed out draining subscription %s", consumer.topic,
+					))
+				}
+			}
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// shutdownSteps groups the running subscriptions into the steps in which
+// they're stopped: one step for each subscription in the ShutdownOrder,
+// followed by a step for all the remaining subscriptions. It must be called
+// with c.mu held.
+func (c *TypedConsumer[T]) shutdownSteps() [][]*consumer[T] {
+	remaining := append([]*consumer[T](nil), c.consumers...)
+	steps := make([][]*consumer[T], 0, len(c.cfg.ShutdownOrder)+1)
+	for _, topic := range c.cfg.ShutdownOrder {
+		for i, sub := range remaining {
+			if sub.topic == topic {
+				steps = append(steps, []*consumer[T]{sub})
+				remaining = append(remaining[:i:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(remaining) > 0 {
+		steps = append(steps, remaining)
+	}
+	return steps
 }
 
 // Run executes the consumer in a blocking manner. It should only be called once,
-// any subsequent calls will return an error.
-func (c *Consumer) Run(ctx context.Context) error {
+// any subsequent calls will return an error wrapping apmqueue.ErrAlreadyStarted.
+func (c *TypedConsumer[T]) Run(ctx context.Context) (err error) {
 	c.mu.Lock()
 	if c.stopSubscriber != nil {
 		c.mu.Unlock()
-		return errors.New("pubsublite: consumer already started")
+		return fmt.Errorf("pubsublite: %w", apmqueue.ErrAlreadyStarted)
+	}
+	defer func() { c.runDone.finish(err) }()
+	if c.cfg.OnStart != nil {
+		if err := c.cfg.OnStart(ctx); err != nil {
+			c.mu.Unlock()
+			return fmt.Errorf("pubsublite: start hook failed: %w", err)
+		}
+	}
+	if c.cfg.OnStop != nil {
+		stopCtx := queuecontext.DetachedContext(ctx)
+		defer func() {
+			if stopErr := c.cfg.OnStop(stopCtx); stopErr != nil {
+				err = errors.Join(err, fmt.Errorf("pubsublite: stop hook failed: %w", stopErr))
+			}
+		}()
 	}
 	ctx, c.stopSubscriber = context.WithCancel(ctx)
-	c.mu.Unlock()
-
+	if c.cfg.MaxRuntime > 0 {
+		runtimeCtx, stop := context.WithCancelCause(ctx)
+		ctx = runtimeCtx
+		timer := time.AfterFunc(c.cfg.MaxRuntime, func() { stop(errMaxRuntime) })
+		defer timer.Stop()
+		defer stop(nil)
+		defer func() {
+			if errors.Is(context.Cause(runtimeCtx), errMaxRuntime) {
+				c.cfg.Logger.Info("stopping consumer: max runtime reached",
+					zap.Duration("max_runtime", c.cfg.MaxRuntime),
+				)
+			}
+		}()
+	}
+	if c.probe != nil {
+		ctx, c.probe.abort = context.WithCancelCause(ctx)
+	}
+	if c.decodeGuard != nil {
+		ctx, c.decodeGuard.abort = context.WithCancelCause(ctx)
+	}
 	g, ctx := errgroup.WithContext(ctx)
+	c.group, c.runCtx = g, ctx
+	// Keep the group running until ctx is done, even if all the subscriptions
+	// are removed, so new subscriptions can still be added. The lock ensures
+	// AddSubscription can't start a subscription after ctx is done.
+	g.Go(func() error {
+		<-ctx.Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil
+	})
+	// The schedule is checked even when unset, since it may be set with
+	// Reconfigure.
+	g.Go(func() error {
+		ticker := time.NewTicker(maintenanceCheckInterval)
+		defer ticker.Stop()
+		for {
+			c.checkMaintenance()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+	if c.reorder != nil {
+		g.Go(func() error {
+			c.reorder.run(ctx)
+			return nil
+		})
+	}
+	if c.auditor != nil {
+		g.Go(func() error {
+			c.auditor.run(ctx)
+			return nil
+		})
+	}
+	c.logTopology()
 	for _, consumer := range c.consumers {
-		consumer := consumer
+		c.start(consumer)
+	}
+	if len(c.pending) > 0 {
 		g.Go(func() error {
+			c.connect(ctx)
+			return nil
+		})
+	}
+	c.mu.Unlock()
+
+	err = g.Wait()
+	if c.probe != nil {
+		if probeErr := c.probe.failed(); probeErr != nil {
+			return probeErr
+		}
+	}
+	if c.decodeGuard != nil {
+		if guardErr := c.decodeGuard.failed(); guardErr != nil {
+			c.cfg.Logger.Error("stopping consumer: decode failure rate exceeded", zap.Error(guardErr))
+			return guardErr
+		}
+	}
+	return err
+}
+
+// start starts receiving messages for the consumer in the running group.
+// It must be called with c.mu held.
+func (c *TypedConsumer[T]) start(consumer *consumer[T]) {
+	ctx, cancel := context.WithCancel(c.runCtx)
+	consumer.stop = cancel
+	consumer.done = make(chan struct{})
+	wg := &consumer.wg
+	if consumer.acks != nil {
+		wg.Add(1)
+		c.group.Go(func() error {
+			defer wg.Done()
+			// Pending acks are flushed after ctx is done, since Receive
+			// doesn't return until all messages have been acknowledged.
+			ticker := time.NewTicker(c.cfg.AckBatchInterval)
+			defer ticker.Stop()
 			for {
-				err := consumer.Receive(ctx, telemetry.Consumer(
-					c.tracer,
-					consumer.processMessage,
-					consumer.telemetryAttributes,
-				))
-				// Keep attempting to receive until a fatal error is received.
-				if errors.Is(err, pscompat.ErrBackendUnavailable) {
-					continue
+				select {
+				case <-ctx.Done():
+					consumer.flushAcks(context.Background())
+					return nil
+				case <-ticker.C:
+					consumer.flushAcks(ctx)
 				}
-				return err
 			}
 		})
 	}
-	return g.Wait()
+	handler := consumer.processMessage
+	if c.reorder != nil {
+		handler = func(ctx context.Context, msg *pubsub.Message) {
+			c.reorder.push(ctx, consumer, msg)
+		}
+	}
+	if consumer.lastOffsets != nil {
+		next := handler
+		handler = func(ctx context.Context, msg *pubsub.Message) {
+			consumer.lastOffsets.record(msg.ID)
+			next(ctx, msg)
+		}
+	}
+	if consumer.anomalies != nil {
+		next := handler
+		handler = func(ctx context.Context, msg *pubsub.Message) {
+			consumer.checkOffset(ctx, msg)
+			next(ctx, msg)
+		}
+	}
+	if consumer.conns != nil {
+		consumer.conns.started.Store(true)
+	}
+	wg.Add(1)
+	c.group.Go(func() error {
+		defer wg.Done()
+		for {
+			err := consumer.Receive(ctx, telemetry.Consumer(
+				c.tracer,
+				"pubsublite",
+				handler,
+				consumer.spanAttributes(),
+			))
+			// The subscriber is terminated once ctx is done by the messages
+			// nacked because they were cancelled, see cancelled.
+			if errors.Is(err, errNackedOnCancel) {
+				return nil
+			}
+			// Keep attempting to receive until a fatal error is received.
+			if errors.Is(err, pscompat.ErrBackendUnavailable) {
+				if consumer.anomalies != nil {
+					consumer.anomalies.reset()
+				}
+				continue
+			}
+			if err != nil {
+				err = subscriptionError(consumer.subscription, err)
+				consumer.terminated(err)
+			}
+			return err
+		}
+	})
+	go func() {
+		wg.Wait()
+		close(consumer.done)
+	}()
+}
+
+// AddSubscription starts consuming from the topic's subscription. If the
+// consumer is running, the subscription is started immediately, otherwise it
+// is started when Run is called. The subscription must already exist.
+func (c *TypedConsumer[T]) AddSubscription(ctx context.Context, topic apmqueue.Topic) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, consumer := range c.consumers {
+		if consumer.topic == topic {
+			return fmt.Errorf("pubsublite: already subscribed to %s", topic)
+		}
+	}
+	for _, pending := range c.pending {
+		if pending == topic {
+			return fmt.Errorf("pubsublite: already subscribed to %s", topic)
+		}
+	}
+	if c.runCtx != nil && c.runCtx.Err() != nil {
+		return fmt.Errorf("pubsublite: %w", apmqueue.ErrConsumerClosed)
+	}
+	consumer, err := c.newConsumer(ctx, topic)
+	if err != nil {
+		return err
+	}
+	c.consumers = append(c.consumers, consumer)
+	if c.group != nil {
+		c.start(consumer)
+	}
+	return nil
+}
+
+// RemoveSubscription stops consuming from the topic's subscription. If the
+// consumer is running, it blocks until all the in-flight messages for the
+// subscription have been processed and acknowledged. The consumer keeps
+// running even after all its subscriptions are removed.
+func (c *TypedConsumer[T]) RemoveSubscription(topic apmqueue.Topic) error {
+	c.mu.Lock()
+	var removed *consumer[T]
+	for i, consumer := range c.consumers {
+		if consumer.topic == topic {
+			removed = consumer
+			c.consumers = append(c.consumers[:i:i], c.consumers[i+1:]...)
+			break
+		}
+	}
+	for i, pending := range c.pending {
+		if pending == topic {
+			c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+			if len(c.pending) == 0 {
+				c.connecting.Store(false)
+			}
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	c.mu.Unlock()
+	if removed == nil {
+		return fmt.Errorf("pubsublite: not subscribed to %s", topic)
+	}
+	if removed.stop != nil {
+		removed.stop()
+		<-removed.done
+	}
+	return nil
+}
+
+// Done returns a channel which is closed once Run returns, allowing the
+// termination of the consumer to be awaited alongside other events.
+func (c *TypedConsumer[T]) Done() <-chan struct{} {
+	return c.runDone.done()
+}
+
+// Err returns nil until Done is closed, and the error returned by Run
+// afterwards.
+func (c *TypedConsumer[T]) Err() error {
+	return c.runDone.error()
+}
+
+// Healthy returns an error if the consumer isn't healthy, including when any
+// subscriber client has lost its connections. See ConnectionState.
+func (c *TypedConsumer[T]) Healthy(ctx context.Context) error {
+	if c.connecting.Load() {
+		return fmt.Errorf("pubsublite: %w: consumer connecting", apmqueue.ErrBackendUnavailable)
+	}
+	for _, reason := range c.pauser.pausedBy() {
+		if reason == pauseReasonMaintenance {
+			return errors.New("pubsublite: consumer paused for maintenance")
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.disconnected()
+}
+
+// LastOffset returns the offset of the highest message acknowledged by the
+// consumer for the partition of the topic's subscription. It returns false
+// if no message of the partition has been acknowledged yet, or if the
+// consumer isn't subscribed to the topic.
+func (c *TypedConsumer[T]) LastOffset(topic apmqueue.Topic, partition int) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, consumer := range c.consumers {
+		if consumer.topic == topic {
+			return consumer.acked.get(partition)
+		}
+	}
+	return 0, false
+}
+
+// SubscriberClient returns the underlying pscompat.SubscriberClient of the
+// topic's subscription, for advanced uses of the pscompat API which aren't
+// surfaced by the consumer. It returns false if the consumer isn't subscribed
+// to the topic, or if the subscription hasn't been connected yet when
+// LazyConnect is set.
+//
+// The client is owned by the consumer: it's used by Run to receive messages
+// and must not be used to call Receive, nor be used after the subscription
+// has been removed or the consumer closed. Its methods may be called
+// concurrently with Run.
+func (c *TypedConsumer[T]) SubscriberClient(topic apmqueue.Topic) (*pscompat.SubscriberClient, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, consumer := range c.consumers {
+		if consumer.topic == topic {
+			return consumer.SubscriberClient, consumer.SubscriberClient != nil
+		}
+	}
+	return nil, false
+}
+
+// EffectiveConfig returns the configuration the consumer is running with,
+// once the defaults have been applied, reflecting the settings changed with
+// Reconfigure and the subscriptions added or removed since it was created.
+// The ClientOpts are omitted, since they may hold credentials. The
+// Decoder, BatchDecoder, Processor, ShadowProcessor and ProcessorRouter are
+// unset for consumers created with NewTypedConsumer, whose typed
+// equivalents can't be represented in a ConsumerConfig.
+func (c *TypedConsumer[T]) EffectiveConfig() ConsumerConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg := c.cfg.ConsumerConfig
+	cfg.ClientOpts = nil
+	cfg.Topics = c.topics()
+	partial := loadConfig(&c.live).partial
+	cfg.MaintenanceSchedule = partial.MaintenanceSchedule
+	cfg.SupportedSchemaVersions = partial.SupportedSchemaVersions
+	cfg.OnContextCancel = partial.OnContextCancel
+	cfg.RedactAttributes = partial.RedactAttributes
+	cfg.RateLimit = partial.RateLimit
+	cfg.MaxConcurrency = partial.MaxConcurrency
+	cfg.MaxAttempts = partial.MaxAttempts
+	cfg.Filter = partial.Filter
+	return cfg
+}
+
+// topics returns the topics of the subscriptions, including the pending
+// ones. It must be called with c.mu held.
+func (c *TypedConsumer[T]) topics() []apmqueue.Topic {
+	topics := make([]apmqueue.Topic, 0, len(c.consumers)+len(c.pending))
+	for _, consumer := range c.consumers {
+		topics = append(topics, consumer.topic)
+	}
+	return append(topics, c.pending...)
+}
+
+// Pause stops processing messages until Resume is called. Messages which are
+// received while paused are left unacknowledged until processing resumes.
+func (c *TypedConsumer[T]) Pause() {
+	c.pauser.pause(pauseReasonManual)
 }
 
-// Healthy returns an error if the consumer isn't healthy.
-func (c *Consumer) Healthy(ctx context.Context) error {
-	return nil // TODO(marclop)
+// Resume resumes processing messages after Pause has been called. If the
+// consumer is in a maintenance window, processing resumes after it ends.
+func (c *TypedConsumer[T]) Resume() {
+	c.pauser.resume(pauseReasonManual)
+}
+
+// PauseTopic stops processing the messages of the topic's subscription until
+// ResumeTopic is called, leaving the other subscriptions running. Like Pause,
+// messages received while paused are left unacknowledged until processing
+// resumes, and the consumer remains healthy. It returns an error if the
+// consumer isn't subscribed to the topic, or the subscription isn't connected
+// yet.
+func (c *TypedConsumer[T]) PauseTopic(topic apmqueue.Topic) error {
+	consumer, err := c.subscribed(topic)
+	if err != nil {
+		return err
+	}
+	consumer.topicPauser.pause(pauseReasonManual)
+	return nil
+}
+
+// ResumeTopic resumes processing the messages of the topic's subscription
+// after PauseTopic has been called. Processing remains paused while the
+// consumer is paused with Pause or in a maintenance window.
+func (c *TypedConsumer[T]) ResumeTopic(topic apmqueue.Topic) error {
+	consumer, err := c.subscribed(topic)
+	if err != nil {
+		return err
+	}
+	consumer.topicPauser.resume(pauseReasonManual)
+	return nil
+}
+
+// PausedTopics returns the topics whose subscriptions are paused with
+// PauseTopic.
+func (c *TypedConsumer[T]) PausedTopics() []apmqueue.Topic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var paused []apmqueue.Topic
+	for _, consumer := range c.consumers {
+		if len(consumer.topicPauser.pausedBy()) > 0 {
+			paused = append(paused, consumer.topic)
+		}
+	}
+	return paused
+}
+
+// subscribed returns the connected consumer of the topic's subscription.
+func (c *TypedConsumer[T]) subscribed(topic apmqueue.Topic) (*consumer[T], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, consumer := range c.consumers {
+		if consumer.topic == topic {
+			return consumer, nil
+		}
+	}
+	return nil, fmt.Errorf("pubsublite: not subscribed to %s", topic)
+}
+
+// checkMaintenance pauses or resumes processing depending on whether the
+// current time is within a maintenance window.
+func (c *TypedConsumer[T]) checkMaintenance() {
+	schedule := loadConfig(&c.live).maintenance
+	if schedule != nil && schedule.InMaintenance(c.now()) {
+		c.pauser.pause(pauseReasonMaintenance)
+		return
+	}
+	c.pauser.resume(pauseReasonMaintenance)
 }
 
 // consumer wraps a PubSub Lite SubscriberClient.
-type consumer struct {
+type consumer[T any] struct {
 	*pscompat.SubscriberClient
-	logger              *zap.Logger
-	delivery            apmqueue.DeliveryType
-	processor           model.BatchProcessor
-	decoder             Decoder
+	topic apmqueue.Topic
+	stop  context.CancelFunc
+	done  chan struct{}
+	// wg tracks the goroutines of the subscription, it gates done.
+	wg sync.WaitGroup
+	// settling counts the goroutines which settle messages after their
+	// receive callback has returned, see goSettle.
+	settling atomic.Int64
+	// held holds the messages left unacknowledged by LeaveUnackedOnCancel
+	// until the settling goroutines have returned.
+	heldMu sync.Mutex
+	held   []*pubsub.Message
+	// cancelNacks holds the IDs of the messages nacked because they were
+	// cancelled, for which the nack handler terminates the subscriber.
+	cancelNacks sync.Map
+	logger      *zap.Logger
+	delivery    apmqueue.DeliveryType
+	processor   TypedProcessor[T]
+	decoder     TypedDecoder[T]
+	// batchDecoder is nil unless a BatchDecoder is configured, in which
+	// case it's used instead of decoder.
+	batchDecoder        TypedBatchDecoder[T]
 	telemetryAttributes []attribute.KeyValue
 	failed              sync.Map
+	metrics             consumerMetrics
+	ackDeadline         time.Duration
+	pauser              *pauser
+	// topicPauser gates the processing of the subscription's messages only,
+	// see PauseTopic.
+	topicPauser *pauser
+	throughput  *throughput
+	// conns tracks the connections of the subscriber client.
+	conns            *connTracker
+	acks             *ackBatcher
+	contextDecorator func(context.Context, map[string]string) context.Context
+	probe            *startupProbe
+	decodeGuard      *decodeGuard
+	// auditor is nil unless an AuditSampler is configured.
+	auditor *auditor
+	// sampler samples the error logs, it's nil when sampling is disabled.
+	sampler            *errorSampler
+	deferredAckTimeout time.Duration
+	results            chan<- ProcessResult
+	// observe, when set, is called synchronously with every result, it's
+	// used by ProcessMessages.
+	observe func(ProcessResult)
+	tracer  trace.Tracer
+	// lastOffsets is nil unless ReportTermination is enabled.
+	lastOffsets *lastOffsets
+	// anomalies is nil unless DetectOffsetAnomalies is enabled.
+	anomalies      *offsetAnomalies
+	onEmptyPayload EmptyPayloadPolicy
+	recoveredLog   RecoveredLogPolicy
+	// keyLocks is shared by the consumers of a TypedConsumer, it's nil
+	// unless SerializeKeyAttribute is set.
+	keyLocks *keyedMutex
+	// partitionBackoff is nil unless PartitionBackoff is configured.
+	partitionBackoff *partitionBackoff
+	serializeKey     string
+	correlationID    string
+	logTraceContext  bool
+	// acked holds the offset of the last acknowledged message of each
+	// partition.
+	acked         *lastOffsets
+	metadataCodec queuecontext.MetadataCodec
+	eventType     bool
+	// shadowProcessor is nil unless a ShadowProcessor is configured.
+	shadowProcessor TypedProcessor[T]
+	// router is nil unless a ProcessorRouter is configured.
+	router         map[string]TypedProcessor[T]
+	routeAttribute string
+	// live holds the settings which can be changed with Reconfigure.
+	live *atomic.Pointer[liveConfig]
+	// limiter is shared by the consumers of a TypedConsumer, it's nil in
+	// tests.
+	limiter *limiter
+	// subscription is the full path of the subscription.
+	subscription string
+	retryBackoff RetryBackoff
+	// requiredAttributes holds the attributes counted when missing.
+	requiredAttributes []string
+	// observer is nil unless ObserveAttributes is configured.
+	observer *attributeObserver
+	// deadlines is nil unless AckDeadline is configured.
+	deadlines *deadlineTracker
+	pipeline  Pipeline
+	decrypter Decrypter
+}
+
+// subscriptionKey is the span attribute key holding the full subscription
+// path, i.e. projects/<project>/locations/<region>/subscriptions/<name>.
+const subscriptionKey = attribute.Key("messaging.destination.subscription.name")
+
+// spanAttributes returns the attributes of the processing spans, which
+// include the full subscription path on top of the telemetry attributes.
+// Unlike the telemetry attributes, they aren't used as metric attributes.
+func (c *consumer[T]) spanAttributes() []attribute.KeyValue {
+	attrs := append([]attribute.KeyValue(nil), c.telemetryAttributes...)
+	return append(attrs, subscriptionKey.String(c.subscription))
 }
 
-func (c *consumer) processMessage(ctx context.Context, msg *pubsub.Message) {
-	var event model.APMEvent
-	if err := c.decoder.Decode(msg.Data, &event); err != nil {
+// messageLogger returns the logger of the message, which includes its
+// correlation ID and the trace context of its processing span, if enabled.
+func (c *consumer[T]) messageLogger(ctx context.Context, msg *pubsub.Message) *zap.Logger {
+	var fields []zap.Field
+	if c.correlationID != "" {
+		if id, ok := msg.Attributes[c.correlationID]; ok {
+			fields = append(fields, zap.String("correlation_id", id))
+		}
+	}
+	if c.logTraceContext {
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			fields = append(fields,
+				zap.String("trace_id", sc.TraceID().String()),
+				zap.String("span_id", sc.SpanID().String()),
+			)
+		}
+	}
+	if len(fields) == 0 {
+		return c.logger
+	}
+	return c.logger.With(fields...)
+}
+
+// startSpan starts a span for handling the message once the receive callback,
+// whose span has ended, has returned. Like the receive span, its parent is
+// the trace context propagated in the message attributes, and it's linked to
+// the receive span. The returned context keeps the cancellation of ctx, but
+// none of the receive span.
+func (c *consumer[T]) startSpan(ctx context.Context, msg *pubsub.Message, name string) (context.Context, trace.Span) {
+	link := trace.LinkFromContext(ctx)
+	ctx = trace.ContextWithSpanContext(ctx, trace.SpanContext{})
+	if msg.Attributes != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Attributes))
+	}
+	attrs := append(c.spanAttributes(), semconv.MessagingMessageIDKey.String(msg.ID))
+	return c.tracer.Start(ctx, "pubsublite."+name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(link),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func (c *consumer[T]) processMessage(ctx context.Context, msg *pubsub.Message) {
+	c.processReceived(ctx, msg, time.Now())
+}
+
+// processReceived processes the message, which was received at the given
+// time.
+func (c *consumer[T]) processReceived(ctx context.Context, msg *pubsub.Message, received time.Time) {
+	// Label the processing goroutine, and any goroutine it starts, so CPU
+	// profiles and goroutine dumps attribute the work to its subscription.
+	partition, _ := partitionOffset(msg.ID)
+	pprof.Do(ctx, pprof.Labels(
+		"subscription", c.subscription,
+		"partition", strconv.Itoa(partition),
+	), func(ctx context.Context) {
+		c.handleMessage(ctx, msg, received)
+	})
+}
+
+// handleMessage processes the message, once the goroutine has been labelled.
+func (c *consumer[T]) handleMessage(ctx context.Context, msg *pubsub.Message, received time.Time) {
+	if c.correlationID != "" {
+		if id, ok := msg.Attributes[c.correlationID]; ok {
+			trace.SpanFromContext(ctx).SetAttributes(semconv.MessagingMessageConversationID(id))
+		}
+	}
+	if c.auditor != nil {
+		c.auditor.sample(ctx, msg)
+	}
+	if c.probe == nil || !c.probe.acquire() {
+		c.process(ctx, msg, received)
+		return
+	}
+	c.probe.release(c.process(ctx, msg, received))
+}
+
+// process decodes and processes the message received at the given time,
+// acknowledging it according to the delivery type. The decoding or
+// processing error is returned, if any.
+func (c *consumer[T]) process(ctx context.Context, msg *pubsub.Message, received time.Time) (err error) {
+	if err := c.pauser.wait(ctx); err != nil {
+		c.cancelled(ctx, msg, received, err)
+		return nil
+	}
+	if err := c.throttle(ctx, msg); err != nil {
+		c.cancelled(ctx, msg, received, err)
+		return nil
+	}
+	if c.topicPauser != nil {
+		if err := c.topicPauser.wait(ctx); err != nil {
+			c.cancelled(ctx, msg, received, err)
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		c.cancelled(ctx, msg, received, err)
+		return nil
+	}
+	if c.expired(ctx, msg) {
+		c.metrics.expired.Add(ctx, 1, metric.WithAttributes(c.telemetryAttributes...))
+		c.ack(ctx, msg, received)
+		c.result(ctx, msg, received, OutcomeAcked, nil)
+		return nil
+	}
+	if version, ok := c.unsupportedSchema(msg); ok {
+		partition, offset := partitionOffset(msg.ID)
+		c.messageLogger(ctx, msg).Warn("data loss: dropping message with unsupported "+SchemaVersionAttribute,
+			zap.String("schema_version", version),
+			zap.Int64("offset", offset),
+			zap.Int("partition", partition),
+		)
+		c.metrics.unsupported.Add(ctx, 1, metric.WithAttributes(c.telemetryAttributes...))
+		c.ack(ctx, msg, received)
+		c.result(ctx, msg, received, OutcomeAcked, nil)
+		return nil
+	}
+	if filter := loadConfig(c.live).partial.Filter; filter != nil && !filter(msg.Attributes) {
+		c.metrics.filtered.Add(ctx, 1, metric.WithAttributes(c.telemetryAttributes...))
+		c.ack(ctx, msg, received)
+		c.result(ctx, msg, received, OutcomeAcked, nil)
+		return nil
+	}
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		c.cancelled(ctx, msg, received, err)
+		return nil
+	}
+	defer release()
+	c.checkAttributes(ctx, msg)
+	c.observeAttributes(ctx, msg)
+	empty := len(msg.Data) == 0
+	if empty && c.onEmptyPayload == SkipEmptyPayload {
+		c.ack(ctx, msg, received)
+		c.result(ctx, msg, received, OutcomeAcked, nil)
+		return nil
+	}
+	data, err := c.decrypt(ctx, msg.Data, msg.Attributes)
+	if err != nil {
 		defer msg.Nack()
 		partition, offset := partitionOffset(msg.ID)
-		c.logger.Error("unable to decode message.Data into model.APMEvent",
-			zap.Error(err),
+		c.sampler.error(c.messageLogger(ctx, msg), "unable to decrypt message.Data", err,
+			zap.Int64("offset", offset),
+			zap.Int("partition", partition),
+			zap.Any("headers", loadConfig(c.live).redact.attributes(msg.Attributes)),
+		)
+		c.result(ctx, msg, received, OutcomeNacked, err)
+		return err
+	}
+	data, err = c.transform(ctx, data, msg.Attributes)
+	var events []T
+	switch {
+	case err != nil:
+	case empty && c.onEmptyPayload == ProcessEmptyPayload:
+		events = make([]T, 1)
+	default:
+		events, err = c.decode(data)
+	}
+	if c.decodeGuard != nil {
+		c.decodeGuard.record(c.topic, err != nil)
+	}
+	if err != nil {
+		defer msg.Nack()
+		partition, offset := partitionOffset(msg.ID)
+		c.sampler.error(c.messageLogger(ctx, msg), "unable to decode message.Data", err,
 			zap.ByteString("message.value", msg.Data),
 			zap.Int64("offset", offset),
 			zap.Int("partition", partition),
-			zap.Any("headers", msg.Attributes),
+			zap.Any("headers", loadConfig(c.live).redact.attributes(msg.Attributes)),
 		)
-		return
+		c.result(ctx, msg, received, OutcomeNacked, err)
+		return err
+	}
+	var structured queuecontext.Metadata
+	if c.metadataCodec != nil {
+		if structured, err = c.metadataCodec.DecodeMetadata(msg.Attributes); err != nil {
+			defer msg.Nack()
+			partition, offset := partitionOffset(msg.ID)
+			c.sampler.error(c.messageLogger(ctx, msg), "unable to decode message.Attributes into metadata", err,
+				zap.Int64("offset", offset),
+				zap.Int("partition", partition),
+				zap.Any("headers", loadConfig(c.live).redact.attributes(msg.Attributes)),
+			)
+			c.result(ctx, msg, received, OutcomeNacked, err)
+			return err
+		}
+	}
+	if published := OriginalPublishTime(msg); !published.IsZero() {
+		c.metrics.deliveryLag.Record(ctx, received.Sub(published).Seconds(),
+			metric.WithAttributes(c.telemetryAttributes...),
+		)
+	}
+	ctx = queuecontext.WithMetadata(ctx, withOriginalPublishTime(msg))
+	if structured != nil {
+		ctx = queuecontext.WithStructuredMetadata(ctx, structured)
+	}
+	if c.contextDecorator != nil {
+		ctx = c.contextDecorator(ctx, msg.Attributes)
 	}
-	batch := model.Batch{event}
-	ctx = queuecontext.WithMetadata(ctx, msg.Attributes)
-	var err error
 	switch c.delivery {
 	case apmqueue.AtMostOnceDeliveryType:
-		msg.Ack()
+		c.ack(ctx, msg, received)
+		defer func() { c.result(ctx, msg, received, OutcomeAcked, err) }()
 	case apmqueue.AtLeastOnceDeliveryType:
+		deferred := newDeferredAck()
+		ctx = context.WithValue(ctx, deferredAckKey{}, deferred)
 		defer func() {
-			// If processing fails, the message will not be Nacked until the 3rd
-			// delivery, otherwise, ack the message.
-			if err != nil {
-				attempt := int(1)
-				if a, ok := c.failed.LoadOrStore(msg.ID, attempt); ok {
-					attempt += a.(int)
-				}
-				if attempt > 2 {
-					msg.Nack()
-					c.failed.Delete(msg.ID)
-					return
-				}
-				c.failed.Store(msg.ID, attempt)
+			if err == nil && deferred.deferred.Load() {
+				c.goSettle(func() { c.awaitDeferredAck(ctx, msg, received, deferred) })
 				return
 			}
-			partition, offset := partitionOffset(msg.ID)
-			c.logger.Info("processed previously failed event",
-				zap.Int64("offset", offset),
-				zap.Int("partition", partition),
-				zap.Any("headers", msg.Attributes),
-			)
-			msg.Ack()
+			if err != nil && ctx.Err() != nil {
+				// The failure may be caused by the cancellation, so it
+				// doesn't count as a processing attempt.
+				c.cancelled(ctx, msg, received, ctx.Err())
+				return
+			}
+			c.settle(ctx, msg, received, err)
+		}()
+	}
+	unlock, err := c.serialize(ctx, msg)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = c.processEvent(ctx, msg, events)
+	if c.partitionBackoff != nil && ctx.Err() == nil {
+		partition, _ := partitionOffset(msg.ID)
+		c.partitionBackoff.record(partition, err)
+	}
+	if errors.Is(err, apmqueue.ErrAlreadyProcessed) {
+		// Duplicates are acknowledged as successfully processed.
+		c.metrics.duplicate.Add(ctx, 1, metric.WithAttributes(c.telemetryAttributes...))
+		return nil
+	}
+	if err != nil {
+		partition, offset := partitionOffset(msg.ID)
+		c.sampler.error(c.messageLogger(ctx, msg), "unable to process event", err,
+			zap.Int64("offset", offset),
+			zap.Int("partition", partition),
+			zap.Any("headers", loadConfig(c.live).redact.attributes(msg.Attributes)),
+		)
+		return err
+	}
+	return nil
+}
+
+// checkAttributes counts the required attributes missing from the message.
+func (c *consumer[T]) checkAttributes(ctx context.Context, msg *pubsub.Message) {
+	for _, key := range c.requiredAttributes {
+		if _, ok := msg.Attributes[key]; ok {
+			continue
+		}
+		c.metrics.missingAttribute.Add(ctx, 1, metric.WithAttributes(append(
+			[]attribute.KeyValue{attribute.String("attribute", key)},
+			c.telemetryAttributes...,
+		)...))
+	}
+}
+
+// settle acknowledges the message if it was processed successfully. If
+// processing failed, the message will not be Nacked until MaxAttempts
+// attempts have failed.
+// The deliveries are counted across reconnects, as long as the partition
+// remains assigned to the subscriber, see reassigned.
+// When a RetryBackoff is configured, failed messages are reprocessed once
+// the backoff delay has elapsed.
+func (c *consumer[T]) settle(ctx context.Context, msg *pubsub.Message, received time.Time, err error) {
+	if err != nil {
+		attempt := int(1)
+		if a, ok := c.failed.LoadOrStore(msg.ID, attempt); ok {
+			attempt += a.(int)
+		}
+		if attempt >= loadConfig(c.live).maxAttempts() {
+			msg.Nack()
 			c.failed.Delete(msg.ID)
+			c.result(ctx, msg, received, OutcomeNacked, err)
+			return
+		}
+		c.failed.Store(msg.ID, attempt)
+		delay := c.retryBackoff.Delay(attempt)
+		c.report(ctx, msg, received, ProcessResult{
+			Outcome: OutcomeRetried, Err: err, RetryDelay: delay,
+		})
+		if delay > 0 {
+			c.goSettle(func() { c.retry(ctx, msg, delay) })
+		}
+		return
+	}
+	if c.recoveredLog != NoRecoveredLog {
+		level := zapcore.InfoLevel
+		if c.recoveredLog == DebugRecoveredLog {
+			level = zapcore.DebugLevel
+		}
+		partition, offset := partitionOffset(msg.ID)
+		c.messageLogger(ctx, msg).Log(level, "processed previously failed event",
+			zap.Int64("offset", offset),
+			zap.Int("partition", partition),
+			zap.Any("headers", loadConfig(c.live).redact.attributes(msg.Attributes)),
+		)
+	}
+	c.ack(ctx, msg, received)
+	attempt := int64(1)
+	if failures, ok := c.failed.LoadAndDelete(msg.ID); ok {
+		attempt += int64(failures.(int))
+		c.metrics.recovered.Add(ctx, 1, metric.WithAttributes(c.telemetryAttributes...))
+	}
+	c.metrics.attempts.Record(ctx, attempt, metric.WithAttributes(c.telemetryAttributes...))
+	c.result(ctx, msg, received, OutcomeAcked, nil)
+}
+
+// cancelled handles a message whose processing was interrupted by the context
+// being cancelled, according to the OnContextCancel policy. The message is
+// eventually nacked with nackCancelled, which terminates the subscriber,
+// since Receive doesn't return while a message is left unacknowledged.
+func (c *consumer[T]) cancelled(ctx context.Context, msg *pubsub.Message, received time.Time, err error) {
+	if loadConfig(c.live).partial.OnContextCancel == NackOnCancel {
+		c.nackCancelled(msg)
+	} else {
+		c.heldMu.Lock()
+		c.held = append(c.held, msg)
+		c.heldMu.Unlock()
+		if c.settling.Load() == 0 {
+			c.releaseHeld()
+		}
+	}
+	c.result(ctx, msg, received, OutcomeRetried, err)
+}
+
+// releaseHeld nacks the messages held by LeaveUnackedOnCancel.
+func (c *consumer[T]) releaseHeld() {
+	c.heldMu.Lock()
+	held := c.held
+	c.held = nil
+	c.heldMu.Unlock()
+	for _, msg := range held {
+		c.nackCancelled(msg)
+	}
+}
+
+// nackCancelled nacks the cancelled message, for which the nack handler
+// returns errNackedOnCancel.
+func (c *consumer[T]) nackCancelled(msg *pubsub.Message) {
+	c.cancelNacks.Store(msg.ID, struct{}{})
+	msg.Nack()
+}
+
+// goSettle runs settle, which settles a message after its receive callback
+// has returned, in a goroutine tracked by the subscription's WaitGroup, so
+// the subscription isn't done before the message is settled. The messages
+// held by LeaveUnackedOnCancel are released once no such goroutine is left.
+func (c *consumer[T]) goSettle(settle func()) {
+	c.wg.Add(1)
+	c.settling.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() {
+			if c.settling.Add(-1) == 0 {
+				c.releaseHeld()
+			}
 		}()
+		settle()
+	}()
+}
+
+// awaitDeferredAck settles the message once its deferred acknowledgement is
+// settled or times out. It runs after the receive callback has returned, so
+// the message is settled with a context detached from the callback, which
+// may be cancelled by then, in a new span. The message is always acked or
+// nacked: failures which happen once ctx is done are handled as
+// cancellations, like in process, which nacks them to be redelivered.
+func (c *consumer[T]) awaitDeferredAck(ctx context.Context, msg *pubsub.Message, received time.Time, d *deferredAck) {
+	parent := ctx
+	ctx, span := c.startSpan(queuecontext.DetachedContext(ctx), msg, "DeferredAck")
+	defer span.End()
+	err := d.wait(c.deferredAckTimeout)
+	if err != nil && parent.Err() != nil {
+		c.cancelled(ctx, msg, received, parent.Err())
+		return
 	}
-	if err = c.processor.ProcessBatch(ctx, &batch); err != nil {
+	if err != nil {
 		partition, offset := partitionOffset(msg.ID)
-		c.logger.Error("unable to process event",
+		c.sampler.error(c.messageLogger(ctx, msg), "deferred ack failed", err,
+			zap.Int64("offset", offset),
+			zap.Int("partition", partition),
+			zap.Any("headers", loadConfig(c.live).redact.attributes(msg.Attributes)),
+		)
+	}
+	c.settle(ctx, msg, received, err)
+}
+
+// processEvent calls the processor, recovering from any panics. A recovered
+// panic is recorded in the active span and the consumer.processor.panics
+// metric, and returned as an error.
+func (c *consumer[T]) processEvent(ctx context.Context, msg *pubsub.Message, events []T) (err error) {
+	if c.shadowProcessor != nil {
+		// Deferred first, so it's called with any recovered panic error.
+		done := c.shadow(ctx, msg, events)
+		defer func() { done(err) }()
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err = fmt.Errorf("pubsublite: processor panic: %v", r)
+		partition, offset := partitionOffset(msg.ID)
+		c.messageLogger(ctx, msg).Error("recovered processor panic",
+			zap.Any("panic", r),
+			zap.Int64("offset", offset),
+			zap.Int("partition", partition),
+			zap.Stack("stack"),
+		)
+		span := trace.SpanFromContext(ctx)
+		span.AddEvent("panic", trace.WithAttributes(
+			attribute.String("panic.value", fmt.Sprint(r)),
+		))
+		span.SetStatus(codes.Error, err.Error())
+		attrs := append([]attribute.KeyValue{
+			attribute.String("panic.type", panicType(r)),
+		}, c.telemetryAttributes...)
+		c.metrics.panics.Add(ctx, 1, metric.WithAttributes(attrs...))
+	}()
+	attrs := c.telemetryAttributes
+	if e, ok := any(events).([]model.APMEvent); ok && c.eventType {
+		typ := eventTypeKey.String(batchEventType(e))
+		trace.SpanFromContext(ctx).SetAttributes(typ)
+		attrs = append(attrs[:len(attrs):len(attrs)], typ)
+	}
+	defer func(start time.Time) {
+		took := time.Since(start)
+		c.metrics.duration.Record(ctx, took.Seconds(), metric.WithAttributes(attrs...))
+		c.checkDeadline(ctx, took)
+	}(time.Now())
+	return c.route(msg).Process(ctx, events)
+}
+
+// route returns the processor selected for the message by its RouteAttribute,
+// falling back to the default processor.
+func (c *consumer[T]) route(msg *pubsub.Message) TypedProcessor[T] {
+	if value, ok := msg.Attributes[c.routeAttribute]; ok && c.router != nil {
+		if processor, ok := c.router[value]; ok {
+			return processor
+		}
+	}
+	return c.processor
+}
+
+// maxPanicTypeLength bounds the length of the panic.type metric attribute.
+const maxPanicTypeLength = 64
+
+// panicType returns the sanitized type of a recovered panic value. The set of
+// types in a program is bounded, so it's safe to use as a metric attribute,
+// unlike the panic value.
+func panicType(r any) string {
+	typ := fmt.Sprintf("%T", r)
+	if len(typ) > maxPanicTypeLength {
+		typ = typ[:maxPanicTypeLength]
+	}
+	return typ
+}
+
+// dropLate acknowledges a message which arrived too late to be processed in
+// publish time order, without processing it.
+func (c *consumer[T]) dropLate(ctx context.Context, msg *pubsub.Message) {
+	partition, offset := partitionOffset(msg.ID)
+	c.messageLogger(ctx, msg).Warn("data loss: dropping message published before already processed messages",
+		zap.Int64("offset", offset),
+		zap.Int("partition", partition),
+		zap.Time("publish_time", msg.PublishTime),
+	)
+	c.metrics.late.Add(ctx, 1, metric.WithAttributes(c.telemetryAttributes...))
+	received := time.Now()
+	c.ack(ctx, msg, received)
+	c.result(ctx, msg, received, OutcomeAcked, nil)
+}
+
+// expired returns true if the message has an ExpiresAtAttribute in the past.
+// Messages with an invalid ExpiresAtAttribute are never considered expired.
+func (c *consumer[T]) expired(ctx context.Context, msg *pubsub.Message) bool {
+	v, ok := msg.Attributes[ExpiresAtAttribute]
+	if !ok {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		partition, offset := partitionOffset(msg.ID)
+		c.messageLogger(ctx, msg).Warn("ignoring invalid "+ExpiresAtAttribute+" attribute",
 			zap.Error(err),
 			zap.Int64("offset", offset),
 			zap.Int("partition", partition),
-			zap.Any("headers", msg.Attributes),
 		)
+		return false
+	}
+	return time.Now().After(expiresAt)
+}
+
+// unsupportedSchema returns the message SchemaVersionAttribute and true if
+// it isn't one of the SupportedSchemaVersions.
+func (c *consumer[T]) unsupportedSchema(msg *pubsub.Message) (string, bool) {
+	schemaVersions := loadConfig(c.live).schemaVersions
+	if schemaVersions == nil {
+		return "", false
+	}
+	version, ok := msg.Attributes[SchemaVersionAttribute]
+	if !ok {
+		return "", false
+	}
+	_, supported := schemaVersions[version]
+	return version, !supported
+}
+
+// ack acknowledges the message, or adds it to the pending batch when acks are
+// batched.
+func (c *consumer[T]) ack(ctx context.Context, msg *pubsub.Message, received time.Time) {
+	if c.acks == nil {
+		c.ackNow(ctx, msg, received)
 		return
 	}
+	if batch := c.acks.add(msg, received); batch != nil {
+		c.ackBatch(ctx, batch)
+	}
+}
+
+// flushAcks acknowledges all the pending batches.
+func (c *consumer[T]) flushAcks(ctx context.Context) {
+	for _, batch := range c.acks.flush() {
+		c.ackBatch(ctx, batch)
+	}
+}
+
+func (c *consumer[T]) ackBatch(ctx context.Context, batch []pendingAck) {
+	for _, pending := range batch {
+		c.ackNow(ctx, pending.msg, pending.received)
+	}
+	c.metrics.ackBatch.Record(ctx, int64(len(batch)),
+		metric.WithAttributes(c.telemetryAttributes...),
+	)
+}
+
+// ackNow acknowledges the message and records the remaining ack headroom.
+func (c *consumer[T]) ackNow(ctx context.Context, msg *pubsub.Message, received time.Time) {
+	msg.Ack()
+	if c.throughput != nil {
+		c.throughput.add(1)
+	}
+	if c.acked != nil {
+		c.acked.record(msg.ID)
+	}
+	if c.ackDeadline > 0 {
+		headroom := c.ackDeadline - time.Since(received)
+		c.metrics.ackHeadroom.Record(ctx, headroom.Seconds(),
+			metric.WithAttributes(c.telemetryAttributes...),
+		)
+	}
 }
 
 // Parses the message partition and offset. If the metadata can't be parsed,
@@ -19,15 +19,42 @@ package pubsublite
 
 import (
 	"context"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/pubsub"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/option"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queuecontext"
 )
 
 func TestNewConsumer(t *testing.T) {
 	t.Run("empty config", func(t *testing.T) {
 		_, err := NewConsumer(context.Background(), ConsumerConfig{})
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
 	})
 	t.Run("invalid delivery type", func(t *testing.T) {
 		_, err := NewConsumer(context.Background(), ConsumerConfig{
@@ -36,8 +63,1461 @@ func TestNewConsumer(t *testing.T) {
 		assert.Error(t, err)
 		assert.ErrorContains(t, err, "pubsublite: delivery is not valid")
 	})
+	t.Run("incompatible settings", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			cfg ConsumerConfig
+			err string
+		}{
+			"ack batch size": {
+				cfg: ConsumerConfig{Delivery: apmqueue.AtMostOnceDeliveryType, AckBatchSize: 10},
+				err: "pubsublite: ack batch size requires at least once delivery",
+			},
+			"retry backoff": {
+				cfg: ConsumerConfig{Delivery: apmqueue.AtMostOnceDeliveryType, RetryBackoff: RetryBackoff{Initial: time.Second}},
+				err: "pubsublite: retry backoff requires at least once delivery",
+			},
+			"deferred ack timeout": {
+				cfg: ConsumerConfig{Delivery: apmqueue.AtMostOnceDeliveryType, DeferredAckTimeout: time.Second},
+				err: "pubsublite: deferred ack timeout requires at least once delivery",
+			},
+			"recovered log": {
+				cfg: ConsumerConfig{Delivery: apmqueue.AtMostOnceDeliveryType, RecoveredLog: NoRecoveredLog},
+				err: "pubsublite: recovered log policy requires at least once delivery",
+			},
+			"route attribute": {
+				cfg: ConsumerConfig{RouteAttribute: "event.type"},
+				err: "pubsublite: processor router must be set with a route attribute",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := NewConsumer(context.Background(), tc.cfg)
+				assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+				assert.ErrorContains(t, err, tc.err)
+			})
+		}
+		// The same settings are valid with at least once delivery.
+		err := ConsumerConfig{
+			Delivery:           apmqueue.AtLeastOnceDeliveryType,
+			AckBatchSize:       10,
+			RetryBackoff:       RetryBackoff{Initial: time.Second},
+			DeferredAckTimeout: time.Second,
+			RecoveredLog:       NoRecoveredLog,
+		}.Validate()
+		assert.NotContains(t, err.Error(), "requires at least once delivery")
+	})
+	t.Run("typed incompatible settings", func(t *testing.T) {
+		err := TypedConsumerConfig[customEvent]{
+			ConsumerConfig: ConsumerConfig{EventTypeAttribute: true},
+			ProcessorRouter: map[string]TypedProcessor[customEvent]{
+				"span": TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error { return nil }),
+			},
+		}.Validate()
+		assert.ErrorContains(t, err, "pubsublite: event type attribute only applies to model.APMEvent consumers")
+		assert.ErrorContains(t, err, "pubsublite: route attribute must be set with a processor router")
+	})
+	t.Run("typed with untyped fields", func(t *testing.T) {
+		err := TypedConsumerConfig[customEvent]{
+			ConsumerConfig: ConsumerConfig{
+				Decoder:   json.JSON{},
+				Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+			},
+		}.Validate()
+		assert.ErrorContains(t, err, "pubsublite: ConsumerConfig.Decoder is not used by typed consumers, set Decoder instead")
+		assert.ErrorContains(t, err, "pubsublite: ConsumerConfig.Processor is not used by typed consumers, set Processor instead")
+		assert.NotContains(t, err.Error(), "ConsumerConfig.ShadowProcessor")
+	})
+}
+
+func TestConsumerLifecycleErrors(t *testing.T) {
+	t.Run("already started", func(t *testing.T) {
+		c := &TypedConsumer[customEvent]{stopSubscriber: func() {}}
+		assert.ErrorIs(t, c.Run(context.Background()), apmqueue.ErrAlreadyStarted)
+	})
+	t.Run("closed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c := &TypedConsumer[customEvent]{runCtx: ctx}
+		assert.ErrorIs(t, c.AddSubscription(ctx, "topic"), apmqueue.ErrConsumerClosed)
+	})
+}
+
+func TestConsumerDone(t *testing.T) {
+	c := &TypedConsumer[customEvent]{
+		cfg: TypedConsumerConfig[customEvent]{ConsumerConfig: ConsumerConfig{
+			Logger: zap.NewNop(),
+		}},
+		pauser: newPauser(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- c.Run(ctx) }()
+	// Rejected runs don't close the channel.
+	assert.Eventually(t, func() bool {
+		return errors.Is(c.Run(ctx), apmqueue.ErrAlreadyStarted)
+	}, time.Second, time.Millisecond)
+	select {
+	case <-c.Done():
+		t.Fatal("done before Run returned")
+	default:
+	}
+
+	cancel()
+	assert.NoError(t, <-errs)
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not done after Run returned")
+	}
+	assert.NoError(t, c.Err())
+}
+
+func TestConsumerLifecycleHooks(t *testing.T) {
+	t.Run("start and stop", func(t *testing.T) {
+		var calls []string
+		c := &TypedConsumer[customEvent]{
+			cfg: TypedConsumerConfig[customEvent]{ConsumerConfig: ConsumerConfig{
+				Logger: zap.NewNop(),
+				OnStart: func(context.Context) error {
+					calls = append(calls, "start")
+					return nil
+				},
+				OnStop: func(ctx context.Context) error {
+					// The context isn't cancelled with Run's.
+					assert.NoError(t, ctx.Err())
+					calls = append(calls, "stop")
+					return errors.New("snapshot failed")
+				},
+			}},
+			pauser: newPauser(),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() { errs <- c.Run(ctx) }()
+		assert.Eventually(t, func() bool {
+			return errors.Is(c.Run(ctx), apmqueue.ErrAlreadyStarted)
+		}, time.Second, time.Millisecond)
+		cancel()
+		assert.EqualError(t, <-errs, "pubsublite: stop hook failed: snapshot failed")
+		assert.Equal(t, []string{"start", "stop"}, calls)
+	})
+	t.Run("start failure", func(t *testing.T) {
+		var stopped bool
+		c := &TypedConsumer[customEvent]{
+			cfg: TypedConsumerConfig[customEvent]{ConsumerConfig: ConsumerConfig{
+				Logger: zap.NewNop(),
+				OnStart: func(context.Context) error {
+					return errors.New("snapshot not found")
+				},
+				OnStop: func(context.Context) error {
+					stopped = true
+					return nil
+				},
+			}},
+			pauser: newPauser(),
+		}
+		err := c.Run(context.Background())
+		assert.EqualError(t, err, "pubsublite: start hook failed: snapshot not found")
+		assert.False(t, stopped)
+	})
+}
+
+func TestConsumerMaxRuntime(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	c := &TypedConsumer[customEvent]{
+		cfg: TypedConsumerConfig[customEvent]{ConsumerConfig: ConsumerConfig{
+			Logger:     zap.New(core),
+			MaxRuntime: 50 * time.Millisecond,
+		}},
+		pauser: newPauser(),
+	}
+	start := time.Now()
+	assert.NoError(t, c.Run(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 1, logs.FilterMessage("stopping consumer: max runtime reached").Len())
+}
+
+func TestNewTypedConsumer(t *testing.T) {
+	_, err := NewTypedConsumer(context.Background(), TypedConsumerConfig[customEvent]{})
+	assert.ErrorContains(t, err, "pubsublite: decoder must be set")
+	assert.ErrorContains(t, err, "pubsublite: processor must be set")
+}
+
+func TestConsumerDecoderSelfTest(t *testing.T) {
+	newConsumer := func(sample []byte) error {
+		c, err := NewTypedConsumer(context.Background(), TypedConsumerConfig[customEvent]{
+			ConsumerConfig: ConsumerConfig{
+				Project:         "project",
+				Region:          "us-east1",
+				Topics:          []apmqueue.Topic{"topic"},
+				Logger:          zap.NewNop(),
+				DecoderSelfTest: sample,
+				ClientOpts: []option.ClientOption{
+					option.WithoutAuthentication(),
+					option.WithEndpoint("localhost:0"),
+				},
+			},
+			Decoder: jsonDecoder[customEvent]{},
+			Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+				return nil
+			}),
+		})
+		if err == nil {
+			assert.NotNil(t, c)
+		}
+		return err
+	}
+	assert.NoError(t, newConsumer([]byte(`{"name":"1"}`)))
+	err := newConsumer([]byte("not json"))
+	assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+	assert.ErrorContains(t, err, "decoder self test failed")
+}
+
+func TestTypedConsumerProcessMessage(t *testing.T) {
+	var processed []customEvent
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{Delivery: apmqueue.AtLeastOnceDeliveryType},
+		Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			processed = append(processed, events...)
+			return nil
+		}),
+	})
+	c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{"name":"a"}`)})
+	c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`invalid`)})
+	require.Len(t, processed, 1)
+	assert.Equal(t, customEvent{Name: "a"}, processed[0])
+}
+
+func TestConsumerAckHeadroom(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			AckDeadline:   time.Minute,
+		},
+	})
+	c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{}`)})
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	m := findMetric(t, rm, "consumer.ack.headroom")
+	hist, ok := m.Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, hist.DataPoints, 1)
+	assert.Equal(t, uint64(1), hist.DataPoints[0].Count)
+	assert.LessOrEqual(t, hist.DataPoints[0].Sum, time.Minute.Seconds())
+	assert.Greater(t, hist.DataPoints[0].Sum, 0.0)
+}
+
+func TestConsumerAttemptsToSuccess(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	failures := map[string]int{"0:2": 2}
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		},
+		Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			if failures[events[0].Name] > 0 {
+				failures[events[0].Name]--
+				return errors.New("failed")
+			}
+			return nil
+		}),
+	})
+	// 0:1 succeeds on the first attempt, 0:2 on the third one.
+	c.processMessage(context.Background(), &pubsub.Message{ID: "0:1", Data: []byte(`{"name":"0:1"}`)})
+	for i := 0; i < 3; i++ {
+		c.processMessage(context.Background(), &pubsub.Message{ID: "0:2", Data: []byte(`{"name":"0:2"}`)})
+	}
+	_, failed := c.failed.Load("0:2")
+	assert.False(t, failed)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	hist, ok := findMetric(t, rm, "consumer.attempts.to.success").Data.(metricdata.Histogram[int64])
+	require.True(t, ok)
+	require.Len(t, hist.DataPoints, 1)
+	assert.Equal(t, uint64(2), hist.DataPoints[0].Count)
+	assert.Equal(t, int64(4), hist.DataPoints[0].Sum)
+}
+
+func TestConsumerRecoveredLog(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy RecoveredLogPolicy
+		levels []zapcore.Level
+	}{
+		"info":  {policy: InfoRecoveredLog, levels: []zapcore.Level{zapcore.InfoLevel, zapcore.InfoLevel}},
+		"debug": {policy: DebugRecoveredLog, levels: []zapcore.Level{zapcore.DebugLevel, zapcore.DebugLevel}},
+		"none":  {policy: NoRecoveredLog},
+	} {
+		t.Run(name, func(t *testing.T) {
+			reader := sdkmetric.NewManualReader()
+			core, logs := observer.New(zapcore.DebugLevel)
+			c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+				ConsumerConfig: ConsumerConfig{
+					Delivery:      apmqueue.AtLeastOnceDeliveryType,
+					Logger:        zap.New(core),
+					MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+					RecoveredLog:  tc.policy,
+				},
+			})
+			c.failed.Store("0:1", 1)
+			c.processMessage(context.Background(), &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+			c.processMessage(context.Background(), &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+
+			var levels []zapcore.Level
+			for _, entry := range logs.FilterMessage("processed previously failed event").All() {
+				levels = append(levels, entry.Level)
+			}
+			assert.Equal(t, tc.levels, levels)
+
+			// Only the message which failed before is counted.
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, reader.Collect(context.Background(), &rm))
+			sum, ok := findMetric(t, rm, "consumer.recovered").Data.(metricdata.Sum[int64])
+			require.True(t, ok)
+			require.Len(t, sum.DataPoints, 1)
+			assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+		})
+	}
+	assert.ErrorContains(t,
+		ConsumerConfig{RecoveredLog: NoRecoveredLog + 1}.Validate(),
+		"pubsublite: invalid recovered log policy 3",
+	)
+}
+
+func TestConsumerMaintenanceSchedule(t *testing.T) {
+	start := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	now := start.Add(-time.Minute)
+	var processed int
+	pauser := newPauser()
+	c := &TypedConsumer[customEvent]{
+		pauser: pauser,
+		now:    func() time.Time { return now },
+	}
+	c.live.Store(newLiveConfig(PartialConfig{
+		MaintenanceSchedule: MaintenanceWindows{
+			{Start: start, End: start.Add(time.Hour)},
+		},
+	}))
+	sub := &consumer[customEvent]{
+		metrics:  noopMetrics(t),
+		logger:   zap.NewNop(),
+		delivery: apmqueue.AtLeastOnceDeliveryType,
+		decoder:  jsonDecoder[customEvent]{},
+		pauser:   pauser,
+		processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			processed++
+			return nil
+		}),
+	}
+	msg := &pubsub.Message{Data: []byte(`{}`)}
+
+	// Before the window.
+	c.checkMaintenance()
+	assert.NoError(t, c.Healthy(context.Background()))
+	sub.processMessage(context.Background(), msg)
+	assert.Equal(t, 1, processed)
+
+	// Within the window, messages aren't processed.
+	now = start
+	c.checkMaintenance()
+	assert.EqualError(t, c.Healthy(context.Background()),
+		"pubsublite: consumer paused for maintenance",
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	sub.processMessage(ctx, msg)
+	assert.Equal(t, 1, processed)
+
+	// A manual pause isn't lifted when the window ends.
+	c.Pause()
+	now = start.Add(time.Hour)
+	c.checkMaintenance()
+	assert.NoError(t, c.Healthy(context.Background()))
+	assert.Equal(t, []string{pauseReasonManual}, pauser.pausedBy())
+	c.Resume()
+	sub.processMessage(context.Background(), msg)
+	assert.Equal(t, 2, processed)
+}
+
+func TestConsumerPauseTopic(t *testing.T) {
+	processed := make(map[apmqueue.Topic]int)
+	pauser := newPauser()
+	newSub := func(topic apmqueue.Topic) *consumer[customEvent] {
+		return &consumer[customEvent]{
+			topic:       topic,
+			metrics:     noopMetrics(t),
+			logger:      zap.NewNop(),
+			delivery:    apmqueue.AtLeastOnceDeliveryType,
+			decoder:     jsonDecoder[customEvent]{},
+			pauser:      pauser,
+			topicPauser: newPauser(),
+			processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+				processed[topic]++
+				return nil
+			}),
+		}
+	}
+	a, b := newSub("a"), newSub("b")
+	c := &TypedConsumer[customEvent]{
+		pauser:    pauser,
+		consumers: []*consumer[customEvent]{a, b},
+	}
+	msg := &pubsub.Message{Data: []byte(`{}`)}
+
+	require.NoError(t, c.PauseTopic("a"))
+	assert.Equal(t, []apmqueue.Topic{"a"}, c.PausedTopics())
+	assert.NoError(t, c.Healthy(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	a.processMessage(ctx, msg)
+	b.processMessage(context.Background(), msg)
+	assert.Equal(t, map[apmqueue.Topic]int{"b": 1}, processed)
+
+	// A paused topic isn't resumed by Resume.
+	c.Pause()
+	c.Resume()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	a.processMessage(ctx, msg)
+	assert.Equal(t, map[apmqueue.Topic]int{"b": 1}, processed)
+
+	require.NoError(t, c.ResumeTopic("a"))
+	assert.Empty(t, c.PausedTopics())
+	a.processMessage(context.Background(), msg)
+	assert.Equal(t, map[apmqueue.Topic]int{"a": 1, "b": 1}, processed)
+
+	assert.EqualError(t, c.PauseTopic("c"), "pubsublite: not subscribed to c")
+	assert.EqualError(t, c.ResumeTopic("c"), "pubsublite: not subscribed to c")
+}
+
+func TestConsumerExpiresAt(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	var processed int
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			processed++
+			return nil
+		}),
+	})
+	for _, expiresAt := range []string{
+		time.Now().Add(-time.Minute).Format(time.RFC3339Nano), // expired
+		time.Now().Add(time.Hour).Format(time.RFC3339Nano),
+		"invalid",
+	} {
+		c.processMessage(context.Background(), &pubsub.Message{
+			Data:       []byte(`{}`),
+			Attributes: map[string]string{ExpiresAtAttribute: expiresAt},
+		})
+	}
+	assert.Equal(t, 2, processed)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	sum, ok := findMetric(t, rm, "consumer.expired.attribute").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+}
+
+func TestConsumerSupportedSchemaVersions(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	var processed []string
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:                apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider:           sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			SupportedSchemaVersions: []string{"1", "2"},
+		},
+		Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			processed = append(processed, events[0].Name)
+			return nil
+		}),
+	})
+	for name, attrs := range map[string]map[string]string{
+		"v1":          {SchemaVersionAttribute: "1"},
+		"v2":          {SchemaVersionAttribute: "2"},
+		"v3":          {SchemaVersionAttribute: "3"},
+		"unversioned": nil,
+	} {
+		// Unsupported messages are dropped before decoding.
+		data := []byte(`{"name":"` + name + `"}`)
+		if name == "v3" {
+			data = []byte(`invalid`)
+		}
+		c.processMessage(context.Background(), &pubsub.Message{Data: data, Attributes: attrs})
+	}
+	assert.ElementsMatch(t, []string{"v1", "v2", "unversioned"}, processed)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	sum, ok := findMetric(t, rm, "consumer.unsupported.schema").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+}
+
+func TestConsumerRequiredAttributes(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	var processed int
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:           apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider:      sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			RequiredAttributes: []string{"service.name", "tenant"},
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			processed++
+			return nil
+		}),
+	})
+	for _, attrs := range []map[string]string{
+		{"service.name": "a", "tenant": "b"},
+		{"service.name": "a"},
+		nil,
+	} {
+		c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{}`), Attributes: attrs})
+	}
+	// Messages missing attributes are still processed.
+	assert.Equal(t, 3, processed)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	sum, ok := findMetric(t, rm, "consumer.missing.attribute").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	missing := make(map[string]int64)
+	for _, dp := range sum.DataPoints {
+		v, _ := dp.Attributes.Value("attribute")
+		missing[v.AsString()] = dp.Value
+	}
+	assert.Equal(t, map[string]int64{"service.name": 1, "tenant": 2}, missing)
+}
+
+func TestConsumerEmptyPayload(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy    EmptyPayloadPolicy
+		processed []customEvent
+		outcome   Outcome
+	}{
+		"error":   {policy: ErrorOnEmptyPayload, outcome: OutcomeNacked},
+		"skip":    {policy: SkipEmptyPayload, outcome: OutcomeAcked},
+		"process": {policy: ProcessEmptyPayload, processed: []customEvent{{}}, outcome: OutcomeAcked},
+	} {
+		t.Run(name, func(t *testing.T) {
+			results := make(chan ProcessResult, 1)
+			var processed []customEvent
+			c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+				ConsumerConfig: ConsumerConfig{
+					Delivery:       apmqueue.AtMostOnceDeliveryType,
+					Results:        results,
+					OnEmptyPayload: tc.policy,
+				},
+				Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+					processed = append(processed, events...)
+					return nil
+				}),
+			})
+			err := c.process(context.Background(), &pubsub.Message{ID: "0:1"}, time.Now())
+			assert.Equal(t, tc.policy == ErrorOnEmptyPayload, err != nil)
+			assert.Equal(t, tc.processed, processed)
+			assert.Equal(t, tc.outcome, (<-results).Outcome)
+		})
+	}
+	assert.ErrorContains(t,
+		ConsumerConfig{OnEmptyPayload: ProcessEmptyPayload + 1}.Validate(),
+		"pubsublite: invalid empty payload policy 3",
+	)
+}
+
+func TestConsumerProcessorRouter(t *testing.T) {
+	var processed []string
+	processor := func(name string, err error) TypedProcessor[customEvent] {
+		return TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			processed = append(processed, name)
+			return err
+		})
+	}
+	results := make(chan ProcessResult, 1)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:       apmqueue.AtLeastOnceDeliveryType,
+			Results:        results,
+			RouteAttribute: "event.type",
+		},
+		Processor: processor("default", nil),
+		ProcessorRouter: map[string]TypedProcessor[customEvent]{
+			"span":  processor("span", nil),
+			"error": processor("error", errors.New("process failed")),
+		},
+	})
+	for _, tc := range []struct {
+		attrs     map[string]string
+		processed string
+		outcome   Outcome
+	}{
+		{attrs: map[string]string{"event.type": "span"}, processed: "span", outcome: OutcomeAcked},
+		{attrs: map[string]string{"event.type": "error"}, processed: "error", outcome: OutcomeRetried},
+		{attrs: map[string]string{"event.type": "log"}, processed: "default", outcome: OutcomeAcked},
+		{attrs: map[string]string{"service": "span"}, processed: "default", outcome: OutcomeAcked},
+		{processed: "default", outcome: OutcomeAcked},
+	} {
+		processed = nil
+		c.processMessage(context.Background(), &pubsub.Message{
+			ID: "0:1", Data: []byte(`{}`), Attributes: tc.attrs,
+		})
+		assert.Equal(t, []string{tc.processed}, processed)
+		assert.Equal(t, tc.outcome, (<-results).Outcome)
+	}
+	assert.ErrorContains(t,
+		ConsumerConfig{ProcessorRouter: map[string]model.BatchProcessor{
+			"span": model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		}}.Validate(),
+		"pubsublite: route attribute must be set with a processor router",
+	)
+}
+
+func TestConsumerProfileLabels(t *testing.T) {
+	labels := make(map[string]string)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Region:   "region",
+			Topics:   []apmqueue.Topic{"name-topic"},
+			Delivery: apmqueue.AtMostOnceDeliveryType,
+		},
+		Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+			pprof.ForLabels(ctx, func(key, value string) bool {
+				labels[key] = value
+				return true
+			})
+			return nil
+		}),
+	})
+	ctx := context.Background()
+	c.processMessage(ctx, &pubsub.Message{ID: "3:10", Data: []byte(`{}`)})
+	assert.Equal(t, map[string]string{
+		"subscription": "projects/project/locations/region/subscriptions/name-topic",
+		"partition":    "3",
+	}, labels)
+	// The labels are removed once the message is processed.
+	_, ok := pprof.Label(ctx, "subscription")
+	assert.False(t, ok)
+}
+
+func TestConsumerContextDecorator(t *testing.T) {
+	type tenantKey struct{}
+	var tenant any
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery: apmqueue.AtLeastOnceDeliveryType,
+			ContextDecorator: func(ctx context.Context, attrs map[string]string) context.Context {
+				return context.WithValue(ctx, tenantKey{}, attrs["tenant"])
+			},
+		},
+		Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+			tenant = ctx.Value(tenantKey{})
+			meta, ok := queuecontext.MetadataFromContext(ctx)
+			assert.True(t, ok)
+			assert.Equal(t, map[string]string{"tenant": "a"}, meta)
+			return nil
+		}),
+	})
+	c.processMessage(context.Background(), &pubsub.Message{
+		Data:       []byte(`{}`),
+		Attributes: map[string]string{"tenant": "a"},
+	})
+	assert.Equal(t, "a", tenant)
+}
+
+func TestConsumerMetadataCodec(t *testing.T) {
+	var got []queuecontext.Metadata
+	results := make(chan ProcessResult, 1)
+	c := &consumer[customEvent]{
+		metrics:       noopMetrics(t),
+		logger:        zap.NewNop(),
+		delivery:      apmqueue.AtLeastOnceDeliveryType,
+		decoder:       jsonDecoder[customEvent]{},
+		pauser:        newPauser(),
+		results:       results,
+		metadataCodec: queuecontext.IdentityCodec{},
+		processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+			meta, ok := queuecontext.StructuredMetadataFromContext(ctx)
+			assert.True(t, ok)
+			got = append(got, meta)
+			return nil
+		}),
+	}
+	c.processMessage(context.Background(), &pubsub.Message{
+		ID:         "0:1",
+		Data:       []byte(`{}`),
+		Attributes: map[string]string{"tenant": "a"},
+	})
+	assert.Equal(t, []queuecontext.Metadata{{"tenant": "a"}}, got)
+	assert.Equal(t, OutcomeAcked, (<-results).Outcome)
+
+	// Messages whose attributes can't be decoded aren't processed.
+	c.metadataCodec = failingMetadataCodec{}
+	c.processMessage(context.Background(), &pubsub.Message{
+		ID:         "0:2",
+		Data:       []byte(`{}`),
+		Attributes: map[string]string{"tenant": "a"},
+	})
+	assert.Len(t, got, 1)
+	assert.Equal(t, ProcessResult{
+		Offset: 2, Outcome: OutcomeNacked, Err: errors.New("boom"),
+	}, <-results)
+}
+
+type failingMetadataCodec struct{}
+
+func (failingMetadataCodec) EncodeMetadata(queuecontext.Metadata) (map[string]string, error) {
+	return nil, errors.New("boom")
+}
+
+func (failingMetadataCodec) DecodeMetadata(map[string]string) (queuecontext.Metadata, error) {
+	return nil, errors.New("boom")
+}
+
+func TestConsumerLastOffset(t *testing.T) {
+	c := &consumer[customEvent]{
+		topic:    "topic",
+		logger:   zap.NewNop(),
+		delivery: apmqueue.AtLeastOnceDeliveryType,
+		decoder:  jsonDecoder[customEvent]{},
+		metrics:  noopMetrics(t),
+		pauser:   newPauser(),
+		acked:    newLastOffsets(),
+		processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			if events[0].Name == "fail" {
+				return errors.New("failed")
+			}
+			return nil
+		}),
+	}
+	typed := &TypedConsumer[customEvent]{consumers: []*consumer[customEvent]{c}}
+	_, ok := typed.LastOffset("topic", 0)
+	assert.False(t, ok)
+
+	for _, msg := range []*pubsub.Message{
+		{ID: "0:5", Data: []byte(`{}`)},
+		{ID: "0:3", Data: []byte(`{}`)},
+		{ID: "0:7", Data: []byte(`{"name":"fail"}`)},
+		{ID: "1:2", Data: []byte(`{}`)},
+	} {
+		c.processMessage(context.Background(), msg)
+	}
+	// The highest acknowledged offset is returned, failed messages aren't
+	// acknowledged.
+	offset, ok := typed.LastOffset("topic", 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), offset)
+	offset, ok = typed.LastOffset("topic", 1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), offset)
+	_, ok = typed.LastOffset("topic", 2)
+	assert.False(t, ok)
+	_, ok = typed.LastOffset("other", 0)
+	assert.False(t, ok)
+}
+
+func TestConsumerSpanAttributes(t *testing.T) {
+	c := &consumer[customEvent]{
+		telemetryAttributes: []attribute.KeyValue{semconv.MessagingSourceNameKey.String("topic")},
+		subscription: Subscription{
+			Project: "project", Region: "region", Name: "topic",
+		}.String(),
+	}
+	assert.Equal(t, []attribute.KeyValue{
+		semconv.MessagingSourceNameKey.String("topic"),
+		attribute.String("messaging.destination.subscription.name",
+			"projects/project/locations/region/subscriptions/topic",
+		),
+	}, c.spanAttributes())
+	// The telemetry attributes, used by the metrics, aren't modified.
+	assert.Len(t, c.telemetryAttributes, 1)
+}
+
+func TestConsumerTelemetryAttributes(t *testing.T) {
+	c := &TypedConsumer[customEvent]{cfg: TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{Project: "project", Region: "region"},
+	}}
+	assert.Equal(t, []attribute.KeyValue{
+		semconv.MessagingSourceNameKey.String("topic"),
+		semconv.CloudRegion("region"),
+		semconv.CloudAccountID("project"),
+	}, c.telemetryAttributes("topic"))
+
+	c.cfg.Version = "8.9.0-canary"
+	assert.Equal(t, []attribute.KeyValue{
+		semconv.MessagingSourceNameKey.String("topic"),
+		semconv.CloudRegion("region"),
+		semconv.CloudAccountID("project"),
+		semconv.ServiceVersion("8.9.0-canary"),
+	}, c.telemetryAttributes("topic"))
+}
+
+func TestConsumerCorrelationID(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:               apmqueue.AtMostOnceDeliveryType,
+			Logger:                 zap.New(core),
+			CorrelationIDAttribute: "order.id",
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			return errors.New("process failed")
+		}),
+	})
+	for _, msg := range []*pubsub.Message{
+		{ID: "0:1", Data: []byte(`{}`), Attributes: map[string]string{"order.id": "abc"}},
+		{ID: "0:2", Data: []byte(`{}`)},
+	} {
+		ctx, span := tracer.Start(context.Background(), "pubsublite.Receive")
+		c.processMessage(ctx, msg)
+		span.End()
+	}
+
+	entries := logs.FilterMessage("unable to process event").All()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "abc", entries[0].ContextMap()["correlation_id"])
+	assert.NotContains(t, entries[1].ContextMap(), "correlation_id")
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Contains(t, spans[0].Attributes(), semconv.MessagingMessageConversationID("abc"))
+	for _, attr := range spans[1].Attributes() {
+		assert.NotEqual(t, semconv.MessagingMessageConversationIDKey, attr.Key)
+	}
+}
+
+func TestConsumerLogTraceContext(t *testing.T) {
+	tracer := sdktrace.NewTracerProvider().Tracer("test")
+	for name, enabled := range map[string]bool{"enabled": true, "disabled": false} {
+		t.Run(name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.ErrorLevel)
+			c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+				ConsumerConfig: ConsumerConfig{
+					Delivery:        apmqueue.AtMostOnceDeliveryType,
+					Logger:          zap.New(core),
+					LogTraceContext: enabled,
+				},
+				Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+					return errors.New("process failed")
+				}),
+			})
+			ctx, span := tracer.Start(context.Background(), "pubsublite.Receive")
+			c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+			span.End()
+			// Messages processed without a span have no trace context.
+			c.processMessage(context.Background(), &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+
+			entries := logs.FilterMessage("unable to process event").All()
+			require.Len(t, entries, 2)
+			fields := entries[0].ContextMap()
+			if enabled {
+				assert.Equal(t, span.SpanContext().TraceID().String(), fields["trace_id"])
+				assert.Equal(t, span.SpanContext().SpanID().String(), fields["span_id"])
+			} else {
+				assert.NotContains(t, fields, "trace_id")
+				assert.NotContains(t, fields, "span_id")
+			}
+			assert.NotContains(t, entries[1].ContextMap(), "trace_id")
+		})
+	}
+}
+
+func TestConsumerProcessorPanic(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			panic("boom")
+		}),
+	})
+	ctx, span := tracer.Start(context.Background(), "pubsublite.Receive")
+	assert.NotPanics(t, func() {
+		c.processMessage(ctx, &pubsub.Message{ID: "1:2", Data: []byte(`{}`)})
+	})
+	span.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "pubsublite: processor panic: boom", spans[0].Status().Description)
+	require.Len(t, spans[0].Events(), 1)
+	assert.Equal(t, "panic", spans[0].Events()[0].Name)
+	assert.Equal(t, []attribute.KeyValue{attribute.String("panic.value", "boom")},
+		spans[0].Events()[0].Attributes,
+	)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	sum, ok := findMetric(t, rm, "consumer.processor.panics").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+	typ, _ := sum.DataPoints[0].Attributes.Value("panic.type")
+	assert.Equal(t, "string", typ.AsString())
+}
+
+func TestConsumerStartupProbe(t *testing.T) {
+	newConsumer := func(probe *startupProbe) *consumer[customEvent] {
+		return &consumer[customEvent]{
+			metrics:  noopMetrics(t),
+			logger:   zap.NewNop(),
+			delivery: apmqueue.AtLeastOnceDeliveryType,
+			decoder:  jsonDecoder[customEvent]{},
+			pauser:   newPauser(),
+			probe:    probe,
+			processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+				return nil
+			}),
+		}
+	}
+	t.Run("success", func(t *testing.T) {
+		probe := &startupProbe{remaining: 2}
+		c := newConsumer(probe)
+		c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{}`)})
+		c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{}`)})
+		// Errors after the probe window don't fail the consumer.
+		c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`invalid`)})
+		assert.NoError(t, probe.failed())
+	})
+	t.Run("decode failure", func(t *testing.T) {
+		ctx, abort := context.WithCancelCause(context.Background())
+		probe := &startupProbe{remaining: 2, abort: abort}
+		c := newConsumer(probe)
+		c.processMessage(ctx, &pubsub.Message{Data: []byte(`invalid`)})
+		assert.ErrorContains(t, probe.failed(), "pubsublite: startup probe failed")
+		assert.Equal(t, probe.failed(), context.Cause(ctx))
+	})
+}
+
+func TestConsumerSubscriberClient(t *testing.T) {
+	c, err := NewConsumer(context.Background(), ConsumerConfig{
+		Project:   "project",
+		Region:    "us-east1",
+		Topics:    []apmqueue.Topic{"a"},
+		Decoder:   json.JSON{},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		ClientOpts: []option.ClientOption{
+			option.WithoutAuthentication(),
+			option.WithEndpoint("localhost:0"),
+		},
+	})
+	require.NoError(t, err)
+
+	client, ok := c.SubscriberClient("a")
+	assert.True(t, ok)
+	assert.Same(t, c.consumers[0].SubscriberClient, client)
+	_, ok = c.SubscriberClient("b")
+	assert.False(t, ok)
+}
+
+func TestConsumerEffectiveConfig(t *testing.T) {
+	c, err := NewConsumer(context.Background(), ConsumerConfig{
+		Project:     "project",
+		Region:      "us-east1",
+		Topics:      []apmqueue.Topic{"a", "b"},
+		Decoder:     json.JSON{},
+		Logger:      zap.NewNop(),
+		Processor:   model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		LazyConnect: true,
+		ClientOpts: []option.ClientOption{
+			option.WithoutAuthentication(),
+			option.WithEndpoint("localhost:0"),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Reconfigure(PartialConfig{RedactAttributes: []string{"user"}}))
+
+	cfg := c.EffectiveConfig()
+	// Defaults are applied.
+	assert.Equal(t, defaultAckBatchInterval, cfg.AckBatchInterval)
+	assert.Equal(t, defaultDeferredAckTimeout, cfg.DeferredAckTimeout)
+	// Live settings and pending subscriptions are reflected.
+	assert.Equal(t, []string{"user"}, cfg.RedactAttributes)
+	assert.Equal(t, []apmqueue.Topic{"a", "b"}, cfg.Topics)
+	// Client options may hold credentials.
+	assert.Nil(t, cfg.ClientOpts)
+	// The model.APMEvent specific settings are reported.
+	assert.Equal(t, json.JSON{}, cfg.Decoder)
+	assert.NotNil(t, cfg.Processor)
+}
+
+func TestConsumerSubscriptions(t *testing.T) {
+	c, err := NewConsumer(context.Background(), ConsumerConfig{
+		Project:   "project",
+		Region:    "us-east1",
+		Topics:    []apmqueue.Topic{"a"},
+		Decoder:   json.JSON{},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		ClientOpts: []option.ClientOption{
+			option.WithoutAuthentication(),
+			option.WithEndpoint("localhost:0"),
+		},
+	})
+	require.NoError(t, err)
+
+	topics := func() (res []apmqueue.Topic) {
+		for _, consumer := range c.consumers {
+			res = append(res, consumer.topic)
+		}
+		return res
+	}
+	require.NoError(t, c.AddSubscription(context.Background(), "b"))
+	assert.ErrorContains(t, c.AddSubscription(context.Background(), "b"),
+		"pubsublite: already subscribed to b",
+	)
+	assert.Equal(t, []apmqueue.Topic{"a", "b"}, topics())
+
+	require.NoError(t, c.RemoveSubscription("a"))
+	assert.ErrorContains(t, c.RemoveSubscription("a"), "pubsublite: not subscribed to a")
+	assert.Equal(t, []apmqueue.Topic{"b"}, topics())
+}
+
+func TestConsumerOnContextCancel(t *testing.T) {
+	newConsumer := func(policy CancelPolicy, results chan ProcessResult) *consumer[customEvent] {
+		return newTestConsumer(t, TypedConsumerConfig[customEvent]{
+			ConsumerConfig: ConsumerConfig{
+				Delivery:        apmqueue.AtLeastOnceDeliveryType,
+				Results:         results,
+				OnContextCancel: policy,
+			},
+			Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+				return ctx.Err()
+			}),
+		})
+	}
+	for name, tc := range map[string]struct {
+		policy  CancelPolicy
+		outcome Outcome
+	}{
+		"leave unacked": {policy: LeaveUnackedOnCancel, outcome: OutcomeRetried},
+		"nack":          {policy: NackOnCancel, outcome: OutcomeRetried},
+	} {
+		t.Run(name, func(t *testing.T) {
+			results := make(chan ProcessResult, 2)
+			c := newConsumer(tc.policy, results)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+
+			// Paused messages are handled the same way.
+			c.pauser.pause(pauseReasonManual)
+			c.processMessage(ctx, &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+
+			require.Len(t, results, 2)
+			for i := int64(1); i <= 2; i++ {
+				assert.Equal(t, ProcessResult{
+					Topic: "topic", Offset: i, Outcome: tc.outcome, Err: context.Canceled,
+				}, <-results)
+			}
+			_, failed := c.failed.Load("0:1")
+			assert.False(t, failed)
+		})
+	}
+	t.Run("cancelled while processing", func(t *testing.T) {
+		results := make(chan ProcessResult, 1)
+		c := newConsumer(LeaveUnackedOnCancel, results)
+		ctx, cancel := context.WithCancel(context.Background())
+		c.processor = TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+			cancel()
+			return ctx.Err()
+		})
+		c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+		require.Len(t, results, 1)
+		assert.Equal(t, OutcomeRetried, (<-results).Outcome)
+		_, failed := c.failed.Load("0:1")
+		assert.False(t, failed)
+	})
+	t.Run("unsupported policy", func(t *testing.T) {
+		err := ConsumerConfig{OnContextCancel: NackOnCancel + 1}.Validate()
+		assert.ErrorContains(t, err, "pubsublite: invalid cancel policy 2")
+	})
+}
+
+func TestConsumerShutdownOrder(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []apmqueue.Topic
+	// newSubscription returns a running subscription which takes drainTime
+	// to drain once stopped.
+	newSubscription := func(topic apmqueue.Topic, drainTime time.Duration) *consumer[customEvent] {
+		done := make(chan struct{})
+		return &consumer[customEvent]{
+			metrics: noopMetrics(t),
+			topic:   topic,
+			done:    done,
+			stop: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				stopped = append(stopped, topic)
+				time.AfterFunc(drainTime, func() { close(done) })
+			},
+		}
+	}
+	newConsumer := func(cfg ConsumerConfig, subscriptions ...*consumer[customEvent]) *TypedConsumer[customEvent] {
+		return &TypedConsumer[customEvent]{
+			cfg:            TypedConsumerConfig[customEvent]{ConsumerConfig: cfg},
+			consumers:      subscriptions,
+			group:          &errgroup.Group{},
+			stopSubscriber: func() {},
+		}
+	}
+
+	t.Run("ordered", func(t *testing.T) {
+		stopped = nil
+		c := newConsumer(ConsumerConfig{ShutdownOrder: []apmqueue.Topic{"c", "a", "unknown"}},
+			newSubscription("a", 10*time.Millisecond),
+			newSubscription("b", 0),
+			newSubscription("c", 20*time.Millisecond),
+		)
+		require.NoError(t, c.Close())
+		assert.Equal(t, []apmqueue.Topic{"c", "a", "b"}, stopped)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		stopped = nil
+		c := newConsumer(ConsumerConfig{
+			ShutdownOrder:   []apmqueue.Topic{"a"},
+			ShutdownTimeout: 100 * time.Millisecond,
+		},
+			newSubscription("a", time.Hour),
+			newSubscription("b", 0),
+		)
+		start := time.Now()
+		err := c.Close()
+		assert.EqualError(t, err, "pubsublite: timed out draining subscription a")
+		// The stuck subscription only uses its share of the timeout.
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, []apmqueue.Topic{"a", "b"}, stopped)
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		stopped = nil
+		c := newConsumer(ConsumerConfig{ShutdownTimeout: 50 * time.Millisecond},
+			newSubscription("a", time.Hour),
+			newSubscription("b", 0),
+		)
+		assert.EqualError(t, c.Close(), "pubsublite: timed out draining subscription a")
+		assert.ElementsMatch(t, []apmqueue.Topic{"a", "b"}, stopped)
+	})
+}
+
+func TestConsumerLoggers(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	c, err := NewConsumer(context.Background(), ConsumerConfig{
+		Project:   "project",
+		Region:    "us-east1",
+		Topics:    []apmqueue.Topic{"a", "b"},
+		Decoder:   json.JSON{},
+		Logger:    zap.NewNop(),
+		Loggers:   map[apmqueue.Topic]*zap.Logger{"b": zap.New(core)},
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		ClientOpts: []option.ClientOption{
+			option.WithoutAuthentication(),
+			option.WithEndpoint("localhost:0"),
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, c.consumers, 2)
+	for _, consumer := range c.consumers {
+		consumer.logger.Info(string(consumer.topic))
+	}
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "b", entries[0].Message)
+	assert.Equal(t, "pubsublite", entries[0].LoggerName)
+	assert.Equal(t, "b", entries[0].ContextMap()["subscription"])
+}
+
+func TestConsumerDeferAck(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := tp.Tracer("test")
+	newConsumer := func(delivery apmqueue.DeliveryType, dones chan<- func(error)) (*consumer[customEvent], *observer.ObservedLogs) {
+		core, logs := observer.New(zapcore.InfoLevel)
+		var timeout time.Duration
+		if delivery == apmqueue.AtLeastOnceDeliveryType {
+			// The timeout requires at least once delivery.
+			timeout = 50 * time.Millisecond
+		}
+		return newTestConsumer(t, TypedConsumerConfig[customEvent]{
+			ConsumerConfig: ConsumerConfig{
+				Delivery:           delivery,
+				Logger:             zap.New(core),
+				TracerProvider:     tp,
+				DeferredAckTimeout: timeout,
+			},
+			Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+				done, ok := DeferAck(ctx)
+				if ok {
+					dones <- done
+				}
+				return nil
+			}),
+		}), logs
+	}
+	failed := func(c *consumer[customEvent], id string) bool {
+		_, ok := c.failed.Load(id)
+		return ok
+	}
+	t.Run("acked", func(t *testing.T) {
+		dones := make(chan func(error), 1)
+		c, logs := newConsumer(apmqueue.AtLeastOnceDeliveryType, dones)
+		c.processMessage(context.Background(), &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+		done := <-dones
+		assert.Zero(t, logs.Len()) // not settled yet.
+		done(nil)
+		done(errors.New("ignored"))
+		assert.Eventually(t, func() bool {
+			return logs.FilterMessage("processed previously failed event").Len() == 1
+		}, time.Second, time.Millisecond)
+		assert.False(t, failed(c, "0:1"))
+	})
+	t.Run("failed", func(t *testing.T) {
+		dones := make(chan func(error), 1)
+		c, _ := newConsumer(apmqueue.AtLeastOnceDeliveryType, dones)
+		c.processMessage(context.Background(), &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+		(<-dones)(errors.New("write failed"))
+		assert.Eventually(t, func() bool { return failed(c, "0:1") }, time.Second, time.Millisecond)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		dones := make(chan func(error), 1)
+		c, logs := newConsumer(apmqueue.AtLeastOnceDeliveryType, dones)
+		c.processMessage(context.Background(), &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+		<-dones
+		assert.Eventually(t, func() bool { return failed(c, "0:1") }, time.Second, time.Millisecond)
+		entries := logs.FilterMessage("deferred ack failed").All()
+		require.Len(t, entries, 1)
+		assert.Equal(t, ErrDeferredAckTimeout.Error(), entries[0].ContextMap()["error"])
+	})
+	t.Run("settled after the callback", func(t *testing.T) {
+		dones := make(chan func(error), 1)
+		c, logs := newConsumer(apmqueue.AtLeastOnceDeliveryType, dones)
+		results := make(chan ProcessResult, 2)
+		c.results = results
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx, receive := tracer.Start(ctx, "pubsublite.Receive")
+		c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+		receive.End()
+		cancel()
+		// The message is settled with a detached context, in its own span.
+		(<-dones)(nil)
+		assert.Equal(t, OutcomeAcked, (<-results).Outcome)
+		assert.Zero(t, logs.FilterMessage("deferred ack failed").Len())
+		assert.Eventually(t, func() bool {
+			for _, span := range recorder.Ended() {
+				if span.Name() == "pubsublite.DeferredAck" && len(span.Links()) == 1 &&
+					span.Links()[0].SpanContext.Equal(receive.SpanContext()) {
+					return true
+				}
+			}
+			return false
+		}, time.Second, time.Millisecond)
+
+		// Failures once the callback context is done are cancellations,
+		// and the subscription isn't done until the message is nacked.
+		ctx, cancel = context.WithCancel(context.Background())
+		c.processMessage(ctx, &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+		cancel()
+		settled := make(chan struct{})
+		go func() {
+			c.wg.Wait()
+			close(settled)
+		}()
+		select {
+		case <-settled:
+			t.Fatal("subscription done before the deferred ack was settled")
+		case <-time.After(10 * time.Millisecond):
+		}
+		(<-dones)(errors.New("write failed"))
+		r := <-results
+		assert.Equal(t, OutcomeRetried, r.Outcome)
+		assert.ErrorIs(t, r.Err, context.Canceled)
+		assert.False(t, failed(c, "0:2"))
+		<-settled
+		_, nacked := c.cancelNacks.Load("0:2")
+		assert.True(t, nacked)
+	})
+	t.Run("at most once", func(t *testing.T) {
+		dones := make(chan func(error), 1)
+		c, _ := newConsumer(apmqueue.AtMostOnceDeliveryType, dones)
+		c.processMessage(context.Background(), &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+		assert.Empty(t, dones)
+	})
+}
+
+func TestConsumerAlreadyProcessed(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	core, logs := observer.New(zapcore.ErrorLevel)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			Logger:        zap.New(core),
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			return fmt.Errorf("duplicate: %w", apmqueue.ErrAlreadyProcessed)
+		}),
+	})
+	c.processMessage(context.Background(), &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+
+	// Duplicates aren't handled as failures.
+	_, failed := c.failed.Load("0:1")
+	assert.False(t, failed)
+	assert.Zero(t, logs.Len())
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	sum, ok := findMetric(t, rm, "consumer.duplicate").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+}
+
+// newTestConsumer creates a consumer with cfg through NewTypedConsumer, and
+// returns the consumer of the subscription of its first topic, without a
+// subscriber client, which processes messages with processMessage. The
+// Project, Region, Topics, Logger, MeterProvider, Decoder and Processor
+// default to test values when unset, the processor succeeds.
+func newTestConsumer[T any](t testing.TB, cfg TypedConsumerConfig[T]) *consumer[T] {
+	t.Helper()
+	if cfg.Project == "" {
+		cfg.Project = "project"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-central1"
+	}
+	if len(cfg.Topics) == 0 {
+		cfg.Topics = []apmqueue.Topic{"topic"}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+	if cfg.MeterProvider == nil {
+		cfg.MeterProvider = noop.NewMeterProvider()
+	}
+	if cfg.Decoder == nil && cfg.BatchDecoder == nil {
+		cfg.Decoder = jsonDecoder[T]{}
+	}
+	if cfg.Processor == nil {
+		cfg.Processor = TypedProcessorFunc[T](func(context.Context, []T) error {
+			return nil
+		})
+	}
+	cfg.LazyConnect = true
+	c, err := NewTypedConsumer(context.Background(), cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.throughputCallback.Unregister()) })
+	topic := cfg.Topics[0]
+	return c.subscriber(topic, Subscription{
+		Name:    string(topic),
+		Project: cfg.Project,
+		Region:  cfg.Region,
+	})
+}
+
+// newLive returns the live config holder of a consumer with cfg.
+func newLive(cfg PartialConfig) *atomic.Pointer[liveConfig] {
+	var live atomic.Pointer[liveConfig]
+	live.Store(newLiveConfig(cfg))
+	return &live
+}
+
+func findMetric(t testing.TB, rm metricdata.ResourceMetrics, name string) metricdata.Metrics {
+	t.Helper()
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	t.Fatalf("metric %q not found", name)
+	return metricdata.Metrics{}
+}
+
+type customEvent struct {
+	Name string `json:"name"`
+}
+
+func BenchmarkConsumerProcessMessage(b *testing.B) {
+	for name, delivery := range map[string]apmqueue.DeliveryType{
+		"at_most_once":  apmqueue.AtMostOnceDeliveryType,
+		"at_least_once": apmqueue.AtLeastOnceDeliveryType,
+	} {
+		b.Run(name, func(b *testing.B) {
+			c := &consumer[customEvent]{
+				logger:   zap.NewNop(),
+				delivery: delivery,
+				decoder:  jsonDecoder[customEvent]{},
+				metrics:  noopMetrics(b),
+				pauser:   newPauser(),
+				processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+					return nil
+				}),
+			}
+			msg := &pubsub.Message{ID: "0:1", Data: []byte(`{"name":"event"}`)}
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.processMessage(ctx, msg)
+			}
+		})
+	}
+}
+
+// BenchmarkConsumerRetry measures the failed messages bookkeeping: each
+// message fails twice, and is nacked on its 3rd delivery.
+func BenchmarkConsumerRetry(b *testing.B) {
+	c := &consumer[customEvent]{
+		logger:   zap.NewNop(),
+		delivery: apmqueue.AtLeastOnceDeliveryType,
+		decoder:  jsonDecoder[customEvent]{},
+		metrics:  noopMetrics(b),
+		pauser:   newPauser(),
+		processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			return errors.New("process failed")
+		}),
+	}
+	msgs := make([]*pubsub.Message, 1000)
+	for i := range msgs {
+		msgs[i] = &pubsub.Message{ID: fmt.Sprintf("0:%d", i), Data: []byte(`{}`)}
+	}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.processMessage(ctx, msgs[(i/3)%len(msgs)])
+	}
 }
 
+// noopMetrics returns consumer metrics which aren't recorded.
+func noopMetrics(t testing.TB) consumerMetrics {
+	metrics, err := newConsumerMetrics(noop.NewMeterProvider(), nil)
+	require.NoError(t, err)
+	return metrics
+}
+
+type jsonDecoder[T any] struct{}
+
+func (jsonDecoder[T]) Decode(b []byte, v *T) error { return stdjson.Unmarshal(b, v) }
+
 func TestSubscriptionString(t *testing.T) {
 	tests := []struct {
 		Project string
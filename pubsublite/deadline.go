@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+const (
+	// deadlineWindow is the number of most recent processing durations
+	// from which the P99 processing duration is computed.
+	deadlineWindow = 1000
+	// deadlineCheckInterval is the number of processed messages between
+	// two checks of the P99 processing duration.
+	deadlineCheckInterval = 100
+	// deadlineRiskRatio is the ratio of the ack deadline above which the P99
+	// processing duration puts the ack deadline at risk.
+	deadlineRiskRatio = 0.8
+)
+
+// deadlineTracker tracks a rolling P99 of the processing durations, to
+// detect when the ack deadline is too tight for the observed processing
+// durations.
+type deadlineTracker struct {
+	deadline time.Duration
+
+	mu        sync.Mutex
+	durations []time.Duration
+	next      int
+	unchecked int
+}
+
+// newDeadlineTracker returns nil when deadline <= 0.
+func newDeadlineTracker(deadline time.Duration) *deadlineTracker {
+	if deadline <= 0 {
+		return nil
+	}
+	return &deadlineTracker{
+		deadline:  deadline,
+		durations: make([]time.Duration, 0, deadlineWindow),
+	}
+}
+
+// observe records the processing duration. Every deadlineCheckInterval
+// durations, it returns the P99 processing duration, and whether it puts
+// the ack deadline at risk.
+func (t *deadlineTracker) observe(d time.Duration) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.durations) < deadlineWindow {
+		t.durations = append(t.durations, d)
+	} else {
+		t.durations[t.next] = d
+		t.next = (t.next + 1) % deadlineWindow
+	}
+	t.unchecked++
+	if t.unchecked < deadlineCheckInterval {
+		return 0, false
+	}
+	t.unchecked = 0
+	sorted := append([]time.Duration(nil), t.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p99 := sorted[(len(sorted)*99-1)/100]
+	return p99, float64(p99) >= deadlineRiskRatio*float64(t.deadline)
+}
+
+// checkDeadline records the processing duration, and reports when the P99
+// processing duration approaches the ack deadline, so it can be widened
+// before messages start exceeding it. It's a no-op when AckDeadline isn't
+// configured.
+func (c *consumer[T]) checkDeadline(ctx context.Context, d time.Duration) {
+	if c.deadlines == nil {
+		return
+	}
+	p99, risk := c.deadlines.observe(d)
+	if !risk {
+		return
+	}
+	c.metrics.deadlineRisk.Add(ctx, 1, metric.WithAttributes(c.telemetryAttributes...))
+	c.logger.Warn("p99 processing duration approaches the ack deadline",
+		zap.Duration("p99", p99),
+		zap.Duration("ack_deadline", c.deadlines.deadline),
+	)
+}
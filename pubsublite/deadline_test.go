@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestDeadlineTracker(t *testing.T) {
+	assert.Nil(t, newDeadlineTracker(0))
+
+	d := newDeadlineTracker(100 * time.Millisecond)
+	observe := func(n int, took time.Duration) (p99 time.Duration, risk bool) {
+		for i := 0; i < n; i++ {
+			p99, risk = d.observe(took)
+		}
+		return
+	}
+	// The P99 is only checked every deadlineCheckInterval durations.
+	p99, risk := observe(deadlineCheckInterval-1, 10*time.Millisecond)
+	assert.Equal(t, time.Duration(0), p99)
+	assert.False(t, risk)
+	p99, risk = observe(1, 10*time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, p99)
+	assert.False(t, risk)
+
+	// Once more than 1% of the durations are >= 80% of the deadline, it's
+	// at risk.
+	observe(deadlineCheckInterval-deadlineWindow/100-1, 10*time.Millisecond)
+	p99, risk = observe(deadlineWindow/100+1, 80*time.Millisecond)
+	assert.Equal(t, 80*time.Millisecond, p99)
+	assert.True(t, risk)
+
+	// Only the most recent durations are taken into account.
+	p99, risk = observe(deadlineWindow, 10*time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, p99)
+	assert.False(t, risk)
+}
+
+func TestConsumerDeadlineRisk(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	core, logs := observer.New(zapcore.WarnLevel)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Logger:        zap.New(core),
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			AckDeadline:   time.Nanosecond,
+		},
+	})
+	for i := 0; i < deadlineCheckInterval; i++ {
+		c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{}`)})
+	}
+	entries := logs.FilterMessage("p99 processing duration approaches the ack deadline").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, time.Nanosecond, entries[0].ContextMap()["ack_deadline"])
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	sum, ok := findMetric(t, rm, "consumer.deadline.risk").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+}
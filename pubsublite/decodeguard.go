@@ -0,0 +1,142 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// defaultDecodeGuardWindow is the default number of messages over which the
+// decode failure rate is computed.
+const defaultDecodeGuardWindow = 1000
+
+// ErrDecodeFailureRate is wrapped by the error returned by Run when the
+// DecodeGuard threshold is exceeded.
+var ErrDecodeFailureRate = errors.New("decode failure rate exceeded")
+
+// DecodeGuard stops the consumer when nearly every message fails to decode,
+// which almost certainly means it's consuming the wrong topic, or using the
+// wrong decoder, rather than silently discarding all the traffic.
+type DecodeGuard struct {
+	// Threshold is the ratio, between 0 and 1, of the messages of a
+	// subscription failing to decode above which Run returns an error
+	// wrapping ErrDecodeFailureRate. The guard is disabled when 0.
+	Threshold float64
+	// Window is the number of the most recent messages of each subscription
+	// over which the decode failure rate is computed. The rate isn't
+	// checked until Window messages have been received. Defaults to 1000.
+	Window int
+}
+
+func (g DecodeGuard) validate() error {
+	if g.Threshold < 0 || g.Threshold > 1 {
+		return errors.New("pubsublite: decode guard threshold must be between 0 and 1")
+	}
+	if g.Window < 0 {
+		return errors.New("pubsublite: decode guard window must not be negative")
+	}
+	return nil
+}
+
+// decodeGuard tracks the decode failures of the most recent messages of
+// each subscription, and aborts the consumer when the failure rate of any
+// of them exceeds the threshold.
+type decodeGuard struct {
+	threshold float64
+	window    int
+
+	mu      sync.Mutex
+	windows map[apmqueue.Topic]*failureWindow
+	err     error
+	abort   context.CancelCauseFunc
+}
+
+// failureWindow is a ring buffer of the decode results of the most recent
+// messages.
+type failureWindow struct {
+	failed   []bool
+	next     int
+	full     bool
+	failures int
+}
+
+// newDecodeGuard returns nil when the guard is disabled.
+func newDecodeGuard(cfg DecodeGuard) *decodeGuard {
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultDecodeGuardWindow
+	}
+	return &decodeGuard{
+		threshold: cfg.Threshold,
+		window:    cfg.Window,
+		windows:   make(map[apmqueue.Topic]*failureWindow),
+	}
+}
+
+// record records whether a message of the subscription failed to decode,
+// aborting the consumer if the failure rate exceeds the threshold.
+func (g *decodeGuard) record(topic apmqueue.Topic, failed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return
+	}
+	w, ok := g.windows[topic]
+	if !ok {
+		w = &failureWindow{failed: make([]bool, g.window)}
+		g.windows[topic] = w
+	}
+	if w.failed[w.next] {
+		w.failures--
+	}
+	w.failed[w.next] = failed
+	if failed {
+		w.failures++
+	}
+	w.next = (w.next + 1) % len(w.failed)
+	if w.next == 0 {
+		w.full = true
+	}
+	if !w.full {
+		return
+	}
+	if rate := float64(w.failures) / float64(len(w.failed)); rate > g.threshold {
+		g.err = fmt.Errorf(
+			"pubsublite: %w: %d of the last %d messages of subscription %s failed to decode, check the subscription and decoder",
+			ErrDecodeFailureRate, w.failures, len(w.failed), topic,
+		)
+		if g.abort != nil {
+			g.abort(g.err)
+		}
+	}
+}
+
+// failed returns the error which caused the guard to abort the consumer,
+// if any.
+func (g *decodeGuard) failed() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
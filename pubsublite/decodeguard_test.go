@@ -0,0 +1,83 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestDecodeGuard(t *testing.T) {
+	assert.Nil(t, newDecodeGuard(DecodeGuard{}))
+	assert.Equal(t, defaultDecodeGuardWindow, newDecodeGuard(DecodeGuard{Threshold: 0.9}).window)
+
+	g := newDecodeGuard(DecodeGuard{Threshold: 0.5, Window: 4})
+	// The rate isn't checked until the window is full.
+	for i := 0; i < 3; i++ {
+		g.record("a", true)
+	}
+	assert.NoError(t, g.failed())
+	// Failures of other subscriptions are tracked separately.
+	for i := 0; i < 4; i++ {
+		g.record("b", i%2 == 0)
+	}
+	assert.NoError(t, g.failed())
+	// The oldest results leave the window.
+	g.record("b", false)
+	g.record("b", true)
+	g.record("b", false)
+	assert.NoError(t, g.failed())
+
+	g.record("a", false)
+	assert.ErrorIs(t, g.failed(), ErrDecodeFailureRate)
+	assert.EqualError(t, g.failed(),
+		"pubsublite: decode failure rate exceeded: 3 of the last 4 messages of subscription a failed to decode, check the subscription and decoder",
+	)
+}
+
+func TestDecodeGuardValidate(t *testing.T) {
+	assert.NoError(t, DecodeGuard{}.validate())
+	assert.NoError(t, DecodeGuard{Threshold: 1, Window: 10}.validate())
+	assert.Error(t, DecodeGuard{Threshold: 1.5}.validate())
+	assert.Error(t, DecodeGuard{Threshold: 0.5, Window: -1}.validate())
+}
+
+func TestConsumerDecodeGuard(t *testing.T) {
+	ctx, abort := context.WithCancelCause(context.Background())
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:    apmqueue.AtMostOnceDeliveryType,
+			DecodeGuard: DecodeGuard{Threshold: 0.5, Window: 4},
+		},
+	})
+	// The abort function is set by Run.
+	c.decodeGuard.abort = abort
+	c.processMessage(ctx, &pubsub.Message{Data: []byte(`{}`)})
+	c.processMessage(ctx, &pubsub.Message{Data: []byte(`invalid`)})
+	c.processMessage(ctx, &pubsub.Message{Data: []byte(`{}`)})
+	c.processMessage(ctx, &pubsub.Message{Data: []byte(`invalid`)})
+	assert.NoError(t, context.Cause(ctx))
+
+	c.processMessage(ctx, &pubsub.Message{Data: []byte(`invalid`)})
+	assert.ErrorIs(t, context.Cause(ctx), ErrDecodeFailureRate)
+}
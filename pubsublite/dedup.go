@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyAttribute is the message attribute which holds the
+// idempotency key of the published event. See
+// ProducerConfig.IdempotencyKeyFn.
+const IdempotencyKeyAttribute = "idempotency-key"
+
+// defaultDeduplicationWindow is the default ProducerConfig.DeduplicationWindow.
+const defaultDeduplicationWindow = time.Minute
+
+// recentKeys holds the idempotency keys published within the deduplication
+// window, in the order they were published.
+type recentKeys struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []recentKey
+}
+
+// recentKey is an idempotency key and the time it was published.
+type recentKey struct {
+	key  string
+	seen time.Time
+}
+
+func newRecentKeys(window time.Duration, now func() time.Time) *recentKeys {
+	return &recentKeys{
+		window: window,
+		now:    now,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// add records the key, returning false if it was already published within
+// the window.
+func (r *recentKeys) add(key string) bool {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+	if _, ok := r.seen[key]; ok {
+		return false
+	}
+	r.seen[key] = now
+	r.order = append(r.order, recentKey{key: key, seen: now})
+	return true
+}
+
+// forget removes the key, so the event can be published again, i.e. once
+// publishing it failed.
+func (r *recentKeys) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.seen, key)
+}
+
+// expire removes the keys published before the window.
+func (r *recentKeys) expire(now time.Time) {
+	var i int
+	for ; i < len(r.order) && now.Sub(r.order[i].seen) >= r.window; i++ {
+		// The key may have been forgotten and added again since.
+		if seen, ok := r.seen[r.order[i].key]; ok && seen.Equal(r.order[i].seen) {
+			delete(r.seen, r.order[i].key)
+		}
+	}
+	r.order = r.order[i:]
+}
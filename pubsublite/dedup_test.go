@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRecentKeys(t *testing.T) {
+	now := time.Now()
+	keys := newRecentKeys(time.Minute, func() time.Time { return now })
+	assert.True(t, keys.add("a"))
+	assert.False(t, keys.add("a"))
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, keys.add("b"))
+	assert.False(t, keys.add("a"))
+
+	// Keys are published again once they're out of the window.
+	now = now.Add(30 * time.Second)
+	assert.True(t, keys.add("a"))
+	assert.False(t, keys.add("b"))
+
+	// Forgotten keys can be published again.
+	keys.forget("b")
+	assert.True(t, keys.add("b"))
+	// The re-published key isn't expired with the key it replaced.
+	now = now.Add(30 * time.Second)
+	assert.False(t, keys.add("b"))
+	assert.Len(t, keys.seen, 2)
+}
+
+func TestProducerForgetsFailedIdempotencyKeys(t *testing.T) {
+	p := &Producer{
+		cfg:       ProducerConfig{Logger: zap.NewNop()},
+		published: newRecentKeys(time.Minute, time.Now),
+	}
+	p.published.add("a")
+	p.published.add("b")
+	p.blockUntilProduced(context.Background(), []resTopic{
+		{response: fakeResult{id: "1"}, topic: "topic", key: "a"},
+		{response: fakeResult{err: errors.New("publisher terminated")}, topic: "topic", key: "b"},
+	})
+	assert.False(t, p.published.add("a"))
+	assert.True(t, p.published.add("b"))
+}
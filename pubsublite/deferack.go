@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDeferredAckTimeout is the default ConsumerConfig.DeferredAckTimeout.
+const defaultDeferredAckTimeout = time.Minute
+
+// ErrDeferredAckTimeout is the processing error of messages whose deferred
+// acknowledgement isn't settled within the DeferredAckTimeout.
+var ErrDeferredAckTimeout = errors.New("pubsublite: deferred ack timed out")
+
+type deferredAckKey struct{}
+
+// deferredAck holds the state of the deferred acknowledgement of a message.
+type deferredAck struct {
+	deferred atomic.Bool
+	once     sync.Once
+	done     chan error
+}
+
+func newDeferredAck() *deferredAck {
+	return &deferredAck{done: make(chan error, 1)}
+}
+
+// DeferAck defers the acknowledgement of the message being processed until
+// the returned done function is called, i.e. once a downstream system has
+// confirmed an asynchronous write. It must be called with the context passed
+// to the Processor, before Process returns.
+//
+// When done is called with a nil error, the message is acknowledged,
+// otherwise it's handled as a processing failure. If done isn't called within
+// the DeferredAckTimeout, the message is handled as a processing failure with
+// ErrDeferredAckTimeout. Failures which happen once the consumer is closing
+// are handled according to the OnContextCancel policy instead, i.e. the
+// message is redelivered. Only the first call to done has any effect.
+//
+// Messages count towards the subscriber flow control limits until they're
+// acknowledged, so deferring acknowledgements reduces the number of messages
+// that can be received, and the consumer doesn't stop until all deferred
+// acknowledgements are settled or timed out.
+//
+// Deferred acknowledgements are only supported with AtLeastOnceDeliveryType,
+// ok is false otherwise.
+func DeferAck(ctx context.Context) (done func(err error), ok bool) {
+	d, ok := ctx.Value(deferredAckKey{}).(*deferredAck)
+	if !ok {
+		return nil, false
+	}
+	d.deferred.Store(true)
+	return func(err error) {
+		d.once.Do(func() { d.done <- err })
+	}, true
+}
+
+// wait blocks until the deferred acknowledgement is settled, returning its
+// error, or ErrDeferredAckTimeout if it isn't settled within timeout.
+func (d *deferredAck) wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-d.done:
+		return err
+	case <-timer.C:
+		return ErrDeferredAckTimeout
+	}
+}
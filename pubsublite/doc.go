@@ -17,4 +17,12 @@
 
 // Package pubsublite abstracts the production and consumption of model.Batch
 // to and from GCP PubSub Lite.
+//
+// The producer injects the trace context and baggage of the produced events
+// into the message attributes using the global otel propagator, and the
+// consumer extracts them into the context passed to the processor. Baggage is
+// only propagated when the global propagator includes propagation.Baggage.
+// The W3C baggage header is limited to 8192 bytes, and is stored as a single
+// message attribute, so it's also subject to the Pub/Sub Lite limits on the
+// attribute value and message sizes, past which publishing fails.
 package pubsublite
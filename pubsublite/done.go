@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import "sync"
+
+// runDone is closed once Run returns, and holds the error it returned.
+type runDone struct {
+	once sync.Once
+	ch   chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+func (d *runDone) init() {
+	d.once.Do(func() { d.ch = make(chan struct{}) })
+}
+
+func (d *runDone) done() <-chan struct{} {
+	d.init()
+	return d.ch
+}
+
+// finish records the error returned by Run and closes the channel. Only
+// the first call has any effect.
+func (d *runDone) finish(err error) {
+	d.init()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.err, d.closed = err, true
+	close(d.ch)
+}
+
+func (d *runDone) error() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
@@ -0,0 +1,269 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/api/option"
+)
+
+// EncryptionAttribute is the message attribute which holds the scheme used
+// to encrypt the message payload. Messages without it aren't decrypted.
+const EncryptionAttribute = "encryption"
+
+// ErrDecryptionFailed is wrapped by the errors of the messages which can't
+// be decrypted.
+var ErrDecryptionFailed = errors.New("decryption failed")
+
+// Encrypter encrypts the payload of the produced messages.
+type Encrypter interface {
+	// Encrypt encrypts the payload, and returns the attributes to set on its
+	// message, which must include the EncryptionAttribute.
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, map[string]string, error)
+}
+
+// Decrypter decrypts the payload of the consumed messages whose
+// EncryptionAttribute is set.
+type Decrypter interface {
+	// Decrypt decrypts the payload given the message attributes.
+	Decrypt(ctx context.Context, ciphertext []byte, attrs map[string]string) ([]byte, error)
+}
+
+// PassthroughEncryption is an Encrypter and Decrypter which leaves payloads
+// unchanged, i.e. for tests.
+type PassthroughEncryption struct{}
+
+// Encrypt returns the payload as is.
+func (PassthroughEncryption) Encrypt(_ context.Context, plaintext []byte) ([]byte, map[string]string, error) {
+	return plaintext, map[string]string{EncryptionAttribute: "none"}, nil
+}
+
+// Decrypt returns the payload as is.
+func (PassthroughEncryption) Decrypt(_ context.Context, ciphertext []byte, _ map[string]string) ([]byte, error) {
+	return ciphertext, nil
+}
+
+const (
+	// kmsEnvelopeScheme is the EncryptionAttribute of the messages encrypted
+	// by a KMSEnvelope.
+	kmsEnvelopeScheme = "kms-aes256-gcm"
+	// dataKeyAttribute is the message attribute which holds the data key
+	// of a KMSEnvelope encrypted message, itself encrypted with KMS.
+	dataKeyAttribute = "encryption-key"
+	// dataKeyRotation is how long a KMSEnvelope encrypts messages with the
+	// same data key.
+	dataKeyRotation = time.Hour
+	// maxCachedDataKeys bounds the number of decrypted data keys cached by
+	// a KMSEnvelope.
+	maxCachedDataKeys = 100
+)
+
+// keyWrapper encrypts and decrypts data keys.
+type keyWrapper interface {
+	wrap(ctx context.Context, key []byte) ([]byte, error)
+	unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// KMSEnvelope is an Encrypter and Decrypter implementing envelope
+// encryption with Cloud KMS: payloads are encrypted with AES-256-GCM data
+// keys, which are encrypted with a KMS key and stored alongside each
+// message. Data keys are rotated every hour, and the decrypted data keys
+// are cached, so KMS isn't called for every message.
+type KMSEnvelope struct {
+	wrapper keyWrapper
+	close   func() error
+	now     func() time.Time
+
+	mu      sync.Mutex
+	key     cipher.AEAD
+	wrapped string
+	created time.Time
+	keys    map[string]cipher.AEAD
+}
+
+// NewKMSEnvelope returns a KMSEnvelope which encrypts the data keys with
+// the KMS key, in the format
+// "projects/PROJECT/locations/LOCATION/keyRings/KEY_RING/cryptoKeys/KEY".
+func NewKMSEnvelope(ctx context.Context, keyName string, opts ...option.ClientOption) (*KMSEnvelope, error) {
+	client, err := kms.NewKeyManagementClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsublite: failed creating kms client: %w", err)
+	}
+	return newKMSEnvelope(kmsKeyWrapper{client: client, keyName: keyName}, client.Close), nil
+}
+
+func newKMSEnvelope(wrapper keyWrapper, close func() error) *KMSEnvelope {
+	return &KMSEnvelope{
+		wrapper: wrapper,
+		close:   close,
+		now:     time.Now,
+		keys:    make(map[string]cipher.AEAD),
+	}
+}
+
+// Close closes the KMS client.
+func (e *KMSEnvelope) Close() error {
+	return e.close()
+}
+
+// Encrypt encrypts the payload with the current data key.
+func (e *KMSEnvelope) Encrypt(ctx context.Context, plaintext []byte) ([]byte, map[string]string, error) {
+	key, wrapped, err := e.dataKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, key.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed generating nonce: %w", err)
+	}
+	return key.Seal(nonce, nonce, plaintext, nil), map[string]string{
+		EncryptionAttribute: kmsEnvelopeScheme,
+		dataKeyAttribute:    wrapped,
+	}, nil
+}
+
+// Decrypt decrypts the payload with the data key stored in the attributes.
+func (e *KMSEnvelope) Decrypt(ctx context.Context, ciphertext []byte, attrs map[string]string) ([]byte, error) {
+	if scheme := attrs[EncryptionAttribute]; scheme != kmsEnvelopeScheme {
+		return nil, fmt.Errorf("unsupported encryption scheme %q", scheme)
+	}
+	key, err := e.cachedKey(ctx, attrs[dataKeyAttribute])
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < key.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:key.NonceSize()], ciphertext[key.NonceSize():]
+	return key.Open(nil, nonce, ciphertext, nil)
+}
+
+// dataKey returns the current data key and its encrypted form, generating
+// a new one when it's older than dataKeyRotation.
+func (e *KMSEnvelope) dataKey(ctx context.Context) (cipher.AEAD, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.key != nil && e.now().Sub(e.created) < dataKeyRotation {
+		return e.key, e.wrapped, nil
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", fmt.Errorf("failed generating data key: %w", err)
+	}
+	wrapped, err := e.wrapper.wrap(ctx, raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed encrypting data key: %w", err)
+	}
+	key, err := newAEAD(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	e.key, e.wrapped, e.created = key, base64.StdEncoding.EncodeToString(wrapped), e.now()
+	e.cache(e.wrapped, key)
+	return e.key, e.wrapped, nil
+}
+
+// cachedKey returns the decrypted data key, decrypting it with KMS if it
+// isn't cached yet.
+func (e *KMSEnvelope) cachedKey(ctx context.Context, wrapped string) (cipher.AEAD, error) {
+	e.mu.Lock()
+	key, ok := e.keys[wrapped]
+	e.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(decoded) == 0 {
+		return nil, fmt.Errorf("invalid %s attribute", dataKeyAttribute)
+	}
+	raw, err := e.wrapper.unwrap(ctx, decoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting data key: %w", err)
+	}
+	if key, err = newAEAD(raw); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cache(wrapped, key)
+	return key, nil
+}
+
+// cache caches the decrypted data key. It must be called with e.mu held.
+func (e *KMSEnvelope) cache(wrapped string, key cipher.AEAD) {
+	if len(e.keys) >= maxCachedDataKeys {
+		e.keys = make(map[string]cipher.AEAD)
+	}
+	e.keys[wrapped] = key
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// kmsKeyWrapper encrypts and decrypts data keys with a Cloud KMS key.
+type kmsKeyWrapper struct {
+	client  *kms.KeyManagementClient
+	keyName string
+}
+
+func (w kmsKeyWrapper) wrap(ctx context.Context, key []byte) ([]byte, error) {
+	resp, err := w.client.Encrypt(ctx, &kmspb.EncryptRequest{Name: w.keyName, Plaintext: key})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+func (w kmsKeyWrapper) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := w.client.Decrypt(ctx, &kmspb.DecryptRequest{Name: w.keyName, Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// decrypt decrypts the message payload if its EncryptionAttribute is set.
+func (c *consumer[T]) decrypt(ctx context.Context, data []byte, attrs map[string]string) ([]byte, error) {
+	if _, ok := attrs[EncryptionAttribute]; !ok {
+		return data, nil
+	}
+	if c.decrypter == nil {
+		return nil, fmt.Errorf("%w: no decrypter configured", ErrDecryptionFailed)
+	}
+	decrypted, err := c.decrypter.Decrypt(ctx, data, attrs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestKMSEnvelope(t *testing.T) {
+	wrapper := &fakeKeyWrapper{}
+	e := newKMSEnvelope(wrapper, func() error { return nil })
+	now := time.Now()
+	e.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	ciphertext, attrs, err := e.Encrypt(ctx, []byte("payload"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), "payload")
+	assert.Equal(t, kmsEnvelopeScheme, attrs[EncryptionAttribute])
+	plaintext, err := e.Decrypt(ctx, ciphertext, attrs)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("payload"), plaintext)
+
+	// The data key is reused until it's rotated, and decrypted data keys
+	// are cached.
+	_, attrs2, err := e.Encrypt(ctx, []byte("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, attrs, attrs2)
+	now = now.Add(dataKeyRotation)
+	ciphertext3, attrs3, err := e.Encrypt(ctx, []byte("payload"))
+	require.NoError(t, err)
+	assert.NotEqual(t, attrs[dataKeyAttribute], attrs3[dataKeyAttribute])
+	_, err = e.Decrypt(ctx, ciphertext3, attrs3)
+	require.NoError(t, err)
+	_, err = e.Decrypt(ctx, ciphertext, attrs)
+	require.NoError(t, err)
+	assert.Equal(t, 2, wrapper.wraps)
+	assert.Equal(t, 0, wrapper.unwraps, "keys generated by the envelope are cached")
+
+	// Decrypting with another envelope requires decrypting the data key.
+	other := newKMSEnvelope(wrapper, func() error { return nil })
+	_, err = other.Decrypt(ctx, ciphertext, attrs)
+	require.NoError(t, err)
+	_, err = other.Decrypt(ctx, ciphertext, attrs)
+	require.NoError(t, err)
+	assert.Equal(t, 1, wrapper.unwraps)
+
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = e.Decrypt(ctx, tampered, attrs)
+	assert.Error(t, err)
+	_, err = e.Decrypt(ctx, ciphertext, map[string]string{EncryptionAttribute: "none"})
+	assert.EqualError(t, err, `unsupported encryption scheme "none"`)
+}
+
+func TestConsumerDecrypt(t *testing.T) {
+	envelope := newKMSEnvelope(&fakeKeyWrapper{}, func() error { return nil })
+	results := make(chan ProcessResult, 10)
+	var processed []string
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:  apmqueue.AtLeastOnceDeliveryType,
+			Results:   results,
+			Decrypter: envelope,
+		},
+		Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			processed = append(processed, events[0].Name)
+			return nil
+		}),
+	})
+	encrypted, attrs, err := envelope.Encrypt(context.Background(), []byte(`{"name":"encrypted"}`))
+	require.NoError(t, err)
+	c.processMessage(context.Background(), &pubsub.Message{Data: encrypted, Attributes: attrs})
+	c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{"name":"plain"}`)})
+	assert.Equal(t, []string{"encrypted", "plain"}, processed)
+	assert.Equal(t, OutcomeAcked, (<-results).Outcome)
+	assert.Equal(t, OutcomeAcked, (<-results).Outcome)
+
+	c.processMessage(context.Background(), &pubsub.Message{Data: []byte(`{}`), Attributes: attrs})
+	r := <-results
+	assert.Equal(t, OutcomeNacked, r.Outcome)
+	assert.ErrorIs(t, r.Err, ErrDecryptionFailed)
+
+	c.decrypter = nil
+	c.processMessage(context.Background(), &pubsub.Message{Data: encrypted, Attributes: attrs})
+	r = <-results
+	assert.Equal(t, OutcomeNacked, r.Outcome)
+	assert.ErrorIs(t, r.Err, ErrDecryptionFailed)
+	assert.Len(t, processed, 2)
+}
+
+func TestPassthroughEncryption(t *testing.T) {
+	var e PassthroughEncryption
+	data, attrs, err := e.Encrypt(context.Background(), []byte("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{EncryptionAttribute: "none"}, attrs)
+	data, err = e.Decrypt(context.Background(), data, attrs)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("payload"), data)
+}
+
+// fakeKeyWrapper "encrypts" data keys by prefixing them.
+type fakeKeyWrapper struct {
+	wraps, unwraps int
+}
+
+func (w *fakeKeyWrapper) wrap(_ context.Context, key []byte) ([]byte, error) {
+	w.wraps++
+	return append([]byte("wrapped:"), key...), nil
+}
+
+func (w *fakeKeyWrapper) unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	w.unwraps++
+	if !bytes.HasPrefix(wrapped, []byte("wrapped:")) {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return bytes.TrimPrefix(wrapped, []byte("wrapped:")), nil
+}
@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// eventTypeKey is the attribute key holding the type of the processed event.
+const eventTypeKey = attribute.Key("event.type")
+
+// unknownEventType is the event type of events which aren't of a known type.
+const unknownEventType = "unknown"
+
+// knownEventTypes bounds the values of the event.type attribute, so it's safe
+// to use as a metric attribute.
+var knownEventTypes = map[string]struct{}{
+	"transaction": {},
+	"span":        {},
+	"error":       {},
+	"metric":      {},
+	"log":         {},
+}
+
+// eventType returns the type of the event. The processor event is used when
+// it's a known type, otherwise the type is derived from the populated event
+// fields.
+func eventType(event *model.APMEvent) string {
+	if _, ok := knownEventTypes[event.Processor.Event]; ok {
+		return event.Processor.Event
+	}
+	switch {
+	case event.Transaction != nil:
+		return "transaction"
+	case event.Span != nil:
+		return "span"
+	case event.Error != nil:
+		return "error"
+	case event.Metricset != nil:
+		return "metric"
+	}
+	return unknownEventType
+}
+
+// batchEventType returns the type of the events decoded from a message. When
+// a BatchDecoder yields events of different types, unknown is returned.
+func batchEventType(events []model.APMEvent) string {
+	if len(events) == 0 {
+		return unknownEventType
+	}
+	typ := eventType(&events[0])
+	for i := range events[1:] {
+		if eventType(&events[i+1]) != typ {
+			return unknownEventType
+		}
+	}
+	return typ
+}
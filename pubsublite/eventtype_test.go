@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestConsumerEventTypeAttribute(t *testing.T) {
+	for name, tc := range map[string]struct {
+		event model.APMEvent
+		want  string
+	}{
+		"transaction": {event: model.APMEvent{Transaction: &model.Transaction{ID: "1"}}, want: "transaction"},
+		"span":        {event: model.APMEvent{Span: &model.Span{ID: "1"}}, want: "span"},
+		"error":       {event: model.APMEvent{Error: &model.Error{ID: "1"}}, want: "error"},
+		"metric":      {event: model.APMEvent{Metricset: &model.Metricset{Name: "app"}}, want: "metric"},
+		"log":         {event: model.APMEvent{Processor: model.LogProcessor}, want: "log"},
+		"unknown":     {event: model.APMEvent{Processor: model.Processor{Event: "custom"}}, want: "unknown"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			reader := sdkmetric.NewManualReader()
+			recorder := tracetest.NewSpanRecorder()
+			tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+			c := newTestConsumer(t, TypedConsumerConfig[model.APMEvent]{
+				ConsumerConfig: ConsumerConfig{
+					Delivery:           apmqueue.AtLeastOnceDeliveryType,
+					MeterProvider:      sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+					EventTypeAttribute: true,
+				},
+				Decoder: json.JSON{},
+			})
+			data, err := json.JSON{}.Encode(tc.event)
+			require.NoError(t, err)
+			ctx, span := tracer.Start(context.Background(), "pubsublite.Receive")
+			c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: data})
+			span.End()
+
+			want := attribute.String("event.type", tc.want)
+			spans := recorder.Ended()
+			require.Len(t, spans, 1)
+			assert.Equal(t, []attribute.KeyValue{want}, spans[0].Attributes())
+
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, reader.Collect(context.Background(), &rm))
+			hist, ok := findMetric(t, rm, "consumer.process.duration").Data.(metricdata.Histogram[float64])
+			require.True(t, ok)
+			require.Len(t, hist.DataPoints, 1)
+			assert.Equal(t, attribute.NewSet(append([]attribute.KeyValue{want}, c.telemetryAttributes...)...), hist.DataPoints[0].Attributes)
+		})
+	}
+}
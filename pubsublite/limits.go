@@ -0,0 +1,130 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limiter enforces the RateLimit and MaxConcurrency of the live config
+// across all the subscriptions of a consumer. The limits are read from the
+// live config on every acquisition, so Reconfigure changes them without
+// recreating the limiter.
+type limiter struct {
+	live *atomic.Pointer[liveConfig]
+
+	mu sync.Mutex
+	// next is the earliest time at which the next message may be processed
+	// according to the rate limit.
+	next time.Time
+	// active is the number of messages being processed.
+	active int
+	// changed is closed and replaced when a message stops being processed,
+	// or when the limits change, to wake the goroutines waiting for a slot.
+	changed chan struct{}
+}
+
+func newLimiter(live *atomic.Pointer[liveConfig]) *limiter {
+	return &limiter{live: live, changed: make(chan struct{})}
+}
+
+// acquire waits until the message can be processed according to the rate
+// limit and the maximum concurrency. The returned function must be called
+// once the message has been processed. If ctx is done first, its error is
+// returned. A nil limiter doesn't limit processing.
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.wait(ctx); err != nil {
+		return nil, err
+	}
+	for {
+		l.mu.Lock()
+		max := loadConfig(l.live).partial.MaxConcurrency
+		if max <= 0 || l.active < max {
+			l.active++
+			l.mu.Unlock()
+			return l.release, nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// wait waits for the next slot of the rate limit, if any. The slots are
+// evenly spaced, without bursts.
+func (l *limiter) wait(ctx context.Context) error {
+	limit := loadConfig(l.live).partial.RateLimit
+	if limit <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / limit)
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(interval)
+	l.mu.Unlock()
+	delay := at.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.notify()
+}
+
+// reconfigured wakes the goroutines waiting for a slot once the limits have
+// changed, so a raised MaxConcurrency applies immediately.
+func (l *limiter) reconfigured() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notify()
+}
+
+// notify must be called with l.mu held.
+func (l *limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterMaxConcurrency(t *testing.T) {
+	live := newLive(PartialConfig{MaxConcurrency: 1})
+	l := newLimiter(live)
+	release, err := l.acquire(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	acquired := make(chan func())
+	go func() {
+		release, err := l.acquire(context.Background())
+		assert.NoError(t, err)
+		acquired <- release
+	}()
+	// Raising the limit wakes the waiting goroutine.
+	live.Store(newLiveConfig(PartialConfig{MaxConcurrency: 2}))
+	l.reconfigured()
+	(<-acquired)()
+	release()
+	assert.Zero(t, l.active)
+}
+
+func TestLimiterRateLimit(t *testing.T) {
+	l := newLimiter(newLive(PartialConfig{RateLimit: 100}))
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		release, err := l.acquire(context.Background())
+		require.NoError(t, err)
+		release()
+	}
+	// The first message is processed immediately, the others every 10ms.
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	// Messages waiting for the rate limit are cancelled with ctx.
+	l.live.Store(newLiveConfig(PartialConfig{RateLimit: 0.001}))
+	_, err := l.acquire(context.Background())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestLimiterNil(t *testing.T) {
+	var l *limiter
+	release, err := l.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+	l.reconfigured()
+}
@@ -0,0 +1,135 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxSampledErrors bounds the number of distinct errors tracked by the
+// errorSampler. Once exceeded, errors whose interval has elapsed are evicted.
+const maxSampledErrors = 1000
+
+// LogSampling configures the sampling of the per message error logs.
+type LogSampling struct {
+	// Interval is the period over which identical errors are sampled. The
+	// number of suppressed errors is logged as the "suppressed" field of the
+	// first identical error logged after the interval has elapsed. Disabled
+	// when <= 0.
+	Interval time.Duration
+	// First is the number of identical errors which are logged per Interval.
+	// If First <= 0, defaults to 1.
+	First int
+}
+
+type sampleKey struct {
+	msg string
+	err string
+}
+
+type sampleCount struct {
+	start time.Time
+	n     int
+}
+
+// errorSampler samples error logs, keyed by their message and error, so that
+// repeated identical errors are coalesced while distinct errors are logged.
+type errorSampler struct {
+	interval time.Duration
+	first    int
+	now      func() time.Time
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+func newErrorSampler(cfg LogSampling, now func() time.Time) *errorSampler {
+	if cfg.Interval <= 0 {
+		return nil
+	}
+	if cfg.First <= 0 {
+		cfg.First = 1
+	}
+	return &errorSampler{
+		interval: cfg.Interval,
+		first:    cfg.First,
+		now:      now,
+		counts:   make(map[sampleKey]*sampleCount),
+	}
+}
+
+// error logs msg with err at error level, unless the same error has already
+// been logged First times in the current interval. A nil sampler logs every
+// error.
+func (s *errorSampler) error(logger *zap.Logger, msg string, err error, fields ...zap.Field) {
+	if s == nil {
+		logger.Error(msg, append(fields, zap.Error(err))...)
+		return
+	}
+	ok, suppressed := s.check(sampleKey{msg: msg, err: err.Error()})
+	if !ok {
+		return
+	}
+	fields = append(fields, zap.Error(err))
+	if suppressed > 0 {
+		fields = append(fields, zap.Int("suppressed", suppressed))
+	}
+	logger.Error(msg, fields...)
+}
+
+// check returns whether the error must be logged and, when it starts a new
+// interval, how many identical errors were suppressed in the previous one.
+func (s *errorSampler) check(key sampleKey) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	count, ok := s.counts[key]
+	if !ok {
+		if len(s.counts) >= maxSampledErrors {
+			s.evict(now)
+			if len(s.counts) >= maxSampledErrors {
+				return true, 0
+			}
+		}
+		s.counts[key] = &sampleCount{start: now, n: 1}
+		return true, 0
+	}
+	if now.Sub(count.start) >= s.interval {
+		suppressed := count.n - s.first
+		if suppressed < 0 {
+			suppressed = 0
+		}
+		count.start, count.n = now, 1
+		return true, suppressed
+	}
+	count.n++
+	return count.n <= s.first, 0
+}
+
+// evict removes the errors whose interval has elapsed. It must be called with
+// s.mu held.
+func (s *errorSampler) evict(now time.Time) {
+	for key, count := range s.counts {
+		if now.Sub(count.start) >= s.interval {
+			delete(s.counts, key)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestErrorSampler(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	logger := zap.New(core)
+	now := time.Now()
+	s := newErrorSampler(LogSampling{Interval: time.Second, First: 2},
+		func() time.Time { return now },
+	)
+	errA, errB := errors.New("a"), errors.New("b")
+
+	for i := 0; i < 5; i++ {
+		s.error(logger, "unable to process event", errA)
+	}
+	s.error(logger, "unable to process event", errB)
+	s.error(logger, "unable to decode message.Data", errA)
+	require.Equal(t, 4, logs.Len())
+	assert.Equal(t, 2, logs.FilterField(zap.Error(errA)).FilterMessage("unable to process event").Len())
+
+	now = now.Add(time.Second)
+	s.error(logger, "unable to process event", errA)
+	entries := logs.TakeAll()
+	require.Len(t, entries, 5)
+	assert.Equal(t, map[string]any{"error": "a", "suppressed": int64(3)},
+		entries[4].ContextMap(),
+	)
+}
+
+func TestErrorSamplerDisabled(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	s := newErrorSampler(LogSampling{}, time.Now)
+	assert.Nil(t, s)
+	for i := 0; i < 5; i++ {
+		s.error(zap.New(core), "unable to process event", errors.New("a"))
+	}
+	assert.Equal(t, 5, logs.Len())
+}
@@ -0,0 +1,219 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/metric"
+)
+
+// DefaultLatencyBuckets returns the histogram bucket boundaries, in seconds,
+// of the consumer latency histograms when ConsumerConfig.LatencyBuckets is
+// not set. They range from sub-millisecond processing to messages stuck for
+// minutes. A new slice is returned on every call, so callers may modify it.
+func DefaultLatencyBuckets() []float64 {
+	return []float64{
+		0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+		1, 2.5, 5, 10, 30, 60, 120, 300,
+	}
+}
+
+// validateLatencyBuckets returns an error if the boundaries aren't strictly
+// increasing.
+func validateLatencyBuckets(boundaries []float64) error {
+	for i := 1; i < len(boundaries); i++ {
+		if boundaries[i] <= boundaries[i-1] {
+			return fmt.Errorf("pubsublite: latency buckets must be strictly increasing, got %v", boundaries)
+		}
+	}
+	return nil
+}
+
+// consumerMetrics holds the instruments used to record consumer metrics.
+type consumerMetrics struct {
+	ackHeadroom      metric.Float64Histogram
+	expired          metric.Int64Counter
+	ackBatch         metric.Int64Histogram
+	panics           metric.Int64Counter
+	late             metric.Int64Counter
+	deliveryLag      metric.Float64Histogram
+	duplicate        metric.Int64Counter
+	attempts         metric.Int64Histogram
+	duration         metric.Float64Histogram
+	shadowErrors     metric.Int64Counter
+	unsupported      metric.Int64Counter
+	dwell            metric.Float64Histogram
+	missingAttribute metric.Int64Counter
+	deadlineRisk     metric.Int64Counter
+	stageDuration    metric.Float64Histogram
+	attributeValue   metric.Int64Counter
+	auditBuffered    metric.Int64UpDownCounter
+	auditDropped     metric.Int64Counter
+	offsetAnomaly    metric.Int64Counter
+	reassignments    metric.Int64Counter
+	throughput       metric.Float64ObservableGauge
+	recovered        metric.Int64Counter
+	partitionBackoff metric.Float64Histogram
+	filtered         metric.Int64Counter
+}
+
+// newConsumerMetrics creates the consumer instruments. The latency buckets
+// are the boundaries of the consumer.process.duration and
+// consumer.message.dwell histograms, DefaultLatencyBuckets when empty. Views
+// registered with the MeterProvider take precedence over them.
+func newConsumerMetrics(mp metric.MeterProvider, latencyBuckets []float64) (consumerMetrics, error) {
+	if len(latencyBuckets) == 0 {
+		latencyBuckets = DefaultLatencyBuckets()
+	}
+	meter := mp.Meter("pubsublite")
+	var m consumerMetrics
+	var err error
+	var errs []error
+	if m.ackHeadroom, err = meter.Float64Histogram("consumer.ack.headroom",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time remaining until the ack deadline when a message is acked"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.expired, err = meter.Int64Counter("consumer.expired.attribute",
+		metric.WithDescription("Number of messages dropped due to their expires-at attribute"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.ackBatch, err = meter.Int64Histogram("consumer.ack.batch.size",
+		metric.WithDescription("Number of messages acknowledged together"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.panics, err = meter.Int64Counter("consumer.processor.panics",
+		metric.WithDescription("Number of panics recovered while processing messages"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.late, err = meter.Int64Counter("consumer.reorder.late",
+		metric.WithDescription("Number of messages dropped for arriving too late to be processed in publish time order"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.deliveryLag, err = meter.Float64Histogram("consumer.delivery.lag",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time between a message's original publish time and its receipt"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.duplicate, err = meter.Int64Counter("consumer.duplicate",
+		metric.WithDescription("Number of messages acknowledged because the processor had already processed them"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.attempts, err = meter.Int64Histogram("consumer.attempts.to.success",
+		metric.WithDescription("Delivery attempt on which messages were successfully processed, 1 for the first attempt"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.duration, err = meter.Float64Histogram("consumer.process.duration",
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...),
+		metric.WithDescription("Time spent processing a decoded message"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.shadowErrors, err = meter.Int64Counter("consumer.shadow.errors",
+		metric.WithDescription("Number of messages which the shadow processor failed to process"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.unsupported, err = meter.Int64Counter("consumer.unsupported.schema",
+		metric.WithDescription("Number of messages dropped due to their unsupported schema-version attribute"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.dwell, err = meter.Float64Histogram("consumer.message.dwell",
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...),
+		metric.WithDescription("Time between a message's receipt and its acknowledgement, nack or retry, by outcome and error kind"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.missingAttribute, err = meter.Int64Counter("consumer.missing.attribute",
+		metric.WithDescription("Number of messages missing a required attribute, by attribute"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.deadlineRisk, err = meter.Int64Counter("consumer.deadline.risk",
+		metric.WithDescription("Number of times the P99 processing duration was found close to the ack deadline"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.stageDuration, err = meter.Float64Histogram("consumer.pipeline.stage.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time spent transforming a message payload, by pipeline stage"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.attributeValue, err = meter.Int64Counter("consumer.attribute.value",
+		metric.WithDescription("Number of messages received, by observed attribute and value"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.auditBuffered, err = meter.Int64UpDownCounter("consumer.audit.buffered",
+		metric.WithDescription("Number of sampled messages waiting to be published to the audit topic"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.auditDropped, err = meter.Int64Counter("consumer.audit.dropped",
+		metric.WithDescription("Number of sampled messages dropped because the audit buffer was full"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.filtered, err = meter.Int64Counter("consumer.filtered",
+		metric.WithDescription("Number of messages acknowledged without being processed because the filter rejected them"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.offsetAnomaly, err = meter.Int64Counter("consumer.offset.anomaly",
+		metric.WithDescription("Number of messages received with a skipped or non-increasing offset, by anomaly"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.reassignments, err = meter.Int64Counter("consumer.reassignment.count",
+		metric.WithDescription("Number of partition assignments received by the subscriber"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.throughput, err = meter.Float64ObservableGauge("consumer.throughput",
+		metric.WithUnit("{message}/s"),
+		metric.WithDescription("Number of messages acknowledged per second, as a moving average over the last minute"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.recovered, err = meter.Int64Counter("consumer.recovered",
+		metric.WithDescription("Number of messages processed successfully after failing to be processed"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	if m.partitionBackoff, err = meter.Float64Histogram("consumer.partition.backoff",
+		metric.WithUnit("s"),
+		metric.WithDescription("Delay applied before processing a message of a partition whose messages failed to be processed, by partition"),
+	); err != nil {
+		errs = append(errs, err)
+	}
+	return m, errors.Join(errs...)
+}
@@ -0,0 +1,71 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestLatencyBuckets(t *testing.T) {
+	for name, tc := range map[string]struct {
+		boundaries []float64
+		expected   []float64
+	}{
+		"default": {expected: DefaultLatencyBuckets()},
+		"custom":  {boundaries: []float64{0.1, 1, 10}, expected: []float64{0.1, 1, 10}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			reader := sdkmetric.NewManualReader()
+			metrics, err := newConsumerMetrics(sdkmetric.NewMeterProvider(
+				sdkmetric.WithReader(reader),
+			), tc.boundaries)
+			require.NoError(t, err)
+			ctx := context.Background()
+			metrics.duration.Record(ctx, 0.5)
+			metrics.dwell.Record(ctx, 0.5)
+			metrics.deliveryLag.Record(ctx, 0.5)
+
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, reader.Collect(ctx, &rm))
+			for _, name := range []string{"consumer.process.duration", "consumer.message.dwell"} {
+				hist, ok := findMetric(t, rm, name).Data.(metricdata.Histogram[float64])
+				require.True(t, ok)
+				require.Len(t, hist.DataPoints, 1)
+				assert.Equal(t, tc.expected, hist.DataPoints[0].Bounds, name)
+			}
+			// Other histograms keep the SDK default boundaries.
+			hist, ok := findMetric(t, rm, "consumer.delivery.lag").Data.(metricdata.Histogram[float64])
+			require.True(t, ok)
+			assert.NotEqual(t, tc.expected, hist.DataPoints[0].Bounds)
+		})
+	}
+}
+
+func TestValidateLatencyBuckets(t *testing.T) {
+	assert.NoError(t, validateLatencyBuckets(nil))
+	assert.NoError(t, validateLatencyBuckets([]float64{0.1, 1, 10}))
+	assert.EqualError(t, validateLatencyBuckets([]float64{1, 1}),
+		"pubsublite: latency buckets must be strictly increasing, got [1 1]",
+	)
+}
@@ -0,0 +1,146 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// partitionCountTTL is how long an out of bounds partition is rejected for
+// without looking up the partition count of the topic again.
+const partitionCountTTL = time.Minute
+
+// partitionRouter computes the ordering keys which route messages to a
+// specific partition. The pscompat publisher doesn't allow choosing the
+// partition of a message, but routes messages with an ordering key to the
+// partition given by the SHA-256 hash of the key modulo the partition count,
+// see routePartition.
+type partitionRouter struct {
+	// count returns the partition count of the topic.
+	count func(ctx context.Context, topic apmqueue.Topic) (int, error)
+	// now returns the current time, it's overridden in tests.
+	now     func() time.Time
+	lookups singleflight.Group
+
+	mu     sync.Mutex
+	counts map[apmqueue.Topic]partitionCount
+	keys   map[[2]int]string
+}
+
+// partitionCount is the partition count of a topic, and when it was looked
+// up.
+type partitionCount struct {
+	count   int
+	checked time.Time
+}
+
+func newPartitionRouter(count func(context.Context, apmqueue.Topic) (int, error)) *partitionRouter {
+	return &partitionRouter{
+		count:  count,
+		now:    time.Now,
+		counts: make(map[apmqueue.Topic]partitionCount),
+		keys:   make(map[[2]int]string),
+	}
+}
+
+// orderingKey returns an ordering key which routes messages to the topic
+// partition. An error is returned if the partition is out of bounds.
+func (r *partitionRouter) orderingKey(ctx context.Context, topic apmqueue.Topic, partition int) (string, error) {
+	count, err := r.partitionCount(ctx, topic, partition)
+	if err != nil {
+		return "", err
+	}
+	if partition < 0 || partition >= count {
+		return "", fmt.Errorf("partition %d out of bounds, topic %s has %d partitions",
+			partition, topic, count,
+		)
+	}
+	k := [2]int{count, partition}
+	r.mu.Lock()
+	key, ok := r.keys[k]
+	r.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	key = findOrderingKey(count, partition)
+	r.mu.Lock()
+	r.keys[k] = key
+	r.mu.Unlock()
+	return key, nil
+}
+
+// partitionCount returns the partition count of the topic. Partitions can be
+// added to a topic, so the count is looked up again when the partition is
+// out of the cached bounds, at most once per partitionCountTTL. Concurrent
+// lookups of a topic are deduplicated, and made without holding r.mu.
+func (r *partitionRouter) partitionCount(ctx context.Context, topic apmqueue.Topic, partition int) (int, error) {
+	r.mu.Lock()
+	cached, ok := r.counts[topic]
+	r.mu.Unlock()
+	if ok && (partition < cached.count || r.now().Sub(cached.checked) < partitionCountTTL) {
+		return cached.count, nil
+	}
+	v, err, _ := r.lookups.Do(string(topic), func() (any, error) {
+		count, err := r.count(ctx, topic)
+		if err != nil {
+			return 0, err
+		}
+		r.mu.Lock()
+		r.counts[topic] = partitionCount{count: count, checked: r.now()}
+		r.mu.Unlock()
+		return count, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed getting partition count of topic %s: %w", topic, err)
+	}
+	return v.(int), nil
+}
+
+// findOrderingKey searches for an ordering key which is routed to the
+// partition. Each candidate has a 1/count chance of being routed to it.
+func findOrderingKey(count, partition int) string {
+	n := big.NewInt(int64(count))
+	for i := 0; ; i++ {
+		key := "partition-" + strconv.Itoa(partition) + "-" + strconv.Itoa(i)
+		if routePartition(key, n) == partition {
+			return key
+		}
+	}
+}
+
+// routePartition returns the partition to which the message router of the
+// pscompat publisher routes messages with the ordering key. It mirrors the
+// hashingMsgRouter of cloud.google.com/go/pubsublite/internal/wire, as of
+// cloud.google.com/go/pubsublite v1.8.0, which can't be imported. The
+// routing must be checked again when upgrading the module, which
+// TestPartitionRouterPublisher does against a fake server.
+func routePartition(key string, count *big.Int) int {
+	h := sha256.Sum256([]byte(key))
+	num := new(big.Int).SetBytes(h[:])
+	return int(new(big.Int).Mod(num, count).Int64())
+}
@@ -0,0 +1,207 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsublite/apiv1/pubsublitepb"
+	"cloud.google.com/go/pubsublite/pscompat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestPartitionRouter(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[apmqueue.Topic]int{"topic": 4}
+	var lookups int
+	r := newPartitionRouter(func(_ context.Context, topic apmqueue.Topic) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups++
+		count, ok := counts[topic]
+		if !ok {
+			return 0, errors.New("topic not found")
+		}
+		return count, nil
+	})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for partition := 0; partition < 4; partition++ {
+		key, err := r.orderingKey(ctx, "topic", partition)
+		require.NoError(t, err)
+		assert.Equal(t, partition, routePartition(key, big.NewInt(4)))
+	}
+	assert.Equal(t, 1, lookups)
+
+	_, err := r.orderingKey(ctx, "topic", -1)
+	assert.EqualError(t, err, "partition -1 out of bounds, topic topic has 4 partitions")
+	_, err = r.orderingKey(ctx, "topic", 4)
+	assert.EqualError(t, err, "partition 4 out of bounds, topic topic has 4 partitions")
+	// Out of bounds partitions are rejected from the cache until it expires.
+	assert.Equal(t, 1, lookups)
+
+	// The partition count is looked up again when partitions are added.
+	mu.Lock()
+	counts["topic"] = 8
+	mu.Unlock()
+	_, err = r.orderingKey(ctx, "topic", 6)
+	assert.Error(t, err)
+	now = now.Add(partitionCountTTL)
+	key, err := r.orderingKey(ctx, "topic", 6)
+	require.NoError(t, err)
+	assert.Equal(t, 6, routePartition(key, big.NewInt(8)))
+	assert.Equal(t, 2, lookups)
+
+	_, err = r.orderingKey(ctx, "unknown", 0)
+	assert.ErrorContains(t, err, "failed getting partition count of topic unknown")
+}
+
+func TestPartitionRouterConcurrentLookups(t *testing.T) {
+	release := make(chan struct{})
+	var lookups atomic.Int32
+	r := newPartitionRouter(func(_ context.Context, topic apmqueue.Topic) (int, error) {
+		lookups.Add(1)
+		if topic == "slow" {
+			<-release
+		}
+		return 2, nil
+	})
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.orderingKey(ctx, "slow", 1)
+			assert.NoError(t, err)
+		}()
+	}
+	// The lookup of a topic doesn't block the other topics.
+	assert.Eventually(t, func() bool { return lookups.Load() == 1 }, time.Second, time.Millisecond)
+	_, err := r.orderingKey(ctx, "fast", 1)
+	require.NoError(t, err)
+	close(release)
+	wg.Wait()
+	// The concurrent lookups of the slow topic are deduplicated, though a
+	// lookup may start once the first one has completed.
+	assert.LessOrEqual(t, lookups.Load(), int32(6))
+	assert.GreaterOrEqual(t, lookups.Load(), int32(2))
+}
+
+// TestPartitionRouterPublisher checks that the ordering keys are routed to
+// their partition by the pscompat publisher, which hashes ordering keys in
+// its internal wire package, using a fake Pub/Sub Lite server.
+func TestPartitionRouterPublisher(t *testing.T) {
+	const partitions = 4
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pubsublitepb.RegisterAdminServiceServer(server, &fakeAdminServer{partitions: partitions})
+	pubsublitepb.RegisterPublisherServiceServer(server, &fakePublisherServer{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	ctx := context.Background()
+	publisher, err := pscompat.NewPublisherClient(ctx,
+		"projects/project/locations/us-central1-a/topics/topic",
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	require.NoError(t, err)
+	defer publisher.Stop()
+
+	r := newPartitionRouter(func(context.Context, apmqueue.Topic) (int, error) {
+		return partitions, nil
+	})
+	for partition := 0; partition < partitions; partition++ {
+		key, err := r.orderingKey(ctx, "topic", partition)
+		require.NoError(t, err)
+		id, err := publisher.Publish(ctx, &pubsub.Message{
+			Data: []byte("data"), OrderingKey: key,
+		}).Get(ctx)
+		require.NoError(t, err)
+		published, _ := partitionOffset(id)
+		assert.Equal(t, partition, published, "ordering key %s", key)
+	}
+}
+
+type fakeAdminServer struct {
+	pubsublitepb.UnimplementedAdminServiceServer
+	partitions int64
+}
+
+func (s *fakeAdminServer) GetTopicPartitions(context.Context, *pubsublitepb.GetTopicPartitionsRequest) (*pubsublitepb.TopicPartitions, error) {
+	return &pubsublitepb.TopicPartitions{PartitionCount: s.partitions}, nil
+}
+
+// fakePublisherServer accepts the published messages of every partition,
+// without returning their offsets.
+type fakePublisherServer struct {
+	pubsublitepb.UnimplementedPublisherServiceServer
+}
+
+func (*fakePublisherServer) Publish(stream pubsublitepb.PublisherService_PublishServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.GetInitialRequest() == nil {
+		return fmt.Errorf("unexpected request %v", req)
+	}
+	if err := stream.Send(&pubsublitepb.PublishResponse{
+		ResponseType: &pubsublitepb.PublishResponse_InitialResponse{
+			InitialResponse: &pubsublitepb.InitialPublishResponse{},
+		},
+	}); err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := stream.Send(&pubsublitepb.PublishResponse{
+			ResponseType: &pubsublitepb.PublishResponse_MessageResponse{
+				MessageResponse: &pubsublitepb.MessagePublishResponse{},
+			},
+		}); err != nil {
+			return err
+		}
+	}
+}
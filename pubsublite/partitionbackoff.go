@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// partitionBackoff tracks the consecutive processing failures of each
+// partition, delaying the processing of a failing partition's messages.
+type partitionBackoff struct {
+	backoff RetryBackoff
+
+	mu       sync.Mutex
+	failures map[int]int
+}
+
+func newPartitionBackoff(backoff RetryBackoff) *partitionBackoff {
+	if backoff.Initial <= 0 {
+		return nil
+	}
+	return &partitionBackoff{backoff: backoff, failures: make(map[int]int)}
+}
+
+// delay returns the delay before processing the next message of partition.
+func (b *partitionBackoff) delay(partition int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backoff.Delay(b.failures[partition])
+}
+
+// record records the result of processing a message of partition. A success
+// resets the partition's backoff.
+func (b *partitionBackoff) record(partition int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.failures[partition]++
+		return
+	}
+	delete(b.failures, partition)
+}
+
+// reset drops the failures of the partitions which aren't assigned.
+func (b *partitionBackoff) reset(assigned map[int]struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for partition := range b.failures {
+		if _, ok := assigned[partition]; !ok {
+			delete(b.failures, partition)
+		}
+	}
+}
+
+// throttle waits for the backoff delay of the message's partition, if any.
+// Messages of a partition are delivered one at a time, so only the failing
+// partition is throttled.
+func (c *consumer[T]) throttle(ctx context.Context, msg *pubsub.Message) error {
+	if c.partitionBackoff == nil {
+		return nil
+	}
+	partition, _ := partitionOffset(msg.ID)
+	delay := c.partitionBackoff.delay(partition)
+	if delay <= 0 {
+		return nil
+	}
+	c.metrics.partitionBackoff.Record(ctx, delay.Seconds(), metric.WithAttributes(append(
+		[]attribute.KeyValue{attribute.Int("partition", partition)},
+		c.telemetryAttributes...,
+	)...))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestPartitionBackoff(t *testing.T) {
+	assert.Nil(t, newPartitionBackoff(RetryBackoff{}))
+
+	b := newPartitionBackoff(RetryBackoff{Initial: time.Second, Max: 3 * time.Second})
+	require.NotNil(t, b)
+	assert.Zero(t, b.delay(0))
+
+	b.record(0, errors.New("boom"))
+	assert.Equal(t, time.Second, b.delay(0))
+	b.record(0, errors.New("boom"))
+	assert.Equal(t, 2*time.Second, b.delay(0))
+	b.record(0, errors.New("boom"))
+	assert.Equal(t, 3*time.Second, b.delay(0))
+	assert.Zero(t, b.delay(1))
+
+	b.record(0, nil)
+	assert.Zero(t, b.delay(0))
+
+	b.record(0, errors.New("boom"))
+	b.record(1, errors.New("boom"))
+	b.reset(map[int]struct{}{1: {}})
+	assert.Zero(t, b.delay(0))
+	assert.Equal(t, time.Second, b.delay(1))
+}
+
+func TestConsumerPartitionBackoff(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:         apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider:    sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			PartitionBackoff: RetryBackoff{Initial: 50 * time.Millisecond},
+		},
+		Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, events []customEvent) error {
+			if events[0].Name == "poison" {
+				return errors.New("boom")
+			}
+			return nil
+		}),
+	})
+	process := func(id, name string) time.Duration {
+		start := time.Now()
+		c.process(context.Background(), &pubsub.Message{ID: id, Data: []byte(`{"name":"` + name + `"}`)}, time.Now())
+		return time.Since(start)
+	}
+
+	assert.Less(t, process("0:1", "poison"), 50*time.Millisecond)
+	// The failing partition is throttled, the others aren't.
+	assert.Less(t, process("1:1", "ok"), 50*time.Millisecond)
+	assert.GreaterOrEqual(t, process("0:2", "ok"), 50*time.Millisecond)
+	// A successfully processed message resets the partition's backoff.
+	assert.Less(t, process("0:3", "ok"), 50*time.Millisecond)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	m := findMetric(t, rm, "consumer.partition.backoff")
+	hist := m.Data.(metricdata.Histogram[float64])
+	require.Len(t, hist.DataPoints, 1)
+	assert.Equal(t, uint64(1), hist.DataPoints[0].Count)
+	partition, ok := hist.DataPoints[0].Attributes.Value("partition")
+	require.True(t, ok)
+	assert.Equal(t, int64(0), partition.AsInt64())
+}
+
+func TestConsumerPartitionBackoffCancelled(t *testing.T) {
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:         apmqueue.AtLeastOnceDeliveryType,
+			PartitionBackoff: RetryBackoff{Initial: time.Hour},
+		},
+	})
+	c.partitionBackoff.record(0, errors.New("boom"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.throttle(ctx, &pubsub.Message{ID: "0:1"}), context.DeadlineExceeded)
+}
@@ -0,0 +1,122 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	pauseReasonManual      = "manual"
+	pauseReasonMaintenance = "maintenance"
+)
+
+// MaintenanceSchedule determines when message processing must be paused,
+// i.e. during scheduled maintenance of the downstream systems. It can be
+// implemented to support recurring (cron-like) schedules.
+type MaintenanceSchedule interface {
+	// InMaintenance returns true if t is within a maintenance window.
+	InMaintenance(t time.Time) bool
+}
+
+// MaintenanceWindow is a fixed maintenance window. Start is inclusive and End
+// is exclusive.
+type MaintenanceWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// MaintenanceWindows is a MaintenanceSchedule composed of fixed windows.
+type MaintenanceWindows []MaintenanceWindow
+
+// InMaintenance returns true if t is within any of the windows.
+func (w MaintenanceWindows) InMaintenance(t time.Time) bool {
+	for _, window := range w {
+		if !t.Before(window.Start) && t.Before(window.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// pauser gates message processing. It's paused while at least one reason to
+// pause is present.
+type pauser struct {
+	mu      sync.Mutex
+	reasons map[string]struct{}
+	// resumed is closed while the pauser isn't paused.
+	resumed chan struct{}
+}
+
+func newPauser() *pauser {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &pauser{reasons: make(map[string]struct{}), resumed: resumed}
+}
+
+// pause pauses processing for the specified reason.
+func (p *pauser) pause(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.reasons) == 0 {
+		p.resumed = make(chan struct{})
+	}
+	p.reasons[reason] = struct{}{}
+}
+
+// resume removes the specified reason, resuming processing when no other
+// reasons remain.
+func (p *pauser) resume(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.reasons[reason]; !ok {
+		return
+	}
+	delete(p.reasons, reason)
+	if len(p.reasons) == 0 {
+		close(p.resumed)
+	}
+}
+
+// pausedBy returns the sorted reasons why processing is paused.
+func (p *pauser) pausedBy() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reasons := make([]string, 0, len(p.reasons))
+	for r := range p.reasons {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// wait blocks until processing is resumed or the context is done.
+func (p *pauser) wait(ctx context.Context) error {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StageFunc transforms the raw payload of a message, i.e. decompressing or
+// decrypting it. attrs holds the message attributes, which must not be
+// modified.
+type StageFunc func(ctx context.Context, data []byte, attrs map[string]string) ([]byte, error)
+
+// Stage is a named step of a Pipeline.
+type Stage struct {
+	// Name identifies the stage in the span events and metrics.
+	Name string
+	// Transform transforms the payload.
+	Transform StageFunc
+}
+
+// Pipeline is an ordered list of stages which transform the raw payload of
+// each message before it's decoded. The payload returned by each stage is
+// passed to the next one, and the payload returned by the last one is
+// decoded.
+type Pipeline []Stage
+
+// validate returns an error if a stage has no name or transform, or if
+// stage names aren't unique.
+func (p Pipeline) validate() error {
+	var errs []error
+	names := make(map[string]struct{}, len(p))
+	for i, stage := range p {
+		if stage.Name == "" {
+			errs = append(errs, fmt.Errorf("pubsublite: pipeline stage %d name must be set", i))
+		} else if _, ok := names[stage.Name]; ok {
+			errs = append(errs, fmt.Errorf("pubsublite: duplicate pipeline stage %s", stage.Name))
+		}
+		names[stage.Name] = struct{}{}
+		if stage.Transform == nil {
+			errs = append(errs, fmt.Errorf("pubsublite: pipeline stage %d transform must be set", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stageKey is the attribute key holding the name of a pipeline stage.
+const stageKey = attribute.Key("pipeline.stage")
+
+// transform runs the message payload through the pipeline stages. Each
+// stage is recorded as a span event and timed in the
+// consumer.pipeline.stage.duration metric.
+func (c *consumer[T]) transform(ctx context.Context, data []byte, attrs map[string]string) ([]byte, error) {
+	span := trace.SpanFromContext(ctx)
+	for _, stage := range c.pipeline {
+		start := time.Now()
+		out, err := stage.Transform(ctx, data, attrs)
+		took := time.Since(start)
+		name := stageKey.String(stage.Name)
+		c.metrics.stageDuration.Record(ctx, took.Seconds(), metric.WithAttributes(
+			append([]attribute.KeyValue{name}, c.telemetryAttributes...)...,
+		))
+		eventAttrs := []attribute.KeyValue{name, attribute.Int64("duration_us", took.Microseconds())}
+		if err != nil {
+			eventAttrs = append(eventAttrs, attribute.String("error", err.Error()))
+		}
+		span.AddEvent("pipeline.stage", trace.WithAttributes(eventAttrs...))
+		if err != nil {
+			return nil, fmt.Errorf("pipeline stage %s failed: %w", stage.Name, err)
+		}
+		data = out
+	}
+	return data, nil
+}
@@ -0,0 +1,120 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestPipelineValidate(t *testing.T) {
+	noop := func(_ context.Context, data []byte, _ map[string]string) ([]byte, error) {
+		return data, nil
+	}
+	assert.NoError(t, Pipeline{{Name: "a", Transform: noop}, {Name: "b", Transform: noop}}.validate())
+	assert.EqualError(t, Pipeline{
+		{Transform: noop},
+		{Name: "a", Transform: noop},
+		{Name: "a"},
+	}.validate(), "pubsublite: pipeline stage 0 name must be set\n"+
+		"pubsublite: duplicate pipeline stage a\n"+
+		"pubsublite: pipeline stage 2 transform must be set",
+	)
+}
+
+func TestConsumerPipeline(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	results := make(chan ProcessResult, 10)
+	var processed []string
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			Results:       results,
+			Pipeline: Pipeline{
+				{Name: "unwrap", Transform: func(_ context.Context, data []byte, attrs map[string]string) ([]byte, error) {
+					if attrs["wrapped"] != "true" {
+						return nil, errors.New("not wrapped")
+					}
+					return bytes.TrimPrefix(data, []byte("wrapped:")), nil
+				}},
+				{Name: "normalize", Transform: func(_ context.Context, data []byte, _ map[string]string) ([]byte, error) {
+					return bytes.ToLower(data), nil
+				}},
+			},
+		},
+		Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			processed = append(processed, events[0].Name)
+			return nil
+		}),
+	})
+	ctx, span := tracer.Start(context.Background(), "process")
+	c.processMessage(ctx, &pubsub.Message{
+		ID:         "0:1",
+		Data:       []byte(`wrapped:{"name":"EVENT"}`),
+		Attributes: map[string]string{"wrapped": "true"},
+	})
+	span.End()
+	assert.Equal(t, []string{"event"}, processed)
+	assert.Equal(t, OutcomeAcked, (<-results).Outcome)
+
+	// Stages are recorded as span events, in order.
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	var stages []string
+	for _, event := range spans[0].Events() {
+		assert.Equal(t, "pipeline.stage", event.Name)
+		set := attribute.NewSet(event.Attributes...)
+		stage, _ := set.Value(stageKey)
+		stages = append(stages, stage.AsString())
+	}
+	assert.Equal(t, []string{"unwrap", "normalize"}, stages)
+
+	// Messages for which a stage fails are nacked, skipping the next stages.
+	c.processMessage(context.Background(), &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+	r := <-results
+	assert.Equal(t, OutcomeNacked, r.Outcome)
+	assert.EqualError(t, r.Err, "pipeline stage unwrap failed: not wrapped")
+	assert.Len(t, processed, 1)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	hist, ok := findMetric(t, rm, "consumer.pipeline.stage.duration").Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	counts := make(map[string]uint64)
+	for _, dp := range hist.DataPoints {
+		v, _ := dp.Attributes.Value(stageKey)
+		counts[v.AsString()] = dp.Count
+	}
+	assert.Equal(t, map[string]uint64{"unwrap": 2, "normalize": 1}, counts)
+}
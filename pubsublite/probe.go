@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// startupProbe processes the first messages received by all the subscriptions
+// one at a time, and aborts the consumer on the first error.
+type startupProbe struct {
+	mu        sync.Mutex
+	remaining int
+	err       error
+	abort     context.CancelCauseFunc
+}
+
+// acquire returns true if the probe is still active, in which case the
+// caller must process the message and call release with the result.
+func (p *startupProbe) acquire() bool {
+	p.mu.Lock()
+	if p.remaining <= 0 {
+		p.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// release records the result of processing a message while the probe is
+// active, aborting the consumer if processing failed.
+func (p *startupProbe) release(err error) {
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.remaining--
+	if err != nil {
+		p.remaining = 0
+		p.err = fmt.Errorf("pubsublite: startup probe failed: %w", err)
+		if p.abort != nil {
+			p.abort(p.err)
+		}
+	}
+}
+
+// failed returns the error which caused the probe to fail, if any.
+func (p *startupProbe) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// ProcessMessages processes msgs synchronously, one at a time and in order,
+// with the decoding, processing and acknowledgement logic of a consumer
+// created with cfg, and returns the outcome of each message. No connection
+// to PubSub Lite is made, so it allows testing a Processor in isolation.
+//
+// Messages are processed as if they were received by the subscription of
+// the first of cfg.Topics, and their IDs should be formatted as
+// "partition:offset" for the partition based settings to apply. A message
+// left unacknowledged is redelivered, after the RetryBackoff delay if any,
+// before ProcessMessages moves on to the next message, so the returned
+// outcome of each message is either OutcomeAcked or OutcomeNacked. If ctx
+// is done while a message is left unacknowledged, its OutcomeRetried is
+// returned along with the context error.
+func ProcessMessages(ctx context.Context, cfg ConsumerConfig, msgs []*pubsub.Message) ([]Outcome, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("pubsublite: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	return ProcessTypedMessages[model.APMEvent](ctx, cfg.typed(), msgs)
+}
+
+// ProcessTypedMessages is the ProcessMessages equivalent for consumers which
+// decode messages into T.
+func ProcessTypedMessages[T any](ctx context.Context, cfg TypedConsumerConfig[T], msgs []*pubsub.Message) ([]Outcome, error) {
+	// The subscriber clients of lazily connected consumers are only created
+	// once the consumer runs.
+	cfg.LazyConnect = true
+	c, err := NewTypedConsumer(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.throughputCallback.Unregister()
+	topic := cfg.Topics[0]
+	sub := c.subscriber(topic, Subscription{
+		Name:    string(topic),
+		Project: cfg.Project,
+		Region:  cfg.Region,
+	})
+	var (
+		outcome  Outcome
+		reported bool
+	)
+	sub.observe = func(r ProcessResult) {
+		outcome, reported = r.Outcome, true
+	}
+	// Retried messages are redelivered synchronously below, rather than by
+	// the consumer in the background.
+	sub.retryBackoff = RetryBackoff{}
+	outcomes := make([]Outcome, 0, len(msgs))
+	for _, msg := range msgs {
+		for attempt := 1; ; attempt++ {
+			reported = false
+			sub.processMessage(ctx, msg)
+			if !reported {
+				return outcomes, fmt.Errorf("pubsublite: no outcome for message %s", msg.ID)
+			}
+			if outcome != OutcomeRetried {
+				break
+			}
+			if err := redeliver(ctx, cfg.RetryBackoff.Delay(attempt)); err != nil {
+				return append(outcomes, outcome), err
+			}
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes, nil
+}
+
+// redeliver waits for delay before a retried message is redelivered,
+// returning the context error if ctx is done first.
+func redeliver(ctx context.Context, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
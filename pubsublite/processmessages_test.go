@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProcessMessages(t *testing.T) {
+	var processed []string
+	outcomes, err := ProcessMessages(context.Background(), ConsumerConfig{
+		Project:  "project",
+		Region:   "us-east1",
+		Topics:   []apmqueue.Topic{"topic"},
+		Decoder:  json.JSON{},
+		Logger:   zap.NewNop(),
+		Delivery: apmqueue.AtLeastOnceDeliveryType,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Transaction.ID)
+			}
+			if (*b)[0].Transaction.ID == "fail" {
+				return errors.New("boom")
+			}
+			return nil
+		}),
+	}, []*pubsub.Message{
+		{ID: "0:1", Data: []byte(`{"transaction":{"id":"ok"}}`)},
+		{ID: "0:2", Data: []byte(`{"transaction":{"id":"fail"}}`)},
+		{ID: "0:3", Data: []byte(`invalid`)},
+	})
+	require.NoError(t, err)
+	// The failing message is redelivered until it's nacked on its 3rd
+	// delivery.
+	assert.Equal(t, []Outcome{OutcomeAcked, OutcomeNacked, OutcomeNacked}, outcomes)
+	assert.Equal(t, []string{"ok", "fail", "fail", "fail"}, processed)
+}
+
+func TestProcessMessagesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	outcomes, err := ProcessTypedMessages(ctx, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Project:      "project",
+			Region:       "us-east1",
+			Topics:       []apmqueue.Topic{"topic"},
+			Logger:       zap.NewNop(),
+			Delivery:     apmqueue.AtLeastOnceDeliveryType,
+			RetryBackoff: RetryBackoff{Initial: time.Hour},
+		},
+		Decoder: jsonDecoder[customEvent]{},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			cancel()
+			return errors.New("boom")
+		}),
+	}, []*pubsub.Message{
+		{ID: "0:1", Data: []byte(`{"name":"event"}`)},
+		{ID: "0:2", Data: []byte(`{"name":"event"}`)},
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []Outcome{OutcomeRetried}, outcomes)
+}
+
+func TestProcessMessagesInvalidConfig(t *testing.T) {
+	_, err := ProcessMessages(context.Background(), ConsumerConfig{}, nil)
+	assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+}
+
+func TestProcessTypedMessagesRetryBackoff(t *testing.T) {
+	var attempts int
+	outcomes, err := ProcessTypedMessages(context.Background(), TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Project:      "project",
+			Region:       "us-east1",
+			Topics:       []apmqueue.Topic{"topic"},
+			Logger:       zap.NewNop(),
+			Delivery:     apmqueue.AtLeastOnceDeliveryType,
+			RetryBackoff: RetryBackoff{Initial: time.Millisecond},
+		},
+		Decoder: jsonDecoder[customEvent]{},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			if attempts++; attempts < 3 {
+				return errors.New("boom")
+			}
+			return nil
+		}),
+	}, []*pubsub.Message{{ID: "0:1", Data: []byte(`{"name":"event"}`)}})
+	require.NoError(t, err)
+	assert.Equal(t, []Outcome{OutcomeAcked}, outcomes)
+	assert.Equal(t, 3, attempts)
+}
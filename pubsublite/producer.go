@@ -22,8 +22,10 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsublite"
 	"cloud.google.com/go/pubsublite/pscompat"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -31,11 +33,13 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/elastic/apm-data/model"
 	apmqueue "github.com/elastic/apm-queue"
-	"github.com/elastic/apm-queue/pubsublite/internal/telemetry"
+	"github.com/elastic/apm-queue/internal/telemetry"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
@@ -45,6 +49,27 @@ type Encoder interface {
 	Encode(model.APMEvent) ([]byte, error)
 }
 
+// HealthProbe determines how Producer.Healthy verifies the producer can reach
+// Pub/Sub Lite.
+type HealthProbe uint8
+
+const (
+	// AdminHealthProbe looks up the topics that the producer has published to
+	// using the Pub/Sub Lite admin API. If nothing has been published yet, it
+	// lists the topics in the configured project and region instead.
+	AdminHealthProbe HealthProbe = iota
+	// PublisherHealthProbe checks whether any of the publisher clients has
+	// terminated due to a fatal error. It doesn't issue any requests.
+	PublisherHealthProbe
+)
+
+// defaultHealthCacheTTL is the default ProducerConfig.HealthCacheTTL.
+const defaultHealthCacheTTL = 5 * time.Second
+
+// minPublishTimeout is the minimum publish timeout accepted by pscompat,
+// lower timeouts are clamped to it.
+const minPublishTimeout = 2 * time.Minute
+
 // ProducerConfig for the PubSub Lite producer.
 type ProducerConfig struct {
 	// Region is the GCP region for the producer.
@@ -61,12 +86,83 @@ type ProducerConfig struct {
 	// Due to the mechanics of pubsub lite publishing, producing synchronously
 	// will yield poor performance unless the model.Batch are large enough to
 	// trigger immediate flush after processing a single batch.
-	Sync       bool
+	Sync bool
+	// ClientOpts are passed to the underlying Pub/Sub Lite clients. The
+	// auth package provides helpers to build the authentication options.
 	ClientOpts []option.ClientOption
 
 	// TracerProvider allows specifying a custom otel tracer provider.
 	// Defaults to the global one.
 	TracerProvider trace.TracerProvider
+
+	// HealthProbe is the probe used by Healthy. Defaults to AdminHealthProbe.
+	HealthProbe HealthProbe
+	// HealthCacheTTL is the duration for which the result of a health probe
+	// is cached, to avoid issuing requests on frequent probes. If
+	// HealthCacheTTL <= 0, defaults to 5s.
+	HealthCacheTTL time.Duration
+
+	// PublishTimeout is the retry budget of the publisher clients: the
+	// maximum time spent retrying transient errors, such as the backend
+	// being unavailable, before publishing fails. Once exceeded, all the
+	// pending messages fail and the publisher client terminates. It must be
+	// at least 2 minutes, the pscompat minimum. If PublishTimeout <= 0,
+	// defaults to the pscompat default of 7 days.
+	PublishTimeout time.Duration
+	// OnProduceFailure, when set, is called with each event which could not
+	// be published, after the retry budget has been exhausted or the
+	// publisher client terminated with a fatal error. It allows persisting
+	// unpublishable events locally or sending them to an alternate sink.
+	//
+	// When Sync is true, it's called from ProcessBatch with its context
+	// before ProcessBatch returns, and may be called concurrently. Otherwise,
+	// it's called from a background goroutine with a background context.
+	// Slow hooks delay the handling of subsequent publish results.
+	OnProduceFailure func(ctx context.Context, event model.APMEvent, err error)
+	// OnPublished, when set, is called with each event which was published,
+	// and where it was published to, i.e. to correlate the published events
+	// with the messages received by consumers. It's called like
+	// OnProduceFailure, so slow hooks delay the handling of subsequent
+	// publish results.
+	OnPublished func(ctx context.Context, event model.APMEvent, result PublishResult)
+	// PartitionFn, when set, is called with each event and its message
+	// attributes. When it returns true, the message is published to the
+	// returned partition of the topic, rather than to a partition chosen by
+	// the publisher client, i.e. to pin messages to a partition for debugging
+	// or controlled load tests. ProcessBatch returns an error if the
+	// partition is out of the topic's partition bounds.
+	//
+	// Pinned messages are routed by setting their ordering key, so messages
+	// pinned to the same partition are published in order.
+	PartitionFn func(event *model.APMEvent, attrs map[string]string) (int, bool)
+	// MetadataCodec encodes the structured metadata stored in the context
+	// with queuecontext.WithStructuredMetadata into message attributes.
+	// Defaults to queuecontext.IdentityCodec.
+	MetadataCodec queuecontext.MetadataCodec
+	// Encrypter, when set, encrypts the payload of every message once the
+	// event has been encoded, and sets the attributes it returns on the
+	// message, including the EncryptionAttribute. Consumers need a matching
+	// Decrypter to decrypt the messages.
+	Encrypter Encrypter
+	// TimestampFn, when set, returns the event time of the message published
+	// for each event, i.e. the original event time when backfilling
+	// historical events. It's set in the pscompat.EventTimeAttributeKey
+	// attribute. When nil or when it returns the zero time, messages have no
+	// event time and only carry their publish time.
+	TimestampFn func(*model.APMEvent) time.Time
+	// IdempotencyKeyFn, when set, returns the idempotency key of each event,
+	// which is set in the IdempotencyKeyAttribute. Pub/Sub Lite doesn't
+	// deduplicate messages, so events whose key was already published by
+	// this producer within the DeduplicationWindow are dropped, suppressing
+	// obvious duplicates, i.e. when a batch is retried. Events whose
+	// publishing failed can be published again. Deduplication is best
+	// effort: it doesn't span producer instances or processes, where
+	// consumers are responsible for deduplicating messages by their key.
+	// Events with an empty key are always published.
+	IdempotencyKeyFn func(*model.APMEvent) string
+	// DeduplicationWindow is how long the idempotency keys of the published
+	// events are remembered. If DeduplicationWindow <= 0, defaults to 1m.
+	DeduplicationWindow time.Duration
 }
 
 // Validate ensures the configuration is valid, otherwise, returns an error.
@@ -87,13 +183,38 @@ func (cfg ProducerConfig) Validate() error {
 	if cfg.TopicRouter == nil {
 		errs = append(errs, errors.New("pubsublite: topic router must be set"))
 	}
+	switch cfg.HealthProbe {
+	case AdminHealthProbe:
+	case PublisherHealthProbe:
+	default:
+		errs = append(errs, errors.New("pubsublite: health probe is not valid"))
+	}
+	if cfg.PublishTimeout > 0 && cfg.PublishTimeout < minPublishTimeout {
+		errs = append(errs, fmt.Errorf("pubsublite: publish timeout must be at least %s", minPublishTimeout))
+	}
 	return errors.Join(errs...)
 }
 
-// resTopic enriches a pubsub.PublishResult with its topic.
+// publishResult is the result of an asynchronous publish, implemented by
+// pubsub.PublishResult.
+type publishResult interface {
+	Get(ctx context.Context) (serverID string, err error)
+}
+
+// PublishResult holds where a message was published to.
+type PublishResult struct {
+	Topic     apmqueue.Topic
+	Partition int
+	Offset    int64
+}
+
+// resTopic enriches a publishResult with its topic and published event.
 type resTopic struct {
-	response *pubsub.PublishResult
+	response publishResult
 	topic    apmqueue.Topic
+	event    model.APMEvent
+	// key is the idempotency key of the event, if any.
+	key string
 }
 
 // Producer implementes the model.BatchProcessor interface and sends each of
@@ -107,21 +228,38 @@ type Producer struct {
 	responses chan []resTopic
 	closed    chan struct{}
 	tracer    trace.Tracer
+	health    healthCache
+	// partitions is nil unless PartitionFn is set.
+	partitions *partitionRouter
+	// published is nil unless IdempotencyKeyFn is set.
+	published *recentKeys
 
 	project string
 	region  string
 }
 
+// healthCache caches the result of the last health probe. Its admin client is
+// also used to look up the partition count of topics.
+type healthCache struct {
+	mu      sync.Mutex
+	admin   *pubsublite.AdminClient
+	checked time.Time
+	err     error
+}
+
 // NewProducer creates a new PubSub Lite producer for a single project.
 func NewProducer(cfg ProducerConfig) (*Producer, error) {
 	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("pubsublite: invalid producer config: %w", err)
+		return nil, fmt.Errorf("pubsublite: %w: %w", apmqueue.ErrInvalidConfig, err)
 	}
 
 	tracerProvider := cfg.TracerProvider
 	if tracerProvider == nil {
 		tracerProvider = otel.GetTracerProvider()
 	}
+	if cfg.HealthCacheTTL <= 0 {
+		cfg.HealthCacheTTL = defaultHealthCacheTTL
+	}
 
 	p := &Producer{
 		cfg:    cfg,
@@ -135,6 +273,15 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 		region:  cfg.Region,
 	}
 
+	if cfg.IdempotencyKeyFn != nil {
+		if cfg.DeduplicationWindow <= 0 {
+			cfg.DeduplicationWindow = defaultDeduplicationWindow
+		}
+		p.published = newRecentKeys(cfg.DeduplicationWindow, time.Now)
+	}
+	if cfg.PartitionFn != nil {
+		p.partitions = newPartitionRouter(p.partitionCount)
+	}
 	if !cfg.Sync {
 		// If producing is async, start a goroutine that blocks until the
 		// all messages have been produced. This happens in the ProcessBatch
@@ -142,7 +289,7 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 		p.errg.Go(func() error {
 			ctx := context.Background()
 			for responses := range p.responses {
-				blockUntilProduced(ctx, responses, cfg.Logger)
+				p.blockUntilProduced(ctx, responses)
 			}
 			return nil
 		})
@@ -165,7 +312,13 @@ func (p *Producer) Close() error {
 	})
 	close(p.closed)
 	close(p.responses)
-	return p.errg.Wait()
+	err := p.errg.Wait()
+	p.health.mu.Lock()
+	defer p.health.mu.Unlock()
+	if p.health.admin != nil {
+		err = errors.Join(err, p.health.admin.Close())
+	}
+	return err
 }
 
 // ProcessBatch publishes the batch to the PubSub Lite topic inferred from the
@@ -180,6 +333,10 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 		return errors.New("pubsublite: producer closed")
 	default:
 	}
+	meta, hasMeta, err := queuecontext.EncodeFromContext(ctx, p.cfg.MetadataCodec)
+	if err != nil {
+		return fmt.Errorf("pubsublite: %w", err)
+	}
 	responses := make([]resTopic, 0, len(*batch))
 	for _, event := range *batch {
 		encoded, err := p.cfg.Encoder.Encode(event)
@@ -187,7 +344,7 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 			return fmt.Errorf("failed to encode event: %w", err)
 		}
 		msg := pubsub.Message{Data: encoded}
-		if meta, ok := queuecontext.MetadataFromContext(ctx); ok {
+		if hasMeta {
 			for k, v := range meta {
 				if msg.Attributes == nil {
 					msg.Attributes = make(map[string]string)
@@ -195,26 +352,73 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 				msg.Attributes[k] = v
 			}
 		}
+		if p.cfg.Encrypter != nil {
+			encrypted, attrs, err := p.cfg.Encrypter.Encrypt(ctx, encoded)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt event: %w", err)
+			}
+			msg.Data = encrypted
+			for k, v := range attrs {
+				if msg.Attributes == nil {
+					msg.Attributes = make(map[string]string)
+				}
+				msg.Attributes[k] = v
+			}
+		}
+		var key string
+		if p.cfg.IdempotencyKeyFn != nil {
+			key = p.cfg.IdempotencyKeyFn(&event)
+		}
+		if key != "" {
+			if msg.Attributes == nil {
+				msg.Attributes = make(map[string]string)
+			}
+			msg.Attributes[IdempotencyKeyAttribute] = key
+		}
+		if p.cfg.TimestampFn != nil {
+			if err := setEventTime(&msg, p.cfg.TimestampFn(&event)); err != nil {
+				return fmt.Errorf("failed to set event time: %w", err)
+			}
+		}
 		topic := p.cfg.TopicRouter(event)
+		if p.partitions != nil {
+			if partition, ok := p.cfg.PartitionFn(&event, msg.Attributes); ok {
+				key, err := p.partitions.orderingKey(ctx, topic, partition)
+				if err != nil {
+					return fmt.Errorf("pubsublite: failed to route event to partition: %w", err)
+				}
+				msg.OrderingKey = key
+			}
+		}
 		publisher, err := p.getPublisher(topic)
 		if err != nil {
 			return fmt.Errorf("pubsublite: failed to get publisher: %w", err)
 		}
+		// The key is only recorded once the event is about to be published,
+		// so events which failed to be prepared can be published again.
+		if key != "" && !p.published.add(key) {
+			p.cfg.Logger.Debug("dropping duplicate event",
+				zap.String("idempotency_key", key),
+			)
+			continue
+		}
 		responses = append(responses, resTopic{
 			// NOTE(marclop) producer.Publish() is completely asynchronous and
 			// doesn't use the context. If/when the pubsublite library supports
 			// instrumentation, the context will be useful to propagate traces.
 			// This is accurates as of pubsublite@v1.7.0
-			response: telemetry.Publisher(ctx, p.tracer, &msg, publisher.Publish, []attribute.KeyValue{
+			response: telemetry.Publisher(ctx, p.tracer, "pubsublite", &msg, publisher.Publish, []attribute.KeyValue{
 				semconv.MessagingDestinationNameKey.String(string(topic)),
 				semconv.CloudRegion(p.region),
 				semconv.CloudAccountID(p.project),
 			}),
 			topic: topic,
+			event: event,
+			key:   key,
 		})
 	}
 	if p.cfg.Sync {
-		blockUntilProduced(ctx, responses, p.cfg.Logger)
+		p.blockUntilProduced(ctx, responses)
 		return nil
 	}
 	select {
@@ -225,6 +429,32 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 	return nil
 }
 
+// ProduceAtomically always returns an error wrapping
+// apmqueue.ErrAtomicUnsupported, since Pub/Sub Lite has no transactions
+// spanning multiple topics or messages, and published messages can't be
+// retracted. Publishing the events with a synchronous producer is best
+// effort: when it fails, some of the events may have been published, and
+// it's up to the caller to compensate, i.e. with idempotent consumers.
+func (p *Producer) ProduceAtomically(context.Context, []apmqueue.TopicEvent) error {
+	return fmt.Errorf("pubsublite: %w: no cross-topic transactions", apmqueue.ErrAtomicUnsupported)
+}
+
+// setEventTime sets the event time of the message, unless t is zero.
+func setEventTime(msg *pubsub.Message, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	value, err := pscompat.EncodeEventTimeAttribute(timestamppb.New(t))
+	if err != nil {
+		return err
+	}
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string)
+	}
+	msg.Attributes[pscompat.EventTimeAttributeKey] = value
+	return nil
+}
+
 func (p *Producer) getPublisher(topic apmqueue.Topic) (*pscompat.PublisherClient, error) {
 	if v, ok := p.producers.Load(topic); ok {
 		return v.(*pscompat.PublisherClient), nil
@@ -247,20 +477,31 @@ func (p *Producer) getPublisher(topic apmqueue.Topic) (*pscompat.PublisherClient
 func newPublisher(ctx context.Context, cfg ProducerConfig, topic apmqueue.Topic) (*pscompat.PublisherClient, error) {
 	// TODO(marclop) connection pools:
 	// https://pkg.go.dev/cloud.google.com/go/pubsublite#hdr-gRPC_Connection_Pools
-	settings := pscompat.PublishSettings{
+	return pscompat.NewPublisherClientWithSettings(ctx,
+		formatTopic(cfg.Project, cfg.Region, topic),
+		publishSettings(cfg), cfg.ClientOpts...,
+	)
+}
+
+// publishSettings returns the settings of the publisher clients.
+func publishSettings(cfg ProducerConfig) pscompat.PublishSettings {
+	// pscompat clamps any non-zero timeout lower than the minimum, including
+	// negative ones, so the default is requested with a zero timeout.
+	timeout := cfg.PublishTimeout
+	if timeout <= 0 {
+		timeout = 0
+	}
+	return pscompat.PublishSettings{
 		// TODO(marclop) tweak producing settings, to cap memory use, trying
 		// to size for good performance. It may be desireable to provide a
 		// maximum memory usage for this component and size accordingly.
 		// The number of topics should be taken into account since it creates
 		// a publisher client per topic.
+		Timeout: timeout,
 	}
-	return pscompat.NewPublisherClientWithSettings(ctx,
-		formatTopic(cfg.Project, cfg.Region, topic),
-		settings, cfg.ClientOpts...,
-	)
 }
 
-func blockUntilProduced(ctx context.Context, res []resTopic, logger *zap.Logger) {
+func (p *Producer) blockUntilProduced(ctx context.Context, res []resTopic) {
 	// TODO(marclop) Retryable errors are automatically handled. If a result
 	// returns an error, this indicates that the publisher client encountered
 	// a fatal error and can no longer be used. Fatal errors should be manually
@@ -271,18 +512,127 @@ func blockUntilProduced(ctx context.Context, res []resTopic, logger *zap.Logger)
 	// will be useless and all the messages that are attempted to be producer
 	// will fail with an error.
 	for _, res := range res {
-		if serverID, err := res.response.Get(ctx); err != nil {
-			logger.Error("failed producing message",
+		serverID, err := res.response.Get(ctx)
+		if err != nil {
+			p.cfg.Logger.Error("failed producing message",
 				zap.Error(err),
 				zap.String("server_id", serverID),
 				zap.String("topic", string(res.topic)),
 			)
+			if res.key != "" {
+				p.published.forget(res.key)
+			}
+			if p.cfg.OnProduceFailure != nil {
+				p.cfg.OnProduceFailure(ctx, res.event, err)
+			}
+			continue
+		}
+		if p.cfg.OnPublished != nil {
+			// The server ID holds the partition and offset of the message.
+			partition, offset := partitionOffset(serverID)
+			p.cfg.OnPublished(ctx, res.event, PublishResult{
+				Topic:     res.topic,
+				Partition: partition,
+				Offset:    offset,
+			})
 		}
 	}
 }
 
+// Healthy returns an error if the producer can't reach Pub/Sub Lite, as
+// determined by the configured HealthProbe. Results are cached for the
+// configured HealthCacheTTL.
 func (p *Producer) Healthy(ctx context.Context) error {
-	return nil // TODO(marclop)
+	p.health.mu.Lock()
+	defer p.health.mu.Unlock()
+	if !p.health.checked.IsZero() && time.Since(p.health.checked) < p.cfg.HealthCacheTTL {
+		return p.health.err
+	}
+	var err error
+	switch p.cfg.HealthProbe {
+	case AdminHealthProbe:
+		err = p.adminProbe(ctx)
+	case PublisherHealthProbe:
+		err = p.publisherProbe()
+	}
+	if err != nil {
+		err = fmt.Errorf("pubsublite: %w: health probe: %w", apmqueue.ErrBackendUnavailable, err)
+	}
+	// Avoid caching the result when the probe is interrupted by the caller.
+	if ctx.Err() == nil {
+		p.health.checked, p.health.err = time.Now(), err
+	}
+	return err
+}
+
+// partitionCount returns the partition count of the topic.
+// The lookup is made without holding p.health.mu, so it doesn't block the
+// health probes.
+func (p *Producer) partitionCount(ctx context.Context, topic apmqueue.Topic) (int, error) {
+	p.health.mu.Lock()
+	err := p.initAdmin(ctx)
+	admin := p.health.admin
+	p.health.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return admin.TopicPartitionCount(ctx, formatTopic(p.project, p.region, topic))
+}
+
+// initAdmin creates the admin client if it hasn't been created yet. It must
+// be called with p.health.mu held.
+func (p *Producer) initAdmin(ctx context.Context) error {
+	if p.health.admin != nil {
+		return nil
+	}
+	admin, err := pubsublite.NewAdminClient(ctx, p.region, p.cfg.ClientOpts...)
+	if err != nil {
+		return fmt.Errorf("failed creating admin client: %w", err)
+	}
+	p.health.admin = admin
+	return nil
+}
+
+// adminProbe looks up the topics with publisher clients, or lists the topics
+// when there are none. It must be called with p.health.mu held.
+func (p *Producer) adminProbe(ctx context.Context) error {
+	if err := p.initAdmin(ctx); err != nil {
+		return err
+	}
+	var topics []apmqueue.Topic
+	p.producers.Range(func(key, _ any) bool {
+		topics = append(topics, key.(apmqueue.Topic))
+		return true
+	})
+	if len(topics) == 0 {
+		parent := fmt.Sprintf("projects/%s/locations/%s", p.project, p.region)
+		if _, err := p.health.admin.Topics(ctx, parent).Next(); err != nil &&
+			!errors.Is(err, iterator.Done) {
+			return fmt.Errorf("failed listing topics: %w", err)
+		}
+		return nil
+	}
+	var errs []error
+	for _, topic := range topics {
+		if _, err := p.health.admin.Topic(ctx,
+			formatTopic(p.project, p.region, topic),
+		); err != nil {
+			errs = append(errs, fmt.Errorf("failed getting topic %s: %w", topic, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// publisherProbe returns the fatal errors of the publisher clients, if any.
+func (p *Producer) publisherProbe() error {
+	var errs []error
+	p.producers.Range(func(key, value any) bool {
+		if err := value.(*pscompat.PublisherClient).Error(); err != nil {
+			errs = append(errs, fmt.Errorf("publisher for topic %s failed: %w", key, err))
+		}
+		return true
+	})
+	return errors.Join(errs...)
 }
 
 func formatTopic(project, region string, topic apmqueue.Topic) string {
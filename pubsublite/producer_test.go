@@ -18,16 +18,158 @@
 package pubsublite
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsublite/pscompat"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 
+	"github.com/elastic/apm-data/model"
 	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
 )
 
 func TestNewProducer(t *testing.T) {
 	_, err := NewProducer(ProducerConfig{})
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+}
+
+func TestProducerPublishTimeout(t *testing.T) {
+	cfg := ProducerConfig{
+		Project:     "project",
+		Region:      "region",
+		Encoder:     json.JSON{},
+		Logger:      zap.NewNop(),
+		TopicRouter: func(model.APMEvent) apmqueue.Topic { return "topic" },
+	}
+	for _, timeout := range []time.Duration{0, -time.Second, minPublishTimeout, time.Hour} {
+		cfg.PublishTimeout = timeout
+		assert.NoError(t, cfg.Validate(), timeout)
+	}
+	cfg.PublishTimeout = time.Minute
+	assert.EqualError(t, cfg.Validate(), "pubsublite: publish timeout must be at least 2m0s")
+
+	// Unset timeouts are left to the pscompat default rather than clamped.
+	for timeout, expected := range map[time.Duration]time.Duration{
+		-time.Second: 0,
+		0:            0,
+		time.Hour:    time.Hour,
+	} {
+		cfg.PublishTimeout = timeout
+		assert.Equal(t, expected, publishSettings(cfg).Timeout, timeout)
+	}
+}
+
+func TestProducerHealthy(t *testing.T) {
+	newProducer := func(t testing.TB, probe HealthProbe) *Producer {
+		p, err := NewProducer(ProducerConfig{
+			Project:     "project",
+			Region:      "region",
+			Encoder:     json.JSON{},
+			Logger:      zap.NewNop(),
+			TopicRouter: func(model.APMEvent) apmqueue.Topic { return "topic" },
+			HealthProbe: probe,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, p.Close()) })
+		return p
+	}
+	t.Run("invalid probe", func(t *testing.T) {
+		_, err := NewProducer(ProducerConfig{HealthProbe: 100})
+		assert.ErrorContains(t, err, "pubsublite: health probe is not valid")
+	})
+	t.Run("publisher probe", func(t *testing.T) {
+		p := newProducer(t, PublisherHealthProbe)
+		assert.NoError(t, p.Healthy(context.Background()))
+	})
+	t.Run("cached", func(t *testing.T) {
+		p := newProducer(t, AdminHealthProbe)
+		cachedErr := errors.New("cached")
+		p.health.checked, p.health.err = time.Now(), cachedErr
+		assert.Equal(t, cachedErr, p.Healthy(context.Background()))
+	})
+}
+
+func TestProducerOnProduceFailure(t *testing.T) {
+	type failure struct {
+		event model.APMEvent
+		err   error
+	}
+	var failures []failure
+	p := &Producer{cfg: ProducerConfig{
+		Logger: zap.NewNop(),
+		OnProduceFailure: func(_ context.Context, event model.APMEvent, err error) {
+			failures = append(failures, failure{event: event, err: err})
+		},
+	}}
+	publishErr := errors.New("publisher terminated")
+	p.blockUntilProduced(context.Background(), []resTopic{
+		{response: fakeResult{id: "1"}, topic: "a", event: model.APMEvent{Transaction: &model.Transaction{ID: "1"}}},
+		{response: fakeResult{err: publishErr}, topic: "a", event: model.APMEvent{Transaction: &model.Transaction{ID: "2"}}},
+	})
+	assert.Equal(t, []failure{{
+		event: model.APMEvent{Transaction: &model.Transaction{ID: "2"}},
+		err:   publishErr,
+	}}, failures)
+}
+
+func TestProducerOnPublished(t *testing.T) {
+	type published struct {
+		event  model.APMEvent
+		result PublishResult
+	}
+	var results []published
+	p := &Producer{cfg: ProducerConfig{
+		Logger: zap.NewNop(),
+		OnPublished: func(_ context.Context, event model.APMEvent, result PublishResult) {
+			results = append(results, published{event: event, result: result})
+		},
+	}}
+	p.blockUntilProduced(context.Background(), []resTopic{
+		{response: fakeResult{id: "3:42"}, topic: "a", event: model.APMEvent{Transaction: &model.Transaction{ID: "1"}}},
+		{response: fakeResult{err: errors.New("publisher terminated")}, topic: "a", event: model.APMEvent{Transaction: &model.Transaction{ID: "2"}}},
+		{response: fakeResult{id: "0:7"}, topic: "b", event: model.APMEvent{Transaction: &model.Transaction{ID: "3"}}},
+	})
+	assert.Equal(t, []published{{
+		event:  model.APMEvent{Transaction: &model.Transaction{ID: "1"}},
+		result: PublishResult{Topic: "a", Partition: 3, Offset: 42},
+	}, {
+		event:  model.APMEvent{Transaction: &model.Transaction{ID: "3"}},
+		result: PublishResult{Topic: "b", Partition: 0, Offset: 7},
+	}}, results)
+}
+
+type fakeResult struct {
+	id  string
+	err error
+}
+
+func (r fakeResult) Get(context.Context) (string, error) { return r.id, r.err }
+
+func TestProducerProduceAtomically(t *testing.T) {
+	p := &Producer{}
+	err := p.ProduceAtomically(context.Background(), []apmqueue.TopicEvent{{Topic: "a"}})
+	assert.ErrorIs(t, err, apmqueue.ErrAtomicUnsupported)
+}
+
+func TestSetEventTime(t *testing.T) {
+	eventTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	msg := pubsub.Message{Attributes: map[string]string{"a": "b"}}
+	require.NoError(t, setEventTime(&msg, eventTime))
+	assert.Equal(t, "b", msg.Attributes["a"])
+	decoded, err := pscompat.DecodeEventTimeAttribute(msg.Attributes[pscompat.EventTimeAttributeKey])
+	require.NoError(t, err)
+	assert.True(t, eventTime.Equal(decoded.AsTime()))
+
+	// The zero time leaves the message without an event time.
+	var current pubsub.Message
+	require.NoError(t, setEventTime(&current, time.Time{}))
+	assert.Nil(t, current.Attributes)
 }
 
 func TestTopicString(t *testing.T) {
@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// OriginalPublishTimeAttribute is the message attribute which holds the RFC
+// 3339 time when a message was first published, before it was republished,
+// i.e. requeued or transcoded.
+//
+// The consumer adds it to the metadata passed to the processor, so messages
+// republished by a Producer with the same context keep it, and uses it to
+// measure the consumer.delivery.lag.
+const OriginalPublishTimeAttribute = "x-original-publish-time"
+
+// SetOriginalPublishTime sets the OriginalPublishTimeAttribute to t, unless
+// it's already set, so the first publish time is kept across republishes.
+func SetOriginalPublishTime(attrs map[string]string, t time.Time) {
+	if _, ok := attrs[OriginalPublishTimeAttribute]; ok || t.IsZero() {
+		return
+	}
+	attrs[OriginalPublishTimeAttribute] = t.UTC().Format(time.RFC3339Nano)
+}
+
+// OriginalPublishTime returns the time when the message was first published,
+// read from the OriginalPublishTimeAttribute. If the attribute isn't set or
+// is invalid, the message PublishTime is returned.
+func OriginalPublishTime(msg *pubsub.Message) time.Time {
+	if v, ok := msg.Attributes[OriginalPublishTimeAttribute]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t
+		}
+	}
+	return msg.PublishTime
+}
+
+// withOriginalPublishTime returns the message attributes with the
+// OriginalPublishTimeAttribute set. The message attributes aren't modified.
+func withOriginalPublishTime(msg *pubsub.Message) map[string]string {
+	if _, ok := msg.Attributes[OriginalPublishTimeAttribute]; ok || msg.PublishTime.IsZero() {
+		return msg.Attributes
+	}
+	attrs := make(map[string]string, len(msg.Attributes)+1)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	SetOriginalPublishTime(attrs, msg.PublishTime)
+	return attrs
+}
@@ -0,0 +1,93 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestOriginalPublishTime(t *testing.T) {
+	first := time.Date(2023, 1, 1, 0, 0, 0, 1, time.UTC)
+	second := first.Add(time.Hour)
+
+	attrs := map[string]string{}
+	SetOriginalPublishTime(attrs, time.Time{})
+	assert.Empty(t, attrs)
+	SetOriginalPublishTime(attrs, first)
+	SetOriginalPublishTime(attrs, second) // The first publish time is kept.
+	assert.Equal(t, map[string]string{
+		OriginalPublishTimeAttribute: "2023-01-01T00:00:00.000000001Z",
+	}, attrs)
+
+	assert.Equal(t, first, OriginalPublishTime(&pubsub.Message{
+		Attributes: attrs, PublishTime: second,
+	}))
+	assert.Equal(t, second, OriginalPublishTime(&pubsub.Message{
+		PublishTime: second,
+	}))
+	assert.Equal(t, second, OriginalPublishTime(&pubsub.Message{
+		Attributes:  map[string]string{OriginalPublishTimeAttribute: "invalid"},
+		PublishTime: second,
+	}))
+}
+
+func TestConsumerOriginalPublishTime(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	var meta map[string]string
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtMostOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		},
+		Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+			meta, _ = queuecontext.MetadataFromContext(ctx)
+			return nil
+		}),
+	})
+	published := time.Now().Add(-time.Minute).UTC()
+	msg := &pubsub.Message{
+		Data:        []byte(`{}`),
+		Attributes:  map[string]string{"a": "b"},
+		PublishTime: published,
+	}
+	c.processMessage(context.Background(), msg)
+	// The metadata carries the publish time, the message is left untouched.
+	assert.Equal(t, map[string]string{
+		"a":                          "b",
+		OriginalPublishTimeAttribute: published.Format(time.RFC3339Nano),
+	}, meta)
+	assert.Equal(t, map[string]string{"a": "b"}, msg.Attributes)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	hist, ok := findMetric(t, rm, "consumer.delivery.lag").Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, hist.DataPoints, 1)
+	assert.GreaterOrEqual(t, hist.DataPoints[0].Sum, time.Minute.Seconds())
+}
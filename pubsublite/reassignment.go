@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// reassigned handles a new partition assignment of the subscriber. The
+// retry state of the failed messages of the partitions assigned away is
+// dropped: they'll be processed by another subscriber, and if a partition
+// is assigned back, its redelivered messages start over with a first
+// attempt. The retry state of the partitions which remain assigned is kept,
+// so their redeliveries keep counting towards the message being nacked.
+func (c *consumer[T]) reassigned(previous, next []int) {
+	assigned := make(map[int]struct{}, len(next))
+	for _, partition := range next {
+		assigned[partition] = struct{}{}
+	}
+	var dropped int
+	c.failed.Range(func(key, _ any) bool {
+		partition, _ := partitionOffset(key.(string))
+		if _, ok := assigned[partition]; !ok {
+			c.failed.Delete(key)
+			dropped++
+		}
+		return true
+	})
+	if c.partitionBackoff != nil {
+		c.partitionBackoff.reset(assigned)
+	}
+	c.logger.Info("partitions reassigned",
+		zap.Ints("previous_partitions", previous),
+		zap.Ints("partitions", next),
+		zap.Int("dropped_retries", dropped),
+	)
+	c.metrics.reassignments.Add(context.Background(), 1,
+		metric.WithAttributes(c.telemetryAttributes...),
+	)
+}
@@ -0,0 +1,71 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerReassigned(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	results := make(chan ProcessResult, 10)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			Results:       results,
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			return errors.New("process failed")
+		}),
+	})
+	ctx := context.Background()
+	process := func(id string) Outcome {
+		c.processMessage(ctx, &pubsub.Message{ID: id, Data: []byte(`{}`)})
+		return (<-results).Outcome
+	}
+	assert.Equal(t, OutcomeRetried, process("0:1"))
+	assert.Equal(t, OutcomeRetried, process("1:1"))
+	assert.Equal(t, OutcomeRetried, process("1:1"))
+
+	// Partition 1 is assigned away and back, partition 0 remains assigned.
+	c.reassigned([]int{0, 1}, []int{0})
+	c.reassigned([]int{0}, []int{0, 1})
+
+	// The deliveries of the retained partition keep counting, while the
+	// redeliveries of the reassigned partition start over.
+	assert.Equal(t, OutcomeRetried, process("0:1"))
+	assert.Equal(t, OutcomeNacked, process("0:1"))
+	assert.Equal(t, OutcomeRetried, process("1:1"))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	sum, ok := findMetric(t, rm, "consumer.reassignment.count").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	assert.Equal(t, int64(2), sum.DataPoints[0].Value)
+}
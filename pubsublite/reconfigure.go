@@ -0,0 +1,235 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"google.golang.org/api/option"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// PartialConfig holds the consumer settings which can be changed while the
+// consumer is running, see ConsumerConfig for their description. The
+// hot-reloadable settings are the MaintenanceSchedule,
+// SupportedSchemaVersions, OnContextCancel, RedactAttributes, RateLimit,
+// MaxConcurrency, MaxAttempts and Filter.
+//
+// The Region, Project, Topics and ClientOpts require the consumer to be
+// re-created. They may be set to the consumer's settings, i.e. when the
+// PartialConfig is derived from a complete configuration, but Reconfigure
+// returns an error when they're changed. Subscriptions are changed with
+// AddSubscription and RemoveSubscription instead.
+type PartialConfig struct {
+	MaintenanceSchedule     MaintenanceSchedule
+	SupportedSchemaVersions []string
+	OnContextCancel         CancelPolicy
+	RedactAttributes        []string
+	RateLimit               float64
+	MaxConcurrency          int
+	MaxAttempts             int
+	Filter                  func(attrs map[string]string) bool
+
+	Region     string
+	Project    string
+	Topics     []apmqueue.Topic
+	ClientOpts []option.ClientOption
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg PartialConfig) Validate() error {
+	if cfg.OnContextCancel > NackOnCancel {
+		return fmt.Errorf("pubsublite: invalid cancel policy %d", cfg.OnContextCancel)
+	}
+	return nil
+}
+
+// merge returns cfg with its unset hot-reloadable settings set to the ones
+// of current. Negative limits are reset to their default.
+func (cfg PartialConfig) merge(current PartialConfig) PartialConfig {
+	if cfg.MaintenanceSchedule == nil {
+		cfg.MaintenanceSchedule = current.MaintenanceSchedule
+	}
+	if cfg.SupportedSchemaVersions == nil {
+		cfg.SupportedSchemaVersions = current.SupportedSchemaVersions
+	}
+	if cfg.OnContextCancel == 0 {
+		cfg.OnContextCancel = current.OnContextCancel
+	}
+	if cfg.RedactAttributes == nil {
+		cfg.RedactAttributes = current.RedactAttributes
+	}
+	switch {
+	case cfg.RateLimit == 0:
+		cfg.RateLimit = current.RateLimit
+	case cfg.RateLimit < 0:
+		cfg.RateLimit = 0
+	}
+	switch {
+	case cfg.MaxConcurrency == 0:
+		cfg.MaxConcurrency = current.MaxConcurrency
+	case cfg.MaxConcurrency < 0:
+		cfg.MaxConcurrency = 0
+	}
+	switch {
+	case cfg.MaxAttempts == 0:
+		cfg.MaxAttempts = current.MaxAttempts
+	case cfg.MaxAttempts < 0:
+		cfg.MaxAttempts = 0
+	}
+	if cfg.Filter == nil {
+		cfg.Filter = current.Filter
+	}
+	cfg.Region, cfg.Project, cfg.Topics, cfg.ClientOpts = "", "", nil, nil
+	return cfg
+}
+
+// liveConfig holds the settings in PartialConfig, in the form used by the
+// consumers. It's replaced as a whole by Reconfigure, so the consumers never
+// observe a mix of old and new settings.
+type liveConfig struct {
+	maintenance MaintenanceSchedule
+	// schemaVersions is nil unless SupportedSchemaVersions are configured.
+	schemaVersions map[string]struct{}
+	// redact is nil unless RedactAttributes are configured.
+	redact redactor
+	// partial holds the settings the live config was created from.
+	partial PartialConfig
+}
+
+// defaultLiveConfig is used by the consumers which have no live config.
+var defaultLiveConfig = &liveConfig{}
+
+func newLiveConfig(cfg PartialConfig) *liveConfig {
+	var schemaVersions map[string]struct{}
+	if len(cfg.SupportedSchemaVersions) > 0 {
+		schemaVersions = make(map[string]struct{}, len(cfg.SupportedSchemaVersions))
+		for _, v := range cfg.SupportedSchemaVersions {
+			schemaVersions[v] = struct{}{}
+		}
+	}
+	return &liveConfig{
+		maintenance:    cfg.MaintenanceSchedule,
+		schemaVersions: schemaVersions,
+		redact:         newRedactor(cfg.RedactAttributes),
+		partial:        cfg,
+	}
+}
+
+// partialConfig returns the settings of cfg which can be changed live.
+func (cfg ConsumerConfig) partialConfig() PartialConfig {
+	return PartialConfig{
+		MaintenanceSchedule:     cfg.MaintenanceSchedule,
+		SupportedSchemaVersions: cfg.SupportedSchemaVersions,
+		OnContextCancel:         cfg.OnContextCancel,
+		RedactAttributes:        cfg.RedactAttributes,
+		RateLimit:               cfg.RateLimit,
+		MaxConcurrency:          cfg.MaxConcurrency,
+		MaxAttempts:             cfg.MaxAttempts,
+		Filter:                  cfg.Filter,
+	}
+}
+
+// Reconfigure atomically applies the hot-reloadable settings of cfg, see
+// PartialConfig, to the messages processed from then on by all the
+// subscriptions. Settings which are unset in cfg keep their current value,
+// and the RateLimit, MaxConcurrency and MaxAttempts are reset to their
+// default by setting them to a negative value. Changing the
+// MaintenanceSchedule takes effect within a second when the consumer is
+// running.
+//
+// An error is returned, and no setting is changed, if cfg is invalid or
+// changes a setting which requires the consumer to be re-created.
+func (c *TypedConsumer[T]) Reconfigure(cfg PartialConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("pubsublite: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.restartRequired(cfg); err != nil {
+		return fmt.Errorf("pubsublite: %w: %w", apmqueue.ErrInvalidConfig, err)
+	}
+	c.live.Store(newLiveConfig(cfg.merge(loadConfig(&c.live).partial)))
+	c.limiter.reconfigured()
+	return nil
+}
+
+// restartRequired returns an error if cfg changes any of the settings which
+// require the consumer to be re-created. It must be called with c.mu held.
+func (c *TypedConsumer[T]) restartRequired(cfg PartialConfig) error {
+	var errs []error
+	if cfg.Region != "" && cfg.Region != c.cfg.Region {
+		errs = append(errs, errors.New("pubsublite: changing the region requires re-creating the consumer"))
+	}
+	if cfg.Project != "" && cfg.Project != c.cfg.Project {
+		errs = append(errs, errors.New("pubsublite: changing the project requires re-creating the consumer"))
+	}
+	if cfg.Topics != nil && !sameTopics(cfg.Topics, c.topics()) {
+		errs = append(errs, errors.New("pubsublite: changing the topics requires AddSubscription or RemoveSubscription"))
+	}
+	if len(cfg.ClientOpts) > 0 {
+		// Client options can't be compared, i.e. they hold credentials.
+		errs = append(errs, errors.New("pubsublite: changing the client options requires re-creating the consumer"))
+	}
+	return errors.Join(errs...)
+}
+
+// sameTopics returns true if a and b hold the same topics, in any order.
+func sameTopics(a, b []apmqueue.Topic) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[apmqueue.Topic]int, len(a))
+	for _, topic := range a {
+		set[topic]++
+	}
+	for _, topic := range b {
+		if set[topic] == 0 {
+			return false
+		}
+		set[topic]--
+	}
+	return true
+}
+
+// defaultMaxAttempts is the default MaxAttempts.
+const defaultMaxAttempts = 3
+
+// maxAttempts returns the number of failed attempts after which a message is
+// nacked.
+func (l *liveConfig) maxAttempts() int {
+	if l.partial.MaxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return l.partial.MaxAttempts
+}
+
+// loadConfig returns the current live config of the consumer, or the default
+// config if the consumer has none.
+func loadConfig(live *atomic.Pointer[liveConfig]) *liveConfig {
+	if live == nil {
+		return defaultLiveConfig
+	}
+	if l := live.Load(); l != nil {
+		return l
+	}
+	return defaultLiveConfig
+}
@@ -0,0 +1,159 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerReconfigure(t *testing.T) {
+	c, err := NewTypedConsumer(context.Background(), TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Project:                 "project",
+			Region:                  "region",
+			Logger:                  zap.NewNop(),
+			Topics:                  []apmqueue.Topic{"topic"},
+			LazyConnect:             true,
+			SupportedSchemaVersions: []string{"1"},
+		},
+		Decoder:   jsonDecoder[customEvent]{},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error { return nil }),
+	})
+	require.NoError(t, err)
+	var processed []string
+	sub := &consumer[customEvent]{
+		metrics:  noopMetrics(t),
+		logger:   zap.NewNop(),
+		delivery: apmqueue.AtLeastOnceDeliveryType,
+		decoder:  jsonDecoder[customEvent]{},
+		pauser:   c.pauser,
+		live:     &c.live,
+		processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			processed = append(processed, events[0].Name)
+			return nil
+		}),
+	}
+	process := func(version string) {
+		sub.processMessage(context.Background(), &pubsub.Message{
+			Data:       []byte(`{"name":"` + version + `"}`),
+			Attributes: map[string]string{SchemaVersionAttribute: version},
+		})
+	}
+	process("1")
+	process("2")
+	assert.Equal(t, []string{"1"}, processed)
+
+	require.NoError(t, c.Reconfigure(PartialConfig{SupportedSchemaVersions: []string{"2"}}))
+	process("1")
+	process("2")
+	assert.Equal(t, []string{"1", "2"}, processed)
+
+	// Invalid settings aren't applied.
+	err = c.Reconfigure(PartialConfig{OnContextCancel: 100})
+	assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+	assert.EqualError(t, err, "pubsublite: invalid config: pubsublite: invalid cancel policy 100")
+	process("2")
+	assert.Equal(t, []string{"1", "2", "2"}, processed)
+
+	t.Run("unset settings are kept", func(t *testing.T) {
+		require.NoError(t, c.Reconfigure(PartialConfig{
+			MaxAttempts: 5,
+			Filter: func(attrs map[string]string) bool {
+				return attrs[SchemaVersionAttribute] != "skip"
+			},
+		}))
+		cfg := c.EffectiveConfig()
+		assert.Equal(t, []string{"2"}, cfg.SupportedSchemaVersions)
+		assert.Equal(t, 5, cfg.MaxAttempts)
+		assert.NotNil(t, cfg.Filter)
+
+		require.NoError(t, c.Reconfigure(PartialConfig{RateLimit: 100}))
+		cfg = c.EffectiveConfig()
+		assert.Equal(t, 5, cfg.MaxAttempts)
+		assert.Equal(t, float64(100), cfg.RateLimit)
+		assert.NotNil(t, cfg.Filter)
+
+		// Negative limits are reset to their default.
+		require.NoError(t, c.Reconfigure(PartialConfig{RateLimit: -1, MaxAttempts: -1}))
+		cfg = c.EffectiveConfig()
+		assert.Zero(t, cfg.RateLimit)
+		assert.Zero(t, cfg.MaxAttempts)
+		assert.Equal(t, defaultMaxAttempts, loadConfig(&c.live).maxAttempts())
+	})
+	t.Run("filter", func(t *testing.T) {
+		processed = nil
+		process("skip")
+		process("2")
+		assert.Equal(t, []string{"2"}, processed)
+	})
+	t.Run("restart required", func(t *testing.T) {
+		// The settings of the consumer may be passed.
+		require.NoError(t, c.Reconfigure(PartialConfig{
+			Region:  "region",
+			Project: "project",
+			Topics:  []apmqueue.Topic{"topic"},
+		}))
+		err := c.Reconfigure(PartialConfig{
+			Region:      "other",
+			Project:     "other",
+			Topics:      []apmqueue.Topic{"topic", "other"},
+			ClientOpts:  []option.ClientOption{option.WithoutAuthentication()},
+			MaxAttempts: 10,
+		})
+		assert.ErrorIs(t, err, apmqueue.ErrInvalidConfig)
+		for _, msg := range []string{
+			"pubsublite: changing the region requires re-creating the consumer",
+			"pubsublite: changing the project requires re-creating the consumer",
+			"pubsublite: changing the topics requires AddSubscription or RemoveSubscription",
+			"pubsublite: changing the client options requires re-creating the consumer",
+		} {
+			assert.ErrorContains(t, err, msg)
+		}
+		// None of the settings are applied.
+		assert.Zero(t, c.EffectiveConfig().MaxAttempts)
+	})
+}
+
+func TestConsumerMaxAttempts(t *testing.T) {
+	results := make(chan ProcessResult, 10)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:    apmqueue.AtLeastOnceDeliveryType,
+			Results:     results,
+			MaxAttempts: 2,
+		},
+		Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error {
+			return errors.New("process failed")
+		}),
+	})
+	msg := &pubsub.Message{ID: "0:1", Data: []byte(`{}`)}
+	c.processMessage(context.Background(), msg)
+	assert.Equal(t, OutcomeRetried, (<-results).Outcome)
+	c.processMessage(context.Background(), msg)
+	assert.Equal(t, OutcomeNacked, (<-results).Outcome)
+}
@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+// redactedValue replaces the values of the redacted attributes in logs.
+const redactedValue = "[redacted]"
+
+// redactor replaces the values of sensitive attributes before they're logged.
+type redactor map[string]struct{}
+
+// newRedactor returns a redactor for the keys, or nil if keys is empty.
+func newRedactor(keys []string) redactor {
+	if len(keys) == 0 {
+		return nil
+	}
+	r := make(redactor, len(keys))
+	for _, k := range keys {
+		r[k] = struct{}{}
+	}
+	return r
+}
+
+// attributes returns attrs with the values of the redacted keys replaced.
+// attrs is returned as is if none of its keys are redacted.
+func (r redactor) attributes(attrs map[string]string) map[string]string {
+	var redacted map[string]string
+	for k := range attrs {
+		if _, ok := r[k]; !ok {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(map[string]string, len(attrs))
+			for k, v := range attrs {
+				redacted[k] = v
+			}
+		}
+		redacted[k] = redactedValue
+	}
+	if redacted == nil {
+		return attrs
+	}
+	return redacted
+}
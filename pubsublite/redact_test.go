@@ -0,0 +1,64 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestRedactor(t *testing.T) {
+	attrs := map[string]string{"user.email": "a@b.c", "tenant": "a"}
+	var r redactor
+	assert.Equal(t, attrs, r.attributes(attrs))
+
+	r = newRedactor([]string{"user.email", "user.name"})
+	assert.Equal(t, map[string]string{"user.email": "[redacted]", "tenant": "a"}, r.attributes(attrs))
+	// The original attributes aren't modified.
+	assert.Equal(t, "a@b.c", attrs["user.email"])
+	assert.Nil(t, r.attributes(nil))
+}
+
+func TestConsumerRedactAttributes(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:         apmqueue.AtLeastOnceDeliveryType,
+			Logger:           zap.New(core),
+			RedactAttributes: []string{"user.email"},
+		},
+	})
+	c.processMessage(context.Background(), &pubsub.Message{
+		Data:       []byte(`invalid`),
+		Attributes: map[string]string{"user.email": "a@b.c", "tenant": "a"},
+	})
+	entries := logs.FilterMessage("unable to decode message.Data").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, map[string]string{"user.email": "[redacted]", "tenant": "a"},
+		entries[0].ContextMap()["headers"],
+	)
+}
@@ -0,0 +1,195 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// reorderTarget processes the messages released by a reorderBuffer.
+type reorderTarget interface {
+	// processMessage processes a message from its receive callback, once
+	// the buffer is closed.
+	processMessage(ctx context.Context, msg *pubsub.Message)
+	// processReleased processes a buffered message, after its receive
+	// callback has returned.
+	processReleased(ctx context.Context, msg *pubsub.Message, received time.Time)
+	dropLate(ctx context.Context, msg *pubsub.Message)
+}
+
+// reorderEntry is a message buffered in a reorderBuffer.
+type reorderEntry struct {
+	ctx    context.Context
+	msg    *pubsub.Message
+	target reorderTarget
+	// received is when the message was received, before being buffered.
+	received time.Time
+	// seq preserves the arrival order of messages with the same publish time.
+	seq uint64
+}
+
+// reorderBuffer buffers messages from multiple subscriptions and partitions,
+// releasing them in publish time order once they're older than the window.
+// Messages published before the last released message are late, and are
+// dropped since processing them would break the ordering.
+type reorderBuffer struct {
+	window time.Duration
+	now    func() time.Time
+	// notify is signaled when a message is buffered.
+	notify chan struct{}
+
+	mu       sync.Mutex
+	entries  reorderHeap
+	seq      uint64
+	released time.Time
+	closed   bool
+}
+
+func newReorderBuffer(window time.Duration, now func() time.Time) *reorderBuffer {
+	return &reorderBuffer{
+		window: window,
+		now:    now,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push buffers the message. Once the buffer is closed, messages are processed
+// immediately, since their ordering can't be guaranteed anymore.
+func (b *reorderBuffer) push(ctx context.Context, target reorderTarget, msg *pubsub.Message) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		target.processMessage(ctx, msg)
+		return
+	}
+	if msg.PublishTime.Before(b.released) {
+		b.mu.Unlock()
+		target.dropLate(ctx, msg)
+		return
+	}
+	b.seq++
+	heap.Push(&b.entries, reorderEntry{
+		ctx: ctx, msg: msg, target: target, received: time.Now(), seq: b.seq,
+	})
+	b.mu.Unlock()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run releases the buffered messages as they become ready until ctx is done,
+// then processes all the remaining messages in order and closes the buffer.
+func (b *reorderBuffer) run(ctx context.Context) {
+	timer := time.NewTimer(b.window)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.drain()
+			return
+		case <-timer.C:
+		case <-b.notify:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		timer.Reset(b.release())
+	}
+}
+
+// release processes the messages which are older than the window, in publish
+// time order, and returns the duration until the next message is ready.
+func (b *reorderBuffer) release() time.Duration {
+	ready, next := b.ready()
+	for _, e := range ready {
+		e.target.processReleased(e.ctx, e.msg, e.received)
+	}
+	return next
+}
+
+// ready pops the messages which are older than the window.
+func (b *reorderBuffer) ready() ([]reorderEntry, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ready []reorderEntry
+	now := b.now()
+	for len(b.entries) > 0 {
+		wait := b.entries[0].msg.PublishTime.Add(b.window).Sub(now)
+		if wait > 0 {
+			return ready, wait
+		}
+		e := heap.Pop(&b.entries).(reorderEntry)
+		b.released = e.msg.PublishTime
+		ready = append(ready, e)
+	}
+	return ready, b.window
+}
+
+// drain closes the buffer and processes all the buffered messages in order.
+func (b *reorderBuffer) drain() {
+	b.mu.Lock()
+	b.closed = true
+	entries := make([]reorderEntry, 0, len(b.entries))
+	for len(b.entries) > 0 {
+		entries = append(entries, heap.Pop(&b.entries).(reorderEntry))
+	}
+	b.mu.Unlock()
+	for _, e := range entries {
+		e.target.processReleased(e.ctx, e.msg, e.received)
+	}
+}
+
+// processReleased processes a message released by the reorder buffer. The
+// receive span of the message ended once it was buffered, so it's processed
+// in a new span. The time spent buffered counts towards its dwell time.
+func (c *consumer[T]) processReleased(ctx context.Context, msg *pubsub.Message, received time.Time) {
+	ctx, span := c.startSpan(ctx, msg, "Release")
+	defer span.End()
+	c.processReceived(ctx, msg, received)
+}
+
+// reorderHeap implements heap.Interface, ordering entries by publish time.
+type reorderHeap []reorderEntry
+
+func (h reorderHeap) Len() int { return len(h) }
+
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].msg.PublishTime.Equal(h[j].msg.PublishTime) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].msg.PublishTime.Before(h[j].msg.PublishTime)
+}
+
+func (h reorderHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *reorderHeap) Push(x any) { *h = append(*h, x.(reorderEntry)) }
+
+func (h *reorderHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = reorderEntry{}
+	*h = old[:n-1]
+	return e
+}
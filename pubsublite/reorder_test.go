@@ -0,0 +1,182 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	start := time.Now()
+	now := start
+	b := newReorderBuffer(time.Second, func() time.Time { return now })
+	target := &recordingTarget{}
+	msg := func(id string, published time.Duration) *pubsub.Message {
+		return &pubsub.Message{ID: id, PublishTime: start.Add(published)}
+	}
+	ctx := context.Background()
+
+	// Messages arrive out of order from different partitions.
+	b.push(ctx, target, msg("1:0", 3*time.Second))
+	b.push(ctx, target, msg("0:0", time.Second))
+	b.push(ctx, target, msg("2:0", 2*time.Second))
+	b.push(ctx, target, msg("0:1", 2*time.Second))
+
+	now = start.Add(2500 * time.Millisecond)
+	assert.Equal(t, 500*time.Millisecond, b.release())
+	assert.Equal(t, []string{"0:0"}, target.processedIDs())
+
+	now = start.Add(10 * time.Second)
+	assert.Equal(t, time.Second, b.release())
+	// Messages with the same publish time are released in arrival order.
+	assert.Equal(t, []string{"0:0", "2:0", "0:1", "1:0"}, target.processedIDs())
+
+	// Messages published before the last released message are dropped.
+	b.push(ctx, target, msg("3:0", 1500*time.Millisecond))
+	assert.Equal(t, []string{"3:0"}, target.droppedIDs())
+
+	// Draining processes the buffered messages regardless of their age, and
+	// any messages pushed afterwards are processed immediately.
+	b.push(ctx, target, msg("1:2", 9*time.Second))
+	b.push(ctx, target, msg("1:1", 8*time.Second))
+	b.drain()
+	b.push(ctx, target, msg("1:3", 0))
+	assert.Equal(t, []string{"0:0", "2:0", "0:1", "1:0", "1:1", "1:2", "1:3"},
+		target.processedIDs(),
+	)
+	assert.Equal(t, []string{"3:0"}, target.droppedIDs())
+}
+
+func TestReorderBufferRun(t *testing.T) {
+	b := newReorderBuffer(20*time.Millisecond, time.Now)
+	target := &recordingTarget{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.run(ctx)
+	}()
+
+	now := time.Now()
+	b.push(ctx, target, &pubsub.Message{ID: "0:1", PublishTime: now.Add(time.Millisecond)})
+	b.push(ctx, target, &pubsub.Message{ID: "1:1", PublishTime: now})
+	assert.Eventually(t, func() bool {
+		return len(target.processedIDs()) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"1:1", "0:1"}, target.processedIDs())
+
+	b.push(ctx, target, &pubsub.Message{ID: "2:1", PublishTime: time.Now().Add(time.Hour)})
+	cancel()
+	<-done
+	assert.Equal(t, []string{"1:1", "0:1", "2:1"}, target.processedIDs())
+}
+
+func TestConsumerReorderRelease(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := tp.Tracer("test")
+	processed := make(chan trace.Span, 1)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:       apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider:  sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			TracerProvider: tp,
+		},
+		Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+			processed <- trace.SpanFromContext(ctx)
+			return nil
+		}),
+	})
+	start := time.Now()
+	now := start
+	b := newReorderBuffer(time.Second, func() time.Time { return now })
+
+	ctx, receive := tracer.Start(context.Background(), "pubsublite.Receive")
+	b.push(ctx, c, &pubsub.Message{ID: "0:1", Data: []byte(`{}`), PublishTime: start})
+	receive.End()
+	time.Sleep(20 * time.Millisecond)
+	now = start.Add(time.Second)
+	b.release()
+
+	// The message is processed in a new span, linked to the ended receive
+	// span.
+	span := <-processed
+	assert.NotEqual(t, receive.SpanContext().SpanID(), span.SpanContext().SpanID())
+	ended := recorder.Ended()
+	require.Len(t, ended, 2)
+	assert.Equal(t, "pubsublite.Release", ended[1].Name())
+	require.Len(t, ended[1].Links(), 1)
+	assert.Equal(t, receive.SpanContext(), ended[1].Links()[0].SpanContext)
+
+	// The time spent buffered counts towards the dwell time.
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	dwell, ok := findMetric(t, rm, "consumer.message.dwell").Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, dwell.DataPoints, 1)
+	assert.GreaterOrEqual(t, dwell.DataPoints[0].Sum, (20 * time.Millisecond).Seconds())
+}
+
+type recordingTarget struct {
+	mu        sync.Mutex
+	processed []string
+	dropped   []string
+}
+
+func (r *recordingTarget) processMessage(_ context.Context, msg *pubsub.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.processed = append(r.processed, msg.ID)
+}
+
+func (r *recordingTarget) processReleased(ctx context.Context, msg *pubsub.Message, _ time.Time) {
+	r.processMessage(ctx, msg)
+}
+
+func (r *recordingTarget) dropLate(_ context.Context, msg *pubsub.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dropped = append(r.dropped, msg.ID)
+}
+
+func (r *recordingTarget) processedIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.processed...)
+}
+
+func (r *recordingTarget) droppedIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.dropped...)
+}
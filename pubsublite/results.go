@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// errorKindKey is the metric attribute key holding the kind of error which
+// caused a message to be nacked or retried.
+const errorKindKey = attribute.Key("error.kind")
+
+// errorKind classifies the error into a bounded set of kinds: timeout,
+// sink-unavailable for errors wrapping apmqueue.ErrBackendUnavailable,
+// validation for errors wrapping apmqueue.ErrInvalidEvent, or unknown.
+func errorKind(err error) string {
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &timeout) && timeout.Timeout():
+		return "timeout"
+	case errors.Is(err, apmqueue.ErrBackendUnavailable):
+		return "sink-unavailable"
+	case errors.Is(err, apmqueue.ErrInvalidEvent):
+		return "validation"
+	}
+	return "unknown"
+}
+
+// Outcome is the outcome of consuming a message.
+type Outcome uint8
+
+const (
+	// OutcomeAcked is the outcome of messages which are acknowledged, either
+	// because they have been processed, or because they're dropped without
+	// being processed, i.e. when they're expired.
+	OutcomeAcked Outcome = iota
+	// OutcomeNacked is the outcome of messages which are nacked, either
+	// because they can't be decoded, or because they failed to be processed
+	// too many times.
+	OutcomeNacked
+	// OutcomeRetried is the outcome of messages which failed to be
+	// processed, or whose processing was interrupted by the consumer being
+	// closed, and are left unacknowledged to be redelivered.
+	OutcomeRetried
+)
+
+// String returns the name of the outcome.
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeAcked:
+		return "acked"
+	case OutcomeNacked:
+		return "nacked"
+	case OutcomeRetried:
+		return "retried"
+	}
+	return "unknown"
+}
+
+// ProcessResult is the result of consuming a message, sent to the
+// ConsumerConfig.Results channel.
+type ProcessResult struct {
+	// Topic is the topic of the subscription which received the message.
+	Topic apmqueue.Topic
+	// Partition is the partition of the message.
+	Partition int
+	// Offset is the offset of the message in its partition.
+	Offset int64
+	// Outcome is the outcome of the message.
+	Outcome Outcome
+	// Err is the decoding or processing error, if any.
+	Err error
+	// RetryDelay is the delay before a retried message is reprocessed,
+	// when a RetryBackoff is configured.
+	RetryDelay time.Duration
+}
+
+// result records the time the message spent in the consumer since it was
+// received, and sends the result of consuming the message to the results
+// channel, if any. The result is dropped if the channel is full, so slow
+// receivers never block message processing.
+func (c *consumer[T]) result(ctx context.Context, msg *pubsub.Message, received time.Time,
+	outcome Outcome, err error,
+) {
+	c.report(ctx, msg, received, ProcessResult{Outcome: outcome, Err: err})
+}
+
+// report records and sends the result, filling in its topic, partition and
+// offset from the message.
+func (c *consumer[T]) report(ctx context.Context, msg *pubsub.Message, received time.Time, r ProcessResult) {
+	attrs := []attribute.KeyValue{attribute.String("outcome", r.Outcome.String())}
+	if r.Err != nil {
+		attrs = append(attrs, errorKindKey.String(errorKind(r.Err)))
+	}
+	c.metrics.dwell.Record(ctx, time.Since(received).Seconds(), metric.WithAttributes(
+		append(attrs, c.telemetryAttributes...)...,
+	))
+	if c.results == nil && c.observe == nil {
+		return
+	}
+	r.Topic = c.topic
+	r.Partition, r.Offset = partitionOffset(msg.ID)
+	if c.observe != nil {
+		c.observe(r)
+	}
+	if c.results == nil {
+		return
+	}
+	select {
+	case c.results <- r:
+	default:
+	}
+}
@@ -0,0 +1,211 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerResults(t *testing.T) {
+	errProcess := errors.New("process failed")
+	newConsumer := func(delivery apmqueue.DeliveryType, results chan ProcessResult) *consumer[customEvent] {
+		return newTestConsumer(t, TypedConsumerConfig[customEvent]{
+			ConsumerConfig: ConsumerConfig{
+				Delivery: delivery,
+				Results:  results,
+			},
+			Processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+				if events[0].Name == "fail" {
+					return errProcess
+				}
+				return nil
+			}),
+		})
+	}
+	ctx := context.Background()
+
+	t.Run("at least once", func(t *testing.T) {
+		results := make(chan ProcessResult, 10)
+		c := newConsumer(apmqueue.AtLeastOnceDeliveryType, results)
+		c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{"name":"ok"}`)})
+		c.processMessage(ctx, &pubsub.Message{ID: "1:2", Data: []byte(`invalid`)})
+		for i := 0; i < 3; i++ {
+			c.processMessage(ctx, &pubsub.Message{ID: "0:3", Data: []byte(`{"name":"fail"}`)})
+		}
+		close(results)
+		var got []ProcessResult
+		for r := range results {
+			got = append(got, r)
+		}
+		require.Len(t, got, 5)
+		assert.Equal(t, ProcessResult{Topic: "topic", Partition: 0, Offset: 1, Outcome: OutcomeAcked}, got[0])
+		assert.Equal(t, OutcomeNacked, got[1].Outcome)
+		assert.Equal(t, 1, got[1].Partition)
+		assert.Equal(t, int64(2), got[1].Offset)
+		assert.Error(t, got[1].Err)
+		for _, r := range got[2:4] {
+			assert.Equal(t, ProcessResult{Topic: "topic", Partition: 0, Offset: 3, Outcome: OutcomeRetried, Err: errProcess}, r)
+		}
+		assert.Equal(t, ProcessResult{Topic: "topic", Partition: 0, Offset: 3, Outcome: OutcomeNacked, Err: errProcess}, got[4])
+	})
+	t.Run("at most once", func(t *testing.T) {
+		results := make(chan ProcessResult, 10)
+		c := newConsumer(apmqueue.AtMostOnceDeliveryType, results)
+		c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{"name":"fail"}`)})
+		require.Len(t, results, 1)
+		assert.Equal(t, ProcessResult{Topic: "topic", Partition: 0, Offset: 1, Outcome: OutcomeAcked, Err: errProcess}, <-results)
+	})
+	t.Run("full channel", func(t *testing.T) {
+		results := make(chan ProcessResult, 1)
+		c := newConsumer(apmqueue.AtLeastOnceDeliveryType, results)
+		// Results are dropped rather than blocking processing.
+		c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+		c.processMessage(ctx, &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+		require.Len(t, results, 1)
+		assert.Equal(t, int64(1), (<-results).Offset)
+	})
+}
+
+func TestConsumerMessageDwell(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	metrics, err := newConsumerMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), nil)
+	require.NoError(t, err)
+	c := &consumer[customEvent]{
+		metrics:  metrics,
+		logger:   zap.NewNop(),
+		delivery: apmqueue.AtLeastOnceDeliveryType,
+		decoder:  jsonDecoder[customEvent]{},
+		pauser:   newPauser(),
+		processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			if events[0].Name == "fail" {
+				return errors.New("process failed")
+			}
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{"name":"ok"}`)})
+	c.processMessage(ctx, &pubsub.Message{ID: "0:2", Data: []byte(`invalid`)})
+	c.processMessage(ctx, &pubsub.Message{ID: "0:3", Data: []byte(`{"name":"fail"}`)})
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	hist, ok := findMetric(t, rm, "consumer.message.dwell").Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	counts := make(map[string]uint64)
+	for _, dp := range hist.DataPoints {
+		outcome, _ := dp.Attributes.Value("outcome")
+		counts[outcome.AsString()] = dp.Count
+		if outcome.AsString() == "acked" {
+			// The dwell time includes the processing time.
+			assert.GreaterOrEqual(t, dp.Sum, (10 * time.Millisecond).Seconds())
+		}
+	}
+	assert.Equal(t, map[string]uint64{"acked": 1, "nacked": 1, "retried": 1}, counts)
+}
+
+func TestConsumerMessageDwellErrorKind(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	metrics, err := newConsumerMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), nil)
+	require.NoError(t, err)
+	c := &consumer[customEvent]{
+		metrics:  metrics,
+		logger:   zap.NewNop(),
+		delivery: apmqueue.AtMostOnceDeliveryType,
+		decoder:  jsonDecoder[customEvent]{},
+		pauser:   newPauser(),
+		processor: TypedProcessorFunc[customEvent](func(_ context.Context, events []customEvent) error {
+			switch events[0].Name {
+			case "timeout":
+				return fmt.Errorf("flush: %w", context.DeadlineExceeded)
+			case "unavailable":
+				return fmt.Errorf("flush: %w", apmqueue.ErrBackendUnavailable)
+			case "invalid":
+				return fmt.Errorf("bad event: %w", apmqueue.ErrInvalidEvent)
+			case "other":
+				return errors.New("process failed")
+			}
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	for i, name := range []string{"ok", "timeout", "unavailable", "invalid", "invalid", "other"} {
+		c.processMessage(ctx, &pubsub.Message{
+			ID:   fmt.Sprintf("0:%d", i),
+			Data: []byte(fmt.Sprintf(`{"name":%q}`, name)),
+		})
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	hist, ok := findMetric(t, rm, "consumer.message.dwell").Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	counts := make(map[string]uint64)
+	for _, dp := range hist.DataPoints {
+		kind, ok := dp.Attributes.Value(errorKindKey)
+		if !ok {
+			counts["none"] += dp.Count
+			continue
+		}
+		counts[kind.AsString()] += dp.Count
+	}
+	assert.Equal(t, map[string]uint64{
+		"none":             1,
+		"timeout":          1,
+		"sink-unavailable": 1,
+		"validation":       2,
+		"unknown":          1,
+	}, counts)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestErrorKind(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err  error
+		kind string
+	}{
+		"deadline":    {err: fmt.Errorf("x: %w", context.DeadlineExceeded), kind: "timeout"},
+		"net timeout": {err: fmt.Errorf("x: %w", timeoutError{}), kind: "timeout"},
+		"unavailable": {err: fmt.Errorf("x: %w", apmqueue.ErrBackendUnavailable), kind: "sink-unavailable"},
+		"invalid":     {err: fmt.Errorf("x: %w", apmqueue.ErrInvalidEvent), kind: "validation"},
+		"canceled":    {err: context.Canceled, kind: "unknown"},
+		"other":       {err: errors.New("x"), kind: "unknown"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.kind, errorKind(tc.err))
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/zap"
+)
+
+// defaultMaxRetryDelay is the default RetryBackoff.Max.
+const defaultMaxRetryDelay = time.Minute
+
+// RetryBackoff configures the delay between the processing attempts of a
+// message which failed to be processed.
+type RetryBackoff struct {
+	// Initial is the delay before the second processing attempt, which is
+	// doubled on every subsequent failed attempt. Disabled when <= 0.
+	Initial time.Duration
+	// Max caps the delay between attempts. If Max <= 0, defaults to 1m.
+	Max time.Duration
+}
+
+// Delay returns the delay before reprocessing a message whose processing
+// failed attempt times. It returns 0 when the backoff is disabled.
+func (b RetryBackoff) Delay(attempt int) time.Duration {
+	if b.Initial <= 0 || attempt < 1 {
+		return 0
+	}
+	max := b.Max
+	if max <= 0 {
+		max = defaultMaxRetryDelay
+	}
+	delay := b.Initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// retry reprocesses the message after delay, holding it unacknowledged in
+// the meantime. If ctx is done before the delay has elapsed, the message is
+// handled as cancelled. The receive span of the failed attempt has ended by
+// then, so every retry gets its own span. Retries skip the audit sampling,
+// the startup probe and the labelling of processMessage, which apply to the
+// first attempt only.
+func (c *consumer[T]) retry(ctx context.Context, msg *pubsub.Message, delay time.Duration) {
+	partition, offset := partitionOffset(msg.ID)
+	c.messageLogger(ctx, msg).Debug("retrying failed event",
+		zap.Int64("offset", offset),
+		zap.Int("partition", partition),
+		zap.Duration("retry_delay", delay),
+	)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		c.cancelled(ctx, msg, time.Now(), ctx.Err())
+	case <-timer.C:
+		ctx, span := c.startSpan(ctx, msg, "Retry")
+		defer span.End()
+		c.process(ctx, msg, time.Now())
+	}
+}
@@ -0,0 +1,147 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestRetryBackoffDelay(t *testing.T) {
+	b := RetryBackoff{Initial: time.Second, Max: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{
+		0: 0,
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		// Large attempts don't overflow.
+		100: 5 * time.Second,
+	} {
+		assert.Equal(t, want, b.Delay(attempt), "attempt %d", attempt)
+	}
+	assert.Equal(t, time.Duration(0), RetryBackoff{}.Delay(1))
+	assert.Equal(t, time.Minute, RetryBackoff{Initial: time.Second}.Delay(10))
+}
+
+func TestConsumerRetryBackoff(t *testing.T) {
+	results := make(chan ProcessResult, 10)
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := tp.Tracer("test")
+	var attempts atomic.Int32
+	spans := make(chan trace.Span, 2)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Delivery:       apmqueue.AtLeastOnceDeliveryType,
+			Results:        results,
+			RetryBackoff:   RetryBackoff{Initial: 20 * time.Millisecond},
+			TracerProvider: tp,
+		},
+		Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+			spans <- trace.SpanFromContext(ctx)
+			if attempts.Add(1) == 1 {
+				return errors.New("process failed")
+			}
+			return nil
+		}),
+	})
+	start := time.Now()
+	ctx, receive := tracer.Start(context.Background(), "pubsublite.Receive")
+	c.processMessage(ctx, &pubsub.Message{ID: "0:1", Data: []byte(`{}`)})
+	receive.End()
+
+	r := <-results
+	assert.Equal(t, OutcomeRetried, r.Outcome)
+	assert.Equal(t, 20*time.Millisecond, r.RetryDelay)
+	// The message is reprocessed once the delay has elapsed.
+	r = <-results
+	assert.Equal(t, OutcomeAcked, r.Outcome)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, int32(2), attempts.Load())
+
+	// The retry is processed in its own span, linked to the ended receive
+	// span, rather than in the receive span.
+	assert.Equal(t, receive, <-spans)
+	retry := <-spans
+	assert.NotEqual(t, receive.SpanContext().SpanID(), retry.SpanContext().SpanID())
+	ended := recorder.Ended()
+	require.Len(t, ended, 2)
+	assert.Equal(t, "pubsublite.Retry", ended[1].Name())
+	assert.False(t, ended[1].Parent().IsValid())
+	require.Len(t, ended[1].Links(), 1)
+	assert.Equal(t, receive.SpanContext(), ended[1].Links()[0].SpanContext)
+
+	t.Run("cancelled", func(t *testing.T) {
+		attempts.Store(0)
+		c.retryBackoff = RetryBackoff{Initial: time.Hour}
+		ctx, cancel := context.WithCancel(context.Background())
+		c.processMessage(ctx, &pubsub.Message{ID: "0:2", Data: []byte(`{}`)})
+		<-spans
+		r := <-results
+		require.Equal(t, OutcomeRetried, r.Outcome)
+		assert.Equal(t, time.Minute, r.RetryDelay)
+
+		// The held message is nacked for the subscriber to be terminated,
+		// and the subscription isn't done until then.
+		cancel()
+		r = <-results
+		assert.Equal(t, OutcomeRetried, r.Outcome)
+		assert.Equal(t, int32(1), attempts.Load())
+		c.wg.Wait()
+		_, nacked := c.cancelNacks.Load("0:2")
+		assert.True(t, nacked)
+	})
+	t.Run("held until the retries return", func(t *testing.T) {
+		attempts.Store(0)
+		c.retryBackoff = RetryBackoff{Initial: time.Hour}
+		retryCtx, cancelRetry := context.WithCancel(context.Background())
+		c.processMessage(retryCtx, &pubsub.Message{ID: "0:3", Data: []byte(`{}`)})
+		<-spans
+		require.Equal(t, OutcomeRetried, (<-results).Outcome)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c.processMessage(ctx, &pubsub.Message{ID: "0:4", Data: []byte(`{}`)})
+		require.Equal(t, OutcomeRetried, (<-results).Outcome)
+		// LeaveUnackedOnCancel doesn't nack the cancelled message, which
+		// would terminate the subscriber, while a retry is in flight.
+		_, nacked := c.cancelNacks.Load("0:4")
+		assert.False(t, nacked)
+
+		cancelRetry()
+		<-results
+		c.wg.Wait()
+		for _, id := range []string{"0:3", "0:4"} {
+			_, nacked := c.cancelNacks.Load(id)
+			assert.True(t, nacked, id)
+		}
+	})
+}
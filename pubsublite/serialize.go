@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// keyedMutex is a set of mutexes keyed by string, which can be acquired with
+// a context. Mutexes are removed once they're no longer held or waited for.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock is a mutex and the number of goroutines holding or waiting for it.
+type keyLock struct {
+	held chan struct{}
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyLock)}
+}
+
+// lock acquires the mutex of key, unless ctx is done first. The returned
+// function releases the mutex.
+func (m *keyedMutex) lock(ctx context.Context, key string) (func(), error) {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyLock{held: make(chan struct{}, 1)}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+	select {
+	case l.held <- struct{}{}:
+		return func() {
+			<-l.held
+			m.release(key, l)
+		}, nil
+	case <-ctx.Done():
+		m.release(key, l)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a reference to the mutex of key, removing it once unused.
+func (m *keyedMutex) release(key string, l *keyLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(m.locks, key)
+	}
+}
+
+// serialize waits until no other message with the same SerializeKeyAttribute
+// value is being processed by any subscription of the consumer. Messages
+// without the attribute aren't serialized. The returned function must be
+// called once the message has been processed.
+func (c *consumer[T]) serialize(ctx context.Context, msg *pubsub.Message) (func(), error) {
+	if c.keyLocks == nil {
+		return func() {}, nil
+	}
+	key, ok := msg.Attributes[c.serializeKey]
+	if !ok {
+		return func() {}, nil
+	}
+	return c.keyLocks.lock(ctx, key)
+}
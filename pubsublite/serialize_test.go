@@ -0,0 +1,110 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerSerializeKey(t *testing.T) {
+	keyLocks := newKeyedMutex()
+	var mu sync.Mutex
+	var active, maxActive int
+	newSub := func(topic apmqueue.Topic) *consumer[customEvent] {
+		return &consumer[customEvent]{
+			topic:        topic,
+			logger:       zap.NewNop(),
+			delivery:     apmqueue.AtLeastOnceDeliveryType,
+			decoder:      jsonDecoder[customEvent]{},
+			metrics:      noopMetrics(t),
+			pauser:       newPauser(),
+			keyLocks:     keyLocks,
+			serializeKey: "entity",
+			processor: TypedProcessorFunc[customEvent](func(ctx context.Context, _ []customEvent) error {
+				mu.Lock()
+				if active++; active > maxActive {
+					maxActive = active
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				active--
+				mu.Unlock()
+				return nil
+			}),
+		}
+	}
+	a, b := newSub("a"), newSub("b")
+	process := func(msgs map[*consumer[customEvent]]map[string]string) {
+		var wg sync.WaitGroup
+		for sub, attrs := range msgs {
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func(sub *consumer[customEvent], attrs map[string]string) {
+					defer wg.Done()
+					sub.processMessage(context.Background(), &pubsub.Message{
+						ID: "0:1", Data: []byte(`{}`), Attributes: attrs,
+					})
+				}(sub, attrs)
+			}
+		}
+		wg.Wait()
+	}
+
+	// Messages sharing a key are processed one at a time across subscriptions.
+	process(map[*consumer[customEvent]]map[string]string{
+		a: {"entity": "1"},
+		b: {"entity": "1"},
+	})
+	assert.Equal(t, 1, maxActive)
+	assert.Empty(t, keyLocks.locks)
+
+	// Messages with different keys, or without a key, are processed
+	// concurrently.
+	maxActive = 0
+	process(map[*consumer[customEvent]]map[string]string{
+		a: {"entity": "1"},
+		b: {"entity": "2"},
+	})
+	assert.Greater(t, maxActive, 1)
+	maxActive = 0
+	process(map[*consumer[customEvent]]map[string]string{a: nil, b: nil})
+	assert.Greater(t, maxActive, 1)
+}
+
+func TestKeyedMutexContext(t *testing.T) {
+	m := newKeyedMutex()
+	unlock, err := m.lock(context.Background(), "key")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = m.lock(ctx, "key")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	unlock()
+	assert.Empty(t, m.locks)
+}
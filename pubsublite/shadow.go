@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// shadow processes the events with the shadow processor in the background,
+// concurrently with the primary processor. The returned function must be
+// called with the result of the primary processor, which is compared with
+// the shadow result once both are known. The shadow result never affects the
+// acknowledgement of the message.
+func (c *consumer[T]) shadow(ctx context.Context, msg *pubsub.Message, events []T) func(error) {
+	primary := make(chan error, 1)
+	// Detach the context, so the shadow processor isn't cancelled once the
+	// primary processor has returned.
+	ctx = queuecontext.DetachedContext(ctx)
+	go func() {
+		err := c.processShadow(ctx, events)
+		primaryErr := <-primary
+		if err == nil && primaryErr == nil {
+			return
+		}
+		if err != nil {
+			c.metrics.shadowErrors.Add(ctx, 1, metric.WithAttributes(append(
+				[]attribute.KeyValue{attribute.Bool("primary.failed", primaryErr != nil)},
+				c.telemetryAttributes...,
+			)...))
+		}
+		if (err == nil) == (primaryErr == nil) {
+			return
+		}
+		partition, offset := partitionOffset(msg.ID)
+		c.sampler.error(c.messageLogger(ctx, msg), "shadow processor result differs from the processor result", err,
+			zap.NamedError("processor_error", primaryErr),
+			zap.Int64("offset", offset),
+			zap.Int("partition", partition),
+		)
+	}()
+	return func(err error) { primary <- err }
+}
+
+// processShadow processes the events with the shadow processor, recovering
+// from any panic.
+func (c *consumer[T]) processShadow(ctx context.Context, events []T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("pubsublite: shadow processor panic: %v", r)
+		}
+	}()
+	return c.shadowProcessor.Process(ctx, events)
+}
@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerShadowProcessor(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	core, logs := observer.New(zapcore.ErrorLevel)
+	results := make(chan ProcessResult, 3)
+	shadowed := make(chan string, 3)
+	c := newTestConsumer(t, TypedConsumerConfig[customEvent]{
+		ConsumerConfig: ConsumerConfig{
+			Logger:        zap.New(core),
+			Delivery:      apmqueue.AtLeastOnceDeliveryType,
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			Results:       results,
+		},
+		ShadowProcessor: TypedProcessorFunc[customEvent](func(ctx context.Context, events []customEvent) error {
+			defer func() { shadowed <- events[0].Name }()
+			switch events[0].Name {
+			case "error":
+				return errors.New("shadow failed")
+			case "panic":
+				panic("boom")
+			}
+			return nil
+		}),
+	})
+	for i, name := range []string{"ok", "error", "panic"} {
+		c.processMessage(context.Background(), &pubsub.Message{
+			ID:   "0:" + strconv.Itoa(i),
+			Data: []byte(`{"name":"` + name + `"}`),
+		})
+		// The shadow processor result doesn't affect the acknowledgement.
+		assert.Equal(t, OutcomeAcked, (<-results).Outcome)
+		select {
+		case got := <-shadowed:
+			assert.Equal(t, name, got)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the shadow processor")
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		return logs.FilterMessage("shadow processor result differs from the processor result").Len() == 2
+	}, time.Second, time.Millisecond)
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	sum, ok := findMetric(t, rm, "consumer.shadow.errors").Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(2), sum.DataPoints[0].Value)
+	assert.Equal(t, attribute.NewSet(append(
+		[]attribute.KeyValue{attribute.Bool("primary.failed", false)},
+		c.telemetryAttributes...,
+	)...), sum.DataPoints[0].Attributes)
+}
@@ -0,0 +1,241 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsublite/apiv1/pubsublitepb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// TestConsumerOnContextCancelSubscriber checks that closing the consumer
+// while a message is being processed doesn't block the shutdown of the
+// pscompat subscriber client, which waits for all the outstanding messages
+// to be acknowledged, and that the cancelled messages aren't committed.
+func TestConsumerOnContextCancelSubscriber(t *testing.T) {
+	for name, policy := range map[string]CancelPolicy{
+		"leave unacked": LeaveUnackedOnCancel,
+		"nack":          NackOnCancel,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := newFakeSubscriptionServer(t, 3)
+			core, logs := observer.New(zapcore.DebugLevel)
+			processing := make(chan struct{})
+			c, err := NewTypedConsumer(context.Background(), TypedConsumerConfig[customEvent]{
+				ConsumerConfig: ConsumerConfig{
+					Project:         "project",
+					Region:          "us-central1-a",
+					Topics:          []apmqueue.Topic{"topic"},
+					Logger:          zap.New(core),
+					Delivery:        apmqueue.AtLeastOnceDeliveryType,
+					OnContextCancel: policy,
+					ClientOpts:      server.clientOpts(),
+				},
+				Decoder: jsonDecoder[customEvent]{},
+				Processor: TypedProcessorFunc[customEvent](func(ctx context.Context, events []customEvent) error {
+					if events[0].Name == "0" {
+						return nil
+					}
+					close(processing)
+					<-ctx.Done()
+					return ctx.Err()
+				}),
+			})
+			require.NoError(t, err)
+			runErr := make(chan error, 1)
+			go func() { runErr <- c.Run(context.Background()) }()
+
+			select {
+			case <-processing:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the message to be processed")
+			}
+			require.NoError(t, c.Close())
+			select {
+			case err := <-runErr:
+				assert.NoError(t, err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the subscriber to stop")
+			}
+			// The cancelled message isn't committed, it's redelivered once
+			// the subscription is consumed again.
+			assert.LessOrEqual(t, server.committed(), int64(1))
+			assert.Zero(t, logs.FilterMessage("handling nacked message").Len())
+		})
+	}
+}
+
+// fakeSubscriptionServer is a fake Pub/Sub Lite server, which assigns the
+// partition 0 of the subscription, delivers its messages and records the
+// committed cursor.
+type fakeSubscriptionServer struct {
+	pubsublitepb.UnimplementedPartitionAssignmentServiceServer
+	pubsublitepb.UnimplementedSubscriberServiceServer
+	pubsublitepb.UnimplementedCursorServiceServer
+
+	addr     string
+	messages int
+
+	mu     sync.Mutex
+	cursor int64
+}
+
+// newFakeSubscriptionServer starts a server delivering the given number of
+// messages, whose data is {"name":"<offset>"}.
+func newFakeSubscriptionServer(t testing.TB, messages int) *fakeSubscriptionServer {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	s := &fakeSubscriptionServer{addr: lis.Addr().String(), messages: messages}
+	server := grpc.NewServer()
+	pubsublitepb.RegisterPartitionAssignmentServiceServer(server, s)
+	pubsublitepb.RegisterSubscriberServiceServer(server, s)
+	pubsublitepb.RegisterCursorServiceServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return s
+}
+
+func (s *fakeSubscriptionServer) clientOpts() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(s.addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// committed returns the last committed cursor, i.e. the offset of the next
+// message to deliver.
+func (s *fakeSubscriptionServer) committed() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cursor
+}
+
+func (s *fakeSubscriptionServer) AssignPartitions(stream pubsublitepb.PartitionAssignmentService_AssignPartitionsServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.GetInitial() == nil {
+		return fmt.Errorf("unexpected request %v", req)
+	}
+	if err := stream.Send(&pubsublitepb.PartitionAssignment{Partitions: []int64{0}}); err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			return nil
+		}
+	}
+}
+
+func (s *fakeSubscriptionServer) Subscribe(stream pubsublitepb.SubscriberService_SubscribeServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.GetInitial() == nil {
+		return fmt.Errorf("unexpected request %v", req)
+	}
+	if err := stream.Send(&pubsublitepb.SubscribeResponse{
+		Response: &pubsublitepb.SubscribeResponse_Initial{
+			Initial: &pubsublitepb.InitialSubscribeResponse{
+				Cursor: &pubsublitepb.Cursor{Offset: s.committed()},
+			},
+		},
+	}); err != nil {
+		return err
+	}
+	// The messages are delivered once the client has granted flow control
+	// tokens.
+	if _, err := stream.Recv(); err != nil {
+		return nil
+	}
+	messages := make([]*pubsublitepb.SequencedMessage, 0, s.messages)
+	for offset := s.committed(); offset < int64(s.messages); offset++ {
+		data := []byte(`{"name":"` + strconv.FormatInt(offset, 10) + `"}`)
+		messages = append(messages, &pubsublitepb.SequencedMessage{
+			Cursor:      &pubsublitepb.Cursor{Offset: offset},
+			PublishTime: timestamppb.Now(),
+			Message:     &pubsublitepb.PubSubMessage{Data: data},
+			SizeBytes:   int64(len(data)),
+		})
+	}
+	if err := stream.Send(&pubsublitepb.SubscribeResponse{
+		Response: &pubsublitepb.SubscribeResponse_Messages{
+			Messages: &pubsublitepb.MessageResponse{Messages: messages},
+		},
+	}); err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			return nil
+		}
+	}
+}
+
+func (s *fakeSubscriptionServer) StreamingCommitCursor(stream pubsublitepb.CursorService_StreamingCommitCursorServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.GetInitial() == nil {
+		return fmt.Errorf("unexpected request %v", req)
+	}
+	if err := stream.Send(&pubsublitepb.StreamingCommitCursorResponse{
+		Request: &pubsublitepb.StreamingCommitCursorResponse_Initial{
+			Initial: &pubsublitepb.InitialCommitCursorResponse{},
+		},
+	}); err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		s.mu.Lock()
+		s.cursor = req.GetCommit().GetCursor().GetOffset()
+		s.mu.Unlock()
+		if err := stream.Send(&pubsublitepb.StreamingCommitCursorResponse{
+			Request: &pubsublitepb.StreamingCommitCursorResponse_Commit{
+				Commit: &pubsublitepb.SequencedCommitCursorResponse{AcknowledgedCommits: 1},
+			},
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/pubsublite"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// ErrSubscriptionNotFound is returned when a configured subscription doesn't
+// exist. The returned error names the subscription.
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// subscriptionAdmin is the subset of the pubsublite.AdminClient used to
+// create missing subscriptions.
+type subscriptionAdmin interface {
+	Subscription(ctx context.Context, subscription string) (*pubsublite.SubscriptionConfig, error)
+	CreateSubscription(ctx context.Context, config pubsublite.SubscriptionConfig,
+		opts ...pubsublite.CreateSubscriptionOption,
+	) (*pubsublite.SubscriptionConfig, error)
+	Close() error
+}
+
+// newAdminClient creates the admin client used to create missing
+// subscriptions.
+func (c *TypedConsumer[T]) newAdminClient(ctx context.Context) (subscriptionAdmin, error) {
+	return pubsublite.NewAdminClient(ctx, c.cfg.Region, c.cfg.ClientOpts...)
+}
+
+// ensureSubscription creates the subscription if it doesn't exist. It's
+// attached to the topic with the same name as the subscription.
+func (c *TypedConsumer[T]) ensureSubscription(ctx context.Context, subscription Subscription) error {
+	admin, err := c.newAdmin(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsublite: failed creating admin client: %w", err)
+	}
+	defer admin.Close()
+	_, err = admin.Subscription(ctx, subscription.String())
+	if err == nil {
+		return nil
+	}
+	if !isNotFound(err) {
+		return fmt.Errorf("pubsublite: failed looking up subscription %s: %w", subscription, err)
+	}
+	topic := apmqueue.Topic(subscription.Name)
+	_, err = admin.CreateSubscription(ctx, pubsublite.SubscriptionConfig{
+		Name:                subscription.String(),
+		Topic:               formatTopic(subscription.Project, subscription.Region, topic),
+		DeliveryRequirement: pubsublite.DeliverImmediately,
+	})
+	if isAlreadyExists(err) {
+		// Created concurrently, i.e. by another consumer instance.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("pubsublite: failed creating subscription %s: %w", subscription, err)
+	}
+	c.cfg.Logger.Info("created missing subscription",
+		zap.String("subscription", subscription.String()),
+	)
+	return nil
+}
+
+// subscriptionError returns ErrSubscriptionNotFound, naming the
+// subscription, if err is caused by it not existing. Otherwise, err is
+// returned as is.
+func subscriptionError(subscription string, err error) error {
+	if !isNotFound(err) {
+		return err
+	}
+	return fmt.Errorf("pubsublite: %w: %s: %w", ErrSubscriptionNotFound, subscription, err)
+}
+
+func isNotFound(err error) bool {
+	return grpcCode(err) == codes.NotFound
+}
+
+func isAlreadyExists(err error) bool {
+	return grpcCode(err) == codes.AlreadyExists
+}
+
+// grpcCode returns the gRPC status code of the error, unwrapping it, or
+// codes.Unknown if it isn't a gRPC error.
+func grpcCode(err error) codes.Code {
+	var s interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &s) {
+		return s.GRPCStatus().Code()
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/pubsublite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestSubscriptionError(t *testing.T) {
+	const subscription = "projects/project/locations/us-east1/subscriptions/topic"
+	notFound := fmt.Errorf("receive failed: %w", status.Error(codes.NotFound, "not found"))
+	err := subscriptionError(subscription, notFound)
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+	assert.ErrorIs(t, err, notFound)
+	assert.ErrorContains(t, err, "pubsublite: subscription not found: "+subscription)
+
+	other := status.Error(codes.Unavailable, "unavailable")
+	assert.Equal(t, other, subscriptionError(subscription, other))
+}
+
+func TestConsumerCreateMissingSubscriptions(t *testing.T) {
+	newConsumer := func(t *testing.T, admin *fakeSubscriptionAdmin) error {
+		c, err := NewTypedConsumer(context.Background(), TypedConsumerConfig[customEvent]{
+			ConsumerConfig: ConsumerConfig{
+				Project:                    "project",
+				Region:                     "us-east1",
+				Logger:                     zap.NewNop(),
+				Topics:                     []apmqueue.Topic{"topic"},
+				LazyConnect:                true,
+				CreateMissingSubscriptions: true,
+				ClientOpts: []option.ClientOption{
+					option.WithoutAuthentication(),
+					option.WithEndpoint("localhost:0"),
+				},
+			},
+			Decoder:   jsonDecoder[customEvent]{},
+			Processor: TypedProcessorFunc[customEvent](func(context.Context, []customEvent) error { return nil }),
+		})
+		require.NoError(t, err)
+		c.newAdmin = func(context.Context) (subscriptionAdmin, error) { return admin, nil }
+		_, err = c.newConsumer(context.Background(), "topic")
+		assert.True(t, admin.closed)
+		return err
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		admin := &fakeSubscriptionAdmin{lookupErr: status.Error(codes.NotFound, "not found")}
+		require.NoError(t, newConsumer(t, admin))
+		assert.Equal(t, []pubsublite.SubscriptionConfig{{
+			Name:                "projects/project/locations/us-east1/subscriptions/topic",
+			Topic:               "projects/project/locations/us-east1/topics/topic",
+			DeliveryRequirement: pubsublite.DeliverImmediately,
+		}}, admin.created)
+	})
+	t.Run("exists", func(t *testing.T) {
+		admin := &fakeSubscriptionAdmin{}
+		require.NoError(t, newConsumer(t, admin))
+		assert.Empty(t, admin.created)
+	})
+	t.Run("created concurrently", func(t *testing.T) {
+		admin := &fakeSubscriptionAdmin{
+			lookupErr: status.Error(codes.NotFound, "not found"),
+			createErr: status.Error(codes.AlreadyExists, "already exists"),
+		}
+		assert.NoError(t, newConsumer(t, admin))
+	})
+	t.Run("lookup failed", func(t *testing.T) {
+		admin := &fakeSubscriptionAdmin{lookupErr: status.Error(codes.PermissionDenied, "denied")}
+		err := newConsumer(t, admin)
+		assert.ErrorContains(t, err, "pubsublite: failed looking up subscription projects/project/locations/us-east1/subscriptions/topic")
+		assert.Empty(t, admin.created)
+	})
+	t.Run("create failed", func(t *testing.T) {
+		admin := &fakeSubscriptionAdmin{
+			lookupErr: status.Error(codes.NotFound, "not found"),
+			createErr: errors.New("topic not found"),
+		}
+		assert.ErrorContains(t, newConsumer(t, admin), "pubsublite: failed creating subscription")
+	})
+}
+
+type fakeSubscriptionAdmin struct {
+	lookupErr error
+	createErr error
+	created   []pubsublite.SubscriptionConfig
+	closed    bool
+}
+
+func (a *fakeSubscriptionAdmin) Subscription(_ context.Context, name string) (*pubsublite.SubscriptionConfig, error) {
+	if a.lookupErr != nil {
+		return nil, a.lookupErr
+	}
+	return &pubsublite.SubscriptionConfig{Name: name}, nil
+}
+
+func (a *fakeSubscriptionAdmin) CreateSubscription(_ context.Context, cfg pubsublite.SubscriptionConfig,
+	_ ...pubsublite.CreateSubscriptionOption,
+) (*pubsublite.SubscriptionConfig, error) {
+	if a.createErr != nil {
+		return nil, a.createErr
+	}
+	a.created = append(a.created, cfg)
+	return &cfg, nil
+}
+
+func (a *fakeSubscriptionAdmin) Close() error {
+	a.closed = true
+	return nil
+}
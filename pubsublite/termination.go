@@ -0,0 +1,90 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// terminatedEvent is the name of the log and span emitted when a subscriber
+// terminates with a fatal error.
+const terminatedEvent = "consumer.subscriber.terminated"
+
+// lastOffsets tracks the highest offset of the messages recorded for each
+// partition of a subscription, i.e. the last received or acknowledged ones.
+type lastOffsets struct {
+	mu      sync.Mutex
+	offsets map[int]int64
+}
+
+func newLastOffsets() *lastOffsets {
+	return &lastOffsets{offsets: make(map[int]int64)}
+}
+
+// record records the offset of the message.
+func (l *lastOffsets) record(id string) {
+	partition, offset := partitionOffset(id)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.offsets[partition]; !ok || offset > last {
+		l.offsets[partition] = offset
+	}
+}
+
+// get returns the last recorded offset of the partition, if any.
+func (l *lastOffsets) get(partition int) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offset, ok := l.offsets[partition]
+	return offset, ok
+}
+
+// snapshot returns the last recorded offsets keyed by partition.
+func (l *lastOffsets) snapshot() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offsets := make(map[string]int64, len(l.offsets))
+	for partition, offset := range l.offsets {
+		offsets[strconv.Itoa(partition)] = offset
+	}
+	return offsets
+}
+
+// terminated reports the fatal termination of the subscriber with a
+// structured error log and a span, when ReportTermination is enabled.
+func (c *consumer[T]) terminated(err error) {
+	if c.lastOffsets == nil {
+		return
+	}
+	_, span := c.tracer.Start(context.Background(), terminatedEvent,
+		trace.WithAttributes(c.telemetryAttributes...),
+	)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+	c.logger.Error(terminatedEvent,
+		zap.NamedError("cause", err),
+		zap.Any("last_offset", c.lastOffsets.snapshot()),
+	)
+}
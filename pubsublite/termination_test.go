@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConsumerTerminated(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	core, logs := observer.New(zapcore.ErrorLevel)
+	attrs := []attribute.KeyValue{semconv.MessagingSourceNameKey.String("topic")}
+	c := &consumer[customEvent]{
+		logger:              zap.New(core),
+		tracer:              sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"),
+		telemetryAttributes: attrs,
+		lastOffsets:         newLastOffsets(),
+	}
+	for _, id := range []string{"0:0", "1:4", "0:2", "1:3"} {
+		c.lastOffsets.record(id)
+	}
+	c.terminated(errors.New("nack handler failed"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "consumer.subscriber.terminated", spans[0].Name())
+	assert.Equal(t, attrs, spans[0].Attributes())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "nack handler failed", spans[0].Status().Description)
+
+	entries := logs.FilterMessage("consumer.subscriber.terminated").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "nack handler failed", fields["cause"])
+	assert.Equal(t, map[string]int64{"0": 2, "1": 4}, fields["last_offset"])
+}
+
+func TestConsumerTerminatedDisabled(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	c := &consumer[customEvent]{logger: zap.New(core)}
+	c.terminated(errors.New("nack handler failed"))
+	assert.Equal(t, 0, logs.Len())
+}
@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// throughputWindow is the time constant of the throughput moving average:
+// the weight of an acknowledgement decays by 1/e every window.
+const throughputWindow = time.Minute
+
+// throughput is an exponentially weighted moving average of the number of
+// messages acknowledged per second.
+type throughput struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	rate    float64
+	updated time.Time
+}
+
+func newThroughput(now func() time.Time) *throughput {
+	return &throughput{now: now, updated: now()}
+}
+
+// add records n acknowledged messages.
+func (t *throughput) add(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.decay()
+	t.rate += float64(n) / throughputWindow.Seconds()
+}
+
+// get returns the current messages per second rate.
+func (t *throughput) get() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.decay()
+	return t.rate
+}
+
+// decay decays the rate for the time elapsed since it was last updated.
+func (t *throughput) decay() {
+	now := t.now()
+	if elapsed := now.Sub(t.updated); elapsed > 0 {
+		t.rate *= math.Exp(-elapsed.Seconds() / throughputWindow.Seconds())
+		t.updated = now
+	}
+}
+
+// Throughput returns the number of messages acknowledged per second by the
+// topic's subscription, as an exponentially weighted moving average over the
+// last minute. It returns false if the consumer isn't subscribed to the
+// topic, or the subscription isn't connected yet.
+func (c *TypedConsumer[T]) Throughput(topic apmqueue.Topic) (float64, bool) {
+	consumer, err := c.subscribed(topic)
+	if err != nil {
+		return 0, false
+	}
+	return consumer.throughput.get(), true
+}
+
+// observeThroughput reports the throughput of each connected subscription.
+func (c *TypedConsumer[T]) observeThroughput(_ context.Context, o metric.Observer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, consumer := range c.consumers {
+		o.ObserveFloat64(c.metrics.throughput, consumer.throughput.get(),
+			metric.WithAttributes(consumer.telemetryAttributes...),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestThroughput(t *testing.T) {
+	now := time.Now()
+	tp := newThroughput(func() time.Time { return now })
+	assert.Zero(t, tp.get())
+
+	// 10 messages per second converge to a rate of 10.
+	for i := 0; i < 10*600; i++ {
+		now = now.Add(100 * time.Millisecond)
+		tp.add(1)
+	}
+	assert.InDelta(t, 10, tp.get(), 0.1)
+
+	// The rate decays while no messages are acknowledged.
+	now = now.Add(throughputWindow)
+	assert.InDelta(t, 10/math.E, tp.get(), 0.1)
+}
+
+func TestConsumerThroughput(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	metrics, err := newConsumerMetrics(mp, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	c := &TypedConsumer[customEvent]{
+		metrics: metrics,
+		now:     func() time.Time { return now },
+	}
+	newSub := func(topic apmqueue.Topic) *consumer[customEvent] {
+		return &consumer[customEvent]{
+			topic:               topic,
+			metrics:             metrics,
+			throughput:          newThroughput(c.now),
+			telemetryAttributes: []attribute.KeyValue{attribute.String("topic", string(topic))},
+		}
+	}
+	a, b := newSub("a"), newSub("b")
+	c.consumers = []*consumer[customEvent]{a, b}
+	c.throughputCallback, err = mp.Meter("pubsublite").RegisterCallback(
+		c.observeThroughput, metrics.throughput,
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 60; i++ {
+		a.ackNow(context.Background(), &pubsub.Message{}, now)
+	}
+	rate, ok := c.Throughput("a")
+	assert.True(t, ok)
+	assert.InDelta(t, 1, rate, 1e-9)
+	rate, ok = c.Throughput("b")
+	assert.True(t, ok)
+	assert.Zero(t, rate)
+	_, ok = c.Throughput("c")
+	assert.False(t, ok)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	gauge, ok := findMetric(t, rm, "consumer.throughput").Data.(metricdata.Gauge[float64])
+	require.True(t, ok)
+	rates := make(map[string]float64)
+	for _, dp := range gauge.DataPoints {
+		topic, _ := dp.Attributes.Value("topic")
+		rates[topic.AsString()] = dp.Value
+	}
+	require.Len(t, rates, 2)
+	assert.InDelta(t, 1, rates["a"], 1e-9)
+	assert.Zero(t, rates["b"])
+}
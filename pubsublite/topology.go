@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"cloud.google.com/go/pubsublite/pscompat"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// logTopology logs the resolved consumer topology once, so it's easy to
+// verify that a deployed consumer is configured as intended. The ClientOpts
+// are never logged, since they may hold credentials. Must be called with the
+// lock held.
+func (c *TypedConsumer[T]) logTopology() {
+	subscriptions := make([]string, 0, len(c.consumers))
+	for _, consumer := range c.consumers {
+		subscriptions = append(subscriptions, consumer.subscription)
+	}
+	pending := make([]string, 0, len(c.pending))
+	for _, topic := range c.pending {
+		pending = append(pending, string(topic))
+	}
+	delivery := "at_least_once"
+	if c.cfg.Delivery == apmqueue.AtMostOnceDeliveryType {
+		delivery = "at_most_once"
+	}
+	maxMessages := c.settings.MaxOutstandingMessages
+	if maxMessages == 0 {
+		maxMessages = pscompat.DefaultReceiveSettings.MaxOutstandingMessages
+	}
+	maxBytes := c.settings.MaxOutstandingBytes
+	if maxBytes == 0 {
+		maxBytes = pscompat.DefaultReceiveSettings.MaxOutstandingBytes
+	}
+	c.cfg.Logger.Info("consumer topology",
+		zap.String("project", c.cfg.Project),
+		zap.String("region", c.cfg.Region),
+		zap.Strings("subscriptions", subscriptions),
+		zap.Strings("pending_topics", pending),
+		zap.String("delivery", delivery),
+		zap.Int("max_outstanding_messages", maxMessages),
+		zap.Int("max_outstanding_bytes", maxBytes),
+		zap.Int("ack_batch_size", c.cfg.AckBatchSize),
+		zap.Duration("ack_batch_interval", c.cfg.AckBatchInterval),
+		zap.Strings("features", c.features()),
+	)
+}
+
+// features returns the names of the optional features which are enabled.
+func (c *TypedConsumer[T]) features() []string {
+	var features []string
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"retry_backoff", c.cfg.RetryBackoff.Initial > 0},
+		{"reorder", c.reorder != nil},
+		{"audit", c.auditor != nil},
+		{"decode_guard", c.decodeGuard != nil},
+		{"startup_probe", c.probe != nil},
+		{"shadow_processor", c.cfg.ShadowProcessor != nil},
+		{"processor_router", len(c.cfg.ProcessorRouter) > 0},
+		{"pipeline", len(c.cfg.Pipeline) > 0},
+		{"decrypter", c.cfg.Decrypter != nil},
+		{"offset_anomalies", c.cfg.DetectOffsetAnomalies},
+		{"maintenance_schedule", c.cfg.MaintenanceSchedule != nil},
+		{"max_runtime", c.cfg.MaxRuntime > 0},
+	} {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
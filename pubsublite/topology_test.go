@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/api/option"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+func TestConsumerLogTopology(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	c := &TypedConsumer[customEvent]{
+		cfg: TypedConsumerConfig[customEvent]{ConsumerConfig: ConsumerConfig{
+			Project:          "project",
+			Region:           "region",
+			Logger:           zap.New(core),
+			Delivery:         apmqueue.AtMostOnceDeliveryType,
+			AckBatchSize:     100,
+			AckBatchInterval: time.Second,
+			MaxRuntime:       time.Hour,
+			RetryBackoff:     RetryBackoff{Initial: time.Second},
+			ClientOpts:       []option.ClientOption{option.WithAPIKey("secret")},
+		}},
+		pauser: newPauser(),
+	}
+	// The topology is logged once when the consumer runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, c.Run(ctx))
+	assert.Equal(t, 1, logs.FilterMessage("consumer topology").Len())
+
+	// The client options are never logged, since they may hold credentials.
+	logs.TakeAll()
+	c.consumers = []*consumer[customEvent]{
+		{subscription: "projects/project/locations/region/subscriptions/name-a"},
+	}
+	c.pending = []apmqueue.Topic{"b"}
+	c.logTopology()
+	entries := logs.FilterMessage("consumer topology").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, map[string]any{
+		"project":                  "project",
+		"region":                   "region",
+		"subscriptions":            []any{"projects/project/locations/region/subscriptions/name-a"},
+		"pending_topics":           []any{"b"},
+		"delivery":                 "at_most_once",
+		"max_outstanding_messages": int64(1000),
+		"max_outstanding_bytes":    int64(1e9),
+		"ack_batch_size":           int64(100),
+		"ack_batch_interval":       time.Second,
+		"features":                 []any{"retry_backoff", "max_runtime"},
+	}, entries[0].ContextMap())
+}
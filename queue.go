@@ -16,11 +16,12 @@
 // under the License.
 
 // Package apmqueue provides an abstraction layer for producing and consuming
-// model.Batch es from and to Kafka and GCP PubSub Lite.
+// model.Batch es from and to Kafka, GCP Pub/Sub and GCP PubSub Lite.
 package apmqueue
 
 import (
 	"context"
+	"errors"
 	"strings"
 
 	"github.com/elastic/apm-data/model"
@@ -36,6 +37,39 @@ const (
 	AtLeastOnceDeliveryType
 )
 
+// ErrAlreadyProcessed may be returned by processors which detect that an
+// event has already been processed, i.e. when it's redelivered. Consumers
+// acknowledge these events as successfully processed, but count them
+// separately as duplicates.
+var ErrAlreadyProcessed = errors.New("event already processed")
+
+// ErrInvalidEvent may be wrapped by the errors of processors which reject an
+// event as invalid, i.e. when it fails validation, so consumers can report
+// these failures separately from the downstream system being unavailable.
+var ErrInvalidEvent = errors.New("invalid event")
+
+// The errors returned by consumers and producers wrap the following errors
+// when applicable, allowing callers to handle them with errors.Is regardless
+// of the backend.
+var (
+	// ErrInvalidConfig is wrapped by the errors returned when a consumer or
+	// producer can't be created due to an invalid configuration.
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrBackendUnavailable is wrapped by the errors returned when the
+	// backend can't be reached.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	// ErrConsumerClosed is wrapped by the errors returned when using a
+	// consumer which has been closed.
+	ErrConsumerClosed = errors.New("consumer closed")
+	// ErrAlreadyStarted is wrapped by the errors returned when running a
+	// consumer which is already running.
+	ErrAlreadyStarted = errors.New("consumer already started")
+	// ErrAtomicUnsupported is wrapped by the errors returned when producing
+	// events atomically isn't supported by the backend or the producer's
+	// configuration.
+	ErrAtomicUnsupported = errors.New("atomic produce unsupported")
+)
+
 // DeliveryType for the consumer. For more details See the supported DeliveryTypes.
 type DeliveryType uint8
 
@@ -58,6 +92,21 @@ type Producer interface {
 	Close() error
 }
 
+// AtomicProducer is implemented by producers which can publish events to
+// multiple topics atomically: either all or none of them are published.
+type AtomicProducer interface {
+	// ProduceAtomically publishes each event to its topic, bypassing the
+	// producer's TopicRouter, and returns an error if any of them couldn't
+	// be published, in which case none of them are.
+	ProduceAtomically(ctx context.Context, events []TopicEvent) error
+}
+
+// TopicEvent is an event and the topic it's produced to.
+type TopicEvent struct {
+	Topic Topic
+	Event model.APMEvent
+}
+
 // Topic represents a destination topic where to produce a message/record.
 type Topic string
 
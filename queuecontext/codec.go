@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package queuecontext
+
+import (
+	"context"
+	"fmt"
+)
+
+// Metadata holds structured metadata, whose values aren't limited to strings.
+type Metadata map[string]any
+
+// MetadataCodec serializes structured Metadata to and from the string only
+// attributes supported by the queue backends, i.e. Kafka record headers and
+// Pub/Sub Lite message attributes.
+type MetadataCodec interface {
+	// EncodeMetadata encodes the metadata into string attributes.
+	EncodeMetadata(Metadata) (map[string]string, error)
+	// DecodeMetadata decodes the string attributes into metadata.
+	DecodeMetadata(map[string]string) (Metadata, error)
+}
+
+// IdentityCodec is the default MetadataCodec. It encodes string values as is
+// and other values with fmt.Sprint, and decodes attributes as string values.
+type IdentityCodec struct{}
+
+// EncodeMetadata encodes the metadata values as strings.
+func (IdentityCodec) EncodeMetadata(m Metadata) (map[string]string, error) {
+	attrs := make(map[string]string, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			attrs[k] = s
+			continue
+		}
+		attrs[k] = fmt.Sprint(v)
+	}
+	return attrs, nil
+}
+
+// DecodeMetadata decodes the attributes as string metadata values.
+func (IdentityCodec) DecodeMetadata(attrs map[string]string) (Metadata, error) {
+	m := make(Metadata, len(attrs))
+	for k, v := range attrs {
+		m[k] = v
+	}
+	return m, nil
+}
+
+// EncodeFromContext returns the string metadata stored in ctx, merged with
+// the structured metadata stored in ctx encoded with codec, which takes
+// precedence. If codec is nil, IdentityCodec is used. It returns false if ctx
+// holds no metadata.
+func EncodeFromContext(ctx context.Context, codec MetadataCodec) (map[string]string, bool, error) {
+	meta, ok := MetadataFromContext(ctx)
+	structured, structuredOK := StructuredMetadataFromContext(ctx)
+	if !structuredOK {
+		return meta, ok, nil
+	}
+	if codec == nil {
+		codec = IdentityCodec{}
+	}
+	encoded, err := codec.EncodeMetadata(structured)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	attrs := make(map[string]string, len(meta)+len(encoded))
+	for k, v := range meta {
+		attrs[k] = v
+	}
+	for k, v := range encoded {
+		attrs[k] = v
+	}
+	return attrs, true, nil
+}
@@ -0,0 +1,69 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package queuecontext
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityCodec(t *testing.T) {
+	attrs, err := IdentityCodec{}.EncodeMetadata(Metadata{"a": "b", "n": 1, "ok": true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "b", "n": "1", "ok": "true"}, attrs)
+
+	meta, err := IdentityCodec{}.DecodeMetadata(attrs)
+	require.NoError(t, err)
+	assert.Equal(t, Metadata{"a": "b", "n": "1", "ok": "true"}, meta)
+}
+
+func TestEncodeFromContext(t *testing.T) {
+	ctx := context.Background()
+	_, ok, err := EncodeFromContext(ctx, nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ctx = WithMetadata(ctx, map[string]string{"a": "b", "c": "d"})
+	attrs, ok, err := EncodeFromContext(ctx, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "b", "c": "d"}, attrs)
+
+	ctx = WithStructuredMetadata(ctx, Metadata{"c": 1, "e": 2.5})
+	attrs, ok, err = EncodeFromContext(ctx, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "b", "c": "1", "e": "2.5"}, attrs)
+
+	_, _, err = EncodeFromContext(ctx, failingCodec{})
+	assert.EqualError(t, err, "failed to encode metadata: boom")
+}
+
+type failingCodec struct{}
+
+func (failingCodec) EncodeMetadata(Metadata) (map[string]string, error) {
+	return nil, errors.New("boom")
+}
+
+func (failingCodec) DecodeMetadata(map[string]string) (Metadata, error) {
+	return nil, errors.New("boom")
+}
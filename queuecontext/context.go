@@ -38,6 +38,21 @@ func MetadataFromContext(ctx context.Context) (map[string]string, bool) {
 	return nil, false
 }
 
+type structuredMetadataKey struct{}
+
+// WithStructuredMetadata enriches a context with structured metadata. The
+// producers encode it into string attributes with their MetadataCodec.
+func WithStructuredMetadata(ctx context.Context, metadata Metadata) context.Context {
+	return context.WithValue(ctx, structuredMetadataKey{}, metadata)
+}
+
+// StructuredMetadataFromContext returns the structured metadata from the
+// passed context and a bool indicating whether the value is present or not.
+func StructuredMetadataFromContext(ctx context.Context) (Metadata, bool) {
+	metadata, ok := ctx.Value(structuredMetadataKey{}).(Metadata)
+	return metadata, ok
+}
+
 // DetachedContext returns a new context detached from the lifetime
 // of ctx, but which still returns the values of ctx.
 //
@@ -0,0 +1,103 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// RunWithSignals runs the consumer until ctx is done, or until one of the
+// signals is received, by default SIGINT or SIGTERM. When a signal is
+// received, the consumer is closed, which drains the in-flight messages, and
+// RunWithSignals waits up to timeout for the consumer to stop. If the
+// consumer isn't stopped in time, or a second signal is received, the Run
+// context is cancelled to force the consumer to stop, and an error is
+// returned. There's no limit when timeout <= 0.
+//
+// The error returned by Run is discarded once a signal has been received,
+// since closing the consumer may make Run return an error. The consumer is
+// always closed when RunWithSignals returns.
+func RunWithSignals(ctx context.Context, consumer Consumer, timeout time.Duration, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, signals...)
+	defer signal.Stop(sig)
+	return runWithSignals(ctx, consumer, timeout, sig)
+}
+
+func runWithSignals(ctx context.Context, consumer Consumer, timeout time.Duration, sig <-chan os.Signal) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	runDone := make(chan error, 1)
+	go func() { runDone <- consumer.Run(ctx) }()
+	select {
+	case err := <-runDone:
+		// Run returned before any signal was received, i.e. when ctx is
+		// done or the consumer failed.
+		return errors.Join(err, consumer.Close())
+	case <-sig:
+	}
+
+	closeDone := make(chan error, 1)
+	go func() { closeDone <- consumer.Close() }()
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var closeErr error
+	for runDone != nil || closeDone != nil {
+		select {
+		case <-runDone:
+			runDone = nil
+		case closeErr = <-closeDone:
+			closeDone = nil
+		case <-deadline:
+			return forceStop(cancel, runDone, closeDone, closeErr,
+				fmt.Errorf("apmqueue: consumer not stopped within %s", timeout),
+			)
+		case <-sig:
+			return forceStop(cancel, runDone, closeDone, closeErr,
+				errors.New("apmqueue: consumer stop forced by a second signal"),
+			)
+		}
+	}
+	return closeErr
+}
+
+// forceStop cancels the Run context and waits for Run and Close to return,
+// if they haven't yet, so the consumer is closed when RunWithSignals returns.
+func forceStop(cancel context.CancelFunc, runDone, closeDone <-chan error, closeErr, err error) error {
+	cancel()
+	if runDone != nil {
+		<-runDone
+	}
+	if closeDone != nil {
+		closeErr = <-closeDone
+	}
+	return errors.Join(closeErr, err)
+}
@@ -0,0 +1,152 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunWithSignals(t *testing.T) {
+	t.Run("context done", func(t *testing.T) {
+		c := newSignalConsumer(false)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := runWithSignals(ctx, c, 0, make(chan os.Signal))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.True(t, c.isClosed())
+	})
+	t.Run("graceful", func(t *testing.T) {
+		c := newSignalConsumer(false)
+		sig := make(chan os.Signal, 1)
+		sig <- syscall.SIGTERM
+		assert.NoError(t, runWithSignals(context.Background(), c, time.Second, sig))
+		assert.True(t, c.isClosed())
+		// The consumer is stopped by Close, not by cancelling its context.
+		assert.NoError(t, c.runCtxErr())
+	})
+	t.Run("timeout", func(t *testing.T) {
+		c := newSignalConsumer(true)
+		sig := make(chan os.Signal, 1)
+		sig <- syscall.SIGTERM
+		err := runWithSignals(context.Background(), c, 10*time.Millisecond, sig)
+		assert.EqualError(t, err, "apmqueue: consumer not stopped within 10ms")
+		assert.ErrorIs(t, c.runCtxErr(), context.Canceled)
+	})
+	t.Run("second signal", func(t *testing.T) {
+		c := newSignalConsumer(true)
+		sig := make(chan os.Signal, 2)
+		sig <- syscall.SIGTERM
+		sig <- syscall.SIGTERM
+		err := runWithSignals(context.Background(), c, 0, sig)
+		assert.EqualError(t, err, "apmqueue: consumer stop forced by a second signal")
+		assert.ErrorIs(t, c.runCtxErr(), context.Canceled)
+	})
+	t.Run("forced while closing", func(t *testing.T) {
+		// Close blocks until Run returns, so it only returns once the Run
+		// context is cancelled.
+		c := newSignalConsumer(true)
+		c.blockClose = true
+		sig := make(chan os.Signal, 1)
+		sig <- syscall.SIGTERM
+		err := runWithSignals(context.Background(), c, 10*time.Millisecond, sig)
+		assert.EqualError(t, err, "close interrupted\napmqueue: consumer not stopped within 10ms")
+		assert.True(t, c.closeReturned())
+	})
+}
+
+// signalConsumer is a Consumer whose Run returns when it's closed, unless
+// it ignores Close, or when its context is done. When blockClose is set,
+// Close doesn't return until Run has returned.
+type signalConsumer struct {
+	ignoreClose bool
+	blockClose  bool
+	closed      chan struct{}
+	once        sync.Once
+	runReturned chan struct{}
+	closeDone   atomic.Bool
+
+	mu     sync.Mutex
+	ctxErr error
+}
+
+func newSignalConsumer(ignoreClose bool) *signalConsumer {
+	return &signalConsumer{
+		ignoreClose: ignoreClose,
+		closed:      make(chan struct{}),
+		runReturned: make(chan struct{}),
+	}
+}
+
+func (c *signalConsumer) Run(ctx context.Context) error {
+	defer close(c.runReturned)
+	closed := c.closed
+	if c.ignoreClose {
+		closed = nil
+	}
+	select {
+	case <-ctx.Done():
+	case <-closed:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctxErr = ctx.Err()
+	if c.ctxErr != nil {
+		return c.ctxErr
+	}
+	return errors.New("consumer closed")
+}
+
+func (c *signalConsumer) Healthy(context.Context) error { return nil }
+
+func (c *signalConsumer) Close() error {
+	defer c.closeDone.Store(true)
+	c.once.Do(func() { close(c.closed) })
+	if c.blockClose {
+		<-c.runReturned
+		return errors.New("close interrupted")
+	}
+	return nil
+}
+
+func (c *signalConsumer) closeReturned() bool {
+	return c.closeDone.Load()
+}
+
+func (c *signalConsumer) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *signalConsumer) runCtxErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ctxErr
+}